@@ -54,6 +54,32 @@ resource "aws_cloudwatch_metric_alarm" "dlq_visible_messages" {
   tags = var.tags
 }
 
+resource "aws_cloudwatch_metric_alarm" "parking_lot_visible_messages" {
+  count = var.alerting.enabled && local.parking_lot_enabled ? 1 : 0
+
+  alarm_name          = "${local.parking_lot_queue_name}-visible-messages"
+  alarm_description   = "Fleet CloudWatch Pub/Sub bridge parking-lot queue has events that failed every replay attempt. They are not replayed again until requeued to the DLQ. Notifications fire on alarm-state transitions to avoid alert spam."
+  comparison_operator = "GreaterThanOrEqualToThreshold"
+  evaluation_periods  = var.alerting.evaluation_periods
+  datapoints_to_alarm = var.alerting.datapoints_to_alarm
+  threshold           = 1
+  namespace           = "AWS/SQS"
+  metric_name         = "ApproximateNumberOfMessagesVisible"
+  period              = var.alerting.period_seconds
+  statistic           = "Maximum"
+  treat_missing_data  = "notBreaching"
+
+  dimensions = {
+    QueueName = aws_sqs_queue.parking_lot[0].name
+  }
+
+  alarm_actions             = var.alerting.sns_topic_arns
+  ok_actions                = local.alerting_ok_actions
+  insufficient_data_actions = []
+
+  tags = var.tags
+}
+
 resource "aws_cloudwatch_metric_alarm" "replayer_errors" {
   count = var.alerting.enabled && local.replayer_enabled ? 1 : 0
 
@@ -79,3 +105,55 @@ resource "aws_cloudwatch_metric_alarm" "replayer_errors" {
 
   tags = var.tags
 }
+
+resource "aws_cloudwatch_metric_alarm" "canary_failures" {
+  count = var.alerting.enabled && local.canary_enabled && var.metrics.namespace != "" ? 1 : 0
+
+  alarm_name          = "${local.canary_function_name}-failures"
+  alarm_description   = "Fleet CloudWatch Pub/Sub bridge canary lines are not arriving in Pub/Sub. Missing data is treated as breaching so a canary that stops running also alarms."
+  comparison_operator = "LessThanThreshold"
+  evaluation_periods  = var.alerting.evaluation_periods
+  datapoints_to_alarm = var.alerting.datapoints_to_alarm
+  threshold           = 1
+  namespace           = var.metrics.namespace
+  metric_name         = "CanarySuccess"
+  period              = var.alerting.period_seconds
+  statistic           = "Minimum"
+  treat_missing_data  = "breaching"
+
+  dimensions = {
+    LogGroup = var.subscription.log_group_name
+  }
+
+  alarm_actions             = var.alerting.sns_topic_arns
+  ok_actions                = local.alerting_ok_actions
+  insufficient_data_actions = []
+
+  tags = var.tags
+}
+
+resource "aws_cloudwatch_metric_alarm" "streams_behind" {
+  for_each = var.alerting.enabled && local.gap_detection_enabled && var.metrics.namespace != "" ? toset(local.gap_detection_log_groups) : toset([])
+
+  alarm_name          = "${local.gap_detection_function_name}-${trim(replace(each.value, "/[^A-Za-z0-9_.-]+/", "-"), "-")}"
+  alarm_description   = "Fleet CloudWatch Pub/Sub bridge has streams in ${each.value} that have fallen behind or stopped forwarding. See the gap report for backfill ranges."
+  comparison_operator = "GreaterThanOrEqualToThreshold"
+  evaluation_periods  = var.alerting.evaluation_periods
+  datapoints_to_alarm = var.alerting.datapoints_to_alarm
+  threshold           = 1
+  namespace           = var.metrics.namespace
+  metric_name         = "StreamsBehind"
+  period              = var.alerting.period_seconds
+  statistic           = "Maximum"
+  treat_missing_data  = "notBreaching"
+
+  dimensions = {
+    LogGroup = startswith(each.value, "arn:") ? trimsuffix(split(":log-group:", each.value)[1], ":*") : each.value
+  }
+
+  alarm_actions             = var.alerting.sns_topic_arns
+  ok_actions                = local.alerting_ok_actions
+  insufficient_data_actions = []
+
+  tags = var.tags
+}
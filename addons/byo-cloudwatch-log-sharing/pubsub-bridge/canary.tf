@@ -0,0 +1,139 @@
+locals {
+  canary_enabled                = var.canary.enabled
+  canary_function_name          = coalesce(var.canary.function_name, "${var.lambda.function_name}-canary")
+  canary_role_name              = coalesce(var.canary.role_name, "${local.canary_function_name}-role")
+  canary_log_group_name         = "/aws/lambda/${local.canary_function_name}"
+  canary_credentials_secret_arn = var.canary.credentials_secret_arn != "" ? var.canary.credentials_secret_arn : local.gcp_pubsub.credentials_secret_arn
+
+  # The canary runs the bridge binary in canary mode so that the same build and
+  # configuration validation cover both functions.
+  canary_lambda_environment = merge(local.bridge_lambda_environment, {
+    BRIDGE_MODE                   = "canary"
+    CANARY_LOG_GROUP              = var.subscription.log_group_name
+    CANARY_LOG_STREAM             = var.canary.log_stream_name
+    CANARY_SUBSCRIPTION_ID        = var.canary.subscription_id
+    CANARY_CREDENTIALS_SECRET_ARN = local.canary_credentials_secret_arn
+    CANARY_TIMEOUT                = "${var.canary.receive_timeout}s"
+  })
+}
+
+resource "aws_cloudwatch_log_group" "canary" {
+  count = local.canary_enabled ? 1 : 0
+
+  name              = local.canary_log_group_name
+  retention_in_days = var.canary.log_retention_in_days
+  tags              = var.tags
+}
+
+resource "aws_iam_role" "canary" {
+  count = local.canary_enabled ? 1 : 0
+
+  name               = local.canary_role_name
+  assume_role_policy = data.aws_iam_policy_document.lambda_assume_role.json
+  tags               = var.tags
+}
+
+resource "aws_iam_role_policy_attachment" "canary_lambda_basic_execution" {
+  count = local.canary_enabled ? 1 : 0
+
+  role       = aws_iam_role.canary[0].name
+  policy_arn = "arn:${data.aws_partition.current.partition}:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole"
+}
+
+data "aws_iam_policy_document" "canary" {
+  count = local.canary_enabled ? 1 : 0
+
+  statement {
+    sid    = "WriteCanaryLogEvents"
+    effect = "Allow"
+
+    actions = [
+      "logs:CreateLogStream",
+      "logs:PutLogEvents",
+    ]
+
+    resources = [local.source_log_group_subscription_arn]
+  }
+
+  statement {
+    sid    = "GetPubSubCredentialsSecret"
+    effect = "Allow"
+
+    actions = [
+      "secretsmanager:DescribeSecret",
+      "secretsmanager:GetSecretValue",
+    ]
+
+    resources = [local.canary_credentials_secret_arn]
+  }
+}
+
+resource "aws_iam_policy" "canary" {
+  count = local.canary_enabled ? 1 : 0
+
+  name   = "${local.canary_role_name}-policy"
+  policy = data.aws_iam_policy_document.canary[0].json
+  tags   = var.tags
+}
+
+resource "aws_iam_role_policy_attachment" "canary" {
+  count = local.canary_enabled ? 1 : 0
+
+  role       = aws_iam_role.canary[0].name
+  policy_arn = aws_iam_policy.canary[0].arn
+}
+
+resource "aws_lambda_function" "canary" {
+  count = local.canary_enabled ? 1 : 0
+
+  function_name = local.canary_function_name
+  role          = aws_iam_role.canary[0].arn
+  runtime       = var.lambda.runtime
+  handler       = "bootstrap"
+  architectures = [var.lambda.architecture]
+  timeout       = var.canary.timeout
+  memory_size   = 128
+
+  reserved_concurrent_executions = 1
+
+  filename         = data.archive_file.bridge.output_path
+  source_code_hash = data.archive_file.bridge.output_base64sha256
+
+  environment {
+    variables = local.canary_lambda_environment
+  }
+
+  tags = var.tags
+
+  depends_on = [
+    aws_cloudwatch_log_group.canary,
+    aws_iam_role_policy_attachment.canary_lambda_basic_execution,
+    aws_iam_role_policy_attachment.canary,
+  ]
+}
+
+resource "aws_cloudwatch_event_rule" "canary" {
+  count = local.canary_enabled ? 1 : 0
+
+  name                = local.canary_function_name
+  description         = "Runs the Fleet CloudWatch Pub/Sub bridge end-to-end canary."
+  schedule_expression = var.canary.schedule_expression
+  tags                = var.tags
+}
+
+resource "aws_cloudwatch_event_target" "canary" {
+  count = local.canary_enabled ? 1 : 0
+
+  rule = aws_cloudwatch_event_rule.canary[0].name
+  arn  = aws_lambda_function.canary[0].arn
+}
+
+resource "aws_lambda_permission" "allow_canary_schedule" {
+  count = local.canary_enabled ? 1 : 0
+
+  statement_id  = "AllowExecutionFromEventBridge"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.canary[0].function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.canary[0].arn
+}
@@ -1,5 +1,11 @@
 locals {
   dlq_queue_name = coalesce(var.dlq.queue_name, "${var.lambda.function_name}-dlq")
+
+  quarantine_enabled    = var.tenancy.unexpected_owner_action == "quarantine"
+  quarantine_queue_name = coalesce(var.tenancy.quarantine_queue_name, "${var.lambda.function_name}-quarantine")
+
+  parking_lot_enabled    = local.replayer_enabled && var.replayer.max_attempts > 0
+  parking_lot_queue_name = coalesce(var.replayer.parking_lot_queue_name, "${var.lambda.function_name}-parking-lot")
 }
 
 resource "aws_sqs_queue" "dlq" {
@@ -28,3 +34,54 @@ resource "aws_lambda_function_event_invoke_config" "bridge" {
     }
   }
 }
+
+resource "aws_sqs_queue" "quarantine" {
+  count = local.quarantine_enabled ? 1 : 0
+
+  name                       = local.quarantine_queue_name
+  message_retention_seconds  = var.dlq.message_retention_seconds
+  visibility_timeout_seconds = var.dlq.visibility_timeout_seconds
+
+  kms_master_key_id       = var.dlq.kms_master_key_id != "" ? var.dlq.kms_master_key_id : null
+  sqs_managed_sse_enabled = var.dlq.kms_master_key_id == "" ? var.dlq.sqs_managed_sse_enabled : null
+
+  tags = var.tags
+}
+
+resource "aws_sqs_queue" "parking_lot" {
+  count = local.parking_lot_enabled ? 1 : 0
+
+  name                       = local.parking_lot_queue_name
+  message_retention_seconds  = var.dlq.message_retention_seconds
+  visibility_timeout_seconds = var.dlq.visibility_timeout_seconds
+
+  kms_master_key_id       = var.dlq.kms_master_key_id != "" ? var.dlq.kms_master_key_id : null
+  sqs_managed_sse_enabled = var.dlq.kms_master_key_id == "" ? var.dlq.sqs_managed_sse_enabled : null
+
+  tags = var.tags
+}
+
+# The replayer parks events itself so the last error is kept. SQS redrive is a
+# backstop for events the replayer could not park, and makes the parking lot a
+# dead-letter queue of the DLQ, which SQS message move tasks require to
+# requeue parked events. Records the circuit breaker defers are received too,
+# so the backstop allows the most receives SQS does.
+resource "aws_sqs_queue_redrive_policy" "dlq" {
+  count = local.parking_lot_enabled ? 1 : 0
+
+  queue_url = aws_sqs_queue.dlq[0].id
+  redrive_policy = jsonencode({
+    deadLetterTargetArn = aws_sqs_queue.parking_lot[0].arn
+    maxReceiveCount     = 1000
+  })
+}
+
+resource "aws_sqs_queue_redrive_allow_policy" "parking_lot" {
+  count = local.parking_lot_enabled ? 1 : 0
+
+  queue_url = aws_sqs_queue.parking_lot[0].id
+  redrive_allow_policy = jsonencode({
+    redrivePermission = "byQueue"
+    sourceQueueArns   = [aws_sqs_queue.dlq[0].arn]
+  })
+}
@@ -0,0 +1,183 @@
+locals {
+  gap_detection_enabled       = var.gap_detection.enabled
+  gap_detection_table_name    = coalesce(var.gap_detection.table_name, "${var.lambda.function_name}-high-water-marks")
+  gap_detection_table_arn     = "arn:${data.aws_partition.current.partition}:dynamodb:${data.aws_region.current.region}:${data.aws_caller_identity.current.account_id}:table/${local.gap_detection_table_name}"
+  gap_detection_function_name = coalesce(var.gap_detection.function_name, "${var.lambda.function_name}-gap-check")
+  gap_detection_role_name     = coalesce(var.gap_detection.role_name, "${local.gap_detection_function_name}-role")
+  gap_detection_log_groups    = length(var.gap_detection.log_group_names) > 0 ? var.gap_detection.log_group_names : [var.subscription.log_group_name]
+
+  # Entries may be names in this account or ARNs for cross-account
+  # observability; IAM needs ARNs either way.
+  gap_detection_log_group_arns = [
+    for group in local.gap_detection_log_groups :
+    startswith(group, "arn:") ? (endswith(group, ":*") ? group : "${group}:*") : "arn:${data.aws_partition.current.partition}:logs:${data.aws_region.current.region}:${data.aws_caller_identity.current.account_id}:log-group:${group}:*"
+  ]
+
+  gap_detection_lambda_environment = merge(local.bridge_lambda_environment, {
+    BRIDGE_MODE          = "gap-check"
+    GAP_CHECK_LOG_GROUPS = join(",", local.gap_detection_log_groups)
+    GAP_CHECK_THRESHOLD  = "${var.gap_detection.threshold_seconds}s"
+    GAP_CHECK_LOOKBACK   = "${var.gap_detection.lookback_hours}h"
+    GAP_REPORT_BUCKET    = var.gap_detection.report_bucket_name
+    GAP_REPORT_PREFIX    = var.gap_detection.report_prefix
+  })
+}
+
+resource "aws_dynamodb_table" "high_water_marks" {
+  count = local.gap_detection_enabled && var.gap_detection.create_table ? 1 : 0
+
+  name         = local.gap_detection_table_name
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "log_group"
+  range_key    = "log_stream"
+
+  attribute {
+    name = "log_group"
+    type = "S"
+  }
+
+  attribute {
+    name = "log_stream"
+    type = "S"
+  }
+
+  server_side_encryption {
+    enabled = true
+  }
+
+  tags = var.tags
+}
+
+resource "aws_cloudwatch_log_group" "gap_detection" {
+  count = local.gap_detection_enabled ? 1 : 0
+
+  name              = "/aws/lambda/${local.gap_detection_function_name}"
+  retention_in_days = var.gap_detection.log_retention_in_days
+  tags              = var.tags
+}
+
+resource "aws_iam_role" "gap_detection" {
+  count = local.gap_detection_enabled ? 1 : 0
+
+  name               = local.gap_detection_role_name
+  assume_role_policy = data.aws_iam_policy_document.lambda_assume_role.json
+  tags               = var.tags
+}
+
+resource "aws_iam_role_policy_attachment" "gap_detection_lambda_basic_execution" {
+  count = local.gap_detection_enabled ? 1 : 0
+
+  role       = aws_iam_role.gap_detection[0].name
+  policy_arn = "arn:${data.aws_partition.current.partition}:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole"
+}
+
+data "aws_iam_policy_document" "gap_detection" {
+  count = local.gap_detection_enabled ? 1 : 0
+
+  statement {
+    sid    = "ReadHighWaterMarks"
+    effect = "Allow"
+
+    actions = [
+      "dynamodb:Scan",
+    ]
+
+    resources = [local.gap_detection_table_arn]
+  }
+
+  statement {
+    sid    = "DescribeSourceLogStreams"
+    effect = "Allow"
+
+    actions = [
+      "logs:DescribeLogStreams",
+    ]
+
+    resources = local.gap_detection_log_group_arns
+  }
+
+  dynamic "statement" {
+    for_each = var.gap_detection.report_bucket_name != "" ? [1] : []
+
+    content {
+      sid    = "WriteGapReports"
+      effect = "Allow"
+
+      actions = [
+        "s3:PutObject",
+      ]
+
+      resources = ["arn:${data.aws_partition.current.partition}:s3:::${var.gap_detection.report_bucket_name}/${var.gap_detection.report_prefix}*"]
+    }
+  }
+}
+
+resource "aws_iam_policy" "gap_detection" {
+  count = local.gap_detection_enabled ? 1 : 0
+
+  name   = "${local.gap_detection_role_name}-policy"
+  policy = data.aws_iam_policy_document.gap_detection[0].json
+  tags   = var.tags
+}
+
+resource "aws_iam_role_policy_attachment" "gap_detection" {
+  count = local.gap_detection_enabled ? 1 : 0
+
+  role       = aws_iam_role.gap_detection[0].name
+  policy_arn = aws_iam_policy.gap_detection[0].arn
+}
+
+resource "aws_lambda_function" "gap_detection" {
+  count = local.gap_detection_enabled ? 1 : 0
+
+  function_name = local.gap_detection_function_name
+  role          = aws_iam_role.gap_detection[0].arn
+  runtime       = var.lambda.runtime
+  handler       = "bootstrap"
+  architectures = [var.lambda.architecture]
+  timeout       = var.gap_detection.timeout
+  memory_size   = 256
+
+  reserved_concurrent_executions = 1
+
+  filename         = data.archive_file.bridge.output_path
+  source_code_hash = data.archive_file.bridge.output_base64sha256
+
+  environment {
+    variables = local.gap_detection_lambda_environment
+  }
+
+  tags = var.tags
+
+  depends_on = [
+    aws_cloudwatch_log_group.gap_detection,
+    aws_iam_role_policy_attachment.gap_detection_lambda_basic_execution,
+    aws_iam_role_policy_attachment.gap_detection,
+  ]
+}
+
+resource "aws_cloudwatch_event_rule" "gap_detection" {
+  count = local.gap_detection_enabled ? 1 : 0
+
+  name                = local.gap_detection_function_name
+  description         = "Runs the Fleet CloudWatch Pub/Sub bridge gap check."
+  schedule_expression = var.gap_detection.schedule_expression
+  tags                = var.tags
+}
+
+resource "aws_cloudwatch_event_target" "gap_detection" {
+  count = local.gap_detection_enabled ? 1 : 0
+
+  rule = aws_cloudwatch_event_rule.gap_detection[0].name
+  arn  = aws_lambda_function.gap_detection[0].arn
+}
+
+resource "aws_lambda_permission" "allow_gap_detection_schedule" {
+  count = local.gap_detection_enabled ? 1 : 0
+
+  statement_id  = "AllowExecutionFromEventBridge"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.gap_detection[0].function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.gap_detection[0].arn
+}
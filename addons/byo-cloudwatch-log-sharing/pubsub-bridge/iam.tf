@@ -28,6 +28,8 @@ locals {
   replayer_architecture        = coalesce(var.replayer.architecture, var.lambda.architecture)
   replayer_log_group_name      = "/aws/lambda/${local.replayer_function_name}"
   replayer_enabled             = var.replayer.enabled && var.dlq.enabled
+  replayer_direct              = local.replayer_enabled && var.replayer.mode == "direct"
+  replayer_invoke              = local.replayer_enabled && !local.replayer_direct
   replayer_go_arch             = local.replayer_architecture == "arm64" ? "arm64" : "amd64"
   replayer_maximum_concurrency = var.replayer.maximum_concurrency
 }
@@ -56,16 +58,209 @@ resource "aws_iam_role_policy_attachment" "lambda_basic_execution" {
 }
 
 data "aws_iam_policy_document" "bridge" {
-  statement {
-    sid    = "GetPubSubCredentialsSecret"
-    effect = "Allow"
+  dynamic "statement" {
+    for_each = var.sink == "pubsub" ? [1] : []
 
-    actions = [
-      "secretsmanager:DescribeSecret",
-      "secretsmanager:GetSecretValue",
-    ]
+    content {
+      sid    = "GetPubSubCredentialsSecret"
+      effect = "Allow"
+
+      actions = [
+        "secretsmanager:DescribeSecret",
+        "secretsmanager:GetSecretValue",
+      ]
+
+      resources = distinct(concat(
+        [local.gcp_pubsub.credentials_secret_arn],
+        [for route in values(var.tenancy.owner_routes) : route.credentials_secret_arn if route.credentials_secret_arn != ""],
+      ))
+    }
+  }
+
+  dynamic "statement" {
+    for_each = var.sink == "kafka" && var.kafka.sasl_mechanism != "none" ? [1] : []
+
+    content {
+      sid    = "GetKafkaSASLSecret"
+      effect = "Allow"
+
+      actions = [
+        "secretsmanager:DescribeSecret",
+        "secretsmanager:GetSecretValue",
+      ]
+
+      resources = [var.kafka.sasl_secret_arn]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = var.sink == "splunk" ? [1] : []
+
+    content {
+      sid    = "GetSplunkHECTokenSecret"
+      effect = "Allow"
+
+      actions = [
+        "secretsmanager:DescribeSecret",
+        "secretsmanager:GetSecretValue",
+      ]
+
+      resources = [var.splunk.token_secret_arn]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = var.sink == "splunk" && var.splunk.token_secret_kms_key_arn != "" ? [1] : []
+
+    content {
+      sid    = "DecryptSplunkHECTokenSecretKey"
+      effect = "Allow"
+
+      actions = [
+        "kms:Decrypt",
+      ]
+
+      resources = [var.splunk.token_secret_kms_key_arn]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = var.sink == "otlp" && var.otlp.headers_secret_arn != "" ? [1] : []
+
+    content {
+      sid    = "GetOTLPHeadersSecret"
+      effect = "Allow"
+
+      actions = [
+        "secretsmanager:DescribeSecret",
+        "secretsmanager:GetSecretValue",
+      ]
+
+      resources = [var.otlp.headers_secret_arn]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = var.sink == "otlp" && var.otlp.headers_secret_kms_key_arn != "" ? [1] : []
+
+    content {
+      sid    = "DecryptOTLPHeadersSecretKey"
+      effect = "Allow"
+
+      actions = [
+        "kms:Decrypt",
+      ]
+
+      resources = [var.otlp.headers_secret_kms_key_arn]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = var.sink == "loki" && var.loki.auth_secret_arn != "" ? [1] : []
+
+    content {
+      sid    = "GetLokiAuthSecret"
+      effect = "Allow"
+
+      actions = [
+        "secretsmanager:DescribeSecret",
+        "secretsmanager:GetSecretValue",
+      ]
+
+      resources = [var.loki.auth_secret_arn]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = var.sink == "loki" && var.loki.auth_secret_kms_key_arn != "" ? [1] : []
+
+    content {
+      sid    = "DecryptLokiAuthSecretKey"
+      effect = "Allow"
+
+      actions = [
+        "kms:Decrypt",
+      ]
+
+      resources = [var.loki.auth_secret_kms_key_arn]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = var.sink == "elasticsearch" && var.elasticsearch.auth == "basic" ? [1] : []
+
+    content {
+      sid    = "GetElasticsearchBasicAuthSecret"
+      effect = "Allow"
+
+      actions = [
+        "secretsmanager:DescribeSecret",
+        "secretsmanager:GetSecretValue",
+      ]
+
+      resources = [var.elasticsearch.basic_auth_secret_arn]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = var.sink == "elasticsearch" && var.elasticsearch.auth == "basic" && var.elasticsearch.basic_auth_secret_kms_key_arn != "" ? [1] : []
+
+    content {
+      sid    = "DecryptElasticsearchBasicAuthSecretKey"
+      effect = "Allow"
+
+      actions = [
+        "kms:Decrypt",
+      ]
+
+      resources = [var.elasticsearch.basic_auth_secret_kms_key_arn]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = var.sink == "elasticsearch" && var.elasticsearch.auth == "sigv4" && var.elasticsearch.sigv4_service == "es" ? [1] : []
+
+    content {
+      sid    = "WriteOpenSearchDomain"
+      effect = "Allow"
+
+      actions = [
+        "es:ESHttpPost",
+        "es:ESHttpPut",
+      ]
+
+      resources = ["${var.elasticsearch.resource_arn}/*"]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = var.sink == "elasticsearch" && var.elasticsearch.auth == "sigv4" && var.elasticsearch.sigv4_service == "aoss" ? [1] : []
+
+    content {
+      sid    = "WriteOpenSearchServerlessCollection"
+      effect = "Allow"
+
+      actions = [
+        "aoss:APIAccessAll",
+      ]
+
+      resources = [var.elasticsearch.resource_arn]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = var.sink == "kafka" && var.kafka.sasl_secret_kms_key_arn != "" ? [1] : []
+
+    content {
+      sid    = "DecryptKafkaSASLSecretKey"
+      effect = "Allow"
 
-    resources = [var.gcp_pubsub.credentials_secret_arn]
+      actions = [
+        "kms:Decrypt",
+      ]
+
+      resources = [var.kafka.sasl_secret_kms_key_arn]
+    }
   }
 
   dynamic "statement" {
@@ -84,7 +279,37 @@ data "aws_iam_policy_document" "bridge" {
   }
 
   dynamic "statement" {
-    for_each = var.gcp_pubsub.secret_kms_key_arn != "" ? [1] : []
+    for_each = local.quarantine_enabled ? [1] : []
+
+    content {
+      sid    = "SendToQuarantineQueue"
+      effect = "Allow"
+
+      actions = [
+        "sqs:SendMessage",
+      ]
+
+      resources = [aws_sqs_queue.quarantine[0].arn]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = local.gap_detection_enabled ? [1] : []
+
+    content {
+      sid    = "RecordHighWaterMarks"
+      effect = "Allow"
+
+      actions = [
+        "dynamodb:UpdateItem",
+      ]
+
+      resources = [local.gap_detection_table_arn]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = local.gcp_pubsub.secret_kms_key_arn != "" ? [1] : []
 
     content {
       sid    = "DecryptPubSubCredentialsSecretKey"
@@ -94,7 +319,53 @@ data "aws_iam_policy_document" "bridge" {
         "kms:Decrypt",
       ]
 
-      resources = [var.gcp_pubsub.secret_kms_key_arn]
+      resources = [local.gcp_pubsub.secret_kms_key_arn]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = var.encryption.mode == "kms" ? [1] : []
+
+    content {
+      sid    = "GeneratePayloadDataKeys"
+      effect = "Allow"
+
+      actions = [
+        "kms:GenerateDataKey",
+      ]
+
+      resources = [var.encryption.kms_key_arn]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = var.signing.secret_arn != "" ? [1] : []
+
+    content {
+      sid    = "GetSigningKeysetSecret"
+      effect = "Allow"
+
+      actions = [
+        "secretsmanager:DescribeSecret",
+        "secretsmanager:GetSecretValue",
+      ]
+
+      resources = [var.signing.secret_arn]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = var.signing.secret_kms_key_arn != "" ? [1] : []
+
+    content {
+      sid    = "DecryptSigningKeysetSecretKey"
+      effect = "Allow"
+
+      actions = [
+        "kms:Decrypt",
+      ]
+
+      resources = [var.signing.secret_kms_key_arn]
     }
   }
 
@@ -144,15 +415,38 @@ resource "aws_iam_role_policy_attachment" "replayer_lambda_basic_execution" {
 data "aws_iam_policy_document" "replayer" {
   count = local.replayer_enabled ? 1 : 0
 
-  statement {
-    sid    = "InvokeBridgeLambda"
-    effect = "Allow"
+  dynamic "statement" {
+    for_each = local.replayer_invoke ? [1] : []
 
-    actions = [
-      "lambda:InvokeFunction",
-    ]
+    content {
+      sid    = "InvokeBridgeLambda"
+      effect = "Allow"
+
+      actions = [
+        "lambda:InvokeFunction",
+      ]
+
+      resources = [aws_lambda_function.bridge.arn]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = var.replayer.route_to_origin ? [1] : []
 
-    resources = [aws_lambda_function.bridge.arn]
+    content {
+      sid    = "InvokeOriginLambdas"
+      effect = "Allow"
+
+      actions = [
+        "lambda:InvokeFunction",
+      ]
+
+      # Records name the version or alias that failed, which is replayed
+      # as is.
+      resources = flatten([
+        for arn in local.replayer_allowed_function_arns : [arn, "${arn}:*"]
+      ])
+    }
   }
 
   statement {
@@ -169,6 +463,52 @@ data "aws_iam_policy_document" "replayer" {
     resources = [aws_sqs_queue.dlq[0].arn]
   }
 
+  dynamic "statement" {
+    for_each = local.parking_lot_enabled ? [1] : []
+
+    content {
+      sid    = "SendToParkingLotQueue"
+      effect = "Allow"
+
+      actions = [
+        "sqs:SendMessage",
+      ]
+
+      resources = [aws_sqs_queue.parking_lot[0].arn]
+    }
+  }
+
+  # Failed replays are sent back to the DLQ with their attempt counted.
+  dynamic "statement" {
+    for_each = local.parking_lot_enabled ? [1] : []
+
+    content {
+      sid    = "RequeueToDLQ"
+      effect = "Allow"
+
+      actions = [
+        "sqs:SendMessage",
+      ]
+
+      resources = [aws_sqs_queue.dlq[0].arn]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = var.replayer.max_event_age_seconds > 0 ? [1] : []
+
+    content {
+      sid    = "ArchiveStaleEvents"
+      effect = "Allow"
+
+      actions = [
+        "s3:PutObject",
+      ]
+
+      resources = ["arn:${data.aws_partition.current.partition}:s3:::${var.replayer.archive_bucket_name}/${var.replayer.archive_prefix}*"]
+    }
+  }
+
   dynamic "statement" {
     for_each = var.dlq.kms_master_key_id != "" ? [1] : []
 
@@ -183,6 +523,21 @@ data "aws_iam_policy_document" "replayer" {
       resources = [local.dlq_kms_key_arn]
     }
   }
+
+  dynamic "statement" {
+    for_each = local.parking_lot_enabled && var.dlq.kms_master_key_id != "" ? [1] : []
+
+    content {
+      sid    = "EncryptParkedMessages"
+      effect = "Allow"
+
+      actions = [
+        "kms:GenerateDataKey",
+      ]
+
+      resources = [local.dlq_kms_key_arn]
+    }
+  }
 }
 
 resource "aws_iam_policy" "replayer" {
@@ -199,3 +554,12 @@ resource "aws_iam_role_policy_attachment" "replayer" {
   role       = aws_iam_role.replayer[0].name
   policy_arn = aws_iam_policy.replayer[0].arn
 }
+
+# In direct mode the replayer publishes like the bridge, so it needs the
+# bridge's sink credentials and keys.
+resource "aws_iam_role_policy_attachment" "replayer_bridge" {
+  count = local.replayer_direct ? 1 : 0
+
+  role       = aws_iam_role.replayer[0].name
+  policy_arn = aws_iam_policy.bridge.arn
+}
@@ -1,22 +1,141 @@
 locals {
-  bridge_lambda_binary_path = "${path.module}/lambda/bootstrap"
-  bridge_lambda_go_arch     = var.lambda.architecture == "arm64" ? "arm64" : "amd64"
+  bridge_lambda_binary_path  = "${path.module}/lambda/bootstrap"
+  bridge_lambda_go_arch      = var.lambda.architecture == "arm64" ? "arm64" : "amd64"
+  bridge_lambda_source_files = sort(fileset("${path.module}/lambda", "{*.go,awslogs/*.go,dlq/*.go,emf/*.go,envelope/*.go,replay/*.go,signing/*.go}"))
+
+  # gcp_pubsub is optional when another sink is selected; the bridge's own
+  # configuration validation reports it as missing when sink is pubsub.
+  gcp_pubsub = var.gcp_pubsub != null ? var.gcp_pubsub : {
+    project_id             = ""
+    topic_id               = ""
+    credentials_secret_arn = ""
+    secret_kms_key_arn     = ""
+  }
+
+  bridge_lambda_environment = {
+    SINK                                = var.sink
+    GCP_PUBSUB_PROJECT_ID               = local.gcp_pubsub.project_id
+    GCP_PUBSUB_TOPIC_ID                 = local.gcp_pubsub.topic_id
+    GCP_CREDENTIALS_SECRET_ARN          = local.gcp_pubsub.credentials_secret_arn
+    PUBSUB_BATCH_SIZE                   = tostring(var.lambda.batch_size)
+    ENCRYPTION_MODE                     = var.encryption.mode
+    ENCRYPTION_KMS_KEY_ID               = var.encryption.kms_key_arn
+    ENCRYPTION_PUBLIC_KEY               = var.encryption.public_key_pem
+    ENCRYPTION_DATA_KEY_TTL             = "${var.encryption.data_key_ttl_seconds}s"
+    SIGNING_SECRET_ARN                  = var.signing.secret_arn
+    SAMPLING_RULES                      = jsonencode(var.sampling)
+    ALLOWED_OWNER_ACCOUNT_IDS           = join(",", var.tenancy.allowed_owner_account_ids)
+    ALLOWED_LOG_GROUP_ARNS              = join(",", var.tenancy.allowed_log_group_arns)
+    UNEXPECTED_OWNER_ACTION             = var.tenancy.unexpected_owner_action
+    QUARANTINE_QUEUE_URL                = try(aws_sqs_queue.quarantine[0].url, "")
+    OWNER_ROUTES                        = jsonencode(var.tenancy.owner_routes)
+    MESSAGE_FORMAT                      = var.message_format.format
+    PROMOTE_FIELDS                      = join(",", var.message_format.promote_fields)
+    EVENT_TIME_FIELDS                   = join(",", var.message_format.event_time_fields)
+    METRICS_NAMESPACE                   = var.metrics.namespace
+    STATE_TABLE_NAME                    = local.gap_detection_enabled ? local.gap_detection_table_name : ""
+    STATE_ENDPOINT_URL                  = var.gap_detection.endpoint_url
+    KAFKA_BROKERS                       = join(",", var.kafka.brokers)
+    KAFKA_TOPIC                         = var.kafka.topic
+    KAFKA_CLIENT_ID                     = var.kafka.client_id
+    KAFKA_TLS                           = tostring(var.kafka.tls_enabled)
+    KAFKA_TLS_CA_PEM                    = var.kafka.tls_ca_pem
+    KAFKA_SASL_MECHANISM                = var.kafka.sasl_mechanism
+    KAFKA_SASL_SECRET_ARN               = var.kafka.sasl_secret_arn
+    KAFKA_IDEMPOTENCE                   = var.kafka.idempotent ? "enabled" : "disabled"
+    KAFKA_MAX_RETRIES                   = tostring(var.kafka.max_retries)
+    KAFKA_REQUEST_TIMEOUT               = "${var.kafka.request_timeout_seconds}s"
+    SPLUNK_HEC_URL                      = var.splunk.hec_url
+    SPLUNK_HEC_TOKEN_SECRET_ARN         = var.splunk.token_secret_arn
+    SPLUNK_SOURCETYPE                   = var.splunk.sourcetype
+    SPLUNK_INDEX                        = var.splunk.index
+    SPLUNK_HOST                         = var.splunk.host
+    SPLUNK_SOURCE                       = var.splunk.source
+    SPLUNK_ROUTES                       = jsonencode(var.splunk.routes)
+    SPLUNK_ACK                          = tostring(var.splunk.ack_enabled)
+    SPLUNK_ACK_TIMEOUT                  = "${var.splunk.ack_timeout_seconds}s"
+    SPLUNK_TLS_CA_PEM                   = var.splunk.tls_ca_pem
+    SPLUNK_MAX_RETRIES                  = tostring(var.splunk.max_retries)
+    SPLUNK_RETRY_BACKOFF                = "${var.splunk.retry_backoff_ms}ms"
+    SPLUNK_REQUEST_TIMEOUT              = "${var.splunk.request_timeout_seconds}s"
+    OTLP_ENDPOINT                       = var.otlp.endpoint
+    OTLP_PROTOCOL                       = var.otlp.protocol
+    OTLP_INSECURE                       = tostring(var.otlp.insecure)
+    OTLP_TLS_CA_PEM                     = var.otlp.tls_ca_pem
+    OTLP_HEADERS_SECRET_ARN             = var.otlp.headers_secret_arn
+    OTLP_COMPRESSION                    = var.otlp.compression
+    OTLP_SERVICE_NAME                   = var.otlp.service_name
+    OTLP_TIMEOUT                        = "${var.otlp.timeout_seconds}s"
+    OTLP_MAX_RETRIES                    = tostring(var.otlp.max_retries)
+    OTLP_RETRY_BACKOFF                  = "${var.otlp.retry_backoff_ms}ms"
+    LOKI_URL                            = var.loki.url
+    LOKI_FORMAT                         = var.loki.format
+    LOKI_LABELS                         = jsonencode(var.loki.labels)
+    LOKI_LOG_TYPES                      = jsonencode(var.loki.log_types)
+    LOKI_MAX_LABEL_VALUES               = tostring(var.loki.max_label_values)
+    LOKI_TENANT_ID                      = var.loki.tenant_id
+    LOKI_AUTH_SECRET_ARN                = var.loki.auth_secret_arn
+    LOKI_STRUCTURED_METADATA            = tostring(var.loki.structured_metadata)
+    LOKI_TLS_CA_PEM                     = var.loki.tls_ca_pem
+    LOKI_TIMEOUT                        = "${var.loki.timeout_seconds}s"
+    LOKI_MAX_RETRIES                    = tostring(var.loki.max_retries)
+    LOKI_RETRY_BACKOFF                  = "${var.loki.retry_backoff_ms}ms"
+    ELASTICSEARCH_URL                   = var.elasticsearch.url
+    ELASTICSEARCH_INDEX                 = var.elasticsearch.index
+    ELASTICSEARCH_INDEX_DATE_FORMAT     = var.elasticsearch.index_date_format
+    ELASTICSEARCH_AUTH                  = var.elasticsearch.auth
+    ELASTICSEARCH_BASIC_AUTH_SECRET_ARN = var.elasticsearch.basic_auth_secret_arn
+    ELASTICSEARCH_SIGV4_SERVICE         = var.elasticsearch.sigv4_service
+    ELASTICSEARCH_SIGV4_REGION          = var.elasticsearch.sigv4_region
+    ELASTICSEARCH_TLS_CA_PEM            = var.elasticsearch.tls_ca_pem
+    ELASTICSEARCH_REQUEST_TIMEOUT       = "${var.elasticsearch.request_timeout_seconds}s"
+    ELASTICSEARCH_MAX_RETRIES           = tostring(var.elasticsearch.max_retries)
+    ELASTICSEARCH_RETRY_BACKOFF         = "${var.elasticsearch.retry_backoff_ms}ms"
+    SYSLOG_ADDRESS                      = var.syslog.address
+    SYSLOG_TLS_CA_PEM                   = var.syslog.tls_ca_pem
+    SYSLOG_TLS_SERVER_NAME              = var.syslog.tls_server_name
+    SYSLOG_APP_NAME                     = var.syslog.app_name
+    SYSLOG_HOSTNAME                     = var.syslog.hostname
+    SYSLOG_FACILITY                     = tostring(var.syslog.facility)
+    SYSLOG_SD_ID                        = var.syslog.sd_id
+    SYSLOG_MAX_MESSAGE_BYTES            = tostring(var.syslog.max_message_bytes)
+    SYSLOG_DIAL_TIMEOUT                 = "${var.syslog.dial_timeout_seconds}s"
+    SYSLOG_WRITE_TIMEOUT                = "${var.syslog.write_timeout_seconds}s"
+    SYSLOG_MAX_RETRIES                  = tostring(var.syslog.max_retries)
+    SYSLOG_RETRY_BACKOFF                = "${var.syslog.retry_backoff_ms}ms"
+    FLEET_ENVIRONMENT                   = var.fleet_environment
+  }
+}
+
+# Validate the bridge configuration with a host build during plan, so that a
+# setting the bridge rejects fails the plan instead of the function's init
+# phase. Settings that depend on resources created in the same run are only
+# known, and checked, during apply, before the bridge is built.
+data "external" "bridge_config" {
+  working_dir = "${path.module}/lambda"
+  program = concat(
+    ["env"],
+    [for name, value in merge(local.bridge_lambda_environment, { AWS_REGION = data.aws_region.current.region }) : "${name}=${value}"],
+    ["go", "run", ".", "--validate-config", "--validate-config-format", "json"],
+  )
 }
 
 resource "null_resource" "bridge_build" {
+  depends_on = [data.external.bridge_config]
+
   triggers = {
-    main_go_changes = filesha256("${path.module}/lambda/main.go")
-    go_mod_changes  = filesha256("${path.module}/lambda/go.mod")
-    go_sum_changes  = fileexists("${path.module}/lambda/go.sum") ? filesha256("${path.module}/lambda/go.sum") : ""
-    go_arch         = local.bridge_lambda_go_arch
-    binary_exists   = fileexists(local.bridge_lambda_binary_path) ? true : timestamp()
+    go_source_changes = sha256(join("", [for f in local.bridge_lambda_source_files : filesha256("${path.module}/lambda/${f}")]))
+    go_mod_changes    = filesha256("${path.module}/lambda/go.mod")
+    go_sum_changes    = fileexists("${path.module}/lambda/go.sum") ? filesha256("${path.module}/lambda/go.sum") : ""
+    go_arch           = local.bridge_lambda_go_arch
+    binary_exists     = fileexists(local.bridge_lambda_binary_path) ? true : timestamp()
   }
 
   provisioner "local-exec" {
     working_dir = "${path.module}/lambda"
     command     = <<-EOT
       go mod download
-      CGO_ENABLED=0 GOOS=linux GOARCH=${local.bridge_lambda_go_arch} go build -tags lambda.norpc -o bootstrap main.go
+      CGO_ENABLED=0 GOOS=linux GOARCH=${local.bridge_lambda_go_arch} go build -tags lambda.norpc -o bootstrap .
     EOT
   }
 }
@@ -49,12 +168,7 @@ resource "aws_lambda_function" "bridge" {
   source_code_hash = data.archive_file.bridge.output_base64sha256
 
   environment {
-    variables = {
-      GCP_PUBSUB_PROJECT_ID      = var.gcp_pubsub.project_id
-      GCP_PUBSUB_TOPIC_ID        = var.gcp_pubsub.topic_id
-      GCP_CREDENTIALS_SECRET_ARN = var.gcp_pubsub.credentials_secret_arn
-      PUBSUB_BATCH_SIZE          = tostring(var.lambda.batch_size)
-    }
+    variables = local.bridge_lambda_environment
   }
 
   tags = var.tags
@@ -0,0 +1,102 @@
+// Package awslogs decodes the events CloudWatch Logs subscription filters
+// deliver to Lambda. It is shared by the bridge Lambda and by the DLQ tooling
+// that inspects failed bridge events.
+package awslogs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Event is the Lambda event for a subscription filter delivery.
+type Event struct {
+	AWSLogs struct {
+		Data string `json:"data"`
+	} `json:"awslogs"`
+}
+
+// Payload is the gzipped JSON document carried in Event.AWSLogs.Data.
+type Payload struct {
+	Owner               string     `json:"owner"`
+	LogGroup            string     `json:"logGroup"`
+	LogStream           string     `json:"logStream"`
+	SubscriptionFilters []string   `json:"subscriptionFilters"`
+	MessageType         string     `json:"messageType"`
+	LogEvents           []LogEvent `json:"logEvents"`
+}
+
+// LogEvent is one log event of a Payload.
+type LogEvent struct {
+	ID        string `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+	Message   string `json:"message"`
+}
+
+// Decode unpacks event. The replayer recognizes the errors it returns as
+// events that cannot be replayed, so their messages must stay stable.
+func Decode(event Event) (*Payload, error) {
+	if strings.TrimSpace(event.AWSLogs.Data) == "" {
+		return nil, errors.New("event missing awslogs.data")
+	}
+
+	compressed, err := base64.StdEncoding.DecodeString(event.AWSLogs.Data)
+	if err != nil {
+		return nil, fmt.Errorf("decode awslogs.data: %w", err)
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("open gzip payload: %w", err)
+	}
+	defer reader.Close()
+
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("read gzip payload: %w", err)
+	}
+
+	var payload Payload
+	if err := json.Unmarshal(decoded, &payload); err != nil {
+		return nil, fmt.Errorf("parse cloudwatch payload: %w", err)
+	}
+
+	return &payload, nil
+}
+
+// Encode packs payload into an event the way CloudWatch Logs delivers it, so
+// Decode returns an equal payload.
+func Encode(payload *Payload) (Event, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Event{}, fmt.Errorf("marshal cloudwatch payload: %w", err)
+	}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(data); err != nil {
+		return Event{}, fmt.Errorf("gzip cloudwatch payload: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return Event{}, fmt.Errorf("gzip cloudwatch payload: %w", err)
+	}
+
+	var event Event
+	event.AWSLogs.Data = base64.StdEncoding.EncodeToString(compressed.Bytes())
+	return event, nil
+}
+
+// DecodeJSON decodes a raw Lambda event, such as the requestPayload of an
+// async destination record.
+func DecodeJSON(raw []byte) (*Payload, error) {
+	var event Event
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return nil, fmt.Errorf("parse subscription event: %w", err)
+	}
+	return Decode(event)
+}
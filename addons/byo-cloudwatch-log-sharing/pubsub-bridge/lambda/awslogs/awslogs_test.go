@@ -0,0 +1,67 @@
+package awslogs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipBase64(t *testing.T, data string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestDecode(t *testing.T) {
+	var event Event
+	event.AWSLogs.Data = gzipBase64(t, `{"owner":"111","logGroup":"/fleet","logStream":"s","messageType":"DATA_MESSAGE","logEvents":[{"id":"1","timestamp":1714557600000,"message":"m"}]}`)
+
+	payload, err := Decode(event)
+	require.NoError(t, err)
+	assert.Equal(t, "/fleet", payload.LogGroup)
+	require.Len(t, payload.LogEvents, 1)
+	assert.Equal(t, int64(1714557600000), payload.LogEvents[0].Timestamp)
+
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"", "event missing awslogs.data"},
+		{"!!", "decode awslogs.data:"},
+		{base64.StdEncoding.EncodeToString([]byte("plain")), "open gzip payload:"},
+		{gzipBase64(t, "not json"), "parse cloudwatch payload:"},
+	}
+	for _, tt := range tests {
+		event.AWSLogs.Data = tt.data
+		_, err := Decode(event)
+		assert.ErrorContains(t, err, tt.want)
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	payload, err := DecodeJSON([]byte(`{"awslogs":{"data":"` + gzipBase64(t, `{"logGroup":"/fleet"}`) + `"}}`))
+	require.NoError(t, err)
+	assert.Equal(t, "/fleet", payload.LogGroup)
+
+	_, err = DecodeJSON([]byte(`[]`))
+	assert.ErrorContains(t, err, "parse subscription event")
+}
+
+func TestEncode(t *testing.T) {
+	payload := &Payload{Owner: "111", LogGroup: "/fleet", LogStream: "s", MessageType: "DATA_MESSAGE"}
+	payload.LogEvents = []LogEvent{{ID: "1", Timestamp: 1714557600000, Message: "m"}}
+
+	event, err := Encode(payload)
+	require.NoError(t, err)
+	decoded, err := Decode(event)
+	require.NoError(t, err)
+	assert.Equal(t, payload, decoded)
+}
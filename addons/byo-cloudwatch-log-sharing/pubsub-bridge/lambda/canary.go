@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	pubsub "cloud.google.com/go/pubsub/v2"
+	"google.golang.org/api/option"
+)
+
+const (
+	bridgeModeBridge = "bridge"
+	bridgeModeCanary = "canary"
+
+	canaryMarkerField = "fleet_pubsub_bridge_canary"
+)
+
+type canaryLine struct {
+	Marker string    `json:"fleet_pubsub_bridge_canary"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+// canaryReceiver delivers messages from the canary subscription to fn until
+// ctx is done.
+type canaryReceiver func(ctx context.Context, fn func(data []byte)) error
+
+var (
+	putLogEventFunc       = putLogEvent
+	getCanaryReceiverFunc = getCanaryReceiver
+)
+
+func getCanaryReceiver(ctx context.Context) (canaryReceiver, error) {
+	credentialsJSON, err := getServiceAccountJSON(ctx, options.CanaryCredentialsSecretARN)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := pubsub.NewClient(ctx, options.PubSubProjectID, option.WithAuthCredentialsJSON(option.ServiceAccount, credentialsJSON))
+	if err != nil {
+		return nil, fmt.Errorf("create pubsub client: %w", err)
+	}
+
+	return func(ctx context.Context, fn func(data []byte)) error {
+		defer client.Close()
+		subscriber := client.Subscriber(options.CanarySubscriptionID)
+		return subscriber.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+			// The subscription is dedicated to the canary, so everything is
+			// acknowledged, including lines left over from earlier runs.
+			msg.Ack()
+			fn(msg.Data)
+		})
+	}, nil
+}
+
+// canaryMarker returns the canary marker embedded in a published envelope,
+// or "" when the message is not a canary line. The line is a string in the
+// default message format and an embedded object in json format.
+func canaryMarker(data []byte) string {
+	var envelope struct {
+		Message json.RawMessage `json:"message"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil || !bytes.Contains(envelope.Message, []byte(canaryMarkerField)) {
+		return ""
+	}
+
+	body := []byte(envelope.Message)
+	var text string
+	if err := json.Unmarshal(body, &text); err == nil {
+		body = []byte(text)
+	}
+
+	var line canaryLine
+	if err := json.Unmarshal(body, &line); err != nil {
+		return ""
+	}
+	return line.Marker
+}
+
+// canaryHandler writes a uniquely tagged line into the source log group and
+// waits for it to arrive on the canary subscription, emitting success and
+// latency metrics either way.
+func canaryHandler(ctx context.Context, _ json.RawMessage) (map[string]interface{}, error) {
+	markerBytes := make([]byte, 16)
+	if _, err := rand.Read(markerBytes); err != nil {
+		return nil, fmt.Errorf("generate canary marker: %w", err)
+	}
+	marker := hex.EncodeToString(markerBytes)
+
+	receiver, err := getCanaryReceiverFunc(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	receiveCtx, cancel := context.WithTimeout(ctx, options.CanaryTimeout)
+	defer cancel()
+
+	var (
+		mu         sync.Mutex
+		receivedAt time.Time
+	)
+	done := make(chan error, 1)
+	go func() {
+		done <- receiver(receiveCtx, func(data []byte) {
+			if canaryMarker(data) != marker {
+				return
+			}
+			mu.Lock()
+			if receivedAt.IsZero() {
+				receivedAt = time.Now()
+			}
+			mu.Unlock()
+			cancel()
+		})
+	}()
+
+	sentAt := time.Now()
+	line, err := json.Marshal(canaryLine{Marker: marker, SentAt: sentAt.UTC()})
+	if err != nil {
+		return nil, err
+	}
+	if err := putLogEventFunc(ctx, options.CanaryLogGroup, options.CanaryLogStream, string(line), sentAt); err != nil {
+		cancel()
+		<-done
+		emitCanaryMetrics(false, 0)
+		return nil, fmt.Errorf("write canary log event: %w", err)
+	}
+
+	receiveErr := <-done
+
+	mu.Lock()
+	arrived := !receivedAt.IsZero()
+	latency := receivedAt.Sub(sentAt)
+	mu.Unlock()
+
+	emitCanaryMetrics(arrived, latency)
+	if !arrived {
+		if receiveErr != nil && !errors.Is(receiveErr, context.Canceled) && !errors.Is(receiveErr, context.DeadlineExceeded) {
+			log.Printf("canary %s: receive failed: %v", marker, receiveErr)
+		}
+		log.Printf("canary %s did not arrive within %s", marker, options.CanaryTimeout)
+		return map[string]interface{}{"canary_id": marker, "success": false}, nil
+	}
+
+	log.Printf("canary %s arrived after %s", marker, latency)
+	return map[string]interface{}{
+		"canary_id":  marker,
+		"success":    true,
+		"latency_ms": latency.Milliseconds(),
+	}, nil
+}
+
+func emitCanaryMetrics(success bool, latency time.Duration) {
+	metrics := map[string]metricValue{"CanarySuccess": {Value: 0, Unit: "Count"}}
+	if success {
+		metrics["CanarySuccess"] = metricValue{Value: 1, Unit: "Count"}
+		metrics["CanaryLatency"] = metricValue{Value: float64(latency.Milliseconds()), Unit: "Milliseconds"}
+	}
+	emitMetrics(options.MetricsNamespace, map[string]string{"LogGroup": options.CanaryLogGroup}, metrics)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func canaryTestOptions() OptionsStruct {
+	opts := testOptions()
+	opts.Mode = bridgeModeCanary
+	opts.CanaryLogGroup = "/fleet/server"
+	opts.CanaryLogStream = "canary"
+	opts.CanarySubscriptionID = "canary-sub"
+	opts.CanaryCredentialsSecretARN = opts.CredentialsSecretARN
+	opts.CanaryTimeout = time.Second
+	opts.MetricsNamespace = "Test"
+	return opts
+}
+
+func envelopeFor(t *testing.T, message string) []byte {
+	t.Helper()
+	data, err := json.Marshal(map[string]interface{}{"logGroup": "/fleet/server", "message": message})
+	require.NoError(t, err)
+	return data
+}
+
+func TestCanaryMarker(t *testing.T) {
+	assert.Equal(t, "abc", canaryMarker(envelopeFor(t, `{"fleet_pubsub_bridge_canary":"abc","sent_at":"2024-01-01T00:00:00Z"}`)))
+	assert.Empty(t, canaryMarker(envelopeFor(t, "plain log line")))
+	assert.Empty(t, canaryMarker([]byte("not json")))
+}
+
+func TestCanaryHandlerSuccess(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	options = canaryTestOptions()
+	var metrics bytes.Buffer
+	metricsWriter = &metrics
+
+	written := make(chan string, 1)
+	putLogEventFunc = func(ctx context.Context, logGroup, logStream, message string, timestamp time.Time) error {
+		assert.Equal(t, "/fleet/server", logGroup)
+		assert.Equal(t, "canary", logStream)
+		written <- message
+		return nil
+	}
+	getCanaryReceiverFunc = func(ctx context.Context) (canaryReceiver, error) {
+		return func(ctx context.Context, fn func([]byte)) error {
+			fn(envelopeFor(t, "stale line from an earlier run"))
+			select {
+			case line := <-written:
+				fn(envelopeFor(t, line))
+			case <-ctx.Done():
+				return nil
+			}
+			<-ctx.Done()
+			return nil
+		}, nil
+	}
+
+	resp, err := canaryHandler(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, true, resp["success"])
+	assert.NotEmpty(t, resp["canary_id"])
+	assert.Contains(t, metrics.String(), `"CanarySuccess":1`)
+	assert.Contains(t, metrics.String(), `"CanaryLatency"`)
+}
+
+func TestCanaryHandlerTimeout(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	options = canaryTestOptions()
+	options.CanaryTimeout = 50 * time.Millisecond
+	var metrics bytes.Buffer
+	metricsWriter = &metrics
+
+	putLogEventFunc = func(ctx context.Context, logGroup, logStream, message string, timestamp time.Time) error {
+		return nil
+	}
+	getCanaryReceiverFunc = func(ctx context.Context) (canaryReceiver, error) {
+		return func(ctx context.Context, fn func([]byte)) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}, nil
+	}
+
+	resp, err := canaryHandler(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, false, resp["success"])
+	assert.Contains(t, metrics.String(), `"CanarySuccess":0`)
+	assert.NotContains(t, metrics.String(), `"CanaryLatency"`)
+}
+
+func TestCanaryHandlerWriteError(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	options = canaryTestOptions()
+	var metrics bytes.Buffer
+	metricsWriter = &metrics
+
+	putLogEventFunc = func(ctx context.Context, logGroup, logStream, message string, timestamp time.Time) error {
+		return errors.New("access denied")
+	}
+	getCanaryReceiverFunc = func(ctx context.Context) (canaryReceiver, error) {
+		return func(ctx context.Context, fn func([]byte)) error {
+			<-ctx.Done()
+			return nil
+		}, nil
+	}
+
+	_, err := canaryHandler(context.Background(), nil)
+	require.ErrorContains(t, err, "access denied")
+	assert.Contains(t, metrics.String(), `"CanarySuccess":0`)
+}
+
+func TestCanaryMarkerJSONMessageFormat(t *testing.T) {
+	data := []byte(`{"logGroup":"/fleet/server","message":{"fleet_pubsub_bridge_canary":"abc","sent_at":"2024-01-01T00:00:00Z"}}`)
+	assert.Equal(t, "abc", canaryMarker(data))
+}
@@ -0,0 +1,636 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	flags "github.com/jessevdk/go-flags"
+
+	"github.com/fleetdm/fleet/terraform/addons/byo-cloudwatch-log-sharing/pubsub-bridge/lambda/envelope"
+)
+
+type OptionsStruct struct {
+	LambdaRuntimeAPI           string        `long:"lambda-runtime-api" env:"AWS_LAMBDA_RUNTIME_API"`
+	PubSubProjectID            string        `long:"pubsub-project-id" env:"GCP_PUBSUB_PROJECT_ID"`
+	PubSubTopicID              string        `long:"pubsub-topic-id" env:"GCP_PUBSUB_TOPIC_ID"`
+	CredentialsSecretARN       string        `long:"credentials-secret-arn" env:"GCP_CREDENTIALS_SECRET_ARN"`
+	PubSubBatchSize            int           `long:"pubsub-batch-size" env:"PUBSUB_BATCH_SIZE" default:"1000"`
+	CredentialsCacheTTL        time.Duration `long:"credentials-cache-ttl" env:"GCP_CREDENTIALS_CACHE_TTL" default:"5m"`
+	EncryptionMode             string        `long:"encryption-mode" env:"ENCRYPTION_MODE" default:"none" choice:"none" choice:"kms" choice:"rsa"`
+	EncryptionKMSKeyID         string        `long:"encryption-kms-key-id" env:"ENCRYPTION_KMS_KEY_ID"`
+	EncryptionPublicKey        string        `long:"encryption-public-key" env:"ENCRYPTION_PUBLIC_KEY"`
+	EncryptionDataKeyTTL       time.Duration `long:"encryption-data-key-ttl" env:"ENCRYPTION_DATA_KEY_TTL" default:"5m"`
+	SigningSecretARN           string        `long:"signing-secret-arn" env:"SIGNING_SECRET_ARN"`
+	SamplingRules              string        `long:"sampling-rules" env:"SAMPLING_RULES"`
+	AWSRegion                  string        `long:"aws-region" env:"AWS_REGION"`
+	AllowedOwnerAccountIDs     string        `long:"allowed-owner-account-ids" env:"ALLOWED_OWNER_ACCOUNT_IDS"`
+	AllowedLogGroupARNs        string        `long:"allowed-log-group-arns" env:"ALLOWED_LOG_GROUP_ARNS"`
+	UnexpectedOwnerAction      string        `long:"unexpected-owner-action" env:"UNEXPECTED_OWNER_ACTION" default:"reject" choice:"reject" choice:"quarantine"`
+	QuarantineQueueURL         string        `long:"quarantine-queue-url" env:"QUARANTINE_QUEUE_URL"`
+	OwnerRoutes                string        `long:"owner-routes" env:"OWNER_ROUTES"`
+	MessageFormat              string        `long:"message-format" env:"MESSAGE_FORMAT" default:"string" choice:"string" choice:"json"`
+	PromoteFields              string        `long:"promote-fields" env:"PROMOTE_FIELDS"`
+	EventTimeFields            string        `long:"event-time-fields" env:"EVENT_TIME_FIELDS"`
+	Mode                       string        `long:"mode" env:"BRIDGE_MODE" default:"bridge" choice:"bridge" choice:"canary" choice:"gap-check" choice:"replay"`
+	CanaryLogGroup             string        `long:"canary-log-group" env:"CANARY_LOG_GROUP"`
+	CanaryLogStream            string        `long:"canary-log-stream" env:"CANARY_LOG_STREAM" default:"fleet-pubsub-bridge-canary"`
+	CanarySubscriptionID       string        `long:"canary-subscription-id" env:"CANARY_SUBSCRIPTION_ID"`
+	CanaryCredentialsSecretARN string        `long:"canary-credentials-secret-arn" env:"CANARY_CREDENTIALS_SECRET_ARN"`
+	CanaryTimeout              time.Duration `long:"canary-timeout" env:"CANARY_TIMEOUT" default:"2m"`
+	StateTableName             string        `long:"state-table-name" env:"STATE_TABLE_NAME"`
+	StateEndpointURL           string        `long:"state-endpoint-url" env:"STATE_ENDPOINT_URL"`
+	GapCheckLogGroups          string        `long:"gap-check-log-groups" env:"GAP_CHECK_LOG_GROUPS"`
+	GapCheckThreshold          time.Duration `long:"gap-check-threshold" env:"GAP_CHECK_THRESHOLD" default:"15m"`
+	GapCheckLookback           time.Duration `long:"gap-check-lookback" env:"GAP_CHECK_LOOKBACK" default:"24h"`
+	GapReportBucket            string        `long:"gap-report-bucket" env:"GAP_REPORT_BUCKET"`
+	GapReportPrefix            string        `long:"gap-report-prefix" env:"GAP_REPORT_PREFIX" default:"gap-reports/"`
+	Sink                       string        `long:"sink" env:"SINK" default:"pubsub" choice:"pubsub" choice:"kafka" choice:"splunk" choice:"otlp" choice:"loki" choice:"elasticsearch" choice:"syslog"`
+	KafkaBrokers               string        `long:"kafka-brokers" env:"KAFKA_BROKERS"`
+	KafkaTopic                 string        `long:"kafka-topic" env:"KAFKA_TOPIC"`
+	KafkaClientID              string        `long:"kafka-client-id" env:"KAFKA_CLIENT_ID" default:"fleet-pubsub-bridge"`
+	KafkaTLS                   bool          `long:"kafka-tls" env:"KAFKA_TLS"`
+	KafkaTLSCAPEM              string        `long:"kafka-tls-ca-pem" env:"KAFKA_TLS_CA_PEM"`
+	KafkaSASLMechanism         string        `long:"kafka-sasl-mechanism" env:"KAFKA_SASL_MECHANISM" default:"none" choice:"none" choice:"plain" choice:"scram-sha-256" choice:"scram-sha-512"`
+	KafkaSASLSecretARN         string        `long:"kafka-sasl-secret-arn" env:"KAFKA_SASL_SECRET_ARN"`
+	KafkaIdempotence           string        `long:"kafka-idempotence" env:"KAFKA_IDEMPOTENCE" default:"enabled" choice:"enabled" choice:"disabled"`
+	KafkaMaxRetries            int           `long:"kafka-max-retries" env:"KAFKA_MAX_RETRIES" default:"3"`
+	KafkaRequestTimeout        time.Duration `long:"kafka-request-timeout" env:"KAFKA_REQUEST_TIMEOUT" default:"30s"`
+	SplunkHECURL               string        `long:"splunk-hec-url" env:"SPLUNK_HEC_URL"`
+	SplunkTokenSecretARN       string        `long:"splunk-token-secret-arn" env:"SPLUNK_HEC_TOKEN_SECRET_ARN"`
+	SplunkSourcetype           string        `long:"splunk-sourcetype" env:"SPLUNK_SOURCETYPE" default:"fleet:cloudwatch"`
+	SplunkIndex                string        `long:"splunk-index" env:"SPLUNK_INDEX"`
+	SplunkHost                 string        `long:"splunk-host" env:"SPLUNK_HOST"`
+	SplunkSource               string        `long:"splunk-source" env:"SPLUNK_SOURCE" default:"{log_group}"`
+	SplunkRoutes               string        `long:"splunk-routes" env:"SPLUNK_ROUTES"`
+	SplunkAck                  bool          `long:"splunk-ack" env:"SPLUNK_ACK"`
+	SplunkAckTimeout           time.Duration `long:"splunk-ack-timeout" env:"SPLUNK_ACK_TIMEOUT" default:"30s"`
+	SplunkTLSCAPEM             string        `long:"splunk-tls-ca-pem" env:"SPLUNK_TLS_CA_PEM"`
+	SplunkMaxRetries           int           `long:"splunk-max-retries" env:"SPLUNK_MAX_RETRIES" default:"3"`
+	SplunkRetryBackoff         time.Duration `long:"splunk-retry-backoff" env:"SPLUNK_RETRY_BACKOFF" default:"500ms"`
+	SplunkRequestTimeout       time.Duration `long:"splunk-request-timeout" env:"SPLUNK_REQUEST_TIMEOUT" default:"30s"`
+	OTLPEndpoint               string        `long:"otlp-endpoint" env:"OTLP_ENDPOINT"`
+	OTLPProtocol               string        `long:"otlp-protocol" env:"OTLP_PROTOCOL" default:"http/protobuf" choice:"http/protobuf" choice:"grpc"`
+	OTLPInsecure               bool          `long:"otlp-insecure" env:"OTLP_INSECURE"`
+	OTLPTLSCAPEM               string        `long:"otlp-tls-ca-pem" env:"OTLP_TLS_CA_PEM"`
+	OTLPHeadersSecretARN       string        `long:"otlp-headers-secret-arn" env:"OTLP_HEADERS_SECRET_ARN"`
+	OTLPCompression            string        `long:"otlp-compression" env:"OTLP_COMPRESSION" default:"gzip" choice:"gzip" choice:"none"`
+	OTLPServiceName            string        `long:"otlp-service-name" env:"OTLP_SERVICE_NAME" default:"fleet"`
+	OTLPTimeout                time.Duration `long:"otlp-timeout" env:"OTLP_TIMEOUT" default:"30s"`
+	OTLPMaxRetries             int           `long:"otlp-max-retries" env:"OTLP_MAX_RETRIES" default:"3"`
+	OTLPRetryBackoff           time.Duration `long:"otlp-retry-backoff" env:"OTLP_RETRY_BACKOFF" default:"500ms"`
+	FleetEnvironment           string        `long:"fleet-environment" env:"FLEET_ENVIRONMENT"`
+	SyslogAddress              string        `long:"syslog-address" env:"SYSLOG_ADDRESS"`
+	SyslogTLSCAPEM             string        `long:"syslog-tls-ca-pem" env:"SYSLOG_TLS_CA_PEM"`
+	SyslogTLSServerName        string        `long:"syslog-tls-server-name" env:"SYSLOG_TLS_SERVER_NAME"`
+	SyslogAppName              string        `long:"syslog-app-name" env:"SYSLOG_APP_NAME" default:"{log_group}"`
+	SyslogHostname             string        `long:"syslog-hostname" env:"SYSLOG_HOSTNAME"`
+	SyslogFacility             int           `long:"syslog-facility" env:"SYSLOG_FACILITY" default:"1"`
+	SyslogSDID                 string        `long:"syslog-sd-id" env:"SYSLOG_SD_ID" default:"fleet@32473"`
+	SyslogMaxMessageBytes      int           `long:"syslog-max-message-bytes" env:"SYSLOG_MAX_MESSAGE_BYTES" default:"8192"`
+	SyslogDialTimeout          time.Duration `long:"syslog-dial-timeout" env:"SYSLOG_DIAL_TIMEOUT" default:"10s"`
+	SyslogWriteTimeout         time.Duration `long:"syslog-write-timeout" env:"SYSLOG_WRITE_TIMEOUT" default:"10s"`
+	SyslogMaxRetries           int           `long:"syslog-max-retries" env:"SYSLOG_MAX_RETRIES" default:"3"`
+	SyslogRetryBackoff         time.Duration `long:"syslog-retry-backoff" env:"SYSLOG_RETRY_BACKOFF" default:"500ms"`
+	ESURL                      string        `long:"elasticsearch-url" env:"ELASTICSEARCH_URL"`
+	ESIndex                    string        `long:"elasticsearch-index" env:"ELASTICSEARCH_INDEX" default:"fleet-logs-{date}"`
+	ESIndexDateFormat          string        `long:"elasticsearch-index-date-format" env:"ELASTICSEARCH_INDEX_DATE_FORMAT" default:"2006.01.02"`
+	ESAuth                     string        `long:"elasticsearch-auth" env:"ELASTICSEARCH_AUTH" default:"none" choice:"none" choice:"basic" choice:"sigv4"`
+	ESBasicAuthSecretARN       string        `long:"elasticsearch-basic-auth-secret-arn" env:"ELASTICSEARCH_BASIC_AUTH_SECRET_ARN"`
+	ESSigV4Service             string        `long:"elasticsearch-sigv4-service" env:"ELASTICSEARCH_SIGV4_SERVICE" default:"es" choice:"es" choice:"aoss"`
+	ESSigV4Region              string        `long:"elasticsearch-sigv4-region" env:"ELASTICSEARCH_SIGV4_REGION"`
+	ESTLSCAPEM                 string        `long:"elasticsearch-tls-ca-pem" env:"ELASTICSEARCH_TLS_CA_PEM"`
+	ESRequestTimeout           time.Duration `long:"elasticsearch-request-timeout" env:"ELASTICSEARCH_REQUEST_TIMEOUT" default:"30s"`
+	ESMaxRetries               int           `long:"elasticsearch-max-retries" env:"ELASTICSEARCH_MAX_RETRIES" default:"3"`
+	ESRetryBackoff             time.Duration `long:"elasticsearch-retry-backoff" env:"ELASTICSEARCH_RETRY_BACKOFF" default:"500ms"`
+	LokiURL                    string        `long:"loki-url" env:"LOKI_URL"`
+	LokiFormat                 string        `long:"loki-format" env:"LOKI_FORMAT" default:"protobuf" choice:"protobuf" choice:"json"`
+	LokiLabels                 string        `long:"loki-labels" env:"LOKI_LABELS" default:"{\"log_group\":\"{log_group}\"}"`
+	LokiLogTypes               string        `long:"loki-log-types" env:"LOKI_LOG_TYPES"`
+	LokiMaxLabelValues         int           `long:"loki-max-label-values" env:"LOKI_MAX_LABEL_VALUES" default:"50"`
+	LokiTenantID               string        `long:"loki-tenant-id" env:"LOKI_TENANT_ID"`
+	LokiAuthSecretARN          string        `long:"loki-auth-secret-arn" env:"LOKI_AUTH_SECRET_ARN"`
+	LokiStructuredMetadata     bool          `long:"loki-structured-metadata" env:"LOKI_STRUCTURED_METADATA"`
+	LokiTLSCAPEM               string        `long:"loki-tls-ca-pem" env:"LOKI_TLS_CA_PEM"`
+	LokiTimeout                time.Duration `long:"loki-timeout" env:"LOKI_TIMEOUT" default:"30s"`
+	LokiMaxRetries             int           `long:"loki-max-retries" env:"LOKI_MAX_RETRIES" default:"3"`
+	LokiRetryBackoff           time.Duration `long:"loki-retry-backoff" env:"LOKI_RETRY_BACKOFF" default:"500ms"`
+	MetricsNamespace           string        `long:"metrics-namespace" env:"METRICS_NAMESPACE" default:"FleetPubSubBridge"`
+	ValidateConfig             bool          `long:"validate-config" description:"Validate configuration, print a redacted summary and exit"`
+	ValidateConfigFormat       string        `long:"validate-config-format" default:"text" choice:"text" choice:"json" description:"Print the --validate-config summary as text, or as a JSON object for a Terraform external data source"`
+}
+
+var options = OptionsStruct{}
+
+// loadOptions parses command line flags and environment variables into an
+// OptionsStruct and validates the result.
+func loadOptions(args []string) (OptionsStruct, error) {
+	var opts OptionsStruct
+
+	parser := flags.NewParser(&opts, flags.HelpFlag|flags.PassDoubleDash)
+	if _, err := parser.ParseArgs(args); err != nil {
+		return opts, fmt.Errorf("parse configuration: %w", err)
+	}
+
+	if err := opts.validate(); err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+func (o *OptionsStruct) validate() error {
+	var errs []error
+
+	o.PubSubProjectID = strings.TrimSpace(o.PubSubProjectID)
+	o.PubSubTopicID = strings.TrimSpace(o.PubSubTopicID)
+	o.CredentialsSecretARN = strings.TrimSpace(o.CredentialsSecretARN)
+
+	switch o.Sink {
+	case sinkKafka:
+		errs = append(errs, o.validateKafka()...)
+	case sinkSplunk:
+		errs = append(errs, o.validateSplunk()...)
+	case sinkOTLP:
+		errs = append(errs, o.validateOTLP()...)
+	case sinkLoki:
+		errs = append(errs, o.validateLoki()...)
+	case sinkElasticsearch:
+		errs = append(errs, o.validateElasticsearch()...)
+	case sinkSyslog:
+		errs = append(errs, o.validateSyslog()...)
+	default:
+		if o.PubSubProjectID == "" {
+			errs = append(errs, errors.New("GCP_PUBSUB_PROJECT_ID must not be empty"))
+		}
+
+		if o.PubSubTopicID == "" {
+			errs = append(errs, errors.New("GCP_PUBSUB_TOPIC_ID must not be empty"))
+		}
+
+		if !strings.HasPrefix(o.CredentialsSecretARN, "arn:") {
+			errs = append(errs, fmt.Errorf("GCP_CREDENTIALS_SECRET_ARN must be a Secrets Manager ARN, got %q", o.CredentialsSecretARN))
+		}
+	}
+
+	if o.PubSubBatchSize < 1 || o.PubSubBatchSize > defaultPubSubBatchMax {
+		errs = append(errs, fmt.Errorf("PUBSUB_BATCH_SIZE must be between 1 and %d, got %d", defaultPubSubBatchMax, o.PubSubBatchSize))
+	}
+
+	if o.CredentialsCacheTTL <= 0 {
+		errs = append(errs, fmt.Errorf("GCP_CREDENTIALS_CACHE_TTL must be positive, got %s", o.CredentialsCacheTTL))
+	}
+
+	switch o.EncryptionMode {
+	case encryptionModeKMS:
+		if strings.TrimSpace(o.EncryptionKMSKeyID) == "" {
+			errs = append(errs, errors.New("ENCRYPTION_KMS_KEY_ID is required when ENCRYPTION_MODE is kms"))
+		}
+	case encryptionModeRSA:
+		if _, err := envelope.ParseRSAPublicKey([]byte(o.EncryptionPublicKey)); err != nil {
+			errs = append(errs, fmt.Errorf("ENCRYPTION_PUBLIC_KEY must be a PEM encoded RSA public key when ENCRYPTION_MODE is rsa: %w", err))
+		}
+	}
+
+	if o.EncryptionMode != encryptionModeNone && o.EncryptionDataKeyTTL <= 0 {
+		errs = append(errs, fmt.Errorf("ENCRYPTION_DATA_KEY_TTL must be positive, got %s", o.EncryptionDataKeyTTL))
+	}
+
+	o.SigningSecretARN = strings.TrimSpace(o.SigningSecretARN)
+	if o.SigningSecretARN != "" && !strings.HasPrefix(o.SigningSecretARN, "arn:") {
+		errs = append(errs, fmt.Errorf("SIGNING_SECRET_ARN must be empty or a Secrets Manager ARN, got %q", o.SigningSecretARN))
+	}
+
+	if _, err := parseSamplingRules(o.SamplingRules); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := parsePromotedFields(o.PromoteFields); err != nil {
+		errs = append(errs, err)
+	}
+	if o.PromoteFields != "" && o.MessageFormat != messageFormatJSON {
+		errs = append(errs, errors.New("PROMOTE_FIELDS requires MESSAGE_FORMAT to be json"))
+	}
+
+	if _, err := parseTenancy(*o); err != nil {
+		errs = append(errs, err)
+	}
+	if strings.TrimSpace(o.OwnerRoutes) != "" && o.Sink != sinkPubSub && o.Sink != sinkKafka {
+		errs = append(errs, fmt.Errorf("OWNER_ROUTES is not supported when SINK is %s", o.Sink))
+	}
+
+	if o.AllowedLogGroupARNs != "" && strings.TrimSpace(o.AWSRegion) == "" {
+		errs = append(errs, errors.New("AWS_REGION is required when ALLOWED_LOG_GROUP_ARNS is set"))
+	}
+
+	if o.Mode == bridgeModeCanary {
+		o.CanaryCredentialsSecretARN = strings.TrimSpace(o.CanaryCredentialsSecretARN)
+		if o.CanaryCredentialsSecretARN == "" {
+			o.CanaryCredentialsSecretARN = o.CredentialsSecretARN
+		}
+		if strings.TrimSpace(o.CanaryLogGroup) == "" {
+			errs = append(errs, errors.New("CANARY_LOG_GROUP is required when BRIDGE_MODE is canary"))
+		}
+		if strings.TrimSpace(o.CanaryLogStream) == "" {
+			errs = append(errs, errors.New("CANARY_LOG_STREAM must not be empty when BRIDGE_MODE is canary"))
+		}
+		if strings.TrimSpace(o.CanarySubscriptionID) == "" {
+			errs = append(errs, errors.New("CANARY_SUBSCRIPTION_ID is required when BRIDGE_MODE is canary"))
+		}
+		if !strings.HasPrefix(o.CanaryCredentialsSecretARN, "arn:") {
+			errs = append(errs, fmt.Errorf("CANARY_CREDENTIALS_SECRET_ARN must be a Secrets Manager ARN, got %q", o.CanaryCredentialsSecretARN))
+		}
+		if o.EncryptionMode != encryptionModeNone {
+			errs = append(errs, errors.New("ENCRYPTION_MODE must be none when BRIDGE_MODE is canary"))
+		}
+		if o.Sink != sinkPubSub {
+			errs = append(errs, errors.New("SINK must be pubsub when BRIDGE_MODE is canary"))
+		}
+		if o.CanaryTimeout <= 0 {
+			errs = append(errs, fmt.Errorf("CANARY_TIMEOUT must be positive, got %s", o.CanaryTimeout))
+		}
+		if strings.TrimSpace(o.AWSRegion) == "" {
+			errs = append(errs, errors.New("AWS_REGION is required when BRIDGE_MODE is canary"))
+		}
+	}
+
+	o.StateTableName = strings.TrimSpace(o.StateTableName)
+	o.StateEndpointURL = strings.TrimSpace(o.StateEndpointURL)
+	if o.StateEndpointURL != "" && !strings.HasPrefix(o.StateEndpointURL, "https://") && !strings.HasPrefix(o.StateEndpointURL, "http://") {
+		errs = append(errs, fmt.Errorf("STATE_ENDPOINT_URL must be an http(s) URL, got %q", o.StateEndpointURL))
+	}
+
+	if o.Mode == bridgeModeGapCheck {
+		if o.StateTableName == "" {
+			errs = append(errs, errors.New("STATE_TABLE_NAME is required when BRIDGE_MODE is gap-check"))
+		}
+		if len(splitList(o.GapCheckLogGroups)) == 0 {
+			errs = append(errs, errors.New("GAP_CHECK_LOG_GROUPS is required when BRIDGE_MODE is gap-check"))
+		}
+		if o.GapCheckThreshold <= 0 {
+			errs = append(errs, fmt.Errorf("GAP_CHECK_THRESHOLD must be positive, got %s", o.GapCheckThreshold))
+		}
+		if o.GapCheckLookback <= o.GapCheckThreshold {
+			errs = append(errs, fmt.Errorf("GAP_CHECK_LOOKBACK must be greater than GAP_CHECK_THRESHOLD, got %s", o.GapCheckLookback))
+		}
+		if strings.TrimSpace(o.AWSRegion) == "" {
+			errs = append(errs, errors.New("AWS_REGION is required when BRIDGE_MODE is gap-check"))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+func (o *OptionsStruct) validateKafka() []error {
+	var errs []error
+
+	brokers := splitList(o.KafkaBrokers)
+	if len(brokers) == 0 {
+		errs = append(errs, errors.New("KAFKA_BROKERS is required when SINK is kafka"))
+	}
+	for _, broker := range brokers {
+		if _, port, err := net.SplitHostPort(broker); err != nil || port == "" {
+			errs = append(errs, fmt.Errorf("KAFKA_BROKERS entry %q must be host:port", broker))
+		}
+	}
+
+	o.KafkaTopic = strings.TrimSpace(o.KafkaTopic)
+	if o.KafkaTopic == "" {
+		errs = append(errs, errors.New("KAFKA_TOPIC is required when SINK is kafka"))
+	}
+
+	if strings.TrimSpace(o.KafkaTLSCAPEM) != "" {
+		if !o.KafkaTLS {
+			errs = append(errs, errors.New("KAFKA_TLS_CA_PEM requires KAFKA_TLS"))
+		} else if _, err := newTLSConfig("KAFKA_TLS_CA_PEM", o.KafkaTLSCAPEM); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	o.KafkaSASLSecretARN = strings.TrimSpace(o.KafkaSASLSecretARN)
+	if o.KafkaSASLMechanism != kafkaSASLNone && !strings.HasPrefix(o.KafkaSASLSecretARN, "arn:") {
+		errs = append(errs, fmt.Errorf("KAFKA_SASL_SECRET_ARN must be a Secrets Manager ARN when KAFKA_SASL_MECHANISM is %s, got %q", o.KafkaSASLMechanism, o.KafkaSASLSecretARN))
+	}
+	if o.KafkaSASLMechanism == kafkaSASLPlain && !o.KafkaTLS {
+		errs = append(errs, errors.New("KAFKA_SASL_MECHANISM plain sends the password in clear text and requires KAFKA_TLS"))
+	}
+
+	if o.KafkaMaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("KAFKA_MAX_RETRIES must not be negative, got %d", o.KafkaMaxRetries))
+	}
+	if o.KafkaRequestTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("KAFKA_REQUEST_TIMEOUT must be positive, got %s", o.KafkaRequestTimeout))
+	}
+
+	return errs
+}
+
+func (o *OptionsStruct) validateSplunk() []error {
+	var errs []error
+
+	o.SplunkHECURL = strings.TrimSpace(o.SplunkHECURL)
+	if u, err := url.Parse(o.SplunkHECURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("SPLUNK_HEC_URL must be an http(s) URL, got %q", o.SplunkHECURL))
+	}
+
+	o.SplunkTokenSecretARN = strings.TrimSpace(o.SplunkTokenSecretARN)
+	if !strings.HasPrefix(o.SplunkTokenSecretARN, "arn:") {
+		errs = append(errs, fmt.Errorf("SPLUNK_HEC_TOKEN_SECRET_ARN must be a Secrets Manager ARN, got %q", o.SplunkTokenSecretARN))
+	}
+
+	cfg, err := parseSplunkConfig(*o)
+	if err != nil {
+		errs = append(errs, err)
+	} else if cfg.usesBodyFields() && o.EncryptionMode != encryptionModeNone {
+		// Event metadata is sent in clear text, so it must not be derived
+		// from log bodies that are meant to be encrypted.
+		errs = append(errs, errors.New("SPLUNK_* {field.*} placeholders require ENCRYPTION_MODE none"))
+	}
+
+	if _, err := newTLSConfig("SPLUNK_TLS_CA_PEM", o.SplunkTLSCAPEM); err != nil {
+		errs = append(errs, err)
+	}
+
+	if o.SplunkAck && o.SplunkAckTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("SPLUNK_ACK_TIMEOUT must be positive, got %s", o.SplunkAckTimeout))
+	}
+	if o.SplunkMaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("SPLUNK_MAX_RETRIES must not be negative, got %d", o.SplunkMaxRetries))
+	}
+	if o.SplunkRetryBackoff <= 0 {
+		errs = append(errs, fmt.Errorf("SPLUNK_RETRY_BACKOFF must be positive, got %s", o.SplunkRetryBackoff))
+	}
+	if o.SplunkRequestTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("SPLUNK_REQUEST_TIMEOUT must be positive, got %s", o.SplunkRequestTimeout))
+	}
+
+	return errs
+}
+
+func (o *OptionsStruct) validateOTLP() []error {
+	var errs []error
+
+	o.OTLPEndpoint = strings.TrimSpace(o.OTLPEndpoint)
+	if o.OTLPProtocol == otlpProtocolGRPC {
+		if _, port, err := net.SplitHostPort(o.OTLPEndpoint); err != nil || port == "" {
+			errs = append(errs, fmt.Errorf("OTLP_ENDPOINT must be host:port when OTLP_PROTOCOL is grpc, got %q", o.OTLPEndpoint))
+		}
+	} else {
+		u, err := url.Parse(o.OTLPEndpoint)
+		switch {
+		case err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http"):
+			errs = append(errs, fmt.Errorf("OTLP_ENDPOINT must be an http(s) URL when OTLP_PROTOCOL is http/protobuf, got %q", o.OTLPEndpoint))
+		case u.Scheme == "http" && !o.OTLPInsecure:
+			errs = append(errs, errors.New("OTLP_ENDPOINT uses http and requires OTLP_INSECURE"))
+		}
+	}
+
+	if _, err := newTLSConfig("OTLP_TLS_CA_PEM", o.OTLPTLSCAPEM); err != nil {
+		errs = append(errs, err)
+	}
+
+	o.OTLPHeadersSecretARN = strings.TrimSpace(o.OTLPHeadersSecretARN)
+	if o.OTLPHeadersSecretARN != "" && !strings.HasPrefix(o.OTLPHeadersSecretARN, "arn:") {
+		errs = append(errs, fmt.Errorf("OTLP_HEADERS_SECRET_ARN must be empty or a Secrets Manager ARN, got %q", o.OTLPHeadersSecretARN))
+	}
+
+	if o.OTLPTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("OTLP_TIMEOUT must be positive, got %s", o.OTLPTimeout))
+	}
+	if o.OTLPMaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("OTLP_MAX_RETRIES must not be negative, got %d", o.OTLPMaxRetries))
+	}
+	if o.OTLPRetryBackoff <= 0 {
+		errs = append(errs, fmt.Errorf("OTLP_RETRY_BACKOFF must be positive, got %s", o.OTLPRetryBackoff))
+	}
+
+	return errs
+}
+
+func (o *OptionsStruct) validateLoki() []error {
+	var errs []error
+
+	o.LokiURL = strings.TrimSpace(o.LokiURL)
+	if u, err := url.Parse(o.LokiURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("LOKI_URL must be an http(s) URL, got %q", o.LokiURL))
+	}
+
+	cfg, err := parseLokiConfig(*o)
+	if err != nil {
+		errs = append(errs, err)
+	} else if cfg.usesBodyFields() && o.EncryptionMode != encryptionModeNone {
+		// Labels and tenant IDs are sent in clear text, so they must not be
+		// derived from log bodies that are meant to be encrypted.
+		errs = append(errs, errors.New("LOKI_LABELS and LOKI_TENANT_ID {field.*} placeholders require ENCRYPTION_MODE none"))
+	}
+	if o.LokiMaxLabelValues < 1 {
+		errs = append(errs, fmt.Errorf("LOKI_MAX_LABEL_VALUES must be at least 1, got %d", o.LokiMaxLabelValues))
+	}
+
+	o.LokiAuthSecretARN = strings.TrimSpace(o.LokiAuthSecretARN)
+	if o.LokiAuthSecretARN != "" && !strings.HasPrefix(o.LokiAuthSecretARN, "arn:") {
+		errs = append(errs, fmt.Errorf("LOKI_AUTH_SECRET_ARN must be empty or a Secrets Manager ARN, got %q", o.LokiAuthSecretARN))
+	}
+
+	if _, err := newTLSConfig("LOKI_TLS_CA_PEM", o.LokiTLSCAPEM); err != nil {
+		errs = append(errs, err)
+	}
+
+	if o.LokiTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("LOKI_TIMEOUT must be positive, got %s", o.LokiTimeout))
+	}
+	if o.LokiMaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("LOKI_MAX_RETRIES must not be negative, got %d", o.LokiMaxRetries))
+	}
+	if o.LokiRetryBackoff <= 0 {
+		errs = append(errs, fmt.Errorf("LOKI_RETRY_BACKOFF must be positive, got %s", o.LokiRetryBackoff))
+	}
+
+	return errs
+}
+
+func (o *OptionsStruct) validateElasticsearch() []error {
+	var errs []error
+
+	o.ESURL = strings.TrimSpace(o.ESURL)
+	if u, err := url.Parse(o.ESURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("ELASTICSEARCH_URL must be an http(s) URL, got %q", o.ESURL))
+	}
+
+	if index, err := parseESIndex(o.ESIndex); err != nil {
+		errs = append(errs, err)
+	} else if strings.Contains(string(index), "{field.") && o.EncryptionMode != encryptionModeNone {
+		// Index names are sent in clear text, so they must not be derived
+		// from log bodies that are meant to be encrypted.
+		errs = append(errs, errors.New("ELASTICSEARCH_INDEX {field.*} placeholders require ENCRYPTION_MODE none"))
+	}
+	if strings.TrimSpace(o.ESIndexDateFormat) == "" {
+		errs = append(errs, errors.New("ELASTICSEARCH_INDEX_DATE_FORMAT must not be empty"))
+	}
+
+	o.ESBasicAuthSecretARN = strings.TrimSpace(o.ESBasicAuthSecretARN)
+	if o.ESAuth == esAuthBasic && !strings.HasPrefix(o.ESBasicAuthSecretARN, "arn:") {
+		errs = append(errs, fmt.Errorf("ELASTICSEARCH_BASIC_AUTH_SECRET_ARN must be a Secrets Manager ARN when ELASTICSEARCH_AUTH is basic, got %q", o.ESBasicAuthSecretARN))
+	}
+	if o.ESAuth == esAuthSigV4 && strings.TrimSpace(o.ESSigV4Region) == "" && strings.TrimSpace(o.AWSRegion) == "" {
+		errs = append(errs, errors.New("ELASTICSEARCH_SIGV4_REGION or AWS_REGION is required when ELASTICSEARCH_AUTH is sigv4"))
+	}
+
+	if _, err := newTLSConfig("ELASTICSEARCH_TLS_CA_PEM", o.ESTLSCAPEM); err != nil {
+		errs = append(errs, err)
+	}
+
+	if o.ESRequestTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("ELASTICSEARCH_REQUEST_TIMEOUT must be positive, got %s", o.ESRequestTimeout))
+	}
+	if o.ESMaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("ELASTICSEARCH_MAX_RETRIES must not be negative, got %d", o.ESMaxRetries))
+	}
+	if o.ESRetryBackoff <= 0 {
+		errs = append(errs, fmt.Errorf("ELASTICSEARCH_RETRY_BACKOFF must be positive, got %s", o.ESRetryBackoff))
+	}
+
+	return errs
+}
+
+func (o *OptionsStruct) validateSyslog() []error {
+	var errs []error
+
+	o.SyslogAddress = strings.TrimSpace(o.SyslogAddress)
+	if host, port, err := net.SplitHostPort(o.SyslogAddress); err != nil || host == "" || port == "" {
+		errs = append(errs, fmt.Errorf("SYSLOG_ADDRESS must be host:port, got %q", o.SyslogAddress))
+	}
+	if _, err := newTLSConfig("SYSLOG_TLS_CA_PEM", o.SyslogTLSCAPEM); err != nil {
+		errs = append(errs, err)
+	}
+
+	if appName, hostname, err := parseSyslogTemplates(*o); err != nil {
+		errs = append(errs, err)
+	} else if (strings.Contains(string(appName), "{field.") || strings.Contains(string(hostname), "{field.")) && o.EncryptionMode != encryptionModeNone {
+		// Syslog headers are sent in clear text, so they must not be
+		// derived from log bodies that are meant to be encrypted.
+		errs = append(errs, errors.New("SYSLOG_APP_NAME and SYSLOG_HOSTNAME {field.*} placeholders require ENCRYPTION_MODE none"))
+	}
+	if o.SyslogFacility < 0 || o.SyslogFacility > 23 {
+		errs = append(errs, fmt.Errorf("SYSLOG_FACILITY must be between 0 and 23, got %d", o.SyslogFacility))
+	}
+	if !syslogSDID.MatchString(o.SyslogSDID) || !strings.Contains(o.SyslogSDID, "@") {
+		errs = append(errs, fmt.Errorf("SYSLOG_SD_ID must be an SD-ID of the form name@<enterprise number>, got %q", o.SyslogSDID))
+	}
+	if o.SyslogMaxMessageBytes < 480 {
+		errs = append(errs, fmt.Errorf("SYSLOG_MAX_MESSAGE_BYTES must be at least 480, got %d", o.SyslogMaxMessageBytes))
+	}
+
+	if o.SyslogDialTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("SYSLOG_DIAL_TIMEOUT must be positive, got %s", o.SyslogDialTimeout))
+	}
+	if o.SyslogWriteTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("SYSLOG_WRITE_TIMEOUT must be positive, got %s", o.SyslogWriteTimeout))
+	}
+	if o.SyslogMaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("SYSLOG_MAX_RETRIES must not be negative, got %d", o.SyslogMaxRetries))
+	}
+	if o.SyslogRetryBackoff <= 0 {
+		errs = append(errs, fmt.Errorf("SYSLOG_RETRY_BACKOFF must be positive, got %s", o.SyslogRetryBackoff))
+	}
+
+	return errs
+}
+
+// summary returns a single-line description of the configuration that is safe
+// to log. Account IDs in ARNs are masked and key material is omitted.
+func (o OptionsStruct) summary() string {
+	parsedTenancy, _ := parseTenancy(o)
+	return fmt.Sprintf(
+		"mode=%s sink=%s pubsub_project_id=%s pubsub_topic_id=%s credentials_secret_arn=%s pubsub_batch_size=%d credentials_cache_ttl=%s encryption_mode=%s encryption_kms_key_id=%s signing_secret_arn=%s sampling_rules=%s allowed_owner_account_ids=%s unexpected_owner_action=%s owner_routes=%d state_table_name=%s message_format=%s promote_fields=%s event_time_fields=%s kafka_brokers=%s kafka_topic=%s kafka_tls=%t kafka_sasl_mechanism=%s kafka_idempotence=%s splunk_hec_url=%s splunk_ack=%t otlp_endpoint=%s otlp_protocol=%s loki_url=%s loki_format=%s loki_tenant_id=%s elasticsearch_url=%s elasticsearch_index=%s elasticsearch_auth=%s syslog_address=%s syslog_app_name=%s fleet_environment=%s",
+		o.Mode,
+		o.Sink,
+		o.PubSubProjectID,
+		o.PubSubTopicID,
+		redactARN(o.CredentialsSecretARN),
+		o.PubSubBatchSize,
+		o.CredentialsCacheTTL,
+		o.EncryptionMode,
+		redactARN(o.EncryptionKMSKeyID),
+		redactARN(o.SigningSecretARN),
+		o.SamplingRules,
+		redactAccountIDs(o.AllowedOwnerAccountIDs),
+		o.UnexpectedOwnerAction,
+		len(parsedTenancy.routes),
+		o.StateTableName,
+		o.MessageFormat,
+		o.PromoteFields,
+		o.EventTimeFields,
+		o.KafkaBrokers,
+		o.KafkaTopic,
+		o.KafkaTLS,
+		o.KafkaSASLMechanism,
+		o.KafkaIdempotence,
+		redactURL(o.SplunkHECURL),
+		o.SplunkAck,
+		redactURL(o.OTLPEndpoint),
+		o.OTLPProtocol,
+		redactURL(o.LokiURL),
+		o.LokiFormat,
+		o.LokiTenantID,
+		redactURL(o.ESURL),
+		o.ESIndex,
+		o.ESAuth,
+		o.SyslogAddress,
+		o.SyslogAppName,
+		o.FleetEnvironment,
+	)
+}
+
+// redactedAccountID replaces AWS account IDs in the summary.
+const redactedAccountID = "************"
+
+// redactAccountIDs masks each account ID of a comma-separated list, keeping
+// how many there are.
+func redactAccountIDs(ids string) string {
+	if strings.TrimSpace(ids) == "" {
+		return ids
+	}
+	parts := strings.Split(ids, ",")
+	for i := range parts {
+		parts[i] = redactedAccountID
+	}
+	return strings.Join(parts, ",")
+}
+
+// redactURL drops the credentials an endpoint URL may carry in its userinfo.
+// Values that do not parse are hidden entirely, since they cannot be checked.
+func redactURL(value string) string {
+	if !strings.Contains(value, "@") {
+		return value
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return "<redacted>"
+	}
+	if u.User != nil {
+		u.User = url.User("redacted")
+	}
+	return u.String()
+}
+
+func redactARN(arn string) string {
+	if !strings.HasPrefix(arn, "arn:") {
+		return arn
+	}
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) < 6 {
+		return "<redacted>"
+	}
+	if parts[4] != "" {
+		parts[4] = redactedAccountID
+	}
+	return strings.Join(parts, ":")
+}
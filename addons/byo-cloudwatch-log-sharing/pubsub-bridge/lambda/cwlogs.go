@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+// cloudWatchLogsAPI is the part of the CloudWatch Logs client the canary and
+// the gap check use.
+type cloudWatchLogsAPI interface {
+	CreateLogStream(ctx context.Context, params *cloudwatchlogs.CreateLogStreamInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.CreateLogStreamOutput, error)
+	PutLogEvents(ctx context.Context, params *cloudwatchlogs.PutLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error)
+	DescribeLogStreams(ctx context.Context, params *cloudwatchlogs.DescribeLogStreamsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.DescribeLogStreamsOutput, error)
+}
+
+var (
+	cloudWatchLogsClientOnce sync.Once
+	cloudWatchLogsClient     cloudWatchLogsAPI
+	cloudWatchLogsClientErr  error
+
+	getCloudWatchLogsClientFunc = getCloudWatchLogsClient
+)
+
+func getCloudWatchLogsClient(ctx context.Context) (cloudWatchLogsAPI, error) {
+	cloudWatchLogsClientOnce.Do(func() {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			cloudWatchLogsClientErr = fmt.Errorf("load aws sdk config: %w", err)
+			return
+		}
+		cloudWatchLogsClient = cloudwatchlogs.NewFromConfig(cfg)
+	})
+
+	if cloudWatchLogsClientErr != nil {
+		return nil, cloudWatchLogsClientErr
+	}
+	return cloudWatchLogsClient, nil
+}
+
+// putLogEvent writes a single log line, creating the log stream on first use.
+func putLogEvent(ctx context.Context, logGroup, logStream, message string, timestamp time.Time) error {
+	client, err := getCloudWatchLogsClientFunc(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.CreateLogStream(ctx, &cloudwatchlogs.CreateLogStreamInput{
+		LogGroupName:  aws.String(logGroup),
+		LogStreamName: aws.String(logStream),
+	})
+	var exists *types.ResourceAlreadyExistsException
+	if err != nil && !errors.As(err, &exists) {
+		return fmt.Errorf("create log stream: %w", err)
+	}
+
+	if _, err := client.PutLogEvents(ctx, &cloudwatchlogs.PutLogEventsInput{
+		LogGroupName:  aws.String(logGroup),
+		LogStreamName: aws.String(logStream),
+		LogEvents: []types.InputLogEvent{{
+			Timestamp: aws.Int64(timestamp.UnixMilli()),
+			Message:   aws.String(message),
+		}},
+	}); err != nil {
+		return fmt.Errorf("put log events: %w", err)
+	}
+	return nil
+}
+
+type logStreamInfo struct {
+	LogStreamName       string `json:"logStreamName"`
+	CreationTime        int64  `json:"creationTime"`
+	FirstEventTimestamp int64  `json:"firstEventTimestamp"`
+	LastEventTimestamp  int64  `json:"lastEventTimestamp"`
+	LastIngestionTime   int64  `json:"lastIngestionTime"`
+}
+
+// describeRecentLogStreams lists the streams of a log group, newest first,
+// stopping at the first stream without events since notBefore. logGroup may
+// be a name or, for cross-account observability, a log group ARN.
+func describeRecentLogStreams(ctx context.Context, logGroup string, notBefore time.Time) ([]logStreamInfo, error) {
+	client, err := getCloudWatchLogsClientFunc(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &cloudwatchlogs.DescribeLogStreamsInput{
+		OrderBy:    types.OrderByLastEventTime,
+		Descending: aws.Bool(true),
+	}
+	if strings.HasPrefix(logGroup, "arn:") {
+		input.LogGroupIdentifier = aws.String(strings.TrimSuffix(logGroup, ":*"))
+	} else {
+		input.LogGroupName = aws.String(logGroup)
+	}
+
+	var streams []logStreamInfo
+	paginator := cloudwatchlogs.NewDescribeLogStreamsPaginator(client, input)
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("describe log streams of %s: %w", logGroup, err)
+		}
+
+		for _, s := range out.LogStreams {
+			stream := logStreamInfo{
+				LogStreamName:       aws.ToString(s.LogStreamName),
+				CreationTime:        aws.ToInt64(s.CreationTime),
+				FirstEventTimestamp: aws.ToInt64(s.FirstEventTimestamp),
+				LastEventTimestamp:  aws.ToInt64(s.LastEventTimestamp),
+				LastIngestionTime:   aws.ToInt64(s.LastIngestionTime),
+			}
+			if stream.LastIngestionTime < notBefore.UnixMilli() && stream.LastEventTimestamp < notBefore.UnixMilli() {
+				return streams, nil
+			}
+			streams = append(streams, stream)
+		}
+	}
+	return streams, nil
+}
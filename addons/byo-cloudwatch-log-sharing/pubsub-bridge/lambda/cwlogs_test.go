@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeCloudWatchLogs struct {
+	createErr error
+	putErr    error
+	puts      []*cloudwatchlogs.PutLogEventsInput
+	pages     []*cloudwatchlogs.DescribeLogStreamsOutput
+	describes []*cloudwatchlogs.DescribeLogStreamsInput
+}
+
+func (f *fakeCloudWatchLogs) CreateLogStream(ctx context.Context, params *cloudwatchlogs.CreateLogStreamInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.CreateLogStreamOutput, error) {
+	return &cloudwatchlogs.CreateLogStreamOutput{}, f.createErr
+}
+
+func (f *fakeCloudWatchLogs) PutLogEvents(ctx context.Context, params *cloudwatchlogs.PutLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	f.puts = append(f.puts, params)
+	return &cloudwatchlogs.PutLogEventsOutput{}, f.putErr
+}
+
+func (f *fakeCloudWatchLogs) DescribeLogStreams(ctx context.Context, params *cloudwatchlogs.DescribeLogStreamsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+	f.describes = append(f.describes, params)
+	page := f.pages[0]
+	f.pages = f.pages[1:]
+	return page, nil
+}
+
+func TestPutLogEvent(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	client := &fakeCloudWatchLogs{createErr: &types.ResourceAlreadyExistsException{Message: aws.String("exists")}}
+	getCloudWatchLogsClientFunc = func(ctx context.Context) (cloudWatchLogsAPI, error) {
+		return client, nil
+	}
+
+	sentAt := time.UnixMilli(1700000000000)
+	require.NoError(t, putLogEvent(context.Background(), "g", "s", "hello", sentAt), "an existing stream is reused")
+	require.Len(t, client.puts, 1)
+	assert.Equal(t, "g", aws.ToString(client.puts[0].LogGroupName))
+	assert.Equal(t, "s", aws.ToString(client.puts[0].LogStreamName))
+	assert.Equal(t, []types.InputLogEvent{{Timestamp: aws.Int64(1700000000000), Message: aws.String("hello")}}, client.puts[0].LogEvents)
+
+	client.createErr = errors.New("access denied")
+	err := putLogEvent(context.Background(), "g", "s", "hello", sentAt)
+	assert.ErrorContains(t, err, "create log stream: access denied")
+}
+
+func TestDescribeRecentLogStreams(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	notBefore := time.UnixMilli(1000)
+	client := &fakeCloudWatchLogs{pages: []*cloudwatchlogs.DescribeLogStreamsOutput{
+		{
+			LogStreams: []types.LogStream{{LogStreamName: aws.String("a"), LastIngestionTime: aws.Int64(3000)}},
+			NextToken:  aws.String("next"),
+		},
+		{
+			LogStreams: []types.LogStream{
+				{LogStreamName: aws.String("b"), LastEventTimestamp: aws.Int64(2000)},
+				{LogStreamName: aws.String("old"), LastEventTimestamp: aws.Int64(500), LastIngestionTime: aws.Int64(600)},
+				{LogStreamName: aws.String("older"), LastIngestionTime: aws.Int64(100)},
+			},
+			NextToken: aws.String("more"),
+		},
+	}}
+	getCloudWatchLogsClientFunc = func(ctx context.Context) (cloudWatchLogsAPI, error) {
+		return client, nil
+	}
+
+	streams, err := describeRecentLogStreams(context.Background(), "arn:aws:logs:us-east-2:111111111111:log-group:/fleet/server:*", notBefore)
+	require.NoError(t, err)
+	assert.Equal(t, []logStreamInfo{
+		{LogStreamName: "a", LastIngestionTime: 3000},
+		{LogStreamName: "b", LastEventTimestamp: 2000},
+	}, streams, "listing stops at the first stream without recent events")
+
+	require.Len(t, client.describes, 2)
+	assert.Equal(t, "arn:aws:logs:us-east-2:111111111111:log-group:/fleet/server", aws.ToString(client.describes[0].LogGroupIdentifier))
+	assert.Nil(t, client.describes[0].LogGroupName)
+	assert.Equal(t, types.OrderByLastEventTime, client.describes[0].OrderBy)
+	assert.Equal(t, "next", aws.ToString(client.describes[1].NextToken))
+}
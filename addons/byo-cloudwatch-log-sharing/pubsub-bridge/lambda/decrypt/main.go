@@ -0,0 +1,140 @@
+/*
+decrypt opens Pub/Sub messages that the bridge sealed with client-side
+envelope encryption.
+
+It reads the JSON produced by
+
+    gcloud pubsub subscriptions pull SUBSCRIPTION --format=json
+
+from stdin (or --input) and writes each decrypted payload on its own line.
+RSA-wrapped data keys are opened with --private-key; KMS-wrapped data keys
+are opened with the default AWS credential chain.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	flags "github.com/jessevdk/go-flags"
+
+	"github.com/fleetdm/fleet/terraform/addons/byo-cloudwatch-log-sharing/pubsub-bridge/lambda/envelope"
+)
+
+type OptionsStruct struct {
+	Input      string `long:"input" description:"File containing gcloud pull JSON output (default: stdin)"`
+	PrivateKey string `long:"private-key" description:"PEM encoded RSA private key for AES256-GCM+RSA-OAEP-SHA256 messages"`
+}
+
+type pulledMessage struct {
+	Message struct {
+		Data       string            `json:"data"`
+		Attributes map[string]string `json:"attributes"`
+		MessageID  string            `json:"messageId"`
+	} `json:"message"`
+}
+
+func newUnwrapper(ctx context.Context, privateKeyPath string) (envelope.Unwrapper, error) {
+	var rsaUnwrap envelope.Unwrapper
+	if privateKeyPath != "" {
+		pemData, err := os.ReadFile(privateKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("read private key: %w", err)
+		}
+		priv, err := envelope.ParseRSAPrivateKey(pemData)
+		if err != nil {
+			return nil, err
+		}
+		rsaUnwrap = envelope.RSAUnwrapper(priv)
+	}
+
+	var kmsUnwrap envelope.Unwrapper
+	return func(ctx context.Context, algorithm, keyID string, encrypted []byte) ([]byte, error) {
+		switch algorithm {
+		case envelope.AlgorithmRSA:
+			if rsaUnwrap == nil {
+				return nil, errors.New("message uses an RSA-wrapped data key; pass --private-key")
+			}
+			return rsaUnwrap(ctx, algorithm, keyID, encrypted)
+		case envelope.AlgorithmKMS:
+			if kmsUnwrap == nil {
+				cfg, err := config.LoadDefaultConfig(ctx)
+				if err != nil {
+					return nil, fmt.Errorf("load aws sdk config: %w", err)
+				}
+				kmsUnwrap = envelope.KMSUnwrapper(kms.NewFromConfig(cfg))
+			}
+			return kmsUnwrap(ctx, algorithm, keyID, encrypted)
+		default:
+			return nil, fmt.Errorf("unsupported encryption algorithm: %s", algorithm)
+		}
+	}, nil
+}
+
+func decryptMessages(ctx context.Context, r io.Reader, w io.Writer, unwrap envelope.Unwrapper) error {
+	var messages []pulledMessage
+	if err := json.NewDecoder(r).Decode(&messages); err != nil {
+		return fmt.Errorf("parse pulled messages: %w", err)
+	}
+
+	out := bufio.NewWriter(w)
+	for _, m := range messages {
+		data, err := base64.StdEncoding.DecodeString(m.Message.Data)
+		if err != nil {
+			return fmt.Errorf("decode message %s: %w", m.Message.MessageID, err)
+		}
+
+		plaintext, err := envelope.Decrypt(ctx, data, m.Message.Attributes, unwrap)
+		if err != nil {
+			return fmt.Errorf("decrypt message %s: %w", m.Message.MessageID, err)
+		}
+
+		if _, err := out.Write(append(plaintext, '\n')); err != nil {
+			return err
+		}
+	}
+
+	return out.Flush()
+}
+
+func main() {
+	log.SetFlags(0)
+
+	var options OptionsStruct
+	if _, err := flags.Parse(&options); err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			return
+		}
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	unwrap, err := newUnwrapper(ctx, options.PrivateKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	input := io.Reader(os.Stdin)
+	if options.Input != "" {
+		f, err := os.Open(options.Input)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	if err := decryptMessages(ctx, input, os.Stdout, unwrap); err != nil {
+		log.Fatal(err)
+	}
+}
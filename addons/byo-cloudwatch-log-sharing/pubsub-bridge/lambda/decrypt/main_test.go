@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fleetdm/fleet/terraform/addons/byo-cloudwatch-log-sharing/pubsub-bridge/lambda/envelope"
+)
+
+func TestDecryptMessages(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	dataKey, err := envelope.NewRSADataKey(&priv.PublicKey)
+	require.NoError(t, err)
+
+	sealed, attributes, err := envelope.Seal(dataKey, []byte(`{"message":"m1"}`))
+	require.NoError(t, err)
+
+	pulled := []map[string]interface{}{
+		{"message": map[string]interface{}{
+			"messageId":  "1",
+			"data":       base64.StdEncoding.EncodeToString(sealed),
+			"attributes": attributes,
+		}},
+		{"message": map[string]interface{}{
+			"messageId": "2",
+			"data":      base64.StdEncoding.EncodeToString([]byte(`{"message":"plain"}`)),
+		}},
+	}
+	raw, err := json.Marshal(pulled)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, decryptMessages(context.Background(), bytes.NewReader(raw), &out, envelope.RSAUnwrapper(priv)))
+	assert.Equal(t, "{\"message\":\"m1\"}\n{\"message\":\"plain\"}\n", out.String())
+
+	t.Run("missing private key", func(t *testing.T) {
+		unwrap, err := newUnwrapper(context.Background(), "")
+		require.NoError(t, err)
+
+		err = decryptMessages(context.Background(), bytes.NewReader(raw), &bytes.Buffer{}, unwrap)
+		require.ErrorContains(t, err, "--private-key")
+	})
+
+	t.Run("invalid input", func(t *testing.T) {
+		err := decryptMessages(context.Background(), strings.NewReader("{"), &bytes.Buffer{}, nil)
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,130 @@
+// Package dlq reads the async destination records the bridge Lambda's
+// on-failure destination writes to its dead-letter queue, and checks the
+// responses of bridge invocations that replay them. It is shared by the
+// replayer Lambda and the dlqctl operator CLI.
+package dlq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awslambda "github.com/aws/aws-sdk-go-v2/service/lambda"
+)
+
+// Record is the record Lambda sends to an on-failure destination when an
+// async invocation fails.
+type Record struct {
+	// Timestamp is when the async invocation failed.
+	Timestamp      time.Time       `json:"timestamp"`
+	RequestPayload json.RawMessage `json:"requestPayload"`
+	RequestContext struct {
+		RequestID              string `json:"requestId"`
+		FunctionArn            string `json:"functionArn"`
+		Condition              string `json:"condition"`
+		ApproximateInvokeCount int    `json:"approximateInvokeCount"`
+	} `json:"requestContext"`
+	ResponseContext struct {
+		StatusCode    int    `json:"statusCode"`
+		FunctionError string `json:"functionError"`
+	} `json:"responseContext"`
+	ResponsePayload ResponsePayload `json:"responsePayload"`
+}
+
+// ResponsePayload is the error the failed invocation returned. It is left
+// empty when the payload is not a Lambda error object.
+type ResponsePayload struct {
+	ErrorType    string
+	ErrorMessage string
+}
+
+func (p *ResponsePayload) UnmarshalJSON(data []byte) error {
+	var payload struct {
+		ErrorType    string `json:"errorType"`
+		ErrorMessage string `json:"errorMessage"`
+	}
+	if json.Unmarshal(data, &payload) == nil {
+		p.ErrorType = payload.ErrorType
+		p.ErrorMessage = payload.ErrorMessage
+	}
+	return nil
+}
+
+// ParseRecord parses an SQS message body written by the on-failure
+// destination.
+func ParseRecord(body string) (Record, error) {
+	var record Record
+	if err := json.Unmarshal([]byte(body), &record); err != nil {
+		return Record{}, fmt.Errorf("parse async destination message: %w", err)
+	}
+
+	if len(record.RequestPayload) == 0 {
+		return Record{}, errors.New("async destination message does not include requestPayload")
+	}
+
+	return record, nil
+}
+
+// BridgeResponse is the part of the bridge handler's response, or of a Lambda
+// function error payload, that replays check.
+type BridgeResponse struct {
+	PublishedMessageCount *int   `json:"published_message_count"`
+	ErrorType             string `json:"errorType"`
+	ErrorMessage          string `json:"errorMessage"`
+}
+
+// FunctionError is a replay that reached the function it invoked and failed
+// there. Function is empty when that function is the bridge.
+type FunctionError struct {
+	Function      string
+	FunctionError string
+	ErrorType     string
+	ErrorMessage  string
+}
+
+func (e *FunctionError) Error() string {
+	function := "bridge lambda"
+	if e.Function != "" {
+		function = "lambda " + e.Function
+	}
+	return fmt.Sprintf("%s %s error: %s: %s", function, e.FunctionError, e.ErrorType, e.ErrorMessage)
+}
+
+// CheckBridgeResponse reports whether a synchronous replay published. A
+// function error, or a payload that is not a bridge handler response, is a
+// failed replay.
+func CheckBridgeResponse(resp *awslambda.InvokeOutput) error {
+	var parsed BridgeResponse
+	parseErr := json.Unmarshal(resp.Payload, &parsed)
+
+	if resp.FunctionError != nil {
+		return &FunctionError{
+			FunctionError: aws.ToString(resp.FunctionError),
+			ErrorType:     parsed.ErrorType,
+			ErrorMessage:  parsed.ErrorMessage,
+		}
+	}
+	if parseErr != nil || parsed.PublishedMessageCount == nil {
+		return fmt.Errorf("bridge lambda returned an unexpected response: %.256s", resp.Payload)
+	}
+	return nil
+}
+
+// CheckFunctionResponse reports whether a synchronous replay to a function
+// other than the bridge succeeded. Its response is not known, so only a
+// function error fails the replay.
+func CheckFunctionResponse(function string, resp *awslambda.InvokeOutput) error {
+	if resp.FunctionError == nil {
+		return nil
+	}
+	var parsed BridgeResponse
+	_ = json.Unmarshal(resp.Payload, &parsed)
+	return &FunctionError{
+		Function:      function,
+		FunctionError: aws.ToString(resp.FunctionError),
+		ErrorType:     parsed.ErrorType,
+		ErrorMessage:  parsed.ErrorMessage,
+	}
+}
@@ -0,0 +1,64 @@
+package dlq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awslambda "github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRecord(t *testing.T) {
+	record, err := ParseRecord(`{"timestamp":"2026-03-10T12:00:00.123Z","requestPayload":{"awslogs":{"data":"x"}},"requestContext":{"requestId":"r","functionArn":"arn:aws:lambda:us-east-2:111:function:bridge:$LATEST","condition":"RetriesExhausted","approximateInvokeCount":3},"responseContext":{"statusCode":200,"functionError":"Unhandled"},"responsePayload":{"errorType":"errorString","errorMessage":"boom"}}`)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"awslogs":{"data":"x"}}`, string(record.RequestPayload))
+	assert.Equal(t, time.Date(2026, 3, 10, 12, 0, 0, 123e6, time.UTC), record.Timestamp)
+	assert.Equal(t, "r", record.RequestContext.RequestID)
+	assert.Equal(t, 3, record.RequestContext.ApproximateInvokeCount)
+	assert.Equal(t, "Unhandled", record.ResponseContext.FunctionError)
+	assert.Equal(t, "errorString", record.ResponsePayload.ErrorType)
+	assert.Equal(t, "boom", record.ResponsePayload.ErrorMessage)
+
+	// A response payload that is not an error object is ignored.
+	record, err = ParseRecord(`{"requestPayload":{},"responsePayload":"timed out"}`)
+	require.NoError(t, err)
+	assert.Empty(t, record.ResponsePayload.ErrorType)
+
+	_, err = ParseRecord(`not json`)
+	assert.ErrorContains(t, err, "parse async destination message")
+
+	_, err = ParseRecord(`{"requestContext":{}}`)
+	assert.ErrorContains(t, err, "does not include requestPayload")
+}
+
+func TestCheckBridgeResponse(t *testing.T) {
+	assert.NoError(t, CheckBridgeResponse(&awslambda.InvokeOutput{Payload: []byte(`{"published_message_count":0}`)}))
+
+	err := CheckBridgeResponse(&awslambda.InvokeOutput{
+		FunctionError: aws.String("Unhandled"),
+		Payload:       []byte(`{"errorType":"errorString","errorMessage":"publish failed"}`),
+	})
+	var functionErr *FunctionError
+	require.ErrorAs(t, err, &functionErr)
+	assert.Equal(t, "errorString", functionErr.ErrorType)
+	assert.EqualError(t, err, "bridge lambda Unhandled error: errorString: publish failed")
+
+	err = CheckBridgeResponse(&awslambda.InvokeOutput{Payload: []byte(`null`)})
+	assert.ErrorContains(t, err, "unexpected response")
+}
+
+func TestCheckFunctionResponse(t *testing.T) {
+	// Other functions' responses are not checked.
+	assert.NoError(t, CheckFunctionResponse("reencrypt", &awslambda.InvokeOutput{Payload: []byte(`null`)}))
+
+	err := CheckFunctionResponse("reencrypt", &awslambda.InvokeOutput{
+		FunctionError: aws.String("Unhandled"),
+		Payload:       []byte(`{"errorType":"SyntaxError","errorMessage":"bad event"}`),
+	})
+	var functionErr *FunctionError
+	require.ErrorAs(t, err, &functionErr)
+	assert.Equal(t, "SyntaxError", functionErr.ErrorType)
+	assert.EqualError(t, err, "lambda reencrypt Unhandled error: SyntaxError: bad event")
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awslambda "github.com/aws/aws-sdk-go-v2/service/lambda"
+	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+
+	"github.com/fleetdm/fleet/terraform/addons/byo-cloudwatch-log-sharing/pubsub-bridge/lambda/dlq"
+)
+
+// ageBuckets are the message ages inspect reports, by the longest age each
+// holds.
+var ageBuckets = []struct {
+	label  string
+	maxAge time.Duration
+}{
+	{"< 1h", time.Hour},
+	{"1h - 1d", 24 * time.Hour},
+	{"1d - 7d", 7 * 24 * time.Hour},
+	{">= 7d", 0},
+}
+
+// scanMatching scans the queue and returns the messages filter matches, along
+// with every message received so the caller can release them.
+func scanMatching(ctx context.Context, q queue, maxMessages int, filter messageFilter) (matched, received []*dlqMessage, err error) {
+	received, err = q.scan(ctx, maxMessages, func(m *dlqMessage) error {
+		if filter.matches(m) {
+			matched = append(matched, m)
+		}
+		return nil
+	})
+	return matched, received, err
+}
+
+// inspect prints how many matching messages there are by log group, error
+// type and age.
+func inspect(ctx context.Context, q queue, maxMessages int, opts InspectCommand, w io.Writer, now time.Time) (err error) {
+	filter, err := parseFilter(opts.FilterOptions)
+	if err != nil {
+		return err
+	}
+	matched, received, err := scanMatching(ctx, q, maxMessages, filter)
+	defer func() { err = errors.Join(err, q.release(ctx, received)) }()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%d of %d messages read from %s match\n", len(matched), len(received), q.name())
+	if len(matched) == 0 {
+		return nil
+	}
+
+	logGroups := map[string]int{}
+	errorTypes := map[string]int{}
+	ages := make([]int, len(ageBuckets))
+	for _, m := range matched {
+		logGroups[m.LogGroup()]++
+		errorTypes[m.ErrorType()]++
+		age := now.Sub(m.SentAt)
+		for i, bucket := range ageBuckets {
+			if bucket.maxAge == 0 || age < bucket.maxAge {
+				ages[i]++
+				break
+			}
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw)
+	printCounts(tw, "LOG GROUP", logGroups)
+	fmt.Fprintln(tw)
+	printCounts(tw, "ERROR TYPE", errorTypes)
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "AGE\tMESSAGES")
+	for i, bucket := range ageBuckets {
+		fmt.Fprintf(tw, "%s\t%d\n", bucket.label, ages[i])
+	}
+	return tw.Flush()
+}
+
+// printCounts prints counts most common first.
+func printCounts(w io.Writer, heading string, counts map[string]int) {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	fmt.Fprintf(w, "%s\tMESSAGES\n", heading)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t%d\n", key, counts[key])
+	}
+}
+
+// replay invokes the bridge synchronously with each matching message's
+// original event, at most opts.Rate times a second. Messages the bridge
+// publishes are deleted; the rest are released. The wait between replays ends
+// early when ctx is cancelled, and the command stops there.
+func replay(ctx context.Context, q queue, invoker lambdaInvoker, maxMessages int, opts ReplayCommand, w io.Writer, sleep func(context.Context, time.Duration) error) (err error) {
+	filter, err := parseFilter(opts.FilterOptions)
+	if err != nil {
+		return err
+	}
+	if opts.Rate <= 0 {
+		return errors.New("--rate must be positive")
+	}
+	interval := time.Duration(float64(time.Second) / opts.Rate)
+
+	var replayed, failed int
+	received, err := q.scan(ctx, maxMessages, func(m *dlqMessage) error {
+		if !filter.matches(m) {
+			return nil
+		}
+		if m.RecordErr != nil {
+			failed++
+			fmt.Fprintf(w, "skipped %s: %v\n", m.ID, m.RecordErr)
+			return nil
+		}
+		if opts.DryRun {
+			replayed++
+			fmt.Fprintf(w, "would replay %s (%s)\n", m.ID, m.LogGroup())
+			return nil
+		}
+
+		if replayed+failed > 0 {
+			if err := sleep(ctx, interval); err != nil {
+				return fmt.Errorf("replay stopped after %d messages: %w", replayed+failed, err)
+			}
+		}
+		if err := replayMessage(ctx, invoker, opts.FunctionName, m.Record); err != nil {
+			failed++
+			fmt.Fprintf(w, "failed %s (%s): %v\n", m.ID, m.LogGroup(), err)
+			return nil
+		}
+		if err := q.delete(ctx, []*dlqMessage{m}); err != nil {
+			// The bridge published the event, so a failed delete only
+			// risks a duplicate when the message is replayed again.
+			return fmt.Errorf("replayed %s but could not delete it: %w", m.ID, err)
+		}
+		replayed++
+		fmt.Fprintf(w, "replayed %s (%s)\n", m.ID, m.LogGroup())
+		return nil
+	})
+	defer func() { err = errors.Join(err, q.release(ctx, received)) }()
+	if err != nil {
+		return err
+	}
+
+	if opts.DryRun {
+		fmt.Fprintf(w, "%d messages would be replayed, %d skipped\n", replayed, failed)
+		return nil
+	}
+	fmt.Fprintf(w, "%d messages replayed, %d failed\n", replayed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d messages were not replayed", failed)
+	}
+	return nil
+}
+
+func replayMessage(ctx context.Context, invoker lambdaInvoker, functionName string, record dlq.Record) error {
+	resp, err := invoker.Invoke(ctx, &awslambda.InvokeInput{
+		FunctionName:   aws.String(functionName),
+		InvocationType: lambdatypes.InvocationTypeRequestResponse,
+		Payload:        record.RequestPayload,
+	})
+	if err != nil {
+		return fmt.Errorf("invoke bridge lambda: %w", err)
+	}
+	return dlq.CheckBridgeResponse(resp)
+}
+
+// purge deletes the matching messages once the operator confirms by typing
+// the queue name.
+func purge(ctx context.Context, q queue, maxMessages int, opts PurgeCommand, r io.Reader, w io.Writer) (err error) {
+	filter, err := parseFilter(opts.FilterOptions)
+	if err != nil {
+		return err
+	}
+	matched, received, err := scanMatching(ctx, q, maxMessages, filter)
+	defer func() { err = errors.Join(err, q.release(ctx, received)) }()
+	if err != nil {
+		return err
+	}
+
+	if len(matched) == 0 {
+		fmt.Fprintln(w, "no messages match")
+		return nil
+	}
+	if !opts.Yes {
+		fmt.Fprintf(w, "Delete %d messages from %s? Type the queue name to confirm: ", len(matched), q.name())
+		answer, _ := bufio.NewReader(r).ReadString('\n')
+		if strings.TrimSpace(answer) != q.name() {
+			return errors.New("purge cancelled")
+		}
+	}
+
+	if err := q.delete(ctx, matched); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%d messages deleted\n", len(matched))
+	return nil
+}
+
+// exportedMessage is the file export writes for one message.
+type exportedMessage struct {
+	MessageID         string            `json:"message_id"`
+	SentAt            time.Time         `json:"sent_at"`
+	ReceiveCount      int               `json:"receive_count"`
+	MessageAttributes map[string]string `json:"message_attributes,omitempty"`
+	ErrorType         string            `json:"error_type"`
+	Record            json.RawMessage   `json:"record"`
+	LogGroup          string            `json:"log_group,omitempty"`
+	LogStream         string            `json:"log_stream,omitempty"`
+	LogEvents         any               `json:"log_events,omitempty"`
+}
+
+// export writes each matching message, with its log events decoded, to
+// <message id>.json in opts.Dir. Messages stay on the queue.
+func export(ctx context.Context, q queue, maxMessages int, opts ExportCommand, w io.Writer) (err error) {
+	filter, err := parseFilter(opts.FilterOptions)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(opts.Dir, 0o700); err != nil {
+		return fmt.Errorf("create export directory: %w", err)
+	}
+
+	exported := 0
+	received, err := q.scan(ctx, maxMessages, func(m *dlqMessage) error {
+		if !filter.matches(m) {
+			return nil
+		}
+		out := exportedMessage{
+			MessageID:         m.ID,
+			SentAt:            m.SentAt,
+			ReceiveCount:      m.ReceiveCount,
+			MessageAttributes: m.MessageAttributes,
+			ErrorType:         m.ErrorType(),
+			Record:            prettyJSON(m.Body),
+		}
+		if m.Payload != nil {
+			out.LogGroup = m.Payload.LogGroup
+			out.LogStream = m.Payload.LogStream
+			out.LogEvents = m.Payload.LogEvents
+		}
+
+		data, err := json.MarshalIndent(out, "", "  ")
+		if err != nil {
+			return fmt.Errorf("marshal message %s: %w", m.ID, err)
+		}
+		name := filepath.Join(opts.Dir, m.ID+".json")
+		if err := os.WriteFile(name, append(data, '\n'), 0o600); err != nil {
+			return fmt.Errorf("write message %s: %w", m.ID, err)
+		}
+		exported++
+		return nil
+	})
+	defer func() { err = errors.Join(err, q.release(ctx, received)) }()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%d messages exported to %s\n", exported, opts.Dir)
+	return nil
+}
@@ -0,0 +1,418 @@
+/*
+dlqctl inspects, replays, purges and exports the messages on the bridge's
+dead-letter queue or parking-lot queue.
+
+	dlqctl --queue-url URL inspect
+	dlqctl --queue-url URL replay --function-name BRIDGE [filters] [--rate N] [--dry-run]
+	dlqctl --queue-url URL purge [filters]
+	dlqctl --queue-url URL export --dir DIR [filters]
+
+Messages are read with ReceiveMessage, so they are hidden from the replayer
+while a command runs and their ApproximateReceiveCount goes up. A long command
+keeps extending their visibility timeout, and messages it does not delete are
+made visible again when it finishes or is interrupted. AWS credentials come
+from the default credential chain.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	awslambda "github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	flags "github.com/jessevdk/go-flags"
+
+	"github.com/fleetdm/fleet/terraform/addons/byo-cloudwatch-log-sharing/pubsub-bridge/lambda/awslogs"
+	"github.com/fleetdm/fleet/terraform/addons/byo-cloudwatch-log-sharing/pubsub-bridge/lambda/dlq"
+)
+
+const (
+	// sqsBatchMax is the most entries SQS accepts in one receive or batch
+	// call.
+	sqsBatchMax = 10
+
+	malformedErrorType   = "(malformed)"
+	noErrorType          = "(none)"
+	unknownErrorType     = "(unknown)"
+	undecodableLogGroup  = "(undecodable)"
+	parkedErrorAttribute = "replay_last_error_type"
+)
+
+type OptionsStruct struct {
+	QueueURL          string `long:"queue-url" env:"DLQ_QUEUE_URL" required:"true" description:"URL of the dead-letter or parking-lot queue"`
+	MaxMessages       int    `long:"max-messages" default:"1000" description:"Most messages to read from the queue"`
+	VisibilityTimeout int32  `long:"visibility-timeout" default:"300" description:"Seconds read messages stay hidden before the command extends their visibility; must cover one bridge invocation"`
+
+	Inspect InspectCommand `command:"inspect" description:"Summarize messages by log group, error type and age"`
+	Replay  ReplayCommand  `command:"replay" description:"Replay matching messages to the bridge and delete the ones it publishes"`
+	Purge   PurgeCommand   `command:"purge" description:"Delete matching messages after confirmation"`
+	Export  ExportCommand  `command:"export" description:"Write matching messages to local JSON files"`
+}
+
+// FilterOptions selects messages. Unset filters match every message.
+type FilterOptions struct {
+	Since     string `long:"since" description:"Only messages the queue received at or after this RFC 3339 time"`
+	Until     string `long:"until" description:"Only messages the queue received before this RFC 3339 time"`
+	LogGroup  string `long:"log-group" description:"Only messages whose log group matches this glob (path.Match syntax)"`
+	ErrorType string `long:"error-type" description:"Only messages with this error type, as shown by inspect"`
+}
+
+type InspectCommand struct {
+	FilterOptions
+}
+
+type ReplayCommand struct {
+	FilterOptions
+	FunctionName string  `long:"function-name" env:"TARGET_BRIDGE_FUNCTION_NAME" required:"true" description:"Bridge Lambda function name or ARN"`
+	Rate         float64 `long:"rate" default:"5" description:"Most replays per second"`
+	DryRun       bool    `long:"dry-run" description:"List the messages that would be replayed without replaying them"`
+}
+
+type PurgeCommand struct {
+	FilterOptions
+	Yes bool `long:"yes" description:"Do not ask for confirmation"`
+}
+
+type ExportCommand struct {
+	FilterOptions
+	Dir string `long:"dir" required:"true" description:"Directory to write one JSON file per message to"`
+}
+
+type queueClient interface {
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	ChangeMessageVisibilityBatch(ctx context.Context, params *sqs.ChangeMessageVisibilityBatchInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityBatchOutput, error)
+	DeleteMessageBatch(ctx context.Context, params *sqs.DeleteMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error)
+}
+
+type lambdaInvoker interface {
+	Invoke(ctx context.Context, params *awslambda.InvokeInput, optFns ...func(*awslambda.Options)) (*awslambda.InvokeOutput, error)
+}
+
+// dlqMessage is a received queue message with its async destination record
+// and CloudWatch Logs payload decoded where possible.
+type dlqMessage struct {
+	ID                string
+	ReceiptHandle     string
+	SentAt            time.Time
+	ReceiveCount      int
+	Body              string
+	MessageAttributes map[string]string
+
+	Record     dlq.Record
+	RecordErr  error
+	Payload    *awslogs.Payload
+	PayloadErr error
+
+	deleted bool
+}
+
+func newDLQMessage(m types.Message) *dlqMessage {
+	msg := &dlqMessage{
+		ID:                aws.ToString(m.MessageId),
+		ReceiptHandle:     aws.ToString(m.ReceiptHandle),
+		Body:              aws.ToString(m.Body),
+		MessageAttributes: map[string]string{},
+	}
+	if millis, err := strconv.ParseInt(m.Attributes[string(types.MessageSystemAttributeNameSentTimestamp)], 10, 64); err == nil {
+		msg.SentAt = time.UnixMilli(millis).UTC()
+	}
+	msg.ReceiveCount, _ = strconv.Atoi(m.Attributes[string(types.MessageSystemAttributeNameApproximateReceiveCount)])
+	for name, value := range m.MessageAttributes {
+		msg.MessageAttributes[name] = aws.ToString(value.StringValue)
+	}
+
+	msg.Record, msg.RecordErr = dlq.ParseRecord(msg.Body)
+	if msg.RecordErr == nil {
+		msg.Payload, msg.PayloadErr = awslogs.DecodeJSON(msg.Record.RequestPayload)
+	}
+	return msg
+}
+
+// ErrorType is the error the bridge recorded for the message. Parked messages
+// report the error of their last replay instead.
+func (m *dlqMessage) ErrorType() string {
+	switch {
+	case m.MessageAttributes[parkedErrorAttribute] != "":
+		return m.MessageAttributes[parkedErrorAttribute]
+	case m.RecordErr != nil:
+		return malformedErrorType
+	case m.Record.ResponsePayload.ErrorType != "":
+		return m.Record.ResponsePayload.ErrorType
+	case m.Record.ResponsePayload.ErrorMessage != "":
+		return unknownErrorType
+	}
+	return noErrorType
+}
+
+func (m *dlqMessage) LogGroup() string {
+	if m.Payload == nil {
+		return undecodableLogGroup
+	}
+	return m.Payload.LogGroup
+}
+
+// messageFilter is a parsed FilterOptions.
+type messageFilter struct {
+	since     time.Time
+	until     time.Time
+	logGroup  string
+	errorType string
+}
+
+func parseFilter(o FilterOptions) (messageFilter, error) {
+	f := messageFilter{logGroup: o.LogGroup, errorType: o.ErrorType}
+	var err error
+	if o.Since != "" {
+		if f.since, err = time.Parse(time.RFC3339, o.Since); err != nil {
+			return messageFilter{}, fmt.Errorf("parse --since: %w", err)
+		}
+	}
+	if o.Until != "" {
+		if f.until, err = time.Parse(time.RFC3339, o.Until); err != nil {
+			return messageFilter{}, fmt.Errorf("parse --until: %w", err)
+		}
+	}
+	if o.LogGroup != "" {
+		if _, err := path.Match(o.LogGroup, ""); err != nil {
+			return messageFilter{}, fmt.Errorf("parse --log-group: %w", err)
+		}
+	}
+	return f, nil
+}
+
+func (f messageFilter) matches(m *dlqMessage) bool {
+	if !f.since.IsZero() && m.SentAt.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !m.SentAt.Before(f.until) {
+		return false
+	}
+	if f.logGroup != "" {
+		if matched, _ := path.Match(f.logGroup, m.LogGroup()); !matched {
+			return false
+		}
+	}
+	if f.errorType != "" && f.errorType != m.ErrorType() {
+		return false
+	}
+	return true
+}
+
+// queue reads and settles messages on one SQS queue.
+type queue struct {
+	client            queueClient
+	url               string
+	visibilityTimeout int32
+	// now tells when read messages are due a visibility extension;
+	// time.Now when nil.
+	now func() time.Time
+}
+
+func (q queue) clock() time.Time {
+	if q.now == nil {
+		return time.Now()
+	}
+	return q.now()
+}
+
+// name is the queue name, the last element of its URL.
+func (q queue) name() string {
+	return q.url[strings.LastIndex(q.url, "/")+1:]
+}
+
+// scan receives up to max messages, calling visit for each as it arrives.
+// Received messages stay hidden until release, so none is visited twice. Once
+// half the visibility timeout has passed since they were last hidden, scan
+// hides every message still held for another timeout before the next visit,
+// so a slow visit such as a throttled replay cannot outlive it.
+func (q queue) scan(ctx context.Context, max int, visit func(*dlqMessage) error) ([]*dlqMessage, error) {
+	var received []*dlqMessage
+	hiddenAt := q.clock()
+	extendAfter := time.Duration(q.visibilityTimeout) * time.Second / 2
+	for len(received) < max {
+		out, err := q.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:                    aws.String(q.url),
+			MaxNumberOfMessages:         int32(min(sqsBatchMax, max-len(received))),
+			VisibilityTimeout:           q.visibilityTimeout,
+			WaitTimeSeconds:             1,
+			MessageSystemAttributeNames: []types.MessageSystemAttributeName{types.MessageSystemAttributeNameAll},
+			MessageAttributeNames:       []string{"All"},
+		})
+		if err != nil {
+			return received, fmt.Errorf("receive messages: %w", err)
+		}
+		if len(out.Messages) == 0 {
+			return received, nil
+		}
+		batch := make([]*dlqMessage, 0, len(out.Messages))
+		for _, m := range out.Messages {
+			batch = append(batch, newDLQMessage(m))
+		}
+		received = append(received, batch...)
+		for _, msg := range batch {
+			if q.clock().Sub(hiddenAt) >= extendAfter {
+				if err := q.setVisibility(ctx, received, q.visibilityTimeout); err != nil {
+					return received, fmt.Errorf("extend message visibility: %w", err)
+				}
+				hiddenAt = q.clock()
+			}
+			if err := visit(msg); err != nil {
+				return received, err
+			}
+		}
+	}
+	return received, nil
+}
+
+// release makes the messages that were not deleted visible again. It runs
+// after the command's context is cancelled too, so it ignores cancellation.
+func (q queue) release(ctx context.Context, messages []*dlqMessage) error {
+	if err := q.setVisibility(context.WithoutCancel(ctx), messages, 0); err != nil {
+		return fmt.Errorf("release messages; they become visible after --visibility-timeout: %w", err)
+	}
+	return nil
+}
+
+// setVisibility sets the visibility timeout of the messages that were not
+// deleted.
+func (q queue) setVisibility(ctx context.Context, messages []*dlqMessage, timeout int32) error {
+	var entries []types.ChangeMessageVisibilityBatchRequestEntry
+	for _, m := range messages {
+		if !m.deleted {
+			entries = append(entries, types.ChangeMessageVisibilityBatchRequestEntry{
+				Id:                aws.String(strconv.Itoa(len(entries))),
+				ReceiptHandle:     aws.String(m.ReceiptHandle),
+				VisibilityTimeout: timeout,
+			})
+		}
+	}
+
+	var errs []error
+	for start := 0; start < len(entries); start += sqsBatchMax {
+		out, err := q.client.ChangeMessageVisibilityBatch(ctx, &sqs.ChangeMessageVisibilityBatchInput{
+			QueueUrl: aws.String(q.url),
+			Entries:  entries[start:min(start+sqsBatchMax, len(entries))],
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, failed := range out.Failed {
+			errs = append(errs, fmt.Errorf("%s: %s", aws.ToString(failed.Code), aws.ToString(failed.Message)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// delete deletes messages from the queue and marks them deleted.
+func (q queue) delete(ctx context.Context, messages []*dlqMessage) error {
+	var errs []error
+	for start := 0; start < len(messages); start += sqsBatchMax {
+		batch := messages[start:min(start+sqsBatchMax, len(messages))]
+		entries := make([]types.DeleteMessageBatchRequestEntry, 0, len(batch))
+		for i, m := range batch {
+			entries = append(entries, types.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(i)),
+				ReceiptHandle: aws.String(m.ReceiptHandle),
+			})
+		}
+
+		out, err := q.client.DeleteMessageBatch(ctx, &sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(q.url),
+			Entries:  entries,
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		failed := map[string]bool{}
+		for _, f := range out.Failed {
+			failed[aws.ToString(f.Id)] = true
+			errs = append(errs, fmt.Errorf("message %s: %s", batch[mustAtoi(aws.ToString(f.Id))].ID, aws.ToString(f.Message)))
+		}
+		for i, m := range batch {
+			m.deleted = !failed[strconv.Itoa(i)]
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("delete messages: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// sleepContext waits for d, returning early with the context's error when it
+// is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func mustAtoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// prettyJSON returns raw as JSON when it is valid JSON, and as a JSON string
+// otherwise.
+func prettyJSON(raw string) json.RawMessage {
+	if json.Valid([]byte(raw)) {
+		return json.RawMessage(raw)
+	}
+	quoted, _ := json.Marshal(raw)
+	return quoted
+}
+
+func main() {
+	log.SetFlags(0)
+
+	var options OptionsStruct
+	parser := flags.NewParser(&options, flags.Default)
+	if _, err := parser.Parse(); err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			return
+		}
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		log.Fatalf("load aws sdk config: %v", err)
+	}
+	q := queue{client: sqs.NewFromConfig(cfg), url: options.QueueURL, visibilityTimeout: options.VisibilityTimeout}
+
+	switch parser.Active.Name {
+	case "inspect":
+		err = inspect(ctx, q, options.MaxMessages, options.Inspect, os.Stdout, time.Now())
+	case "replay":
+		err = replay(ctx, q, awslambda.NewFromConfig(cfg), options.MaxMessages, options.Replay, os.Stdout, sleepContext)
+	case "purge":
+		err = purge(ctx, q, options.MaxMessages, options.Purge, os.Stdin, os.Stdout)
+	case "export":
+		err = export(ctx, q, options.MaxMessages, options.Export, os.Stdout)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awslambda "github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeQueue is an in-memory queue that hands out each message once, as SQS
+// does while a received message is hidden.
+type fakeQueue struct {
+	messages []types.Message
+	next     int
+	deleted  []string
+	released []string
+	extended []string
+}
+
+func (f *fakeQueue) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	end := min(f.next+int(params.MaxNumberOfMessages), len(f.messages))
+	out := &sqs.ReceiveMessageOutput{Messages: f.messages[f.next:end]}
+	f.next = end
+	return out, nil
+}
+
+func (f *fakeQueue) ChangeMessageVisibilityBatch(ctx context.Context, params *sqs.ChangeMessageVisibilityBatchInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	for _, entry := range params.Entries {
+		if entry.VisibilityTimeout > 0 {
+			f.extended = append(f.extended, aws.ToString(entry.ReceiptHandle))
+			continue
+		}
+		f.released = append(f.released, aws.ToString(entry.ReceiptHandle))
+	}
+	return &sqs.ChangeMessageVisibilityBatchOutput{}, nil
+}
+
+func (f *fakeQueue) DeleteMessageBatch(ctx context.Context, params *sqs.DeleteMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error) {
+	for _, entry := range params.Entries {
+		f.deleted = append(f.deleted, aws.ToString(entry.ReceiptHandle))
+	}
+	return &sqs.DeleteMessageBatchOutput{}, nil
+}
+
+type fakeInvoker struct {
+	invokeFn func(payload []byte) (*awslambda.InvokeOutput, error)
+	payloads []string
+}
+
+func (f *fakeInvoker) Invoke(ctx context.Context, params *awslambda.InvokeInput, optFns ...func(*awslambda.Options)) (*awslambda.InvokeOutput, error) {
+	f.payloads = append(f.payloads, string(params.Payload))
+	return f.invokeFn(params.Payload)
+}
+
+func subscriptionEvent(t *testing.T, logGroup string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := fmt.Fprintf(zw, `{"logGroup":%q,"logStream":"s","logEvents":[{"id":"1","timestamp":1,"message":"m"}]}`, logGroup)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return `{"awslogs":{"data":"` + base64.StdEncoding.EncodeToString(buf.Bytes()) + `"}}`
+}
+
+// dlqBody is an async destination record for a failed bridge invocation.
+func dlqBody(t *testing.T, logGroup, errorType string) string {
+	return `{"requestPayload":` + subscriptionEvent(t, logGroup) +
+		`,"requestContext":{"requestId":"r","condition":"RetriesExhausted"}` +
+		`,"responsePayload":{"errorType":"` + errorType + `","errorMessage":"boom"}}`
+}
+
+func sqsMessage(id, body string, sentAt time.Time) types.Message {
+	return types.Message{
+		MessageId:     aws.String(id),
+		ReceiptHandle: aws.String("rh-" + id),
+		Body:          aws.String(body),
+		Attributes: map[string]string{
+			"SentTimestamp":           strconv.FormatInt(sentAt.UnixMilli(), 10),
+			"ApproximateReceiveCount": "2",
+		},
+	}
+}
+
+func newFakeQueue(t *testing.T, now time.Time) *fakeQueue {
+	return &fakeQueue{messages: []types.Message{
+		sqsMessage("a", dlqBody(t, "/fleet/orbit", "wrapError"), now.Add(-10*time.Minute)),
+		sqsMessage("b", dlqBody(t, "/fleet/orbit", "wrapError"), now.Add(-2*time.Hour)),
+		sqsMessage("c", dlqBody(t, "/fleet/osquery", "errorString"), now.Add(-3*24*time.Hour)),
+		sqsMessage("d", "not json", now.Add(-30*24*time.Hour)),
+	}}
+}
+
+func testQueue(client queueClient) queue {
+	return queue{client: client, url: "https://sqs.us-east-2.amazonaws.com/111/fleet-dlq", visibilityTimeout: 300}
+}
+
+func TestInspect(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fq := newFakeQueue(t, now)
+
+	var out bytes.Buffer
+	require.NoError(t, inspect(context.Background(), testQueue(fq), 1000, InspectCommand{}, &out, now))
+
+	got := out.String()
+	assert.Contains(t, got, "4 of 4 messages read from fleet-dlq match")
+	assert.Regexp(t, `/fleet/orbit\s+2\n`, got)
+	assert.Regexp(t, `\(undecodable\)\s+1\n`, got)
+	assert.Regexp(t, `wrapError\s+2\n`, got)
+	assert.Regexp(t, `\(malformed\)\s+1\n`, got)
+	assert.Regexp(t, `< 1h\s+1\n1h - 1d\s+1\n1d - 7d\s+1\n>= 7d\s+1\n`, got)
+	assert.ElementsMatch(t, []string{"rh-a", "rh-b", "rh-c", "rh-d"}, fq.released)
+	assert.Empty(t, fq.deleted)
+}
+
+func TestFilter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		opts FilterOptions
+		want []string
+	}{
+		{"none", FilterOptions{}, []string{"a", "b", "c", "d"}},
+		{"log group glob", FilterOptions{LogGroup: "/fleet/o*y"}, []string{"c"}},
+		{"error type", FilterOptions{ErrorType: "wrapError"}, []string{"a", "b"}},
+		{"malformed", FilterOptions{ErrorType: malformedErrorType}, []string{"d"}},
+		{"since", FilterOptions{Since: "2024-05-01T09:00:00Z"}, []string{"a", "b"}},
+		{"until", FilterOptions{Until: "2024-05-01T09:00:00Z"}, []string{"c", "d"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := parseFilter(tt.opts)
+			require.NoError(t, err)
+			matched, _, err := scanMatching(context.Background(), testQueue(newFakeQueue(t, now)), 1000, filter)
+			require.NoError(t, err)
+			var ids []string
+			for _, m := range matched {
+				ids = append(ids, m.ID)
+			}
+			assert.Equal(t, tt.want, ids)
+		})
+	}
+
+	_, err := parseFilter(FilterOptions{Since: "yesterday"})
+	assert.ErrorContains(t, err, "parse --since")
+	_, err = parseFilter(FilterOptions{LogGroup: "["})
+	assert.ErrorContains(t, err, "parse --log-group")
+}
+
+func TestParkedErrorType(t *testing.T) {
+	m := sqsMessage("p", dlqBody(t, "/fleet", "wrapError"), time.Now())
+	m.MessageAttributes = map[string]types.MessageAttributeValue{
+		parkedErrorAttribute: {DataType: aws.String("String"), StringValue: aws.String("Timeout")},
+	}
+	assert.Equal(t, "Timeout", newDLQMessage(m).ErrorType())
+}
+
+func TestScanMaxMessages(t *testing.T) {
+	now := time.Now()
+	fq := newFakeQueue(t, now)
+	received, err := testQueue(fq).scan(context.Background(), 3, func(*dlqMessage) error { return nil })
+	require.NoError(t, err)
+	assert.Len(t, received, 3)
+}
+
+func TestReplay(t *testing.T) {
+	now := time.Now()
+	fq := newFakeQueue(t, now)
+	invoker := &fakeInvoker{invokeFn: func(payload []byte) (*awslambda.InvokeOutput, error) {
+		if payloadLogGroup(t, payload) == "/fleet/osquery" {
+			return &awslambda.InvokeOutput{FunctionError: aws.String("Unhandled"), Payload: []byte(`{"errorType":"errorString","errorMessage":"pubsub down"}`)}, nil
+		}
+		return &awslambda.InvokeOutput{Payload: []byte(`{"published_message_count":1}`)}, nil
+	}}
+	var sleeps []time.Duration
+	sleep := func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return nil
+	}
+
+	var out bytes.Buffer
+	err := replay(context.Background(), testQueue(fq), invoker, 1000, ReplayCommand{FunctionName: "bridge", Rate: 4}, &out, sleep)
+	require.ErrorContains(t, err, "2 messages were not replayed")
+
+	assert.Len(t, invoker.payloads, 3)
+	assert.Equal(t, "/fleet/orbit", payloadLogGroup(t, []byte(invoker.payloads[0])))
+	assert.Equal(t, []string{"rh-a", "rh-b"}, fq.deleted)
+	assert.ElementsMatch(t, []string{"rh-c", "rh-d"}, fq.released)
+	assert.Equal(t, []time.Duration{250 * time.Millisecond, 250 * time.Millisecond}, sleeps)
+	assert.Empty(t, fq.extended)
+	assert.Contains(t, out.String(), "failed c (/fleet/osquery): bridge lambda Unhandled error: errorString: pubsub down")
+	assert.Contains(t, out.String(), "skipped d")
+	assert.Contains(t, out.String(), "2 messages replayed, 2 failed")
+}
+
+func TestReplayExtendsVisibility(t *testing.T) {
+	fq := newFakeQueue(t, time.Now())
+	invoker := &fakeInvoker{invokeFn: func([]byte) (*awslambda.InvokeOutput, error) {
+		return &awslambda.InvokeOutput{Payload: []byte(`{"published_message_count":1}`)}, nil
+	}}
+	now := time.Now()
+	q := testQueue(fq)
+	q.visibilityTimeout = 2
+	q.now = func() time.Time { return now }
+	sleep := func(ctx context.Context, d time.Duration) error {
+		now = now.Add(d)
+		return nil
+	}
+
+	var out bytes.Buffer
+	err := replay(context.Background(), q, invoker, 1000, ReplayCommand{
+		FilterOptions: FilterOptions{LogGroup: "/fleet/orbit"},
+		FunctionName:  "bridge",
+		Rate:          1,
+	}, &out, sleep)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"rh-a", "rh-b"}, fq.deleted)
+	assert.Equal(t, []string{"rh-c", "rh-d"}, fq.extended, "held messages are hidden again once half the timeout has passed")
+	assert.ElementsMatch(t, []string{"rh-c", "rh-d"}, fq.released)
+}
+
+func TestReplayCancelled(t *testing.T) {
+	fq := newFakeQueue(t, time.Now())
+	invoker := &fakeInvoker{invokeFn: func([]byte) (*awslambda.InvokeOutput, error) {
+		return &awslambda.InvokeOutput{Payload: []byte(`{"published_message_count":1}`)}, nil
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sleep := func(ctx context.Context, d time.Duration) error {
+		cancel()
+		return sleepContext(ctx, time.Hour)
+	}
+
+	var out bytes.Buffer
+	err := replay(ctx, testQueue(fq), invoker, 1000, ReplayCommand{FunctionName: "bridge", Rate: 5}, &out, sleep)
+	require.ErrorIs(t, err, context.Canceled)
+	assert.ErrorContains(t, err, "replay stopped after 1 messages")
+
+	assert.Len(t, invoker.payloads, 1)
+	assert.Equal(t, []string{"rh-a"}, fq.deleted)
+	assert.ElementsMatch(t, []string{"rh-b", "rh-c", "rh-d"}, fq.released, "messages are released after cancellation")
+}
+
+func payloadLogGroup(t *testing.T, payload []byte) string {
+	t.Helper()
+	m := newDLQMessage(types.Message{Body: aws.String(`{"requestPayload":` + string(payload) + `}`)})
+	return m.LogGroup()
+}
+
+func TestReplayDryRun(t *testing.T) {
+	fq := newFakeQueue(t, time.Now())
+	invoker := &fakeInvoker{invokeFn: func([]byte) (*awslambda.InvokeOutput, error) {
+		return nil, errors.New("unexpected invoke")
+	}}
+
+	var out bytes.Buffer
+	err := replay(context.Background(), testQueue(fq), invoker, 1000, ReplayCommand{
+		FilterOptions: FilterOptions{ErrorType: "wrapError"},
+		FunctionName:  "bridge",
+		Rate:          5,
+		DryRun:        true,
+	}, &out, func(context.Context, time.Duration) error { return nil })
+	require.NoError(t, err)
+
+	assert.Empty(t, invoker.payloads)
+	assert.Empty(t, fq.deleted)
+	assert.Len(t, fq.released, 4)
+	assert.Contains(t, out.String(), "would replay a (/fleet/orbit)")
+	assert.Contains(t, out.String(), "2 messages would be replayed, 0 skipped")
+}
+
+func TestPurge(t *testing.T) {
+	opts := PurgeCommand{FilterOptions: FilterOptions{LogGroup: "/fleet/orbit"}}
+
+	t.Run("cancelled", func(t *testing.T) {
+		fq := newFakeQueue(t, time.Now())
+		var out bytes.Buffer
+		err := purge(context.Background(), testQueue(fq), 1000, opts, strings.NewReader("yes\n"), &out)
+		require.EqualError(t, err, "purge cancelled")
+		assert.Contains(t, out.String(), "Delete 2 messages from fleet-dlq?")
+		assert.Empty(t, fq.deleted)
+		assert.Len(t, fq.released, 4)
+	})
+
+	t.Run("confirmed", func(t *testing.T) {
+		fq := newFakeQueue(t, time.Now())
+		var out bytes.Buffer
+		require.NoError(t, purge(context.Background(), testQueue(fq), 1000, opts, strings.NewReader("fleet-dlq\n"), &out))
+		assert.Equal(t, []string{"rh-a", "rh-b"}, fq.deleted)
+		assert.ElementsMatch(t, []string{"rh-c", "rh-d"}, fq.released)
+	})
+
+	t.Run("yes", func(t *testing.T) {
+		fq := newFakeQueue(t, time.Now())
+		var out bytes.Buffer
+		yes := opts
+		yes.Yes = true
+		require.NoError(t, purge(context.Background(), testQueue(fq), 1000, yes, strings.NewReader(""), &out))
+		assert.Equal(t, []string{"rh-a", "rh-b"}, fq.deleted)
+		assert.Contains(t, out.String(), "2 messages deleted")
+	})
+}
+
+func TestExport(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "export")
+	fq := newFakeQueue(t, time.Now())
+
+	var out bytes.Buffer
+	require.NoError(t, export(context.Background(), testQueue(fq), 1000, ExportCommand{Dir: dir}, &out))
+	assert.Contains(t, out.String(), "4 messages exported")
+	assert.Empty(t, fq.deleted)
+	assert.Len(t, fq.released, 4)
+
+	data, err := os.ReadFile(filepath.Join(dir, "a.json"))
+	require.NoError(t, err)
+	var exported struct {
+		MessageID    string `json:"message_id"`
+		ReceiveCount int    `json:"receive_count"`
+		ErrorType    string `json:"error_type"`
+		LogGroup     string `json:"log_group"`
+		Record       struct {
+			RequestContext struct {
+				RequestID string `json:"requestId"`
+			} `json:"requestContext"`
+		} `json:"record"`
+		LogEvents []struct {
+			Message string `json:"message"`
+		} `json:"log_events"`
+	}
+	require.NoError(t, json.Unmarshal(data, &exported))
+	assert.Equal(t, "a", exported.MessageID)
+	assert.Equal(t, 2, exported.ReceiveCount)
+	assert.Equal(t, "wrapError", exported.ErrorType)
+	assert.Equal(t, "/fleet/orbit", exported.LogGroup)
+	assert.Equal(t, "r", exported.Record.RequestContext.RequestID)
+	require.Len(t, exported.LogEvents, 1)
+	assert.Equal(t, "m", exported.LogEvents[0].Message)
+
+	data, err = os.ReadFile(filepath.Join(dir, "d.json"))
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"record": "not json"`)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+const (
+	esAuthNone  = "none"
+	esAuthBasic = "basic"
+	esAuthSigV4 = "sigv4"
+
+	// esDatePlaceholder is replaced in ELASTICSEARCH_INDEX with the event
+	// date formatted by ELASTICSEARCH_INDEX_DATE_FORMAT.
+	esDatePlaceholder = "{date}"
+)
+
+// esBulkError reports bulk items that were not indexed after all retries.
+type esBulkError struct {
+	Failed int
+	Status int
+	Reason string
+}
+
+func (e *esBulkError) Error() string {
+	return fmt.Sprintf("%d bulk items failed, first with status %d: %s", e.Failed, e.Status, e.Reason)
+}
+
+// esHTTPError is a non-2xx _bulk response.
+type esHTTPError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *esHTTPError) Error() string {
+	return fmt.Sprintf("elasticsearch returned HTTP %d: %s", e.StatusCode, e.Message)
+}
+
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+type esCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+var (
+	esIndex fieldTemplate
+
+	esMu         sync.Mutex
+	esHTTPClient *http.Client
+	esAWSConfig  *aws.Config
+)
+
+// parseESIndex validates ELASTICSEARCH_INDEX. {date} is handled by the sink;
+// every other placeholder is a field template.
+func parseESIndex(raw string) (fieldTemplate, error) {
+	if strings.TrimSpace(raw) == "" {
+		return "", errors.New("ELASTICSEARCH_INDEX must not be empty")
+	}
+	if _, err := parseFieldTemplate("ELASTICSEARCH_INDEX", strings.ReplaceAll(raw, esDatePlaceholder, "")); err != nil {
+		return "", err
+	}
+	return fieldTemplate(raw), nil
+}
+
+type esSink struct {
+	credentials esCredentials
+	awsConfig   *aws.Config
+}
+
+func getESSink(ctx context.Context) (sink, error) {
+	s := esSink{}
+	switch options.ESAuth {
+	case esAuthBasic:
+		secretText, err := getCachedSecretString(ctx, options.ESBasicAuthSecretARN)
+		if err != nil {
+			return nil, fmt.Errorf("get elasticsearch credentials: %w", err)
+		}
+		if err := json.Unmarshal([]byte(secretText), &s.credentials); err != nil {
+			return nil, fmt.Errorf("parse elasticsearch credentials secret: %w", err)
+		}
+		if s.credentials.Username == "" || s.credentials.Password == "" {
+			return nil, errors.New("elasticsearch credentials secret must contain username and password")
+		}
+	case esAuthSigV4:
+		cfg, err := getESAWSConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.awsConfig = cfg
+	}
+	return s, nil
+}
+
+func getESAWSConfig(ctx context.Context) (*aws.Config, error) {
+	esMu.Lock()
+	defer esMu.Unlock()
+
+	if esAWSConfig == nil {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("load aws sdk config: %w", err)
+		}
+		if options.ESSigV4Region != "" {
+			cfg.Region = options.ESSigV4Region
+		}
+		esAWSConfig = &cfg
+	}
+	return esAWSConfig, nil
+}
+
+// Publish indexes messages with the _bulk API. Items that fail with a
+// retriable status are resent on their own, so a partially failed request
+// does not duplicate the items that succeeded. Items rejected for any other
+// reason, such as a mapping error, fail the batch once the rest are indexed.
+func (s esSink) Publish(ctx context.Context, messages []outboundMessage) error {
+	pending := messages
+	backoff := options.ESRetryBackoff
+	var rejected *esBulkError
+	var err error
+	for attempt := 0; attempt <= options.ESMaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("index to elasticsearch: %w", errors.Join(err, ctx.Err()))
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		var result esBulkResult
+		result, err = s.bulk(ctx, pending)
+		var httpErr *esHTTPError
+		if errors.As(err, &httpErr) && httpErr.StatusCode != http.StatusTooManyRequests && httpErr.StatusCode < 500 {
+			return fmt.Errorf("index to elasticsearch: %w", err)
+		}
+		if err != nil {
+			continue
+		}
+
+		if result.rejected != nil {
+			if rejected == nil {
+				rejected = result.rejected
+			} else {
+				rejected.Failed += result.rejected.Failed
+			}
+		}
+		if len(result.retry) == 0 {
+			if rejected != nil {
+				return fmt.Errorf("index to elasticsearch: %w", rejected)
+			}
+			return nil
+		}
+		log.Printf("retrying %d of %d elasticsearch bulk items: %v", len(result.retry), len(pending), result.retryErr)
+		pending, err = result.retry, result.retryErr
+	}
+	if rejected != nil {
+		err = errors.Join(err, rejected)
+	}
+	return fmt.Errorf("index to elasticsearch: %w", err)
+}
+
+// esBulkResult sorts the failed items of a _bulk response into those worth
+// retrying and those that would fail the same way again.
+type esBulkResult struct {
+	retry    []outboundMessage
+	retryErr *esBulkError
+	rejected *esBulkError
+}
+
+func (s esSink) bulk(ctx context.Context, messages []outboundMessage) (esBulkResult, error) {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, message := range messages {
+		action := map[string]string{"_index": esIndexFor(message)}
+		if message.EventID != "" {
+			action["_id"] = message.EventID
+		}
+		if err := encoder.Encode(map[string]interface{}{"create": action}); err != nil {
+			return esBulkResult{}, fmt.Errorf("marshal bulk action: %w", err)
+		}
+		if err := encoder.Encode(esDocumentFor(message)); err != nil {
+			return esBulkResult{}, fmt.Errorf("marshal bulk document: %w", err)
+		}
+	}
+
+	var resp esBulkResponse
+	if err := s.post(ctx, body.Bytes(), &resp); err != nil {
+		return esBulkResult{}, err
+	}
+	if !resp.Errors {
+		return esBulkResult{}, nil
+	}
+	if len(resp.Items) != len(messages) {
+		return esBulkResult{}, fmt.Errorf("bulk response has %d items for %d documents", len(resp.Items), len(messages))
+	}
+
+	var result esBulkResult
+	for i, item := range resp.Items {
+		for _, outcome := range item {
+			// A conflict means an earlier attempt already created the
+			// document; event IDs make the retry idempotent.
+			if (outcome.Status >= 200 && outcome.Status <= 299) || outcome.Status == http.StatusConflict {
+				continue
+			}
+			target := &result.rejected
+			if outcome.Status == http.StatusTooManyRequests || outcome.Status >= 500 {
+				target = &result.retryErr
+				result.retry = append(result.retry, messages[i])
+			}
+			if *target == nil {
+				*target = &esBulkError{Status: outcome.Status}
+				if outcome.Error != nil {
+					(*target).Reason = outcome.Error.Type + ": " + outcome.Error.Reason
+				}
+			}
+			(*target).Failed++
+		}
+	}
+	return result, nil
+}
+
+func (s esSink) post(ctx context.Context, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(options.ESURL, "/")+"/_bulk", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	switch options.ESAuth {
+	case esAuthBasic:
+		req.SetBasicAuth(s.credentials.Username, s.credentials.Password)
+	case esAuthSigV4:
+		creds, err := s.awsConfig.Credentials.Retrieve(ctx)
+		if err != nil {
+			return fmt.Errorf("retrieve aws credentials: %w", err)
+		}
+		sum := sha256.Sum256(body)
+		payloadHash := hex.EncodeToString(sum[:])
+		// OpenSearch Serverless requires the payload hash header.
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+		if err := v4.NewSigner().SignHTTP(ctx, creds, req, payloadHash, options.ESSigV4Service, s.awsConfig.Region, time.Now()); err != nil {
+			return fmt.Errorf("sign bulk request: %w", err)
+		}
+	}
+
+	resp, err := getESHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &esHTTPError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode bulk response: %w", err)
+	}
+	return nil
+}
+
+func getESHTTPClient() *http.Client {
+	esMu.Lock()
+	defer esMu.Unlock()
+
+	if esHTTPClient == nil {
+		// Already validated by loadOptions.
+		tlsConfig, _ := newTLSConfig("ELASTICSEARCH_TLS_CA_PEM", options.ESTLSCAPEM)
+		esHTTPClient = &http.Client{
+			Timeout: options.ESRequestTimeout,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		}
+	}
+	return esHTTPClient
+}
+
+// esIndexFor expands ELASTICSEARCH_INDEX for message. Index names are dated
+// by event time, so late events land in the index for the day they happened.
+func esIndexFor(message outboundMessage) string {
+	eventTime := time.Now().UTC()
+	if parsed, err := time.Parse(time.RFC3339Nano, message.Attributes["event_time"]); err == nil {
+		eventTime = parsed.UTC()
+	}
+
+	raw := strings.ReplaceAll(string(esIndex), esDatePlaceholder, eventTime.Format(options.ESIndexDateFormat))
+	return sanitizeESIndex(fieldTemplate(raw).expand(message, parseLogBody(message.Body)))
+}
+
+// sanitizeESIndex makes name a valid index name: lowercase, without the
+// characters Elasticsearch and OpenSearch reject, and not starting with -, _
+// or +.
+func sanitizeESIndex(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`\/*?"<>| ,#:`, r) {
+			return '-'
+		}
+		return r
+	}, strings.ToLower(name))
+	return strings.TrimLeft(name, "-_+")
+}
+
+// esDocumentFor builds the indexed document. message is the published data,
+// embedded as JSON when it is JSON, and attributes holds the message
+// attributes.
+func esDocumentFor(message outboundMessage) map[string]interface{} {
+	doc := map[string]interface{}{
+		"attributes": message.Attributes,
+	}
+	if eventTime := message.Attributes["event_time"]; eventTime != "" {
+		doc["@timestamp"] = eventTime
+	}
+	switch {
+	case json.Valid(message.Data):
+		doc["message"] = json.RawMessage(message.Data)
+	case utf8.Valid(message.Data):
+		doc["message"] = string(message.Data)
+	default:
+		doc["message"] = base64.StdEncoding.EncodeToString(message.Data)
+	}
+	return doc
+}
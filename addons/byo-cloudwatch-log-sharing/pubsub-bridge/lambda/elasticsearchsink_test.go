@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func esTestOptions(url string) OptionsStruct {
+	opts := testOptions()
+	opts.Sink = sinkElasticsearch
+	opts.ESURL = url
+	opts.ESIndex = "fleet-{log_group}-{date}"
+	opts.ESIndexDateFormat = "2006.01.02"
+	opts.ESAuth = esAuthNone
+	opts.ESSigV4Service = "es"
+	opts.ESRequestTimeout = 5 * time.Second
+	opts.ESMaxRetries = 2
+	opts.ESRetryBackoff = time.Millisecond
+	return opts
+}
+
+type esBulkAction struct {
+	Index string `json:"_index"`
+	ID    string `json:"_id"`
+}
+
+// fakeES is a _bulk endpoint that keeps created documents by ID and fails
+// items as scripted by itemStatuses, keyed by document ID.
+type fakeES struct {
+	mu           sync.Mutex
+	statuses     []int
+	itemStatuses map[string][]int
+	requests     []*http.Request
+	attempts     [][]string
+	docs         map[string]map[string]interface{}
+	indices      map[string]string
+}
+
+func (f *fakeES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	f.requests = append(f.requests, r)
+	if len(f.statuses) > 0 {
+		status := f.statuses[0]
+		f.statuses = f.statuses[1:]
+		http.Error(w, `{"error":"unavailable"}`, status)
+		return
+	}
+	if f.docs == nil {
+		f.docs = map[string]map[string]interface{}{}
+		f.indices = map[string]string{}
+	}
+
+	type item struct {
+		Status int                    `json:"status"`
+		Error  map[string]interface{} `json:"error,omitempty"`
+	}
+	var items []map[string]item
+	var ids []string
+	hasErrors := false
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		var action map[string]esBulkAction
+		if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !scanner.Scan() {
+			http.Error(w, "missing document", http.StatusBadRequest)
+			return
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		create := action["create"]
+		ids = append(ids, create.ID)
+		status := http.StatusCreated
+		if scripted := f.itemStatuses[create.ID]; len(scripted) > 0 {
+			status = scripted[0]
+			f.itemStatuses[create.ID] = scripted[1:]
+		} else if _, ok := f.docs[create.ID]; ok {
+			status = http.StatusConflict
+		}
+
+		result := item{Status: status}
+		switch status {
+		case http.StatusCreated:
+			f.docs[create.ID] = doc
+			f.indices[create.ID] = create.Index
+		default:
+			hasErrors = true
+			result.Error = map[string]interface{}{"type": "scripted_exception", "reason": "scripted failure"}
+		}
+		items = append(items, map[string]item{"create": result})
+	}
+	f.attempts = append(f.attempts, ids)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"took": 1, "errors": hasErrors, "items": items})
+}
+
+func esMessage(id, logGroup, eventTime, data string) outboundMessage {
+	return outboundMessage{
+		Data:       []byte(data),
+		Attributes: map[string]string{"owner": "111", "log_group": logGroup, "log_stream": "s1", "event_time": eventTime},
+		EventID:    id,
+		Body:       data,
+	}
+}
+
+func TestESIndexFor(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+	options = esTestOptions("http://es:9200")
+
+	var err error
+	esIndex, err = parseESIndex(options.ESIndex)
+	require.NoError(t, err)
+	assert.Equal(t, "fleet--fleet-osquery-result-2024.05.01", esIndexFor(esMessage("1", "/fleet/osquery/Result", "2024-05-01T23:59:59Z", "")))
+	assert.Equal(t, "fleet--fleet-osquery-result-2024.05.02", esIndexFor(esMessage("1", "/fleet/osquery/Result", "2024-05-01T23:59:59-01:00", "")), "dates are UTC")
+
+	options.ESIndexDateFormat = "2006-01"
+	esIndex, err = parseESIndex("_{field.team}-{date}")
+	require.NoError(t, err)
+	assert.Equal(t, "infra-2024-05", esIndexFor(esMessage("1", "/fleet/a", "2024-05-01T10:00:00Z", `{"team":"Infra"}`)))
+
+	_, err = parseESIndex("fleet-{day}")
+	assert.ErrorContains(t, err, "ELASTICSEARCH_INDEX has unknown placeholder {day}")
+	_, err = parseESIndex(" ")
+	assert.ErrorContains(t, err, "ELASTICSEARCH_INDEX must not be empty")
+}
+
+func TestESDocumentFor(t *testing.T) {
+	doc := esDocumentFor(esMessage("1", "/fleet/a", "2024-05-01T10:00:00Z", `{"name":"osquery"}`))
+	encoded, err := json.Marshal(doc)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"@timestamp": "2024-05-01T10:00:00Z",
+		"message": {"name": "osquery"},
+		"attributes": {"owner": "111", "log_group": "/fleet/a", "log_stream": "s1", "event_time": "2024-05-01T10:00:00Z"}
+	}`, string(encoded))
+
+	assert.Equal(t, "plain line", esDocumentFor(outboundMessage{Data: []byte("plain line")})["message"])
+	assert.Equal(t, "//4=", esDocumentFor(outboundMessage{Data: []byte{0xff, 0xfe}})["message"])
+}
+
+func TestHandlerElasticsearchSink(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	es := &fakeES{statuses: []int{http.StatusServiceUnavailable}}
+	server := httptest.NewServer(es)
+	t.Cleanup(server.Close)
+
+	options = esTestOptions(server.URL)
+	options.ESAuth = esAuthBasic
+	options.ESBasicAuthSecretARN = "arn:aws:secretsmanager:us-east-2:111111111111:secret:es"
+	getSecretStringFunc = func(ctx context.Context, secretARN string) (string, error) {
+		return `{"username":"fleet","password":"secret"}`, nil
+	}
+	var err error
+	esIndex, err = parseESIndex(options.ESIndex)
+	require.NoError(t, err)
+
+	ev := makeCloudWatchEvent(t, map[string]interface{}{
+		"owner":       "111",
+		"logGroup":    "/fleet/server",
+		"logStream":   "s1",
+		"messageType": "DATA_MESSAGE",
+		"logEvents": []map[string]interface{}{
+			{"id": "e1", "timestamp": 1714557600000, "message": "m1"},
+			{"id": "e2", "timestamp": 1714557601000, "message": "m2"},
+		},
+	})
+	resp, err := handler(context.Background(), ev)
+	require.NoError(t, err)
+	assert.Equal(t, 2, resp["published_message_count"])
+
+	require.Len(t, es.requests, 2)
+	username, password, ok := es.requests[1].BasicAuth()
+	require.True(t, ok)
+	assert.Equal(t, "fleet", username)
+	assert.Equal(t, "secret", password)
+	assert.Equal(t, map[string]string{"e1": "fleet--fleet-server-2024.05.01", "e2": "fleet--fleet-server-2024.05.01"}, es.indices)
+
+	// A redelivered payload conflicts with the documents already created.
+	_, err = handler(context.Background(), ev)
+	require.NoError(t, err)
+	assert.Len(t, es.docs, 2)
+}
+
+func TestElasticsearchSinkRetriesFailedItems(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	es := &fakeES{itemStatuses: map[string][]int{
+		"e2": {http.StatusTooManyRequests, http.StatusServiceUnavailable},
+		"e3": {http.StatusTooManyRequests},
+	}}
+	server := httptest.NewServer(es)
+	t.Cleanup(server.Close)
+
+	options = esTestOptions(server.URL)
+	esIndex, _ = parseESIndex(options.ESIndex)
+	s, err := getESSink(context.Background())
+	require.NoError(t, err)
+
+	messages := []outboundMessage{
+		esMessage("e1", "/fleet/a", "2024-05-01T10:00:00Z", "1"),
+		esMessage("e2", "/fleet/a", "2024-05-01T10:00:01Z", "2"),
+		esMessage("e3", "/fleet/a", "2024-05-01T10:00:02Z", "3"),
+	}
+	require.NoError(t, s.Publish(context.Background(), messages))
+	assert.Equal(t, [][]string{{"e1", "e2", "e3"}, {"e2", "e3"}, {"e2"}}, es.attempts, "only failed items are resent")
+	assert.Len(t, es.docs, 3)
+
+	es.attempts = nil
+	es.itemStatuses = map[string][]int{
+		"e4": {http.StatusBadRequest},
+		"e5": {http.StatusServiceUnavailable},
+	}
+	err = s.Publish(context.Background(), []outboundMessage{
+		esMessage("e4", "/fleet/a", "2024-05-01T10:00:03Z", "4"),
+		esMessage("e5", "/fleet/a", "2024-05-01T10:00:04Z", "5"),
+	})
+	var bulkErr *esBulkError
+	require.ErrorAs(t, err, &bulkErr)
+	assert.Equal(t, http.StatusBadRequest, bulkErr.Status)
+	assert.Equal(t, 1, bulkErr.Failed)
+	assert.Equal(t, [][]string{{"e4", "e5"}, {"e5"}}, es.attempts, "rejected items are not resent")
+	assert.Contains(t, es.docs, "e5")
+
+	es.attempts = nil
+	es.itemStatuses = map[string][]int{"e6": {503, 503, 503}}
+	err = s.Publish(context.Background(), []outboundMessage{esMessage("e6", "/fleet/a", "", "6")})
+	require.ErrorAs(t, err, &bulkErr)
+	assert.Equal(t, http.StatusServiceUnavailable, bulkErr.Status)
+	assert.Len(t, es.attempts, 3)
+
+	es.attempts = nil
+	es.statuses = []int{http.StatusForbidden}
+	err = s.Publish(context.Background(), []outboundMessage{esMessage("e7", "/fleet/a", "", "7")})
+	var httpErr *esHTTPError
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusForbidden, httpErr.StatusCode)
+	assert.Len(t, es.attempts, 0, "client errors are not retried")
+}
+
+func TestElasticsearchSinkSigV4(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	t.Setenv("AWS_CONFIG_FILE", "/dev/null")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/dev/null")
+	t.Setenv("AWS_REGION", "us-east-2")
+
+	es := &fakeES{}
+	server := httptest.NewServer(es)
+	t.Cleanup(server.Close)
+
+	options = esTestOptions(server.URL)
+	options.ESAuth = esAuthSigV4
+	options.ESSigV4Region = "eu-west-1"
+	esIndex, _ = parseESIndex(options.ESIndex)
+	s, err := getESSink(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, s.Publish(context.Background(), []outboundMessage{esMessage("e1", "/fleet/a", "", "1")}))
+
+	require.Len(t, es.requests, 1)
+	auth := es.requests[0].Header.Get("Authorization")
+	assert.True(t, strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/"), auth)
+	assert.Contains(t, auth, "/eu-west-1/es/aws4_request")
+	assert.Len(t, es.requests[0].Header.Get("X-Amz-Content-Sha256"), 64)
+}
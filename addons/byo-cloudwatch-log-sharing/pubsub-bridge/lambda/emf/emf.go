@@ -0,0 +1,75 @@
+// Package emf writes CloudWatch embedded metric format records. It is shared
+// by the bridge and the replayer, which write the records to stdout; Lambda
+// forwards them to CloudWatch Logs, which extracts the metrics without any
+// PutMetricData calls.
+package emf
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sort"
+	"time"
+)
+
+// MaxValues is the most values one record may hold for a metric.
+const MaxValues = 100
+
+// Value is a metric's value, or its Values when there are several.
+type Value struct {
+	Value  float64
+	Values []float64
+	Unit   string
+}
+
+// Write writes one record holding metrics with dimensions to w. Nothing is
+// written without a namespace, which is how metrics are turned off. Errors are
+// logged rather than returned, since metrics never fail an invocation.
+func Write(w io.Writer, namespace string, dimensions map[string]string, metrics map[string]Value) {
+	if namespace == "" {
+		return
+	}
+
+	dimensionNames := make([]string, 0, len(dimensions))
+	record := map[string]interface{}{}
+	for name, value := range dimensions {
+		dimensionNames = append(dimensionNames, name)
+		record[name] = value
+	}
+	sort.Strings(dimensionNames)
+
+	metricNames := make([]string, 0, len(metrics))
+	for name := range metrics {
+		metricNames = append(metricNames, name)
+	}
+	sort.Strings(metricNames)
+
+	definitions := make([]map[string]string, 0, len(metrics))
+	for _, name := range metricNames {
+		definitions = append(definitions, map[string]string{"Name": name, "Unit": metrics[name].Unit})
+		if metrics[name].Values != nil {
+			record[name] = metrics[name].Values
+		} else {
+			record[name] = metrics[name].Value
+		}
+	}
+
+	record["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  namespace,
+			"Dimensions": [][]string{dimensionNames},
+			"Metrics":    definitions,
+		}},
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("marshal metrics: %v", err)
+		return
+	}
+
+	if _, err := w.Write(append(line, '\n')); err != nil {
+		log.Printf("write metrics: %v", err)
+	}
+}
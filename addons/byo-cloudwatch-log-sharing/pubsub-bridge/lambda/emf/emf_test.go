@@ -0,0 +1,42 @@
+package emf
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	var buf bytes.Buffer
+	Write(&buf, "Fleet", map[string]string{"LogGroup": "/fleet"}, map[string]Value{
+		"Published": {Value: 3, Unit: "Count"},
+		"Latency":   {Value: 12, Unit: "Milliseconds"},
+		"Lag":       {Values: []float64{1, 2}, Unit: "Seconds"},
+	})
+
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "/fleet", record["LogGroup"])
+	assert.Equal(t, float64(3), record["Published"])
+	assert.Equal(t, float64(12), record["Latency"])
+	assert.Equal(t, []interface{}{float64(1), float64(2)}, record["Lag"])
+
+	aws := record["_aws"].(map[string]interface{})
+	definition := aws["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "Fleet", definition["Namespace"])
+	assert.Equal(t, []interface{}{[]interface{}{"LogGroup"}}, definition["Dimensions"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"Name": "Lag", "Unit": "Seconds"},
+		map[string]interface{}{"Name": "Latency", "Unit": "Milliseconds"},
+		map[string]interface{}{"Name": "Published", "Unit": "Count"},
+	}, definition["Metrics"])
+}
+
+func TestWriteDisabled(t *testing.T) {
+	var buf bytes.Buffer
+	Write(&buf, "", nil, map[string]Value{"Published": {Value: 1, Unit: "Count"}})
+	assert.Empty(t, buf.String())
+}
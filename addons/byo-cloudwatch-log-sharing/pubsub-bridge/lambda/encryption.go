@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+
+	"github.com/fleetdm/fleet/terraform/addons/byo-cloudwatch-log-sharing/pubsub-bridge/lambda/envelope"
+)
+
+const (
+	encryptionModeNone = "none"
+	encryptionModeKMS  = "kms"
+	encryptionModeRSA  = "rsa"
+)
+
+var (
+	encryptionPublicKey *rsa.PublicKey
+
+	newDataKeyFunc = newDataKey
+)
+
+func newDataKey(ctx context.Context) (envelope.DataKey, error) {
+	switch options.EncryptionMode {
+	case encryptionModeKMS:
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return envelope.DataKey{}, fmt.Errorf("load aws sdk config: %w", err)
+		}
+		return envelope.NewKMSDataKey(ctx, kms.NewFromConfig(cfg), options.EncryptionKMSKeyID)
+	case encryptionModeRSA:
+		return envelope.NewRSADataKey(encryptionPublicKey)
+	default:
+		return envelope.DataKey{}, fmt.Errorf("unsupported encryption mode: %s", options.EncryptionMode)
+	}
+}
+
+// getDataKey returns the cached data key, generating a new one once the
+// configured TTL has elapsed so that KMS is not called for every invocation.
+func getDataKey(ctx context.Context) (envelope.DataKey, error) {
+	cacheMu.Lock()
+	if len(cache.dataKey.Plaintext) > 0 && time.Since(cache.dataKeyCreated) < options.EncryptionDataKeyTTL {
+		dataKey := cache.dataKey
+		cacheMu.Unlock()
+		return dataKey, nil
+	}
+	cacheMu.Unlock()
+
+	dataKey, err := newDataKeyFunc(ctx)
+	if err != nil {
+		return envelope.DataKey{}, err
+	}
+
+	cacheMu.Lock()
+	cache.dataKey = dataKey
+	cache.dataKeyCreated = time.Now()
+	cacheMu.Unlock()
+
+	return dataKey, nil
+}
+
+// encryptMessages replaces each message's Data with its sealed form and adds
+// the attributes consumers need to decrypt it.
+func encryptMessages(ctx context.Context, messages []outboundMessage) error {
+	if options.EncryptionMode == encryptionModeNone {
+		return nil
+	}
+
+	dataKey, err := getDataKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		sealed, attributes, err := envelope.Seal(dataKey, messages[i].Data)
+		if err != nil {
+			return fmt.Errorf("encrypt message payload: %w", err)
+		}
+
+		messages[i].Data = sealed
+		for k, v := range attributes {
+			messages[i].Attributes[k] = v
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+
+	pubsub "cloud.google.com/go/pubsub/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fleetdm/fleet/terraform/addons/byo-cloudwatch-log-sharing/pubsub-bridge/lambda/envelope"
+)
+
+func TestEncryptMessages(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	options = testOptions()
+	options.EncryptionMode = encryptionModeKMS
+	options.EncryptionDataKeyTTL = time.Minute
+
+	dataKey := envelope.DataKey{
+		Plaintext: bytes.Repeat([]byte{1}, 32),
+		Encrypted: []byte("wrapped"),
+		KeyID:     "arn:aws:kms:us-east-2:111111111111:key/abc",
+		Algorithm: envelope.AlgorithmKMS,
+	}
+
+	var generated int
+	newDataKeyFunc = func(ctx context.Context) (envelope.DataKey, error) {
+		generated++
+		return dataKey, nil
+	}
+
+	messages := []outboundMessage{
+		{Data: []byte("one"), Attributes: map[string]string{"log_group": "g"}},
+		{Data: []byte("two"), Attributes: map[string]string{"log_group": "g"}},
+	}
+	require.NoError(t, encryptMessages(context.Background(), messages))
+	require.NoError(t, encryptMessages(context.Background(), []outboundMessage{{Data: []byte("three"), Attributes: map[string]string{}}}))
+	assert.Equal(t, 1, generated, "data key should be cached within its TTL")
+
+	for i, want := range []string{"one", "two"} {
+		assert.Equal(t, "g", messages[i].Attributes["log_group"])
+		assert.Equal(t, envelope.AlgorithmKMS, messages[i].Attributes[envelope.AttributeAlgorithm])
+
+		plaintext, err := envelope.Open(envelope.AlgorithmKMS, dataKey.Plaintext, messages[i].Data)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(plaintext))
+	}
+
+	t.Run("data key error", func(t *testing.T) {
+		cacheMu.Lock()
+		cache = cacheState{}
+		cacheMu.Unlock()
+
+		newDataKeyFunc = func(ctx context.Context) (envelope.DataKey, error) {
+			return envelope.DataKey{}, errors.New("kms unavailable")
+		}
+		require.Error(t, encryptMessages(context.Background(), []outboundMessage{{Data: []byte("x"), Attributes: map[string]string{}}}))
+	})
+}
+
+func TestHandlerEncryptsBeforePublish(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	options = testOptions()
+	options.EncryptionMode = encryptionModeRSA
+	options.EncryptionDataKeyTTL = time.Minute
+	encryptionPublicKey = &priv.PublicKey
+
+	ev := makeCloudWatchEvent(t, map[string]interface{}{
+		"owner":       "123",
+		"logGroup":    "group",
+		"messageType": "DATA_MESSAGE",
+		"logEvents": []map[string]interface{}{
+			{"id": "1", "timestamp": 10, "message": "secret"},
+		},
+	})
+
+	var published []outboundMessage
+	getPublisherFunc = func(ctx context.Context, projectID, topicID, secretARN string) (*pubsub.Publisher, error) {
+		return nil, nil
+	}
+	publishBatchFunc = func(ctx context.Context, publisher *pubsub.Publisher, messages []outboundMessage) error {
+		published = append(published, messages...)
+		return nil
+	}
+
+	_, err = handler(context.Background(), ev)
+	require.NoError(t, err)
+	require.Len(t, published, 1)
+	assert.NotContains(t, string(published[0].Data), "secret")
+
+	plaintext, err := envelope.Decrypt(context.Background(), published[0].Data, published[0].Attributes, envelope.RSAUnwrapper(priv))
+	require.NoError(t, err)
+	assert.Contains(t, string(plaintext), `"message":"secret"`)
+}
+
+func TestValidateEncryptionOptions(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+
+	opts := testOptions()
+	opts.EncryptionMode = encryptionModeKMS
+	opts.EncryptionDataKeyTTL = time.Minute
+	require.ErrorContains(t, opts.validate(), "ENCRYPTION_KMS_KEY_ID")
+
+	opts.EncryptionKMSKeyID = "alias/fleet-logs"
+	require.NoError(t, opts.validate())
+
+	opts.EncryptionMode = encryptionModeRSA
+	opts.EncryptionPublicKey = "nope"
+	require.ErrorContains(t, opts.validate(), "ENCRYPTION_PUBLIC_KEY")
+
+	opts.EncryptionPublicKey = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	require.NoError(t, opts.validate())
+}
@@ -0,0 +1,231 @@
+// Package envelope implements the client-side envelope encryption applied by
+// the Pub/Sub bridge to log payloads. It is shared by the bridge Lambda and by
+// consumers that need to decrypt messages pulled from the GCP topic.
+//
+// Each message payload is sealed with AES-256-GCM using a data key. The data
+// key itself is wrapped either by AWS KMS or by an RSA public key (RSA-OAEP
+// with SHA-256) and travels with the message as a Pub/Sub attribute, so a
+// consumer only needs access to KMS or the matching RSA private key.
+package envelope
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+const (
+	AlgorithmKMS = "AES256-GCM+KMS"
+	AlgorithmRSA = "AES256-GCM+RSA-OAEP-SHA256"
+
+	AttributeAlgorithm = "encryption_algorithm"
+	AttributeKeyID     = "encryption_key_id"
+	AttributeDataKey   = "encryption_data_key"
+
+	dataKeySize = 32
+)
+
+// DataKey is an AES-256 key together with its wrapped form.
+type DataKey struct {
+	Plaintext []byte
+	Encrypted []byte
+	KeyID     string
+	Algorithm string
+}
+
+// Unwrapper returns the plaintext data key for a wrapped data key.
+type Unwrapper func(ctx context.Context, algorithm, keyID string, encrypted []byte) ([]byte, error)
+
+// Seal encrypts plaintext with the data key and returns the sealed payload
+// (nonce followed by ciphertext) and the attributes a consumer needs to open it.
+func Seal(key DataKey, plaintext []byte) ([]byte, map[string]string, error) {
+	aead, err := newAEAD(key.Plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, fmt.Errorf("generate nonce: %w", err)
+	}
+
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(key.Algorithm))
+	attributes := map[string]string{
+		AttributeAlgorithm: key.Algorithm,
+		AttributeKeyID:     key.KeyID,
+		AttributeDataKey:   base64.StdEncoding.EncodeToString(key.Encrypted),
+	}
+
+	return sealed, attributes, nil
+}
+
+// Open decrypts a sealed payload with a plaintext data key.
+func Open(algorithm string, dataKey, sealed []byte) ([]byte, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed payload is shorter than the nonce")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(algorithm))
+	if err != nil {
+		return nil, fmt.Errorf("open sealed payload: %w", err)
+	}
+
+	return plaintext, nil
+}
+
+// Decrypt opens a message using its Pub/Sub attributes. Messages without an
+// encryption_algorithm attribute are returned unchanged.
+func Decrypt(ctx context.Context, data []byte, attributes map[string]string, unwrap Unwrapper) ([]byte, error) {
+	algorithm := attributes[AttributeAlgorithm]
+	if algorithm == "" {
+		return data, nil
+	}
+
+	if algorithm != AlgorithmKMS && algorithm != AlgorithmRSA {
+		return nil, fmt.Errorf("unsupported encryption algorithm: %s", algorithm)
+	}
+
+	encrypted, err := base64.StdEncoding.DecodeString(attributes[AttributeDataKey])
+	if err != nil {
+		return nil, fmt.Errorf("decode %s attribute: %w", AttributeDataKey, err)
+	}
+
+	dataKey, err := unwrap(ctx, algorithm, attributes[AttributeKeyID], encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key: %w", err)
+	}
+
+	return Open(algorithm, dataKey, data)
+}
+
+// NewRSADataKey generates a random data key wrapped with the RSA public key.
+func NewRSADataKey(pub *rsa.PublicKey) (DataKey, error) {
+	plaintext := make([]byte, dataKeySize)
+	if _, err := rand.Read(plaintext); err != nil {
+		return DataKey{}, fmt.Errorf("generate data key: %w", err)
+	}
+
+	encrypted, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, plaintext, nil)
+	if err != nil {
+		return DataKey{}, fmt.Errorf("wrap data key: %w", err)
+	}
+
+	keyID, err := RSAKeyID(pub)
+	if err != nil {
+		return DataKey{}, err
+	}
+
+	return DataKey{
+		Plaintext: plaintext,
+		Encrypted: encrypted,
+		KeyID:     keyID,
+		Algorithm: AlgorithmRSA,
+	}, nil
+}
+
+// RSAUnwrapper returns an Unwrapper that unwraps RSA-wrapped data keys with
+// the private key.
+func RSAUnwrapper(priv *rsa.PrivateKey) Unwrapper {
+	return func(ctx context.Context, algorithm, keyID string, encrypted []byte) ([]byte, error) {
+		if algorithm != AlgorithmRSA {
+			return nil, fmt.Errorf("rsa private key cannot unwrap %s data keys", algorithm)
+		}
+
+		expected, err := RSAKeyID(&priv.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if keyID != expected {
+			return nil, fmt.Errorf("data key was wrapped for key %s, have %s", keyID, expected)
+		}
+
+		return rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, encrypted, nil)
+	}
+}
+
+// RSAKeyID identifies an RSA public key by the SHA-256 fingerprint of its
+// PKIX encoding.
+func RSAKeyID(pub *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("marshal rsa public key: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// ParseRSAPublicKey parses a PEM encoded PKIX or PKCS #1 RSA public key.
+func ParseRSAPublicKey(pemData []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("no PEM block found in public key")
+	}
+
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse public key: %w", err)
+	}
+
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an RSA key")
+	}
+
+	return key, nil
+}
+
+// ParseRSAPrivateKey parses a PEM encoded PKCS #8 or PKCS #1 RSA private key.
+func ParseRSAPrivateKey(pemData []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("no PEM block found in private key")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("data key must be %d bytes, got %d", dataKeySize, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("create aes cipher: %w", err)
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,121 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeKMSClient struct {
+	plaintext []byte
+}
+
+func (f *fakeKMSClient) GenerateDataKey(ctx context.Context, params *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error) {
+	return &kms.GenerateDataKeyOutput{
+		Plaintext:      f.plaintext,
+		CiphertextBlob: []byte("wrapped"),
+		KeyId:          params.KeyId,
+	}, nil
+}
+
+func (f *fakeKMSClient) Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	if !bytes.Equal(params.CiphertextBlob, []byte("wrapped")) {
+		return nil, assert.AnError
+	}
+	return &kms.DecryptOutput{Plaintext: f.plaintext, KeyId: params.KeyId}, nil
+}
+
+func generateRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return priv
+}
+
+func TestRSARoundTrip(t *testing.T) {
+	priv := generateRSAKey(t)
+
+	dataKey, err := NewRSADataKey(&priv.PublicKey)
+	require.NoError(t, err)
+	assert.Equal(t, AlgorithmRSA, dataKey.Algorithm)
+
+	sealed, attributes, err := Seal(dataKey, []byte(`{"message":"hello"}`))
+	require.NoError(t, err)
+	assert.NotContains(t, string(sealed), "hello")
+	assert.Equal(t, AlgorithmRSA, attributes[AttributeAlgorithm])
+	assert.Equal(t, dataKey.KeyID, attributes[AttributeKeyID])
+
+	plaintext, err := Decrypt(context.Background(), sealed, attributes, RSAUnwrapper(priv))
+	require.NoError(t, err)
+	assert.Equal(t, `{"message":"hello"}`, string(plaintext))
+
+	t.Run("wrong private key", func(t *testing.T) {
+		_, err := Decrypt(context.Background(), sealed, attributes, RSAUnwrapper(generateRSAKey(t)))
+		require.Error(t, err)
+	})
+
+	t.Run("tampered payload", func(t *testing.T) {
+		tampered := append([]byte{}, sealed...)
+		tampered[len(tampered)-1] ^= 0xff
+		_, err := Decrypt(context.Background(), tampered, attributes, RSAUnwrapper(priv))
+		require.Error(t, err)
+	})
+}
+
+func TestKMSRoundTrip(t *testing.T) {
+	client := &fakeKMSClient{plaintext: bytes.Repeat([]byte{7}, 32)}
+
+	dataKey, err := NewKMSDataKey(context.Background(), client, "arn:aws:kms:us-east-2:111111111111:key/abc")
+	require.NoError(t, err)
+
+	sealed, attributes, err := Seal(dataKey, []byte("payload"))
+	require.NoError(t, err)
+	assert.Equal(t, "arn:aws:kms:us-east-2:111111111111:key/abc", attributes[AttributeKeyID])
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("wrapped")), attributes[AttributeDataKey])
+
+	plaintext, err := Decrypt(context.Background(), sealed, attributes, KMSUnwrapper(client))
+	require.NoError(t, err)
+	assert.Equal(t, "payload", string(plaintext))
+}
+
+func TestDecryptUnencrypted(t *testing.T) {
+	plaintext, err := Decrypt(context.Background(), []byte("plain"), map[string]string{"log_group": "g"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "plain", string(plaintext))
+
+	_, err = Decrypt(context.Background(), []byte("plain"), map[string]string{AttributeAlgorithm: "rot13"}, nil)
+	require.Error(t, err)
+}
+
+func TestParseRSAKeys(t *testing.T) {
+	priv := generateRSAKey(t)
+
+	pkix, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+	pub, err := ParseRSAPublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix}))
+	require.NoError(t, err)
+	assert.True(t, priv.PublicKey.Equal(pub))
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+	parsed, err := ParseRSAPrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}))
+	require.NoError(t, err)
+	assert.True(t, priv.Equal(parsed))
+
+	_, err = ParseRSAPublicKey([]byte("not pem"))
+	require.Error(t, err)
+
+	_, err = ParseRSAPrivateKey([]byte("not pem"))
+	require.Error(t, err)
+
+}
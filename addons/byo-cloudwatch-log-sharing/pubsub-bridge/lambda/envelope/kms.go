@@ -0,0 +1,53 @@
+package envelope
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// KMSClient is the subset of the AWS KMS API used for data keys.
+type KMSClient interface {
+	GenerateDataKey(ctx context.Context, params *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error)
+	Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+// NewKMSDataKey generates an AES-256 data key under the KMS key.
+func NewKMSDataKey(ctx context.Context, client KMSClient, keyID string) (DataKey, error) {
+	out, err := client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(keyID),
+		KeySpec: types.DataKeySpecAes256,
+	})
+	if err != nil {
+		return DataKey{}, fmt.Errorf("generate kms data key: %w", err)
+	}
+
+	return DataKey{
+		Plaintext: out.Plaintext,
+		Encrypted: out.CiphertextBlob,
+		KeyID:     aws.ToString(out.KeyId),
+		Algorithm: AlgorithmKMS,
+	}, nil
+}
+
+// KMSUnwrapper returns an Unwrapper that decrypts KMS-wrapped data keys.
+func KMSUnwrapper(client KMSClient) Unwrapper {
+	return func(ctx context.Context, algorithm, keyID string, encrypted []byte) ([]byte, error) {
+		if algorithm != AlgorithmKMS {
+			return nil, fmt.Errorf("kms cannot unwrap %s data keys", algorithm)
+		}
+
+		out, err := client.Decrypt(ctx, &kms.DecryptInput{
+			CiphertextBlob: encrypted,
+			KeyId:          aws.String(keyID),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("kms decrypt: %w", err)
+		}
+
+		return out.Plaintext, nil
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	eventTimeSourceCloudWatch = "cloudwatch"
+	eventTimeSourceMessage    = "message"
+)
+
+// eventTimeFields lists the top-level keys of JSON log bodies that are tried,
+// in order, for the event time before falling back to the CloudWatch
+// timestamp.
+var eventTimeFields []string
+
+// parseEventTimeValue accepts RFC 3339 strings and epoch numbers, either as
+// JSON numbers or numeric strings. Epoch values are read as seconds, such as
+// osquery's unixTime, unless they are too large to be, in which case they are
+// read as milliseconds.
+func parseEventTimeValue(raw json.RawMessage) (time.Time, bool) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		if t, err := time.Parse(time.RFC3339Nano, text); err == nil {
+			return t, true
+		}
+		raw = json.RawMessage(strings.TrimSpace(text))
+	}
+
+	epoch, err := strconv.ParseFloat(string(raw), 64)
+	if err != nil || epoch <= 0 || math.IsInf(epoch, 0) {
+		return time.Time{}, false
+	}
+	if epoch >= 1e11 {
+		return time.UnixMilli(int64(epoch)), true
+	}
+	sec, frac := math.Modf(epoch)
+	return time.Unix(int64(sec), int64(frac*1e9)), true
+}
+
+func extractEventTime(message string, fields []string) (time.Time, bool) {
+	if len(fields) == 0 {
+		return time.Time{}, false
+	}
+
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(message), &body); err != nil {
+		return time.Time{}, false
+	}
+	for _, field := range fields {
+		if value, ok := body[field]; ok {
+			if t, ok := parseEventTimeValue(value); ok {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// stampEventTimes sets event_time, event_time_source and ingestion_lag_ms on
+// each message and returns the oldest event time. messages must be in the
+// same order as payload.LogEvents. It runs after encryption and just before
+// signing, the last point at which attributes can change, so the lag covers
+// as much of the bridge as it can.
+func stampEventTimes(messages []outboundMessage, payload *cloudWatchPayload, now time.Time) time.Time {
+	// The event time is read from the plaintext body, so it is only used when
+	// the body is published in clear text too.
+	fields := eventTimeFields
+	if options.EncryptionMode != encryptionModeNone {
+		fields = nil
+	}
+
+	var oldest time.Time
+	for i := range messages {
+		if i >= len(payload.LogEvents) {
+			break
+		}
+		event := payload.LogEvents[i]
+
+		eventTime, source := time.UnixMilli(event.Timestamp), eventTimeSourceCloudWatch
+		if extracted, ok := extractEventTime(event.Message, fields); ok {
+			eventTime, source = extracted, eventTimeSourceMessage
+		}
+		if oldest.IsZero() || eventTime.Before(oldest) {
+			oldest = eventTime
+		}
+
+		messages[i].Attributes["event_time"] = eventTime.UTC().Format(time.RFC3339Nano)
+		messages[i].Attributes["event_time_source"] = source
+		messages[i].Attributes["ingestion_lag_ms"] = strconv.FormatInt(now.Sub(eventTime).Milliseconds(), 10)
+	}
+	return oldest
+}
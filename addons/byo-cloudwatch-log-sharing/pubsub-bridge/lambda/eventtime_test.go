@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEventTimeValue(t *testing.T) {
+	cases := []struct {
+		raw  string
+		want time.Time
+		ok   bool
+	}{
+		{`"2024-01-02T03:04:05.5Z"`, time.Date(2024, 1, 2, 3, 4, 5, 500_000_000, time.UTC), true},
+		{`1700000000`, time.Unix(1700000000, 0), true},
+		{`"1700000000"`, time.Unix(1700000000, 0), true},
+		{`1700000000.25`, time.Unix(1700000000, 250_000_000), true},
+		{`1700000000123`, time.UnixMilli(1700000000123), true},
+		{`"yesterday"`, time.Time{}, false},
+		{`0`, time.Time{}, false},
+		{`{}`, time.Time{}, false},
+	}
+
+	for _, tc := range cases {
+		got, ok := parseEventTimeValue(json.RawMessage(tc.raw))
+		assert.Equal(t, tc.ok, ok, tc.raw)
+		if tc.ok {
+			assert.True(t, tc.want.Equal(got), "%s: got %s", tc.raw, got)
+		}
+	}
+}
+
+func TestExtractEventTime(t *testing.T) {
+	fields := []string{"unixTime", "ts"}
+
+	got, ok := extractEventTime(`{"unixTime":"1700000000","ts":"2024-01-01T00:00:00Z"}`, fields)
+	require.True(t, ok)
+	assert.Equal(t, int64(1700000000), got.Unix(), "fields are tried in order")
+
+	got, ok = extractEventTime(`{"unixTime":"bad","ts":"2024-01-01T00:00:00Z"}`, fields)
+	require.True(t, ok)
+	assert.Equal(t, "2024-01-01T00:00:00Z", got.UTC().Format(time.RFC3339))
+
+	_, ok = extractEventTime(`plain text`, fields)
+	assert.False(t, ok)
+
+	_, ok = extractEventTime(`{"ts":"2024-01-01T00:00:00Z"}`, nil)
+	assert.False(t, ok)
+}
+
+func TestStampEventTimes(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	options.EncryptionMode = encryptionModeNone
+	eventTimeFields = []string{"unixTime"}
+	payload := &cloudWatchPayload{LogGroup: "g"}
+	payload.LogEvents = append(payload.LogEvents,
+		struct {
+			ID        string `json:"id"`
+			Timestamp int64  `json:"timestamp"`
+			Message   string `json:"message"`
+		}{ID: "1", Timestamp: 1700000060000, Message: `{"unixTime":"1700000000"}`},
+		struct {
+			ID        string `json:"id"`
+			Timestamp int64  `json:"timestamp"`
+			Message   string `json:"message"`
+		}{ID: "2", Timestamp: 1700000090000, Message: "plain"},
+	)
+	messages := []outboundMessage{{Attributes: map[string]string{}}, {Attributes: map[string]string{}}}
+
+	oldest := stampEventTimes(messages, payload, time.UnixMilli(1700000100000))
+	assert.Equal(t, time.Unix(1700000000, 0), oldest)
+
+	assert.Equal(t, "2023-11-14T22:13:20Z", messages[0].Attributes["event_time"])
+	assert.Equal(t, eventTimeSourceMessage, messages[0].Attributes["event_time_source"])
+	assert.Equal(t, "100000", messages[0].Attributes["ingestion_lag_ms"])
+
+	assert.Equal(t, "2023-11-14T22:14:50Z", messages[1].Attributes["event_time"])
+	assert.Equal(t, eventTimeSourceCloudWatch, messages[1].Attributes["event_time_source"])
+	assert.Equal(t, "10000", messages[1].Attributes["ingestion_lag_ms"])
+}
+
+func TestStampEventTimesEncrypted(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	options.EncryptionMode = encryptionModeKMS
+	eventTimeFields = []string{"unixTime"}
+	payload := &cloudWatchPayload{LogGroup: "g"}
+	payload.LogEvents = append(payload.LogEvents, struct {
+		ID        string `json:"id"`
+		Timestamp int64  `json:"timestamp"`
+		Message   string `json:"message"`
+	}{ID: "1", Timestamp: 1700000060000, Message: `{"unixTime":"1700000000"}`})
+	messages := []outboundMessage{{Attributes: map[string]string{}}}
+
+	stampEventTimes(messages, payload, time.UnixMilli(1700000100000))
+	assert.Equal(t, "2023-11-14T22:14:20Z", messages[0].Attributes["event_time"], "encrypted bodies are not read")
+	assert.Equal(t, eventTimeSourceCloudWatch, messages[0].Attributes["event_time_source"])
+	assert.Equal(t, "40000", messages[0].Attributes["ingestion_lag_ms"])
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	bridgeModeGapCheck = "gap-check"
+
+	gapStatusBehind       = "behind"
+	gapStatusNotForwarded = "not_forwarded"
+)
+
+// streamGap describes one stream whose CloudWatch ingestion is ahead of what
+// the bridge has forwarded. BackfillStartTime and BackfillEndTime are epoch
+// milliseconds suitable for FilterLogEvents startTime and endTime.
+type streamGap struct {
+	LogGroup                    string `json:"log_group"`
+	LogStream                   string `json:"log_stream"`
+	Status                      string `json:"status"`
+	LastIngestionTime           int64  `json:"last_ingestion_time"`
+	LastForwardedAt             int64  `json:"last_forwarded_at,omitempty"`
+	LastForwardedEventTimestamp int64  `json:"last_forwarded_event_timestamp,omitempty"`
+	LastForwardedEventID        string `json:"last_forwarded_event_id,omitempty"`
+	LagMillis                   int64  `json:"lag_ms"`
+	BackfillStartTime           int64  `json:"backfill_start_time"`
+	BackfillEndTime             int64  `json:"backfill_end_time"`
+}
+
+type gapReport struct {
+	GeneratedAt    time.Time   `json:"generated_at"`
+	Threshold      string      `json:"threshold"`
+	LogGroups      []string    `json:"log_groups"`
+	StreamsChecked int         `json:"streams_checked"`
+	Gaps           []streamGap `json:"gaps"`
+}
+
+type s3Putter interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+var (
+	s3ClientOnce sync.Once
+	s3Client     s3Putter
+	s3ClientErr  error
+
+	getS3ClientFunc              = getS3Client
+	loadHighWaterMarksFunc       = loadHighWaterMarks
+	describeRecentLogStreamsFunc = describeRecentLogStreams
+)
+
+func getS3Client(ctx context.Context) (s3Putter, error) {
+	s3ClientOnce.Do(func() {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			s3ClientErr = fmt.Errorf("load aws sdk config: %w", err)
+			return
+		}
+		s3Client = s3.NewFromConfig(cfg)
+	})
+
+	if s3ClientErr != nil {
+		return nil, s3ClientErr
+	}
+	return s3Client, nil
+}
+
+// logGroupName returns the name part of a log group ARN, or value unchanged
+// when it is already a name. High-water marks are keyed by name because that
+// is what subscription payloads carry.
+func logGroupName(value string) string {
+	if !strings.HasPrefix(value, "arn:") {
+		return value
+	}
+	_, name, found := strings.Cut(value, ":log-group:")
+	if !found {
+		return value
+	}
+	return strings.TrimSuffix(name, ":*")
+}
+
+// findStreamGaps compares CloudWatch's view of a log group's streams with the
+// stored high-water marks. A stream is behind when CloudWatch ingested events
+// more than threshold after the bridge last forwarded from it, and not
+// forwarded when it has existed for longer than threshold without any mark.
+func findStreamGaps(logGroup string, streams []logStreamInfo, marks map[string]highWaterMark, now time.Time, threshold time.Duration) []streamGap {
+	var gaps []streamGap
+	for _, stream := range streams {
+		end := stream.LastIngestionTime
+		if stream.LastEventTimestamp > end {
+			end = stream.LastEventTimestamp
+		}
+		gap := streamGap{
+			LogGroup:          logGroup,
+			LogStream:         stream.LogStreamName,
+			LastIngestionTime: stream.LastIngestionTime,
+			BackfillEndTime:   end + 1,
+		}
+
+		mark, ok := marks[stream.LogStreamName]
+		if !ok {
+			if now.Sub(time.UnixMilli(stream.CreationTime)) <= threshold {
+				continue
+			}
+			gap.Status = gapStatusNotForwarded
+			gap.LagMillis = now.UnixMilli() - stream.CreationTime
+			gap.BackfillStartTime = stream.FirstEventTimestamp
+			if gap.BackfillStartTime == 0 {
+				gap.BackfillStartTime = stream.CreationTime
+			}
+			gaps = append(gaps, gap)
+			continue
+		}
+
+		lag := stream.LastIngestionTime - mark.LastForwardedAt
+		if lag <= threshold.Milliseconds() {
+			continue
+		}
+		gap.Status = gapStatusBehind
+		gap.LastForwardedAt = mark.LastForwardedAt
+		gap.LastForwardedEventTimestamp = mark.LastEventTimestamp
+		gap.LastForwardedEventID = mark.LastEventID
+		gap.LagMillis = lag
+		gap.BackfillStartTime = mark.LastEventTimestamp
+		gaps = append(gaps, gap)
+	}
+	return gaps
+}
+
+func writeGapReport(ctx context.Context, report gapReport) error {
+	client, err := getS3ClientFunc(ctx)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal gap report: %w", err)
+	}
+
+	keys := []string{
+		options.GapReportPrefix + report.GeneratedAt.UTC().Format("2006/01/02/150405Z") + ".json",
+		options.GapReportPrefix + "latest.json",
+	}
+	for _, key := range keys {
+		if _, err := client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(options.GapReportBucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(body),
+			ContentType: aws.String("application/json"),
+		}); err != nil {
+			return fmt.Errorf("write gap report s3://%s/%s: %w", options.GapReportBucket, key, err)
+		}
+	}
+	return nil
+}
+
+// gapCheckHandler builds a gap report for the configured log groups, emits
+// per log group metrics and, when a bucket is configured, stores the report
+// for backfill tooling.
+func gapCheckHandler(ctx context.Context, _ json.RawMessage) (*gapReport, error) {
+	now := time.Now()
+	report := &gapReport{
+		GeneratedAt: now.UTC(),
+		Threshold:   options.GapCheckThreshold.String(),
+		LogGroups:   splitList(options.GapCheckLogGroups),
+		Gaps:        []streamGap{},
+	}
+
+	marks, err := loadHighWaterMarksFunc(ctx)
+	if err != nil {
+		return nil, err
+	}
+	marksByGroup := map[string]map[string]highWaterMark{}
+	for _, mark := range marks {
+		if marksByGroup[mark.LogGroup] == nil {
+			marksByGroup[mark.LogGroup] = map[string]highWaterMark{}
+		}
+		marksByGroup[mark.LogGroup][mark.LogStream] = mark
+	}
+
+	for _, logGroup := range report.LogGroups {
+		streams, err := describeRecentLogStreamsFunc(ctx, logGroup, now.Add(-options.GapCheckLookback))
+		if err != nil {
+			return nil, fmt.Errorf("describe log streams for %s: %w", logGroup, err)
+		}
+
+		name := logGroupName(logGroup)
+		gaps := findStreamGaps(name, streams, marksByGroup[name], now, options.GapCheckThreshold)
+		report.StreamsChecked += len(streams)
+		report.Gaps = append(report.Gaps, gaps...)
+
+		var maxLag int64
+		for _, gap := range gaps {
+			if gap.LagMillis > maxLag {
+				maxLag = gap.LagMillis
+			}
+		}
+		emitMetrics(options.MetricsNamespace, map[string]string{"LogGroup": name}, map[string]metricValue{
+			"StreamsChecked":   {Value: float64(len(streams)), Unit: "Count"},
+			"StreamsBehind":    {Value: float64(len(gaps)), Unit: "Count"},
+			"MaxForwardingLag": {Value: float64(maxLag), Unit: "Milliseconds"},
+		})
+	}
+
+	sort.Slice(report.Gaps, func(i, j int) bool {
+		return report.Gaps[i].LagMillis > report.Gaps[j].LagMillis
+	})
+
+	for _, gap := range report.Gaps {
+		log.Printf("stream %s/%s is %s by %dms", gap.LogGroup, gap.LogStream, gap.Status, gap.LagMillis)
+	}
+	log.Printf("gap check finished: log_groups=%d streams_checked=%d gaps=%d", len(report.LogGroups), report.StreamsChecked, len(report.Gaps))
+
+	if options.GapReportBucket != "" {
+		if err := writeGapReport(ctx, *report); err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
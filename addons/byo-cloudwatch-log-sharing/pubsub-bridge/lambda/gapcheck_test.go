@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeS3 struct {
+	objects map[string][]byte
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	body, _ := io.ReadAll(params.Body)
+	f.objects[aws.ToString(params.Key)] = body
+	return &s3.PutObjectOutput{}, nil
+}
+
+func TestLogGroupName(t *testing.T) {
+	assert.Equal(t, "/fleet/server", logGroupName("/fleet/server"))
+	assert.Equal(t, "/fleet/server", logGroupName("arn:aws:logs:us-east-2:111111111111:log-group:/fleet/server:*"))
+	assert.Equal(t, "/fleet/server", logGroupName("arn:aws:logs:us-east-2:111111111111:log-group:/fleet/server"))
+}
+
+func TestFindStreamGaps(t *testing.T) {
+	now := time.UnixMilli(10_000_000)
+	threshold := time.Minute
+
+	streams := []logStreamInfo{
+		{LogStreamName: "healthy", CreationTime: 1, LastIngestionTime: now.UnixMilli() - 1000},
+		{LogStreamName: "behind", CreationTime: 1, LastEventTimestamp: now.UnixMilli() - 2000, LastIngestionTime: now.UnixMilli() - 1000},
+		{LogStreamName: "missing", CreationTime: 5_000, FirstEventTimestamp: 6_000, LastIngestionTime: now.UnixMilli() - 1000},
+		{LogStreamName: "new", CreationTime: now.UnixMilli() - 1000, LastIngestionTime: now.UnixMilli() - 500},
+	}
+	marks := map[string]highWaterMark{
+		"healthy": {LastForwardedAt: now.UnixMilli() - 900},
+		"behind":  {LastForwardedAt: now.UnixMilli() - 10*60*1000, LastEventTimestamp: 42, LastEventID: "e42"},
+	}
+
+	gaps := findStreamGaps("/fleet", streams, marks, now, threshold)
+	require.Len(t, gaps, 2)
+
+	assert.Equal(t, "behind", gaps[0].LogStream)
+	assert.Equal(t, gapStatusBehind, gaps[0].Status)
+	assert.Equal(t, int64(10*60*1000-1000), gaps[0].LagMillis)
+	assert.Equal(t, int64(42), gaps[0].BackfillStartTime)
+	assert.Equal(t, now.UnixMilli()-999, gaps[0].BackfillEndTime)
+	assert.Equal(t, "e42", gaps[0].LastForwardedEventID)
+
+	assert.Equal(t, "missing", gaps[1].LogStream)
+	assert.Equal(t, gapStatusNotForwarded, gaps[1].Status)
+	assert.Equal(t, int64(6_000), gaps[1].BackfillStartTime)
+}
+
+func TestGapCheckHandler(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	options = testOptions()
+	options.Mode = bridgeModeGapCheck
+	options.StateTableName = "marks"
+	options.GapCheckLogGroups = "arn:aws:logs:us-east-2:111111111111:log-group:/fleet/server:*"
+	options.GapCheckThreshold = time.Minute
+	options.GapCheckLookback = time.Hour
+	options.GapReportBucket = "reports"
+	options.GapReportPrefix = "gaps/"
+	metricsWriter = io.Discard
+
+	now := time.Now().UnixMilli()
+	loadHighWaterMarksFunc = func(ctx context.Context) ([]highWaterMark, error) {
+		return []highWaterMark{{LogGroup: "/fleet/server", LogStream: "a", LastForwardedAt: now - int64(time.Hour/time.Millisecond)}}, nil
+	}
+	describeRecentLogStreamsFunc = func(ctx context.Context, logGroup string, notBefore time.Time) ([]logStreamInfo, error) {
+		assert.Equal(t, options.GapCheckLogGroups, logGroup)
+		return []logStreamInfo{{LogStreamName: "a", CreationTime: 1, LastIngestionTime: now}}, nil
+	}
+	bucket := &fakeS3{objects: map[string][]byte{}}
+	getS3ClientFunc = func(ctx context.Context) (s3Putter, error) { return bucket, nil }
+
+	report, err := gapCheckHandler(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.StreamsChecked)
+	require.Len(t, report.Gaps, 1)
+	assert.Equal(t, "/fleet/server", report.Gaps[0].LogGroup)
+
+	require.Contains(t, bucket.objects, "gaps/latest.json")
+	assert.Len(t, bucket.objects, 2)
+
+	var stored gapReport
+	require.NoError(t, json.Unmarshal(bucket.objects["gaps/latest.json"], &stored))
+	assert.Equal(t, report.Gaps, stored.Gaps)
+}
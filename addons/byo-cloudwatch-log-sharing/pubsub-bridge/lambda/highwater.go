@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// The state table is keyed by log_group (partition) and log_stream (sort) and
+// holds one item per stream describing the newest event the bridge has
+// forwarded from it. Only the DynamoDB API is used, so any compatible store
+// reachable through STATE_ENDPOINT_URL works too.
+
+type highWaterMark struct {
+	LogGroup           string `json:"log_group"`
+	LogStream          string `json:"log_stream"`
+	Owner              string `json:"owner"`
+	LastEventTimestamp int64  `json:"last_event_timestamp"`
+	LastEventID        string `json:"last_event_id"`
+	LastForwardedAt    int64  `json:"last_forwarded_at"`
+}
+
+type stateStore interface {
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+}
+
+var (
+	stateStoreOnce sync.Once
+	stateStoreImpl stateStore
+	stateStoreErr  error
+
+	getStateStoreFunc = getStateStore
+)
+
+func getStateStore(ctx context.Context) (stateStore, error) {
+	stateStoreOnce.Do(func() {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			stateStoreErr = fmt.Errorf("load aws sdk config: %w", err)
+			return
+		}
+		stateStoreImpl = dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+			if options.StateEndpointURL != "" {
+				o.BaseEndpoint = aws.String(options.StateEndpointURL)
+			}
+		})
+	})
+
+	if stateStoreErr != nil {
+		return nil, stateStoreErr
+	}
+	return stateStoreImpl, nil
+}
+
+// newestEvent returns the high-water mark for the events in payload. It is
+// taken before sampling, so that a stream whose events are all sampled out,
+// rate limited or rejected still shows it is being delivered.
+func newestEvent(payload *cloudWatchPayload, forwardedAt time.Time) (highWaterMark, bool) {
+	mark := highWaterMark{
+		LogGroup:        payload.LogGroup,
+		LogStream:       payload.LogStream,
+		Owner:           payload.Owner,
+		LastForwardedAt: forwardedAt.UnixMilli(),
+	}
+
+	found := false
+	for _, event := range payload.LogEvents {
+		if !found || event.Timestamp > mark.LastEventTimestamp ||
+			(event.Timestamp == mark.LastEventTimestamp && event.ID > mark.LastEventID) {
+			mark.LastEventTimestamp = event.Timestamp
+			mark.LastEventID = event.ID
+			found = true
+		}
+	}
+	return mark, found
+}
+
+// recordHandled records mark once the handler is done with its payload,
+// whether the events were published, deliberately dropped or quarantined.
+// The payload has already been dealt with, so a state store failure is logged
+// rather than returned; a retry would only duplicate the forwarded events.
+func recordHandled(ctx context.Context, mark highWaterMark, ok bool) {
+	if options.StateTableName == "" || !ok {
+		return
+	}
+	mark.LastForwardedAt = time.Now().UnixMilli()
+	if err := recordHighWaterMark(ctx, mark); err != nil {
+		log.Printf("record high-water mark: %v", err)
+	}
+}
+
+// recordHighWaterMark advances the stored mark for the payload's stream. The
+// update is conditional so that out-of-order or replayed payloads never move
+// a mark backwards.
+func recordHighWaterMark(ctx context.Context, mark highWaterMark) error {
+	store, err := getStateStoreFunc(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(options.StateTableName),
+		Key: map[string]types.AttributeValue{
+			"log_group":  &types.AttributeValueMemberS{Value: mark.LogGroup},
+			"log_stream": &types.AttributeValueMemberS{Value: mark.LogStream},
+		},
+		UpdateExpression:    aws.String("SET #owner = :owner, last_event_timestamp = :ts, last_event_id = :id, last_forwarded_at = :at"),
+		ConditionExpression: aws.String("attribute_not_exists(last_event_timestamp) OR last_event_timestamp <= :ts"),
+		ExpressionAttributeNames: map[string]string{
+			"#owner": "owner",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: mark.Owner},
+			":ts":    &types.AttributeValueMemberN{Value: strconv.FormatInt(mark.LastEventTimestamp, 10)},
+			":id":    &types.AttributeValueMemberS{Value: mark.LastEventID},
+			":at":    &types.AttributeValueMemberN{Value: strconv.FormatInt(mark.LastForwardedAt, 10)},
+		},
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("update high-water mark for %s/%s: %w", mark.LogGroup, mark.LogStream, err)
+	}
+	return nil
+}
+
+// loadHighWaterMarks reads every mark in the state table.
+func loadHighWaterMarks(ctx context.Context) ([]highWaterMark, error) {
+	store, err := getStateStoreFunc(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		marks    []highWaterMark
+		startKey map[string]types.AttributeValue
+	)
+	for {
+		out, err := store.Scan(ctx, &dynamodb.ScanInput{
+			TableName:         aws.String(options.StateTableName),
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("scan state table: %w", err)
+		}
+
+		for _, item := range out.Items {
+			marks = append(marks, highWaterMark{
+				LogGroup:           stringAttribute(item, "log_group"),
+				LogStream:          stringAttribute(item, "log_stream"),
+				Owner:              stringAttribute(item, "owner"),
+				LastEventTimestamp: numberAttribute(item, "last_event_timestamp"),
+				LastEventID:        stringAttribute(item, "last_event_id"),
+				LastForwardedAt:    numberAttribute(item, "last_forwarded_at"),
+			})
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return marks, nil
+		}
+		startKey = out.LastEvaluatedKey
+	}
+}
+
+func stringAttribute(item map[string]types.AttributeValue, name string) string {
+	if v, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return v.Value
+	}
+	return ""
+}
+
+func numberAttribute(item map[string]types.AttributeValue, name string) int64 {
+	if v, ok := item[name].(*types.AttributeValueMemberN); ok {
+		n, _ := strconv.ParseInt(v.Value, 10, 64)
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeStateStore struct {
+	updates []*dynamodb.UpdateItemInput
+	pages   []*dynamodb.ScanOutput
+	scans   []*dynamodb.ScanInput
+	err     error
+}
+
+func (f *fakeStateStore) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	f.updates = append(f.updates, params)
+	return &dynamodb.UpdateItemOutput{}, f.err
+}
+
+func (f *fakeStateStore) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	f.scans = append(f.scans, params)
+	page := f.pages[0]
+	f.pages = f.pages[1:]
+	return page, nil
+}
+
+func TestNewestEvent(t *testing.T) {
+	payload := &cloudWatchPayload{Owner: "123", LogGroup: "g", LogStream: "s"}
+	_, ok := newestEvent(payload, time.UnixMilli(100))
+	assert.False(t, ok)
+
+	payload.LogEvents = append(payload.LogEvents,
+		struct {
+			ID        string `json:"id"`
+			Timestamp int64  `json:"timestamp"`
+			Message   string `json:"message"`
+		}{ID: "a", Timestamp: 20},
+		struct {
+			ID        string `json:"id"`
+			Timestamp int64  `json:"timestamp"`
+			Message   string `json:"message"`
+		}{ID: "c", Timestamp: 30},
+		struct {
+			ID        string `json:"id"`
+			Timestamp int64  `json:"timestamp"`
+			Message   string `json:"message"`
+		}{ID: "b", Timestamp: 30},
+	)
+
+	mark, ok := newestEvent(payload, time.UnixMilli(100))
+	require.True(t, ok)
+	assert.Equal(t, highWaterMark{
+		LogGroup:           "g",
+		LogStream:          "s",
+		Owner:              "123",
+		LastEventTimestamp: 30,
+		LastEventID:        "c",
+		LastForwardedAt:    100,
+	}, mark)
+}
+
+func TestRecordHighWaterMark(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	options = testOptions()
+	options.StateTableName = "marks"
+	store := &fakeStateStore{}
+	getStateStoreFunc = func(ctx context.Context) (stateStore, error) { return store, nil }
+
+	mark := highWaterMark{LogGroup: "g", LogStream: "s", Owner: "123", LastEventTimestamp: 30, LastEventID: "c", LastForwardedAt: 100}
+	require.NoError(t, recordHighWaterMark(context.Background(), mark))
+	require.Len(t, store.updates, 1)
+	update := store.updates[0]
+	assert.Equal(t, "marks", aws.ToString(update.TableName))
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "s"}, update.Key["log_stream"])
+	assert.Equal(t, &types.AttributeValueMemberN{Value: "30"}, update.ExpressionAttributeValues[":ts"])
+	assert.Contains(t, aws.ToString(update.ConditionExpression), "last_event_timestamp <= :ts")
+
+	store.err = &types.ConditionalCheckFailedException{}
+	require.NoError(t, recordHighWaterMark(context.Background(), mark))
+
+	store.err = errors.New("throttled")
+	require.ErrorContains(t, recordHighWaterMark(context.Background(), mark), "throttled")
+}
+
+func TestLoadHighWaterMarks(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	options = testOptions()
+	options.StateTableName = "marks"
+	item := func(stream string) map[string]types.AttributeValue {
+		return map[string]types.AttributeValue{
+			"log_group":            &types.AttributeValueMemberS{Value: "g"},
+			"log_stream":           &types.AttributeValueMemberS{Value: stream},
+			"last_event_timestamp": &types.AttributeValueMemberN{Value: "30"},
+			"last_forwarded_at":    &types.AttributeValueMemberN{Value: "100"},
+		}
+	}
+	store := &fakeStateStore{pages: []*dynamodb.ScanOutput{
+		{Items: []map[string]types.AttributeValue{item("s1")}, LastEvaluatedKey: item("s1")},
+		{Items: []map[string]types.AttributeValue{item("s2")}},
+	}}
+	getStateStoreFunc = func(ctx context.Context) (stateStore, error) { return store, nil }
+
+	marks, err := loadHighWaterMarks(context.Background())
+	require.NoError(t, err)
+	require.Len(t, marks, 2)
+	assert.Equal(t, "s2", marks[1].LogStream)
+	assert.Equal(t, int64(30), marks[1].LastEventTimestamp)
+	assert.Equal(t, int64(100), marks[1].LastForwardedAt)
+	require.Len(t, store.scans, 2)
+	assert.NotNil(t, store.scans[1].ExclusiveStartKey)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+const (
+	kafkaSASLNone        = "none"
+	kafkaSASLPlain       = "plain"
+	kafkaSASLScramSHA256 = "scram-sha-256"
+	kafkaSASLScramSHA512 = "scram-sha-512"
+
+	kafkaIdempotenceEnabled = "enabled"
+)
+
+// kafkaProducer is the part of *kgo.Client the sink uses.
+type kafkaProducer interface {
+	ProduceSync(ctx context.Context, records ...*kgo.Record) kgo.ProduceResults
+	Close()
+}
+
+type kafkaCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+var (
+	kafkaMu             sync.Mutex
+	cachedKafkaProducer kafkaProducer
+
+	newKafkaProducerFunc = newKafkaProducer
+)
+
+// kafkaSink publishes to a Kafka topic. Routes reuse the Pub/Sub topic_id
+// field as the Kafka topic; project_id and credentials_secret_arn do not
+// apply.
+type kafkaSink struct {
+	topic string
+}
+
+func getKafkaSink(ctx context.Context, dest pubsubDestination) (sink, error) {
+	return kafkaSink{topic: dest.TopicID}, nil
+}
+
+func (s kafkaSink) Publish(ctx context.Context, messages []outboundMessage) error {
+	producer, err := getKafkaProducer(ctx)
+	if err != nil {
+		return err
+	}
+
+	records := make([]*kgo.Record, 0, len(messages))
+	for _, message := range messages {
+		records = append(records, kafkaRecord(s.topic, message))
+	}
+
+	if err := producer.ProduceSync(ctx, records...).FirstErr(); err != nil {
+		// Drop the producer so the next invocation reconnects and re-reads
+		// the SASL secret, which covers rotated credentials.
+		resetKafkaProducer()
+		return fmt.Errorf("produce to kafka topic %s: %w", s.topic, err)
+	}
+	return nil
+}
+
+// kafkaRecord keys records by log group and stream so that events from one
+// stream land on one partition and keep their order. Attributes become
+// headers and the record timestamp is the event time when one was stamped.
+func kafkaRecord(topic string, message outboundMessage) *kgo.Record {
+	record := &kgo.Record{
+		Topic:     topic,
+		Key:       []byte(message.Attributes["log_group"] + "/" + message.Attributes["log_stream"]),
+		Value:     message.Data,
+		Timestamp: time.Now(),
+	}
+	if eventTime, err := time.Parse(time.RFC3339Nano, message.Attributes["event_time"]); err == nil {
+		record.Timestamp = eventTime
+	}
+
+	keys := make([]string, 0, len(message.Attributes))
+	for key := range message.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		record.Headers = append(record.Headers, kgo.RecordHeader{Key: key, Value: []byte(message.Attributes[key])})
+	}
+	return record
+}
+
+func getKafkaProducer(ctx context.Context) (kafkaProducer, error) {
+	kafkaMu.Lock()
+	defer kafkaMu.Unlock()
+
+	if cachedKafkaProducer != nil {
+		return cachedKafkaProducer, nil
+	}
+
+	producer, err := newKafkaProducerFunc(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cachedKafkaProducer = producer
+	return producer, nil
+}
+
+func resetKafkaProducer() {
+	kafkaMu.Lock()
+	defer kafkaMu.Unlock()
+
+	if cachedKafkaProducer != nil {
+		cachedKafkaProducer.Close()
+		cachedKafkaProducer = nil
+	}
+}
+
+// newKafkaProducer returns a client that waits for all in-sync replicas to
+// acknowledge each batch and writes it uncompressed. Idempotence, on by
+// default, lets the brokers drop batches the client resends after a lost
+// response.
+func newKafkaProducer(ctx context.Context) (kafkaProducer, error) {
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(splitList(options.KafkaBrokers)...),
+		kgo.ClientID(options.KafkaClientID),
+		kgo.RequiredAcks(kgo.AllISRAcks()),
+		kgo.ProducerBatchCompression(kgo.NoCompression()),
+		kgo.ProduceRequestTimeout(options.KafkaRequestTimeout),
+		kgo.RecordRetries(options.KafkaMaxRetries + 1),
+	}
+	if options.KafkaIdempotence != kafkaIdempotenceEnabled {
+		opts = append(opts, kgo.DisableIdempotentWrite())
+	}
+
+	if options.KafkaTLS {
+		tlsConfig, err := newTLSConfig("KAFKA_TLS_CA_PEM", options.KafkaTLSCAPEM)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, kgo.DialTLSConfig(tlsConfig))
+	}
+
+	if options.KafkaSASLMechanism != kafkaSASLNone {
+		secretText, err := getSecretStringFunc(ctx, options.KafkaSASLSecretARN)
+		if err != nil {
+			return nil, fmt.Errorf("get kafka SASL credentials: %w", err)
+		}
+		creds, err := parseKafkaCredentials(secretText)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, kgo.SASL(kafkaMechanism(options.KafkaSASLMechanism, creds)))
+	}
+
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("create kafka client: %w", err)
+	}
+	return client, nil
+}
+
+func parseKafkaCredentials(secretText string) (kafkaCredentials, error) {
+	var creds kafkaCredentials
+	if err := json.Unmarshal([]byte(secretText), &creds); err != nil {
+		return creds, fmt.Errorf("parse kafka SASL secret: %w", err)
+	}
+	if creds.Username == "" || creds.Password == "" {
+		return creds, errors.New("kafka SASL secret must contain username and password")
+	}
+	return creds, nil
+}
+
+func kafkaMechanism(name string, creds kafkaCredentials) sasl.Mechanism {
+	switch name {
+	case kafkaSASLScramSHA256:
+		return scram.Auth{User: creds.Username, Pass: creds.Password}.AsSha256Mechanism()
+	case kafkaSASLScramSHA512:
+		return scram.Auth{User: creds.Username, Pass: creds.Password}.AsSha512Mechanism()
+	default:
+		return plain.Auth{User: creds.Username, Pass: creds.Password}.AsMechanism()
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+type fakeKafkaProducer struct {
+	records [][]*kgo.Record
+	err     error
+	closed  bool
+}
+
+func (f *fakeKafkaProducer) ProduceSync(ctx context.Context, records ...*kgo.Record) kgo.ProduceResults {
+	f.records = append(f.records, records)
+	results := make(kgo.ProduceResults, 0, len(records))
+	for _, record := range records {
+		results = append(results, kgo.ProduceResult{Record: record, Err: f.err})
+	}
+	return results
+}
+
+func (f *fakeKafkaProducer) Close() {
+	f.closed = true
+}
+
+func kafkaTestOptions() OptionsStruct {
+	opts := testOptions()
+	opts.Sink = sinkKafka
+	opts.KafkaBrokers = "127.0.0.1:9092"
+	opts.KafkaTopic = "fleet-logs"
+	opts.KafkaSASLMechanism = kafkaSASLNone
+	opts.KafkaIdempotence = kafkaIdempotenceEnabled
+	opts.KafkaClientID = "fleet-pubsub-bridge"
+	opts.KafkaMaxRetries = 3
+	opts.KafkaRequestTimeout = 30 * time.Second
+	return opts
+}
+
+func TestKafkaRecord(t *testing.T) {
+	record := kafkaRecord("fleet-logs", outboundMessage{
+		Data: []byte(`{"message":"m1"}`),
+		Attributes: map[string]string{
+			"log_stream": "stream",
+			"log_group":  "group",
+			"event_time": "2024-05-01T10:00:00.5Z",
+		},
+	})
+
+	assert.Equal(t, "fleet-logs", record.Topic)
+	assert.Equal(t, []byte("group/stream"), record.Key)
+	assert.Equal(t, time.Date(2024, 5, 1, 10, 0, 0, 500000000, time.UTC), record.Timestamp.UTC())
+	assert.Equal(t, []kgo.RecordHeader{
+		{Key: "event_time", Value: []byte("2024-05-01T10:00:00.5Z")},
+		{Key: "log_group", Value: []byte("group")},
+		{Key: "log_stream", Value: []byte("stream")},
+	}, record.Headers)
+}
+
+func TestHandlerKafkaSink(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	options = kafkaTestOptions()
+	options.OwnerRoutes = `{"222":{"topic_id":"tenant-b-logs"}}`
+	var err error
+	tenancy, err = parseTenancy(options)
+	require.NoError(t, err)
+
+	producer := &fakeKafkaProducer{}
+	created := 0
+	newKafkaProducerFunc = func(ctx context.Context) (kafkaProducer, error) {
+		created++
+		return producer, nil
+	}
+
+	for _, owner := range []string{"111", "222"} {
+		ev := makeCloudWatchEvent(t, map[string]interface{}{
+			"owner":       owner,
+			"logGroup":    "group",
+			"logStream":   "stream",
+			"messageType": "DATA_MESSAGE",
+			"logEvents": []map[string]interface{}{
+				{"id": "1", "timestamp": 10, "message": "m1"},
+			},
+		})
+		resp, err := handler(context.Background(), ev)
+		require.NoError(t, err)
+		assert.Equal(t, 1, resp["published_message_count"])
+	}
+
+	require.Len(t, producer.records, 2)
+	assert.Equal(t, "fleet-logs", producer.records[0][0].Topic)
+	assert.Equal(t, "tenant-b-logs", producer.records[1][0].Topic)
+	assert.Equal(t, 1, created, "the producer is reused across invocations")
+}
+
+func TestHandlerKafkaSinkErrorResetsProducer(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	options = kafkaTestOptions()
+	producer := &fakeKafkaProducer{err: errors.New("broker down")}
+	newKafkaProducerFunc = func(ctx context.Context) (kafkaProducer, error) { return producer, nil }
+
+	ev := makeCloudWatchEvent(t, map[string]interface{}{
+		"owner":       "111",
+		"messageType": "DATA_MESSAGE",
+		"logEvents": []map[string]interface{}{
+			{"id": "1", "timestamp": 10, "message": "m1"},
+		},
+	})
+	_, err := handler(context.Background(), ev)
+	require.ErrorContains(t, err, "broker down")
+	assert.True(t, producer.closed)
+	assert.Nil(t, cachedKafkaProducer)
+}
+
+func TestNewKafkaProducerSASLSecret(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	options = kafkaTestOptions()
+	options.KafkaSASLMechanism = kafkaSASLScramSHA256
+	options.KafkaSASLSecretARN = "arn:aws:secretsmanager:us-east-2:111111111111:secret:kafka"
+
+	getSecretStringFunc = func(ctx context.Context, secretARN string) (string, error) {
+		assert.Equal(t, options.KafkaSASLSecretARN, secretARN)
+		return `{"username":"bridge","password":"secret"}`, nil
+	}
+	producer, err := newKafkaProducer(context.Background())
+	require.NoError(t, err)
+	producer.Close()
+
+	getSecretStringFunc = func(ctx context.Context, secretARN string) (string, error) {
+		return `{"username":"bridge"}`, nil
+	}
+	_, err = newKafkaProducer(context.Background())
+	require.ErrorContains(t, err, "username and password")
+}
+
+func TestKafkaSinkPublishesToCluster(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	cluster, err := kfake.NewCluster(
+		kfake.SeedTopics(3, "fleet-logs"),
+		kfake.EnableSASL(),
+		kfake.Superuser("SCRAM-SHA-512", "bridge", "secret"),
+	)
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+
+	options = kafkaTestOptions()
+	options.KafkaBrokers = strings.Join(cluster.ListenAddrs(), ",")
+	options.KafkaSASLMechanism = kafkaSASLScramSHA512
+	options.KafkaSASLSecretARN = "arn:aws:secretsmanager:us-east-2:111111111111:secret:kafka"
+	getSecretStringFunc = func(ctx context.Context, secretARN string) (string, error) {
+		return `{"username":"bridge","password":"secret"}`, nil
+	}
+	t.Cleanup(resetKafkaProducer)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, kafkaSink{topic: "fleet-logs"}.Publish(ctx, []outboundMessage{
+		{Data: []byte("m1"), Attributes: map[string]string{"log_group": "group", "log_stream": "stream"}},
+		{Data: []byte("m2"), Attributes: map[string]string{"log_group": "group", "log_stream": "stream"}},
+	}))
+
+	consumer, err := kgo.NewClient(
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.SASL(kafkaMechanism(kafkaSASLScramSHA512, kafkaCredentials{Username: "bridge", Password: "secret"})),
+		kgo.ConsumeTopics("fleet-logs"),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+	)
+	require.NoError(t, err)
+	defer consumer.Close()
+
+	var consumed []*kgo.Record
+	for len(consumed) < 2 {
+		fetches := consumer.PollFetches(ctx)
+		require.NoError(t, fetches.Err())
+		consumed = append(consumed, fetches.Records()...)
+	}
+	require.Len(t, consumed, 2)
+	assert.Equal(t, consumed[0].Partition, consumed[1].Partition, "one stream stays on one partition")
+	assert.Equal(t, []byte("m1"), consumed[0].Value)
+	assert.Equal(t, []byte("m2"), consumed[1].Value)
+	assert.Equal(t, []byte("group/stream"), consumed[0].Key)
+	assert.Equal(t, []kgo.RecordHeader{
+		{Key: "log_group", Value: []byte("group")},
+		{Key: "log_stream", Value: []byte("stream")},
+	}, consumed[0].Headers)
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	lokiFormatProtobuf = "protobuf"
+	lokiFormatJSON     = "json"
+
+	lokiPushPath = "/loki/api/v1/push"
+
+	// lokiOverflowValue replaces label values first seen after a label
+	// reached its cardinality limit.
+	lokiOverflowValue = "__overflow__"
+
+	lokiMaxLabels          = 15
+	lokiMaxLabelValueBytes = 1024
+)
+
+var lokiLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+type lokiLabel struct {
+	name     string
+	template fieldTemplate
+}
+
+// lokiLogType sets the log_type label for log groups matching LogGroup, which
+// may be a path.Match glob. The first matching entry wins.
+type lokiLogType struct {
+	LogGroup string `json:"log_group"`
+	LogType  string `json:"log_type"`
+}
+
+type lokiConfig struct {
+	labels   []lokiLabel
+	logTypes []lokiLogType
+	tenantID fieldTemplate
+}
+
+// lokiCardinality caps the distinct values each label takes in this
+// execution environment so that a templated label cannot create unbounded
+// streams.
+type lokiCardinality struct {
+	mu     sync.Mutex
+	limit  int
+	values map[string]map[string]bool
+}
+
+func (c *lokiCardinality) admit(label, value string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.values == nil {
+		c.values = map[string]map[string]bool{}
+	}
+	seen := c.values[label]
+	if seen == nil {
+		seen = map[string]bool{}
+		c.values[label] = seen
+	}
+	if seen[value] {
+		return value
+	}
+	if len(seen) >= c.limit {
+		return lokiOverflowValue
+	}
+	seen[value] = true
+	return value
+}
+
+type lokiEntry struct {
+	timestamp time.Time
+	line      string
+	metadata  map[string]string
+}
+
+type lokiStream struct {
+	labels  map[string]string
+	key     string
+	entries []lokiEntry
+}
+
+// lokiHTTPError is a non-2xx push response.
+type lokiHTTPError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *lokiHTTPError) Error() string {
+	return fmt.Sprintf("loki returned HTTP %d: %s", e.StatusCode, e.Message)
+}
+
+type lokiCredentials struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	BearerToken string `json:"bearer_token"`
+}
+
+var (
+	loki            lokiConfig
+	lokiLabelValues = &lokiCardinality{}
+
+	lokiMu         sync.Mutex
+	lokiHTTPClient *http.Client
+)
+
+func parseLokiConfig(o OptionsStruct) (lokiConfig, error) {
+	var errs []error
+	var cfg lokiConfig
+
+	raw := map[string]string{}
+	if strings.TrimSpace(o.LokiLabels) != "" {
+		if err := json.Unmarshal([]byte(o.LokiLabels), &raw); err != nil {
+			errs = append(errs, fmt.Errorf("parse LOKI_LABELS: %w", err))
+		}
+	}
+	if o.FleetEnvironment != "" {
+		if _, ok := raw["environment"]; !ok {
+			raw["environment"] = o.FleetEnvironment
+		}
+	}
+	if len(raw) == 0 {
+		errs = append(errs, errors.New("LOKI_LABELS must define at least one label"))
+	}
+	if len(raw) > lokiMaxLabels {
+		errs = append(errs, fmt.Errorf("LOKI_LABELS must define at most %d labels, got %d", lokiMaxLabels, len(raw)))
+	}
+
+	names := make([]string, 0, len(raw))
+	for name := range raw {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !lokiLabelName.MatchString(name) || strings.HasPrefix(name, "__") {
+			errs = append(errs, fmt.Errorf("LOKI_LABELS name %q is not a valid Loki label name", name))
+			continue
+		}
+		template, err := parseFieldTemplate(fmt.Sprintf("LOKI_LABELS[%s]", name), raw[name])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		cfg.labels = append(cfg.labels, lokiLabel{name: name, template: template})
+	}
+
+	if strings.TrimSpace(o.LokiLogTypes) != "" {
+		if err := json.Unmarshal([]byte(o.LokiLogTypes), &cfg.logTypes); err != nil {
+			errs = append(errs, fmt.Errorf("parse LOKI_LOG_TYPES: %w", err))
+		}
+	}
+	if _, ok := raw["log_type"]; ok && len(cfg.logTypes) > 0 {
+		errs = append(errs, errors.New("LOKI_LABELS must not define log_type when LOKI_LOG_TYPES is set"))
+	}
+	for i, logType := range cfg.logTypes {
+		if _, err := path.Match(logType.LogGroup, ""); err != nil || logType.LogGroup == "" {
+			errs = append(errs, fmt.Errorf("LOKI_LOG_TYPES[%d].log_group must be a log group name or glob", i))
+		}
+		if logType.LogType == "" {
+			errs = append(errs, fmt.Errorf("LOKI_LOG_TYPES[%d].log_type must not be empty", i))
+		}
+	}
+
+	tenantID, err := parseFieldTemplate("LOKI_TENANT_ID", o.LokiTenantID)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	cfg.tenantID = tenantID
+
+	if len(errs) > 0 {
+		return lokiConfig{}, errors.Join(errs...)
+	}
+	return cfg, nil
+}
+
+// usesBodyFields reports whether a label or the tenant ID reads the log body.
+func (c lokiConfig) usesBodyFields() bool {
+	templates := []fieldTemplate{c.tenantID}
+	for _, label := range c.labels {
+		templates = append(templates, label.template)
+	}
+	for _, t := range templates {
+		if strings.Contains(string(t), "{field.") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c lokiConfig) logTypeFor(logGroup string) string {
+	for _, logType := range c.logTypes {
+		if matched, _ := path.Match(logType.LogGroup, logGroup); matched {
+			return logType.LogType
+		}
+	}
+	return ""
+}
+
+type lokiSink struct {
+	credentials lokiCredentials
+}
+
+func getLokiSink(ctx context.Context) (sink, error) {
+	s := lokiSink{}
+	if options.LokiAuthSecretARN != "" {
+		secretText, err := getCachedSecretString(ctx, options.LokiAuthSecretARN)
+		if err != nil {
+			return nil, fmt.Errorf("get loki credentials: %w", err)
+		}
+		if err := json.Unmarshal([]byte(secretText), &s.credentials); err != nil {
+			return nil, fmt.Errorf("parse loki credentials secret: %w", err)
+		}
+		if s.credentials.BearerToken == "" && (s.credentials.Username == "" || s.credentials.Password == "") {
+			return nil, errors.New("loki credentials secret must contain username and password, or bearer_token")
+		}
+	}
+	return s, nil
+}
+
+func (s lokiSink) Publish(ctx context.Context, messages []outboundMessage) error {
+	for _, tenant := range lokiStreamsByTenant(loki, messages) {
+		var (
+			body        []byte
+			contentType string
+			encoding    string
+			err         error
+		)
+		if options.LokiFormat == lokiFormatJSON {
+			body, err = encodeLokiJSON(tenant.streams)
+			contentType, encoding = "application/json", "gzip"
+		} else {
+			body = snappy.Encode(nil, encodeLokiProtobuf(tenant.streams))
+			contentType = "application/x-protobuf"
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := s.push(ctx, tenant.id, body, contentType, encoding); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type lokiTenant struct {
+	id      string
+	streams []*lokiStream
+}
+
+// lokiStreamsByTenant groups messages into streams by tenant and label set.
+// Streams are ordered by their labels and entries by timestamp, because
+// Loki rejects entries that are older than the newest one it has for a
+// stream.
+func lokiStreamsByTenant(cfg lokiConfig, messages []outboundMessage) []lokiTenant {
+	var tenants []lokiTenant
+	tenantIndex := map[string]int{}
+	streams := map[string]map[string]*lokiStream{}
+
+	for _, message := range messages {
+		body := parseLogBody(message.Body)
+
+		tenantID := cfg.tenantID.expand(message, body)
+		if _, ok := tenantIndex[tenantID]; !ok {
+			tenantIndex[tenantID] = len(tenants)
+			tenants = append(tenants, lokiTenant{id: tenantID})
+			streams[tenantID] = map[string]*lokiStream{}
+		}
+
+		labels := map[string]string{}
+		for _, label := range cfg.labels {
+			value := label.template.expand(message, body)
+			if value == "" {
+				continue
+			}
+			if len(value) > lokiMaxLabelValueBytes {
+				value = strings.ToValidUTF8(value[:lokiMaxLabelValueBytes], "")
+			}
+			labels[label.name] = lokiLabelValues.admit(label.name, value)
+		}
+		if logType := cfg.logTypeFor(message.Attributes["log_group"]); logType != "" {
+			labels["log_type"] = logType
+		}
+		key := lokiLabelString(labels)
+
+		stream, ok := streams[tenantID][key]
+		if !ok {
+			stream = &lokiStream{labels: labels, key: key}
+			streams[tenantID][key] = stream
+			tenants[tenantIndex[tenantID]].streams = append(tenants[tenantIndex[tenantID]].streams, stream)
+		}
+		stream.entries = append(stream.entries, lokiEntryFor(message))
+	}
+
+	for _, tenant := range tenants {
+		sort.Slice(tenant.streams, func(i, j int) bool { return tenant.streams[i].key < tenant.streams[j].key })
+		for _, stream := range tenant.streams {
+			sort.SliceStable(stream.entries, func(i, j int) bool {
+				return stream.entries[i].timestamp.Before(stream.entries[j].timestamp)
+			})
+		}
+	}
+	return tenants
+}
+
+func lokiEntryFor(message outboundMessage) lokiEntry {
+	entry := lokiEntry{timestamp: time.Now()}
+	if eventTime, err := time.Parse(time.RFC3339Nano, message.Attributes["event_time"]); err == nil {
+		entry.timestamp = eventTime
+	}
+
+	if utf8.Valid(message.Data) {
+		entry.line = string(message.Data)
+	} else {
+		entry.line = base64.StdEncoding.EncodeToString(message.Data)
+	}
+
+	if options.LokiStructuredMetadata {
+		entry.metadata = map[string]string{}
+		for key, value := range message.Attributes {
+			entry.metadata[key] = value
+		}
+		if message.EventID != "" {
+			entry.metadata["event_id"] = message.EventID
+		}
+	}
+	return entry
+}
+
+// lokiLabelString renders labels in Prometheus selector form, which is also
+// the stream identity in the protobuf push format.
+func lokiLabelString(labels map[string]string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range lokiSortedKeys(labels) {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[name]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func lokiSortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// encodeLokiProtobuf encodes a logproto.PushRequest:
+//
+//	PushRequest   { repeated Stream streams = 1; }
+//	Stream        { string labels = 1; repeated Entry entries = 2; }
+//	Entry         { Timestamp timestamp = 1; string line = 2; repeated LabelPair structuredMetadata = 3; }
+//	Timestamp     { int64 seconds = 1; int32 nanos = 2; }
+//	LabelPair     { string name = 1; string value = 2; }
+func encodeLokiProtobuf(streams []*lokiStream) []byte {
+	var request []byte
+	for _, stream := range streams {
+		var encodedStream []byte
+		encodedStream = protowire.AppendTag(encodedStream, 1, protowire.BytesType)
+		encodedStream = protowire.AppendString(encodedStream, stream.key)
+
+		for _, entry := range stream.entries {
+			var timestamp []byte
+			timestamp = protowire.AppendTag(timestamp, 1, protowire.VarintType)
+			timestamp = protowire.AppendVarint(timestamp, uint64(entry.timestamp.Unix()))
+			timestamp = protowire.AppendTag(timestamp, 2, protowire.VarintType)
+			timestamp = protowire.AppendVarint(timestamp, uint64(entry.timestamp.Nanosecond()))
+
+			var encodedEntry []byte
+			encodedEntry = protowire.AppendTag(encodedEntry, 1, protowire.BytesType)
+			encodedEntry = protowire.AppendBytes(encodedEntry, timestamp)
+			encodedEntry = protowire.AppendTag(encodedEntry, 2, protowire.BytesType)
+			encodedEntry = protowire.AppendString(encodedEntry, entry.line)
+			for _, key := range lokiSortedKeys(entry.metadata) {
+				var pair []byte
+				pair = protowire.AppendTag(pair, 1, protowire.BytesType)
+				pair = protowire.AppendString(pair, key)
+				pair = protowire.AppendTag(pair, 2, protowire.BytesType)
+				pair = protowire.AppendString(pair, entry.metadata[key])
+
+				encodedEntry = protowire.AppendTag(encodedEntry, 3, protowire.BytesType)
+				encodedEntry = protowire.AppendBytes(encodedEntry, pair)
+			}
+
+			encodedStream = protowire.AppendTag(encodedStream, 2, protowire.BytesType)
+			encodedStream = protowire.AppendBytes(encodedStream, encodedEntry)
+		}
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, encodedStream)
+	}
+	return request
+}
+
+func encodeLokiJSON(streams []*lokiStream) ([]byte, error) {
+	type jsonStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][]interface{}   `json:"values"`
+	}
+
+	request := struct {
+		Streams []jsonStream `json:"streams"`
+	}{}
+	for _, stream := range streams {
+		out := jsonStream{Stream: stream.labels}
+		for _, entry := range stream.entries {
+			value := []interface{}{strconv.FormatInt(entry.timestamp.UnixNano(), 10), entry.line}
+			if len(entry.metadata) > 0 {
+				value = append(value, entry.metadata)
+			}
+			out.Values = append(out.Values, value)
+		}
+		request.Streams = append(request.Streams, out)
+	}
+
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("marshal loki push request: %w", err)
+	}
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write(encoded); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+func (s lokiSink) push(ctx context.Context, tenantID string, body []byte, contentType, encoding string) error {
+	backoff := options.LokiRetryBackoff
+	var err error
+	for attempt := 0; attempt <= options.LokiMaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("push to loki: %w", errors.Join(err, ctx.Err()))
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		err = s.post(ctx, tenantID, body, contentType, encoding)
+		if err == nil {
+			return nil
+		}
+		var httpErr *lokiHTTPError
+		if errors.As(err, &httpErr) && httpErr.StatusCode != http.StatusTooManyRequests && httpErr.StatusCode < 500 {
+			break
+		}
+	}
+	return fmt.Errorf("push to loki: %w", err)
+}
+
+func (s lokiSink) post(ctx context.Context, tenantID string, body []byte, contentType, encoding string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, lokiPushURL(options.LokiURL), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	if tenantID != "" {
+		req.Header.Set("X-Scope-OrgID", tenantID)
+	}
+	switch {
+	case s.credentials.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+s.credentials.BearerToken)
+	case s.credentials.Username != "":
+		req.SetBasicAuth(s.credentials.Username, s.credentials.Password)
+	}
+
+	resp, err := getLokiHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &lokiHTTPError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func lokiPushURL(base string) string {
+	base = strings.TrimRight(base, "/")
+	if strings.HasSuffix(base, lokiPushPath) {
+		return base
+	}
+	return base + lokiPushPath
+}
+
+func getLokiHTTPClient() *http.Client {
+	lokiMu.Lock()
+	defer lokiMu.Unlock()
+
+	if lokiHTTPClient == nil {
+		// Already validated by loadOptions.
+		tlsConfig, _ := newTLSConfig("LOKI_TLS_CA_PEM", options.LokiTLSCAPEM)
+		lokiHTTPClient = &http.Client{
+			Timeout: options.LokiTimeout,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		}
+	}
+	return lokiHTTPClient
+}
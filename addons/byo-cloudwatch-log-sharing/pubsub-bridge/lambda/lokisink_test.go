@@ -0,0 +1,395 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func lokiTestOptions(url string) OptionsStruct {
+	opts := testOptions()
+	opts.Sink = sinkLoki
+	opts.LokiURL = url
+	opts.LokiFormat = lokiFormatProtobuf
+	opts.LokiLabels = `{"log_group":"{log_group}"}`
+	opts.LokiMaxLabelValues = 50
+	opts.LokiTimeout = 5 * time.Second
+	opts.LokiMaxRetries = 2
+	opts.LokiRetryBackoff = time.Millisecond
+	return opts
+}
+
+// decodedLokiStream is a push request stream in the JSON push format's shape.
+type decodedLokiStream struct {
+	Labels  string
+	Stream  map[string]string `json:"stream"`
+	Values  [][]interface{}   `json:"values"`
+	Entries []decodedLokiEntry
+}
+
+type decodedLokiEntry struct {
+	Timestamp time.Time
+	Line      string
+	Metadata  map[string]string
+}
+
+// fakeLoki is a Loki push endpoint that decodes both push formats.
+type fakeLoki struct {
+	mu       sync.Mutex
+	statuses []int
+	tenants  []string
+	auth     []string
+	streams  [][]decodedLokiStream
+}
+
+func (f *fakeLoki) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path != lokiPushPath {
+		http.NotFound(w, r)
+		return
+	}
+	if len(f.statuses) > 0 {
+		status := f.statuses[0]
+		f.statuses = f.statuses[1:]
+		http.Error(w, "unavailable", status)
+		return
+	}
+	f.tenants = append(f.tenants, r.Header.Get("X-Scope-OrgID"))
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+
+	var streams []decodedLokiStream
+	var err error
+	switch r.Header.Get("Content-Type") {
+	case "application/x-protobuf":
+		streams, err = decodeLokiProtobuf(r.Body)
+	case "application/json":
+		streams, err = decodeLokiJSON(r.Body)
+	default:
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.streams = append(f.streams, streams)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decodeLokiProtobuf(r io.Reader) ([]decodedLokiStream, error) {
+	compressed, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	request, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+
+	var streams []decodedLokiStream
+	for _, encodedStream := range protoFields(request)[1] {
+		fields := protoFields(encodedStream)
+		stream := decodedLokiStream{Labels: string(fields[1][0])}
+		for _, encodedEntry := range fields[2] {
+			entryFields := protoFields(encodedEntry)
+			timestamp := protoFields(entryFields[1][0])
+			entry := decodedLokiEntry{
+				Timestamp: time.Unix(int64(protoVarint(timestamp[1])), int64(protoVarint(timestamp[2]))).UTC(),
+				Line:      string(entryFields[2][0]),
+			}
+			for _, pair := range entryFields[3] {
+				if entry.Metadata == nil {
+					entry.Metadata = map[string]string{}
+				}
+				pairFields := protoFields(pair)
+				entry.Metadata[string(pairFields[1][0])] = string(pairFields[2][0])
+			}
+			stream.Entries = append(stream.Entries, entry)
+		}
+		streams = append(streams, stream)
+	}
+	return streams, nil
+}
+
+// protoFields returns the raw values of each field number in a message.
+// Varints are returned in their encoded form.
+func protoFields(b []byte) map[protowire.Number][][]byte {
+	fields := map[protowire.Number][][]byte{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		b = b[n:]
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			fields[num] = append(fields[num], v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			fields[num] = append(fields[num], b[:n])
+			b = b[n:]
+		}
+	}
+	return fields
+}
+
+func protoVarint(values [][]byte) uint64 {
+	if len(values) == 0 {
+		return 0
+	}
+	v, _ := protowire.ConsumeVarint(values[0])
+	return v
+}
+
+func decodeLokiJSON(r io.Reader) ([]decodedLokiStream, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	var request struct {
+		Streams []decodedLokiStream `json:"streams"`
+	}
+	if err := json.NewDecoder(gz).Decode(&request); err != nil {
+		return nil, err
+	}
+	return request.Streams, nil
+}
+
+func lokiMessage(owner, logGroup, stream, eventTime, data string) outboundMessage {
+	return outboundMessage{
+		Data:       []byte(data),
+		Attributes: map[string]string{"owner": owner, "log_group": logGroup, "log_stream": stream, "event_time": eventTime},
+		Body:       data,
+	}
+}
+
+func TestParseLokiConfig(t *testing.T) {
+	opts := lokiTestOptions("http://loki:3100")
+	opts.FleetEnvironment = "prod"
+	opts.LokiLogTypes = `[{"log_group":"/fleet/osquery/result*","log_type":"result"}]`
+	cfg, err := parseLokiConfig(opts)
+	require.NoError(t, err)
+	require.Len(t, cfg.labels, 2)
+	assert.Equal(t, "environment", cfg.labels[0].name)
+	assert.Equal(t, fieldTemplate("prod"), cfg.labels[0].template)
+	assert.Equal(t, "log_group", cfg.labels[1].name)
+	assert.False(t, cfg.usesBodyFields())
+	assert.Equal(t, "result", cfg.logTypeFor("/fleet/osquery/results"))
+	assert.Equal(t, "", cfg.logTypeFor("/fleet/server"))
+
+	opts.LokiTenantID = "{field.tenant}"
+	cfg, err = parseLokiConfig(opts)
+	require.NoError(t, err)
+	assert.True(t, cfg.usesBodyFields())
+
+	opts = lokiTestOptions("http://loki:3100")
+	opts.LokiLabels = `{"__name__":"x","bad-name":"x","ok":"{host}","log_type":"x"}`
+	opts.LokiLogTypes = `[{"log_group":"[","log_type":""}]`
+	_, err = parseLokiConfig(opts)
+	require.Error(t, err)
+	assert.ErrorContains(t, err, `LOKI_LABELS name "__name__" is not a valid Loki label name`)
+	assert.ErrorContains(t, err, `LOKI_LABELS name "bad-name" is not a valid Loki label name`)
+	assert.ErrorContains(t, err, "LOKI_LABELS[ok] has unknown placeholder {host}")
+	assert.ErrorContains(t, err, "LOKI_LABELS must not define log_type when LOKI_LOG_TYPES is set")
+	assert.ErrorContains(t, err, "LOKI_LOG_TYPES[0].log_group must be a log group name or glob")
+	assert.ErrorContains(t, err, "LOKI_LOG_TYPES[0].log_type must not be empty")
+
+	opts = lokiTestOptions("http://loki:3100")
+	opts.LokiLabels = `{}`
+	_, err = parseLokiConfig(opts)
+	assert.ErrorContains(t, err, "LOKI_LABELS must define at least one label")
+}
+
+func TestLokiStreamsByTenant(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+	options = lokiTestOptions("http://loki:3100")
+	options.LokiTenantID = "{owner}"
+
+	cfg, err := parseLokiConfig(options)
+	require.NoError(t, err)
+	tenants := lokiStreamsByTenant(cfg, []outboundMessage{
+		lokiMessage("222", "/fleet/b", "s1", "2024-05-01T10:00:02Z", "b2"),
+		lokiMessage("111", "/fleet/b", "s1", "2024-05-01T10:00:03Z", "b3"),
+		lokiMessage("222", "/fleet/a", "s1", "2024-05-01T10:00:05Z", "a5"),
+		lokiMessage("222", "/fleet/b", "s2", "2024-05-01T10:00:01Z", "b1"),
+		lokiMessage("222", "/fleet/a", "s2", "2024-05-01T10:00:04.5Z", "a4"),
+	})
+
+	require.Len(t, tenants, 2)
+	assert.Equal(t, "222", tenants[0].id)
+	assert.Equal(t, "111", tenants[1].id)
+
+	streams := tenants[0].streams
+	require.Len(t, streams, 2)
+	assert.Equal(t, `{log_group="/fleet/a"}`, streams[0].key, "streams are sorted by labels")
+	assert.Equal(t, `{log_group="/fleet/b"}`, streams[1].key)
+	var lines []string
+	for _, entry := range streams[0].entries {
+		lines = append(lines, entry.line)
+	}
+	for _, entry := range streams[1].entries {
+		lines = append(lines, entry.line)
+	}
+	assert.Equal(t, []string{"a4", "a5", "b1", "b2"}, lines, "entries are sorted by event time")
+}
+
+func TestLokiLabelCardinality(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+	options = lokiTestOptions("http://loki:3100")
+	options.LokiLabels = `{"log_stream":"{log_stream}"}`
+	lokiLabelValues.limit = 2
+
+	cfg, err := parseLokiConfig(options)
+	require.NoError(t, err)
+	tenants := lokiStreamsByTenant(cfg, []outboundMessage{
+		lokiMessage("111", "/fleet/a", "s1", "", "1"),
+		lokiMessage("111", "/fleet/a", "s2", "", "2"),
+		lokiMessage("111", "/fleet/a", "s3", "", "3"),
+		lokiMessage("111", "/fleet/a", "s4", "", "4"),
+		lokiMessage("111", "/fleet/a", "s1", "", "5"),
+	})
+
+	require.Len(t, tenants, 1)
+	var keys []string
+	for _, stream := range tenants[0].streams {
+		keys = append(keys, stream.key)
+	}
+	assert.Equal(t, []string{`{log_stream="__overflow__"}`, `{log_stream="s1"}`, `{log_stream="s2"}`}, keys)
+	assert.Len(t, tenants[0].streams[0].entries, 2)
+	assert.Len(t, tenants[0].streams[1].entries, 2, "values seen before the limit keep their stream")
+}
+
+func TestLokiLabelString(t *testing.T) {
+	assert.Equal(t, `{}`, lokiLabelString(nil))
+	assert.Equal(t, `{a="x\"y", b="\\z"}`, lokiLabelString(map[string]string{"b": `\z`, "a": `x"y`}))
+}
+
+func TestHandlerLokiSink(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	receiver := &fakeLoki{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+
+	options = lokiTestOptions(server.URL)
+	options.FleetEnvironment = "prod"
+	options.LokiTenantID = "fleet-{owner}"
+	options.LokiLogTypes = `[{"log_group":"/fleet/*","log_type":"server"}]`
+	options.LokiStructuredMetadata = true
+	options.LokiAuthSecretARN = "arn:aws:secretsmanager:us-east-2:111111111111:secret:loki"
+	getSecretStringFunc = func(ctx context.Context, secretARN string) (string, error) {
+		return `{"username":"fleet","password":"secret"}`, nil
+	}
+	var err error
+	loki, err = parseLokiConfig(options)
+	require.NoError(t, err)
+
+	ev := makeCloudWatchEvent(t, map[string]interface{}{
+		"owner":       "111",
+		"logGroup":    "/fleet/server",
+		"logStream":   "s1",
+		"messageType": "DATA_MESSAGE",
+		"logEvents": []map[string]interface{}{
+			{"id": "2", "timestamp": 2000, "message": "second"},
+			{"id": "1", "timestamp": 1000, "message": "first"},
+		},
+	})
+	resp, err := handler(context.Background(), ev)
+	require.NoError(t, err)
+	assert.Equal(t, 2, resp["published_message_count"])
+
+	require.Len(t, receiver.streams, 1)
+	assert.Equal(t, []string{"fleet-111"}, receiver.tenants)
+	assert.Equal(t, "Basic ZmxlZXQ6c2VjcmV0", receiver.auth[0])
+
+	streams := receiver.streams[0]
+	require.Len(t, streams, 1)
+	assert.Equal(t, `{environment="prod", log_group="/fleet/server", log_type="server"}`, streams[0].Labels)
+	require.Len(t, streams[0].Entries, 2)
+	assert.Equal(t, time.UnixMilli(1000).UTC(), streams[0].Entries[0].Timestamp)
+	assert.Equal(t, time.UnixMilli(2000).UTC(), streams[0].Entries[1].Timestamp)
+	assert.Contains(t, streams[0].Entries[0].Line, "first")
+	assert.Equal(t, "1", streams[0].Entries[0].Metadata["event_id"])
+	assert.Equal(t, "s1", streams[0].Entries[0].Metadata["log_stream"])
+
+	receiver.statuses = []int{http.StatusBadRequest}
+	_, err = handler(context.Background(), ev)
+	var httpErr *lokiHTTPError
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusBadRequest, httpErr.StatusCode)
+	assert.Len(t, receiver.streams, 1, "client errors are not retried")
+}
+
+func TestLokiSinkJSON(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	receiver := &fakeLoki{}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+
+	options = lokiTestOptions(server.URL + lokiPushPath)
+	options.LokiFormat = lokiFormatJSON
+	options.LokiAuthSecretARN = "arn:aws:secretsmanager:us-east-2:111111111111:secret:loki"
+	getSecretStringFunc = func(ctx context.Context, secretARN string) (string, error) {
+		return `{"bearer_token":"abc"}`, nil
+	}
+	var err error
+	loki, err = parseLokiConfig(options)
+	require.NoError(t, err)
+
+	s, err := getLokiSink(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, s.Publish(context.Background(), []outboundMessage{
+		lokiMessage("111", "/fleet/a", "s1", "2024-05-01T10:00:01Z", "later"),
+		lokiMessage("111", "/fleet/a", "s1", "2024-05-01T10:00:00Z", "earlier"),
+		{Data: []byte{0xff, 0xfe}, Attributes: map[string]string{"log_group": "/fleet/a", "event_time": "2024-05-01T10:00:02Z"}},
+	}))
+
+	require.Len(t, receiver.streams, 1)
+	assert.Equal(t, []string{""}, receiver.tenants)
+	assert.Equal(t, "Bearer abc", receiver.auth[0])
+	streams := receiver.streams[0]
+	require.Len(t, streams, 1)
+	assert.Equal(t, map[string]string{"log_group": "/fleet/a"}, streams[0].Stream)
+	assert.Equal(t, [][]interface{}{
+		{"1714557600000000000", "earlier"},
+		{"1714557601000000000", "later"},
+		{"1714557602000000000", "//4="},
+	}, streams[0].Values)
+}
+
+func TestGetLokiSinkCredentials(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	options = lokiTestOptions("http://loki:3100")
+	options.LokiAuthSecretARN = "arn:aws:secretsmanager:us-east-2:111111111111:secret:loki"
+	getSecretStringFunc = func(ctx context.Context, secretARN string) (string, error) {
+		return `{"username":"fleet"}`, nil
+	}
+	_, err := getLokiSink(context.Background())
+	assert.ErrorContains(t, err, "loki credentials secret must contain username and password, or bearer_token")
+}
+
+func TestLokiPushURL(t *testing.T) {
+	assert.Equal(t, "https://loki.example.com/loki/api/v1/push", lokiPushURL("https://loki.example.com"))
+	assert.Equal(t, "https://loki.example.com/loki/api/v1/push", lokiPushURL("https://loki.example.com/"))
+	assert.Equal(t, "https://loki.example.com/loki/api/v1/push", lokiPushURL("https://loki.example.com/loki/api/v1/push"))
+}
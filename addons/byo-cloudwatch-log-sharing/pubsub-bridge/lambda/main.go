@@ -1,16 +1,12 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
+	"log"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -21,34 +17,30 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	"google.golang.org/api/option"
+
+	"github.com/fleetdm/fleet/terraform/addons/byo-cloudwatch-log-sharing/pubsub-bridge/lambda/awslogs"
+	"github.com/fleetdm/fleet/terraform/addons/byo-cloudwatch-log-sharing/pubsub-bridge/lambda/envelope"
+	"github.com/fleetdm/fleet/terraform/addons/byo-cloudwatch-log-sharing/pubsub-bridge/lambda/replay"
+	"github.com/fleetdm/fleet/terraform/addons/byo-cloudwatch-log-sharing/pubsub-bridge/lambda/signing"
 )
 
 const defaultPubSubBatchMax = 1000
 
 const defaultCredentialsCacheTTL = 5 * time.Minute
 
-type cloudWatchLogsEvent struct {
-	AWSLogs struct {
-		Data string `json:"data"`
-	} `json:"awslogs"`
-}
+type cloudWatchLogsEvent = awslogs.Event
 
-type cloudWatchPayload struct {
-	Owner               string   `json:"owner"`
-	LogGroup            string   `json:"logGroup"`
-	LogStream           string   `json:"logStream"`
-	SubscriptionFilters []string `json:"subscriptionFilters"`
-	MessageType         string   `json:"messageType"`
-	LogEvents           []struct {
-		ID        string `json:"id"`
-		Timestamp int64  `json:"timestamp"`
-		Message   string `json:"message"`
-	} `json:"logEvents"`
-}
+type cloudWatchPayload = awslogs.Payload
+
+type cloudWatchLogEvent = awslogs.LogEvent
 
 type outboundMessage struct {
 	Data       []byte
 	Attributes map[string]string
+	// EventID and Body are the source log event's ID and unencrypted line.
+	// Sinks may derive routing fields from them; they are not published.
+	EventID string
+	Body    string
 }
 
 type serviceAccountCredentials struct {
@@ -56,15 +48,37 @@ type serviceAccountCredentials struct {
 	PrivateKey  string `json:"private_key"`
 }
 
-type cacheState struct {
-	secretARN          string
-	credentialsJSON    []byte
-	credentialsFetched time.Time
+type cachedCredentials struct {
+	credentialsJSON []byte
+	fetched         time.Time
+}
 
+type publisherKey struct {
 	projectID      string
 	topicReference string
-	pubsubClient   *pubsub.Client
-	publisher      *pubsub.Publisher
+	secretARN      string
+}
+
+type cachedPublisher struct {
+	pubsubClient *pubsub.Client
+	publisher    *pubsub.Publisher
+	created      time.Time
+}
+
+// cacheState is shared by warm invocations. Credentials and publishers are
+// keyed so that a bridge routing owners to several tenant topics keeps one
+// client per destination instead of rebuilding clients on every switch.
+type cacheState struct {
+	credentials map[string]cachedCredentials
+	publishers  map[publisherKey]cachedPublisher
+	secrets     map[string]cachedSecret
+
+	dataKey        envelope.DataKey
+	dataKeyCreated time.Time
+
+	signingSecretARN string
+	signingKeyset    signing.Keyset
+	signingFetched   time.Time
 }
 
 var (
@@ -73,18 +87,11 @@ var (
 
 	credentialsCacheTTL = defaultCredentialsCacheTTL
 
-	getPublisherFunc = getPublisher
-	publishBatchFunc = publishBatch
+	getPublisherFunc    = getPublisher
+	publishBatchFunc    = publishBatch
+	getSecretStringFunc = getSecretString
 )
 
-func mustGetEnv(name string) (string, error) {
-	value := strings.TrimSpace(os.Getenv(name))
-	if value == "" {
-		return "", fmt.Errorf("missing required environment variable: %s", name)
-	}
-	return value, nil
-}
-
 func parseServiceAccountSecret(secretText string) ([]byte, error) {
 	candidatePayload := []byte(secretText)
 
@@ -112,35 +119,41 @@ func parseServiceAccountSecret(secretText string) ([]byte, error) {
 	return candidatePayload, nil
 }
 
-func getServiceAccountJSON(ctx context.Context, secretARN string) ([]byte, error) {
-	cacheMu.Lock()
-	if cache.secretARN == secretARN && len(cache.credentialsJSON) > 0 && time.Since(cache.credentialsFetched) < credentialsCacheTTL {
-		cached := make([]byte, len(cache.credentialsJSON))
-		copy(cached, cache.credentialsJSON)
-		cacheMu.Unlock()
-		return cached, nil
-	}
-	cacheMu.Unlock()
-
+func getSecretString(ctx context.Context, secretARN string) (string, error) {
 	cfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("load aws sdk config: %w", err)
+		return "", fmt.Errorf("load aws sdk config: %w", err)
 	}
 
 	smClient := secretsmanager.NewFromConfig(cfg)
 	secretValue, err := smClient.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(secretARN)})
 	if err != nil {
-		return nil, fmt.Errorf("get secret value: %w", err)
+		return "", fmt.Errorf("get secret value: %w", err)
 	}
 
-	var secretText string
 	switch {
 	case secretValue.SecretString != nil:
-		secretText = *secretValue.SecretString
+		return *secretValue.SecretString, nil
 	case len(secretValue.SecretBinary) > 0:
-		secretText = string(secretValue.SecretBinary)
+		return string(secretValue.SecretBinary), nil
 	default:
-		return nil, errors.New("secret has no SecretString or SecretBinary payload")
+		return "", errors.New("secret has no SecretString or SecretBinary payload")
+	}
+}
+
+func getServiceAccountJSON(ctx context.Context, secretARN string) ([]byte, error) {
+	cacheMu.Lock()
+	if entry, ok := cache.credentials[secretARN]; ok && len(entry.credentialsJSON) > 0 && time.Since(entry.fetched) < credentialsCacheTTL {
+		cached := make([]byte, len(entry.credentialsJSON))
+		copy(cached, entry.credentialsJSON)
+		cacheMu.Unlock()
+		return cached, nil
+	}
+	cacheMu.Unlock()
+
+	secretText, err := getSecretStringFunc(ctx, secretARN)
+	if err != nil {
+		return nil, err
 	}
 
 	credentialsJSON, err := parseServiceAccountSecret(secretText)
@@ -148,28 +161,26 @@ func getServiceAccountJSON(ctx context.Context, secretARN string) ([]byte, error
 		return nil, err
 	}
 
+	cached := make([]byte, len(credentialsJSON))
+	copy(cached, credentialsJSON)
+
 	cacheMu.Lock()
-	cache.secretARN = secretARN
-	cache.credentialsJSON = make([]byte, len(credentialsJSON))
-	copy(cache.credentialsJSON, credentialsJSON)
-	cache.credentialsFetched = time.Now()
+	if cache.credentials == nil {
+		cache.credentials = make(map[string]cachedCredentials)
+	}
+	cache.credentials[secretARN] = cachedCredentials{credentialsJSON: cached, fetched: time.Now()}
 	cacheMu.Unlock()
 
 	return credentialsJSON, nil
 }
 
 func getPublisher(ctx context.Context, projectID, topicID, secretARN string) (*pubsub.Publisher, error) {
-	topicReference := topicID
+	key := publisherKey{projectID: projectID, topicReference: topicID, secretARN: secretARN}
 
 	cacheMu.Lock()
-	if cache.publisher != nil &&
-		cache.projectID == projectID &&
-		cache.topicReference == topicReference &&
-		cache.secretARN == secretARN &&
-		time.Since(cache.credentialsFetched) < credentialsCacheTTL {
-		publisher := cache.publisher
+	if entry, ok := cache.publishers[key]; ok && time.Since(entry.created) < credentialsCacheTTL {
 		cacheMu.Unlock()
-		return publisher, nil
+		return entry.publisher, nil
 	}
 	cacheMu.Unlock()
 
@@ -183,53 +194,29 @@ func getPublisher(ctx context.Context, projectID, topicID, secretARN string) (*p
 		return nil, fmt.Errorf("create pubsub client: %w", err)
 	}
 
-	publisher := client.Publisher(topicReference)
+	publisher := client.Publisher(key.topicReference)
 
 	cacheMu.Lock()
-	if cache.publisher != nil {
-		cache.publisher.Stop()
-	}
-	if cache.pubsubClient != nil {
-		_ = cache.pubsubClient.Close()
+	if previous, ok := cache.publishers[key]; ok {
+		previous.publisher.Stop()
+		_ = previous.pubsubClient.Close()
 	}
 
-	cache.projectID = projectID
-	cache.topicReference = topicReference
-	cache.secretARN = secretARN
-	cache.pubsubClient = client
-	cache.publisher = publisher
+	if cache.publishers == nil {
+		cache.publishers = make(map[publisherKey]cachedPublisher)
+	}
+	cache.publishers[key] = cachedPublisher{pubsubClient: client, publisher: publisher, created: time.Now()}
 	cacheMu.Unlock()
 
 	return publisher, nil
 }
 
 func decodeCloudWatchPayload(event cloudWatchLogsEvent) (*cloudWatchPayload, error) {
-	if strings.TrimSpace(event.AWSLogs.Data) == "" {
-		return nil, errors.New("event missing awslogs.data")
-	}
-
-	compressed, err := base64.StdEncoding.DecodeString(event.AWSLogs.Data)
-	if err != nil {
-		return nil, fmt.Errorf("decode awslogs.data: %w", err)
-	}
-
-	reader, err := gzip.NewReader(bytes.NewReader(compressed))
-	if err != nil {
-		return nil, fmt.Errorf("open gzip payload: %w", err)
-	}
-	defer reader.Close()
-
-	decoded, err := io.ReadAll(reader)
-	if err != nil {
-		return nil, fmt.Errorf("read gzip payload: %w", err)
-	}
-
-	var payload cloudWatchPayload
-	if err := json.Unmarshal(decoded, &payload); err != nil {
-		return nil, fmt.Errorf("parse cloudwatch payload: %w", err)
-	}
+	return awslogs.Decode(event)
+}
 
-	return &payload, nil
+func encodeCloudWatchPayload(payload *cloudWatchPayload) (cloudWatchLogsEvent, error) {
+	return awslogs.Encode(payload)
 }
 
 func buildOutboundMessages(payload *cloudWatchPayload) ([]outboundMessage, error) {
@@ -246,8 +233,8 @@ func buildOutboundMessages(payload *cloudWatchPayload) ([]outboundMessage, error
 			"subscriptionFilters": payload.SubscriptionFilters,
 			"id":                  event.ID,
 			"timestamp":           event.Timestamp,
-			"message":             event.Message,
 		}
+		setEnvelopeMessage(envelope, event.Message)
 
 		serialized, err := json.Marshal(envelope)
 		if err != nil {
@@ -261,27 +248,14 @@ func buildOutboundMessages(payload *cloudWatchPayload) ([]outboundMessage, error
 				"log_group":  payload.LogGroup,
 				"log_stream": payload.LogStream,
 			},
+			EventID: event.ID,
+			Body:    event.Message,
 		})
 	}
 
 	return messages, nil
 }
 
-func resolveBatchSize() int {
-	batchSize := defaultPubSubBatchMax
-	raw := strings.TrimSpace(os.Getenv("PUBSUB_BATCH_SIZE"))
-	if raw == "" {
-		return batchSize
-	}
-
-	parsed, err := strconv.Atoi(raw)
-	if err != nil || parsed < 1 || parsed > defaultPubSubBatchMax {
-		return batchSize
-	}
-
-	return parsed
-}
-
 func splitBatches(messages []outboundMessage, batchSize int) [][]outboundMessage {
 	batches := make([][]outboundMessage, 0, (len(messages)+batchSize-1)/batchSize)
 	for i := 0; i < len(messages); i += batchSize {
@@ -313,28 +287,36 @@ func publishBatch(ctx context.Context, publisher *pubsub.Publisher, messages []o
 	return nil
 }
 
-func handler(ctx context.Context, event cloudWatchLogsEvent) (map[string]interface{}, error) {
-	projectID, err := mustGetEnv("GCP_PUBSUB_PROJECT_ID")
-	if err != nil {
-		return nil, err
+// publishMessages encrypts, signs and publishes the messages built from
+// payload to its owner's destination. It returns the time of the oldest event
+// published.
+func publishMessages(ctx context.Context, payload *cloudWatchPayload, messages []outboundMessage) (time.Time, error) {
+	if err := encryptMessages(ctx, messages); err != nil {
+		return time.Time{}, err
 	}
 
-	topicID, err := mustGetEnv("GCP_PUBSUB_TOPIC_ID")
-	if err != nil {
-		return nil, err
+	oldest := stampEventTimes(messages, payload, time.Now())
+
+	if err := signMessages(ctx, messages); err != nil {
+		return time.Time{}, err
 	}
 
-	secretARN, err := mustGetEnv("GCP_CREDENTIALS_SECRET_ARN")
+	dest := resolveDestination(tenancy, payload.Owner)
+	out, err := getSinkFunc(ctx, dest)
 	if err != nil {
-		return nil, err
+		return time.Time{}, err
 	}
 
-	payload, err := decodeCloudWatchPayload(event)
-	if err != nil {
-		return nil, err
+	for _, batch := range splitBatches(messages, options.PubSubBatchSize) {
+		if err := out.Publish(ctx, batch); err != nil {
+			return time.Time{}, err
+		}
 	}
+	return oldest, nil
+}
 
-	messages, err := buildOutboundMessages(payload)
+func handler(ctx context.Context, event cloudWatchLogsEvent) (map[string]interface{}, error) {
+	payload, err := decodeCloudWatchPayload(event)
 	if err != nil {
 		return nil, err
 	}
@@ -344,31 +326,127 @@ func handler(ctx context.Context, event cloudWatchLogsEvent) (map[string]interfa
 		messageType = "UNKNOWN"
 	}
 
-	if len(messages) == 0 {
-		return map[string]interface{}{
-			"published_message_count": 0,
-			"message_type":            messageType,
-		}, nil
+	if payload.MessageType == "CONTROL_MESSAGE" {
+		// CloudWatch Logs sends a control message when the subscription filter
+		// is created or its destination is checked, so it is a cheap signal
+		// that the source account is wired to this function.
+		log.Printf("received subscription control message for log group %q from owner %s", payload.LogGroup, payload.Owner)
+		emitMetrics(options.MetricsNamespace, map[string]string{"LogGroup": payload.LogGroup}, map[string]metricValue{
+			"SubscriptionControlMessages": {Value: 1, Unit: "Count"},
+		})
 	}
 
-	publisher, err := getPublisherFunc(ctx, projectID, topicID, secretARN)
-	if err != nil {
-		return nil, err
+	mark, hasMark := highWaterMark{}, false
+	if payload.MessageType != "CONTROL_MESSAGE" {
+		mark, hasMark = newestEvent(payload, time.Now())
 	}
 
-	batchSize := resolveBatchSize()
-	for _, batch := range splitBatches(messages, batchSize) {
-		if err := publishBatchFunc(ctx, publisher, batch); err != nil {
-			return nil, err
+	if len(payload.LogEvents) > 0 {
+		if allowed, reason := checkPayloadSource(tenancy, options.AWSRegion, payload); !allowed {
+			if options.UnexpectedOwnerAction == unexpectedOwnerQuarantine {
+				if err := quarantinePayload(ctx, event, payload, reason); err != nil {
+					return nil, err
+				}
+			}
+			log.Printf("%s %d log events from %s: %s", options.UnexpectedOwnerAction, len(payload.LogEvents), payload.LogGroup, reason)
+			recordHandled(ctx, mark, hasMark)
+
+			return map[string]interface{}{
+				"published_message_count": 0,
+				"message_type":            messageType,
+				"rejected_message_count":  len(payload.LogEvents),
+				"rejection_reason":        reason,
+			}, nil
 		}
 	}
 
-	return map[string]interface{}{
-		"published_message_count": len(messages),
+	rates, stats := sampleLogEvents(samplingRules, payload, time.Now())
+	if stats.SampledOut > 0 || stats.RateLimited > 0 {
+		log.Printf("dropped log events for %s: sampled_out=%d rate_limited=%d", payload.LogGroup, stats.SampledOut, stats.RateLimited)
+	}
+	if len(samplingRules) > 0 && len(payload.LogEvents)+stats.SampledOut+stats.RateLimited > 0 {
+		emitMetrics(options.MetricsNamespace, map[string]string{"LogGroup": payload.LogGroup}, map[string]metricValue{
+			"SampledOutEvents":  {Value: float64(stats.SampledOut), Unit: "Count"},
+			"RateLimitedEvents": {Value: float64(stats.RateLimited), Unit: "Count"},
+		})
+	}
+
+	messages, err := buildOutboundMessages(payload)
+	if err != nil {
+		return nil, err
+	}
+	stampSampleRates(messages, rates)
+
+	response := map[string]interface{}{
+		"published_message_count": 0,
 		"message_type":            messageType,
-	}, nil
+		"sampled_out_count":       stats.SampledOut,
+		"rate_limited_count":      stats.RateLimited,
+	}
+
+	if len(messages) == 0 {
+		recordHandled(ctx, mark, hasMark)
+		return response, nil
+	}
+
+	oldest, err := publishMessages(ctx, payload, messages)
+	if err != nil {
+		return nil, err
+	}
+
+	response["published_message_count"] = len(messages)
+	emitMetrics(options.MetricsNamespace, map[string]string{"LogGroup": payload.LogGroup}, map[string]metricValue{
+		"IngestionLag": {Value: float64(max(time.Since(oldest), 0).Milliseconds()), Unit: "Milliseconds"},
+	})
+	recordHandled(ctx, mark, hasMark)
+	return response, nil
 }
 
 func main() {
-	lambda.Start(handler)
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	var err error
+	options, err = loadOptions(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if options.ValidateConfig {
+		if options.ValidateConfigFormat == "json" {
+			// Terraform's external data source wants an object of strings.
+			if err := json.NewEncoder(os.Stdout).Encode(map[string]string{"summary": options.summary()}); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		fmt.Println("configuration is valid:", options.summary())
+		return
+	}
+
+	credentialsCacheTTL = options.CredentialsCacheTTL
+	// Already validated by loadOptions.
+	samplingRules, _ = parseSamplingRules(options.SamplingRules)
+	tenancy, _ = parseTenancy(options)
+	promotedFields, _ = parsePromotedFields(options.PromoteFields)
+	eventTimeFields = splitList(options.EventTimeFields)
+	splunk, _ = parseSplunkConfig(options)
+	loki, _ = parseLokiConfig(options)
+	lokiLabelValues.limit = options.LokiMaxLabelValues
+	esIndex, _ = parseESIndex(options.ESIndex)
+	syslogAppName, syslogHostname, _ = parseSyslogTemplates(options)
+	if options.EncryptionMode == encryptionModeRSA {
+		encryptionPublicKey, _ = envelope.ParseRSAPublicKey([]byte(options.EncryptionPublicKey))
+	}
+	log.Printf("starting %s with configuration: %s", options.Mode, options.summary())
+
+	switch options.Mode {
+	case bridgeModeCanary:
+		lambda.Start(canaryHandler)
+	case bridgeModeGapCheck:
+		lambda.Start(gapCheckHandler)
+	case bridgeModeReplay:
+		lambda.Start(replay.DirectHandler(publishReplayedEvent))
+	default:
+		lambda.Start(handler)
+	}
 }
@@ -7,9 +7,13 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
 	pubsub "cloud.google.com/go/pubsub/v2"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -19,9 +23,62 @@ func resetMainTestState() {
 	cache = cacheState{}
 	cacheMu.Unlock()
 
+	options = OptionsStruct{}
 	credentialsCacheTTL = defaultCredentialsCacheTTL
 	getPublisherFunc = getPublisher
 	publishBatchFunc = publishBatch
+	getSecretStringFunc = getSecretString
+	newDataKeyFunc = newDataKey
+	encryptionPublicKey = nil
+	samplingRules = nil
+	tenancy = tenancyConfig{}
+	getSQSClientFunc = getSQSClient
+	metricsWriter = os.Stdout
+	putLogEventFunc = putLogEvent
+	getCanaryReceiverFunc = getCanaryReceiver
+	cloudWatchLogsClientOnce = sync.Once{}
+	cloudWatchLogsClient = nil
+	cloudWatchLogsClientErr = nil
+	getCloudWatchLogsClientFunc = getCloudWatchLogsClient
+	getStateStoreFunc = getStateStore
+	getS3ClientFunc = getS3Client
+	loadHighWaterMarksFunc = loadHighWaterMarks
+	describeRecentLogStreamsFunc = describeRecentLogStreams
+	promotedFields = nil
+	eventTimeFields = nil
+	getSinkFunc = getSink
+	newKafkaProducerFunc = newKafkaProducer
+	cachedKafkaProducer = nil
+	splunk = splunkConfig{}
+	splunkClient = nil
+	splunkAckPollInterval = time.Second
+	otlpHTTPClient = nil
+	otlpGRPCConn = nil
+	loki = lokiConfig{}
+	lokiLabelValues = &lokiCardinality{limit: 50}
+	lokiHTTPClient = nil
+	esIndex = ""
+	esHTTPClient = nil
+	esAWSConfig = nil
+	syslogAppName = ""
+	syslogHostname = ""
+	syslogConn = nil
+	dialSyslogFunc = dialSyslog
+}
+
+func testOptions() OptionsStruct {
+	return OptionsStruct{
+		Mode:                  bridgeModeBridge,
+		MessageFormat:         messageFormatString,
+		Sink:                  sinkPubSub,
+		PubSubProjectID:       "proj",
+		PubSubTopicID:         "topic",
+		CredentialsSecretARN:  "arn:aws:secretsmanager:us-east-2:111111111111:secret:x",
+		PubSubBatchSize:       defaultPubSubBatchMax,
+		CredentialsCacheTTL:   defaultCredentialsCacheTTL,
+		EncryptionMode:        encryptionModeNone,
+		UnexpectedOwnerAction: unexpectedOwnerReject,
+	}
 }
 
 func makeCloudWatchEvent(t *testing.T, payload map[string]interface{}) cloudWatchLogsEvent {
@@ -106,11 +163,7 @@ func TestBuildOutboundMessages(t *testing.T) {
 		LogGroup:    "group",
 		LogStream:   "stream",
 		MessageType: "DATA_MESSAGE",
-		LogEvents: []struct {
-			ID        string `json:"id"`
-			Timestamp int64  `json:"timestamp"`
-			Message   string `json:"message"`
-		}{
+		LogEvents: []cloudWatchLogEvent{
 			{ID: "1", Timestamp: 10, Message: "hello"},
 		},
 	}
@@ -125,17 +178,6 @@ func TestBuildOutboundMessages(t *testing.T) {
 	assert.Nil(t, control)
 }
 
-func TestResolveBatchSize(t *testing.T) {
-	t.Setenv("PUBSUB_BATCH_SIZE", "5")
-	assert.Equal(t, 5, resolveBatchSize())
-
-	t.Setenv("PUBSUB_BATCH_SIZE", "2000")
-	assert.Equal(t, defaultPubSubBatchMax, resolveBatchSize())
-
-	t.Setenv("PUBSUB_BATCH_SIZE", "nope")
-	assert.Equal(t, defaultPubSubBatchMax, resolveBatchSize())
-}
-
 func TestSplitBatches(t *testing.T) {
 	messages := []outboundMessage{{}, {}, {}, {}, {}}
 	batches := splitBatches(messages, 2)
@@ -147,10 +189,8 @@ func TestHandler(t *testing.T) {
 	resetMainTestState()
 	t.Cleanup(resetMainTestState)
 
-	t.Setenv("GCP_PUBSUB_PROJECT_ID", "proj")
-	t.Setenv("GCP_PUBSUB_TOPIC_ID", "topic")
-	t.Setenv("GCP_CREDENTIALS_SECRET_ARN", "arn:aws:secretsmanager:us-east-2:111111111111:secret:x")
-	t.Setenv("PUBSUB_BATCH_SIZE", "2")
+	options = testOptions()
+	options.PubSubBatchSize = 2
 
 	ev := makeCloudWatchEvent(t, map[string]interface{}{
 		"owner":       "123",
@@ -184,9 +224,7 @@ func TestHandlerPublishError(t *testing.T) {
 	resetMainTestState()
 	t.Cleanup(resetMainTestState)
 
-	t.Setenv("GCP_PUBSUB_PROJECT_ID", "proj")
-	t.Setenv("GCP_PUBSUB_TOPIC_ID", "topic")
-	t.Setenv("GCP_CREDENTIALS_SECRET_ARN", "arn:aws:secretsmanager:us-east-2:111111111111:secret:x")
+	options = testOptions()
 
 	ev := makeCloudWatchEvent(t, map[string]interface{}{
 		"owner":       "123",
@@ -207,18 +245,120 @@ func TestHandlerPublishError(t *testing.T) {
 	require.Error(t, err)
 }
 
-func TestHandlerMissingEnv(t *testing.T) {
+func TestHandlerControlMessageMetric(t *testing.T) {
 	resetMainTestState()
 	t.Cleanup(resetMainTestState)
 
-	t.Setenv("GCP_PUBSUB_PROJECT_ID", "")
-	t.Setenv("GCP_PUBSUB_TOPIC_ID", "topic")
-	t.Setenv("GCP_CREDENTIALS_SECRET_ARN", "arn:aws:secretsmanager:us-east-2:111111111111:secret:x")
+	options = testOptions()
+	options.MetricsNamespace = "Test"
+
+	var metrics bytes.Buffer
+	metricsWriter = &metrics
 
 	ev := makeCloudWatchEvent(t, map[string]interface{}{
+		"owner":       "CloudwatchLogs",
+		"logGroup":    "",
+		"logStream":   "",
 		"messageType": "CONTROL_MESSAGE",
+		"logEvents": []map[string]interface{}{
+			{"id": "", "timestamp": 10, "message": "CWL CONTROL MESSAGE: Checking health of destination Firehose."},
+		},
 	})
 
-	_, err := handler(context.Background(), ev)
-	require.Error(t, err)
+	getPublisherFunc = func(ctx context.Context, projectID, topicID, secretARN string) (*pubsub.Publisher, error) {
+		t.Fatal("control messages must not be published")
+		return nil, nil
+	}
+
+	resp, err := handler(context.Background(), ev)
+	require.NoError(t, err)
+	assert.Equal(t, 0, resp["published_message_count"])
+	assert.Equal(t, "CONTROL_MESSAGE", resp["message_type"])
+	assert.Contains(t, metrics.String(), `"SubscriptionControlMessages":1`)
+}
+
+func TestHandlerRecordsHighWaterMark(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	options = testOptions()
+	options.StateTableName = "marks"
+
+	ev := makeCloudWatchEvent(t, map[string]interface{}{
+		"owner":       "123",
+		"logGroup":    "group",
+		"logStream":   "stream",
+		"messageType": "DATA_MESSAGE",
+		"logEvents": []map[string]interface{}{
+			{"id": "1", "timestamp": 10, "message": "m1"},
+			{"id": "2", "timestamp": 11, "message": "m2"},
+		},
+	})
+
+	getPublisherFunc = func(ctx context.Context, projectID, topicID, secretARN string) (*pubsub.Publisher, error) {
+		return nil, nil
+	}
+	publishBatchFunc = func(ctx context.Context, publisher *pubsub.Publisher, messages []outboundMessage) error {
+		return nil
+	}
+	store := &fakeStateStore{err: errors.New("unavailable")}
+	getStateStoreFunc = func(ctx context.Context) (stateStore, error) { return store, nil }
+
+	resp, err := handler(context.Background(), ev)
+	require.NoError(t, err, "state store failures must not fail a published invocation")
+	assert.Equal(t, 2, resp["published_message_count"])
+	require.Len(t, store.updates, 1)
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "2"}, store.updates[0].ExpressionAttributeValues[":id"])
+}
+
+func TestHandlerRecordsHighWaterMarkForDroppedEvents(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	options = testOptions()
+	options.StateTableName = "marks"
+
+	ev := makeCloudWatchEvent(t, map[string]interface{}{
+		"owner":       "123",
+		"logGroup":    "group",
+		"logStream":   "stream",
+		"messageType": "DATA_MESSAGE",
+		"logEvents": []map[string]interface{}{
+			{"id": "1", "timestamp": 10, "message": "m1"},
+			{"id": "2", "timestamp": 11, "message": "m2"},
+		},
+	})
+
+	getPublisherFunc = func(ctx context.Context, projectID, topicID, secretARN string) (*pubsub.Publisher, error) {
+		t.Fatal("dropped events must not be published")
+		return nil, nil
+	}
+
+	t.Run("sampled out", func(t *testing.T) {
+		var err error
+		samplingRules, err = parseSamplingRules(`[{"log_group":"group","sample_rate":0}]`)
+		require.NoError(t, err)
+		t.Cleanup(func() { samplingRules = nil })
+		store := &fakeStateStore{}
+		getStateStoreFunc = func(ctx context.Context) (stateStore, error) { return store, nil }
+
+		resp, err := handler(context.Background(), ev)
+		require.NoError(t, err)
+		assert.Equal(t, 2, resp["sampled_out_count"])
+		require.Len(t, store.updates, 1, "a fully sampled out stream is still being delivered")
+		assert.Equal(t, &types.AttributeValueMemberS{Value: "2"}, store.updates[0].ExpressionAttributeValues[":id"])
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		tenancy = tenancyConfig{allowedOwners: map[string]bool{"111111111111": true}}
+		t.Cleanup(func() { tenancy = tenancyConfig{} })
+		store := &fakeStateStore{}
+		getStateStoreFunc = func(ctx context.Context) (stateStore, error) { return store, nil }
+
+		resp, err := handler(context.Background(), ev)
+		require.NoError(t, err)
+		assert.Equal(t, 2, resp["rejected_message_count"])
+		require.Len(t, store.updates, 1)
+		assert.Equal(t, &types.AttributeValueMemberS{Value: "2"}, store.updates[0].ExpressionAttributeValues[":id"])
+	})
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	messageFormatString = "string"
+	messageFormatJSON   = "json"
+)
+
+// envelopeFields are the keys the bridge itself writes into every envelope.
+// Promoted fields may not shadow them.
+var envelopeFields = map[string]bool{
+	"owner":               true,
+	"logGroup":            true,
+	"logStream":           true,
+	"subscriptionFilters": true,
+	"id":                  true,
+	"timestamp":           true,
+	"message":             true,
+	"message_raw":         true,
+}
+
+// promotedFields lists the top-level keys of JSON log bodies that are copied
+// onto the envelope in json message format.
+var promotedFields []string
+
+func parsePromotedFields(raw string) ([]string, error) {
+	fields := splitList(raw)
+	for _, field := range fields {
+		if envelopeFields[field] {
+			return nil, fmt.Errorf("PROMOTE_FIELDS entry %q collides with an envelope field", field)
+		}
+	}
+	return fields, nil
+}
+
+// setEnvelopeMessage stores the log body on envelope. In string format, the
+// original behaviour, the body is always a string under "message". In json
+// format a body that is a JSON object is embedded as "message", with any
+// promoted fields copied to the top level, and anything else is kept verbatim
+// under "message_raw".
+func setEnvelopeMessage(envelope map[string]interface{}, message string) {
+	if options.MessageFormat != messageFormatJSON {
+		envelope["message"] = message
+		return
+	}
+
+	trimmed := bytes.TrimSpace([]byte(message))
+	var body map[string]json.RawMessage
+	if len(trimmed) == 0 || trimmed[0] != '{' || json.Unmarshal(trimmed, &body) != nil {
+		envelope["message_raw"] = message
+		return
+	}
+
+	envelope["message"] = json.RawMessage(trimmed)
+	for _, field := range promotedFields {
+		if value, ok := body[field]; ok {
+			envelope[field] = value
+		}
+	}
+}
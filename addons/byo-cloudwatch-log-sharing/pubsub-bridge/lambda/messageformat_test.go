@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePromotedFields(t *testing.T) {
+	fields, err := parsePromotedFields("level, ts ,component")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"level", "ts", "component"}, fields)
+
+	_, err = parsePromotedFields("level,timestamp")
+	require.ErrorContains(t, err, "timestamp")
+}
+
+func TestSetEnvelopeMessage(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	options = testOptions()
+
+	envelope := map[string]interface{}{}
+	setEnvelopeMessage(envelope, `{"level":"info"}`)
+	assert.Equal(t, `{"level":"info"}`, envelope["message"], "string format keeps the body as a string")
+
+	options.MessageFormat = messageFormatJSON
+	promotedFields = []string{"level", "ts", "component"}
+
+	envelope = map[string]interface{}{}
+	setEnvelopeMessage(envelope, ` {"level":"warn","ts":"2024-01-01T00:00:00Z","msg":"hi"} `)
+	serialized, err := json.Marshal(envelope)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"message": {"level":"warn","ts":"2024-01-01T00:00:00Z","msg":"hi"},
+		"level": "warn",
+		"ts": "2024-01-01T00:00:00Z"
+	}`, string(serialized))
+
+	for _, raw := range []string{"plain text", `[1,2]`, `{"truncated":`, ""} {
+		envelope = map[string]interface{}{}
+		setEnvelopeMessage(envelope, raw)
+		assert.Equal(t, raw, envelope["message_raw"])
+		assert.NotContains(t, envelope, "message")
+	}
+}
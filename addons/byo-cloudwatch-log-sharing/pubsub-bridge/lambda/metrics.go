@@ -0,0 +1,17 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/fleetdm/fleet/terraform/addons/byo-cloudwatch-log-sharing/pubsub-bridge/lambda/emf"
+)
+
+type metricValue = emf.Value
+
+var metricsWriter io.Writer = os.Stdout
+
+// emitMetrics writes a CloudWatch embedded metric format record to stdout.
+func emitMetrics(namespace string, dimensions map[string]string, metrics map[string]metricValue) {
+	emf.Write(metricsWriter, namespace, dimensions, metrics)
+}
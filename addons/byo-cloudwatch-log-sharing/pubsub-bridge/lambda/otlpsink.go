@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcgzip "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	otlpProtocolHTTP = "http/protobuf"
+	otlpProtocolGRPC = "grpc"
+
+	otlpScopeName = "fleet-pubsub-bridge"
+)
+
+// otlpHTTPError is a non-2xx OTLP/HTTP response.
+type otlpHTTPError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *otlpHTTPError) Error() string {
+	return fmt.Sprintf("otlp endpoint returned HTTP %d: %s", e.StatusCode, e.Message)
+}
+
+var (
+	otlpMu         sync.Mutex
+	otlpHTTPClient *http.Client
+	otlpGRPCConn   *grpc.ClientConn
+)
+
+type otlpSink struct {
+	headers map[string]string
+}
+
+func getOTLPSink(ctx context.Context) (sink, error) {
+	s := otlpSink{}
+	if options.OTLPHeadersSecretARN != "" {
+		secretText, err := getCachedSecretString(ctx, options.OTLPHeadersSecretARN)
+		if err != nil {
+			return nil, fmt.Errorf("get otlp headers: %w", err)
+		}
+		if err := json.Unmarshal([]byte(secretText), &s.headers); err != nil {
+			return nil, fmt.Errorf("parse otlp headers secret: %w", err)
+		}
+	}
+	return s, nil
+}
+
+func (s otlpSink) Publish(ctx context.Context, messages []outboundMessage) error {
+	request := otlpExportRequest(messages, time.Now())
+
+	backoff := options.OTLPRetryBackoff
+	var err error
+	for attempt := 0; attempt <= options.OTLPMaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("export to otlp endpoint: %w", errors.Join(err, ctx.Err()))
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		var rejected int64
+		if options.OTLPProtocol == otlpProtocolGRPC {
+			rejected, err = s.exportGRPC(ctx, request)
+		} else {
+			rejected, err = s.exportHTTP(ctx, request)
+		}
+		if err == nil {
+			// Partial success is final per the OTLP specification; retrying
+			// would only be rejected again.
+			if rejected > 0 {
+				log.Printf("otlp endpoint rejected %d of %d log records", rejected, len(messages))
+			}
+			return nil
+		}
+		if !otlpRetriable(err) {
+			break
+		}
+	}
+	return fmt.Errorf("export to otlp endpoint: %w", err)
+}
+
+// otlpRetriable follows the OTLP exporter specification's list of retryable
+// HTTP statuses and gRPC codes. Transport errors are retried.
+func otlpRetriable(err error) bool {
+	var httpErr *otlpHTTPError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if st, ok := status.FromError(err); ok {
+		switch st.Code() {
+		case codes.Canceled, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.OutOfRange, codes.Unavailable, codes.DataLoss:
+			return true
+		}
+		return false
+	}
+	return true
+}
+
+func (s otlpSink) exportHTTP(ctx context.Context, request *collogspb.ExportLogsServiceRequest) (int64, error) {
+	body, err := proto.Marshal(request)
+	if err != nil {
+		return 0, fmt.Errorf("marshal otlp request: %w", err)
+	}
+
+	contentEncoding := ""
+	if options.OTLPCompression == "gzip" {
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		if _, err := gz.Write(body); err != nil {
+			return 0, err
+		}
+		if err := gz.Close(); err != nil {
+			return 0, err
+		}
+		body, contentEncoding = compressed.Bytes(), "gzip"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, otlpHTTPURL(options.OTLPEndpoint), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	for key, value := range s.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := getOTLPHTTPClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, &otlpHTTPError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(respBody))}
+	}
+
+	var exportResp collogspb.ExportLogsServiceResponse
+	if err := proto.Unmarshal(respBody, &exportResp); err != nil {
+		return 0, fmt.Errorf("decode otlp response: %w", err)
+	}
+	return exportResp.GetPartialSuccess().GetRejectedLogRecords(), nil
+}
+
+func (s otlpSink) exportGRPC(ctx context.Context, request *collogspb.ExportLogsServiceRequest) (int64, error) {
+	conn, err := getOTLPGRPCConn()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(s.headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(s.headers))
+	}
+	ctx, cancel := context.WithTimeout(ctx, options.OTLPTimeout)
+	defer cancel()
+
+	var callOptions []grpc.CallOption
+	if options.OTLPCompression == "gzip" {
+		callOptions = append(callOptions, grpc.UseCompressor(grpcgzip.Name))
+	}
+
+	resp, err := collogspb.NewLogsServiceClient(conn).Export(ctx, request, callOptions...)
+	if err != nil {
+		return 0, err
+	}
+	return resp.GetPartialSuccess().GetRejectedLogRecords(), nil
+}
+
+// otlpHTTPURL appends the standard logs path to an endpoint given without
+// one, matching OTEL_EXPORTER_OTLP_ENDPOINT semantics.
+func otlpHTTPURL(endpoint string) string {
+	endpoint = strings.TrimRight(endpoint, "/")
+	if strings.HasSuffix(endpoint, "/v1/logs") {
+		return endpoint
+	}
+	return endpoint + "/v1/logs"
+}
+
+func getOTLPHTTPClient() *http.Client {
+	otlpMu.Lock()
+	defer otlpMu.Unlock()
+
+	if otlpHTTPClient == nil {
+		// Already validated by loadOptions.
+		tlsConfig, _ := newTLSConfig("OTLP_TLS_CA_PEM", options.OTLPTLSCAPEM)
+		otlpHTTPClient = &http.Client{
+			Timeout: options.OTLPTimeout,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		}
+	}
+	return otlpHTTPClient
+}
+
+func getOTLPGRPCConn() (*grpc.ClientConn, error) {
+	otlpMu.Lock()
+	defer otlpMu.Unlock()
+
+	if otlpGRPCConn != nil {
+		return otlpGRPCConn, nil
+	}
+
+	transport := insecure.NewCredentials()
+	if !options.OTLPInsecure {
+		tlsConfig, err := newTLSConfig("OTLP_TLS_CA_PEM", options.OTLPTLSCAPEM)
+		if err != nil {
+			return nil, err
+		}
+		transport = credentials.NewTLS(tlsConfig)
+	}
+
+	conn, err := grpc.NewClient(options.OTLPEndpoint, grpc.WithTransportCredentials(transport))
+	if err != nil {
+		return nil, fmt.Errorf("create otlp grpc client: %w", err)
+	}
+	otlpGRPCConn = conn
+	return conn, nil
+}
+
+// otlpExportRequest groups messages into one ResourceLogs per source log
+// stream so that the account, log group and log stream are resource
+// attributes rather than repeated on every record.
+func otlpExportRequest(messages []outboundMessage, now time.Time) *collogspb.ExportLogsServiceRequest {
+	type streamKey struct{ owner, logGroup, logStream string }
+
+	request := &collogspb.ExportLogsServiceRequest{}
+	scopes := map[streamKey]*logspb.ScopeLogs{}
+	for _, message := range messages {
+		key := streamKey{
+			owner:     message.Attributes["owner"],
+			logGroup:  message.Attributes["log_group"],
+			logStream: message.Attributes["log_stream"],
+		}
+
+		scope, ok := scopes[key]
+		if !ok {
+			scope = &logspb.ScopeLogs{Scope: &commonpb.InstrumentationScope{Name: otlpScopeName}}
+			scopes[key] = scope
+			request.ResourceLogs = append(request.ResourceLogs, &logspb.ResourceLogs{
+				Resource:  &resourcepb.Resource{Attributes: otlpResourceAttributes(key.owner, key.logGroup, key.logStream)},
+				ScopeLogs: []*logspb.ScopeLogs{scope},
+			})
+		}
+		scope.LogRecords = append(scope.LogRecords, otlpLogRecord(message, now))
+	}
+	return request
+}
+
+func otlpResourceAttributes(owner, logGroup, logStream string) []*commonpb.KeyValue {
+	attributes := []*commonpb.KeyValue{
+		otlpString("cloud.provider", "aws"),
+		otlpString("cloud.account.id", owner),
+		otlpStringArray("aws.log.group.names", logGroup),
+		otlpStringArray("aws.log.stream.names", logStream),
+		otlpString("service.name", options.OTLPServiceName),
+	}
+	if options.AWSRegion != "" {
+		attributes = append(attributes, otlpString("cloud.region", options.AWSRegion))
+	}
+	if options.FleetEnvironment != "" {
+		attributes = append(attributes, otlpString("deployment.environment.name", options.FleetEnvironment))
+	}
+	return attributes
+}
+
+// otlpLogRecord maps a log event to a LogRecord. The body is the log line,
+// or the published envelope when the envelope is encrypted or signed so that
+// consumers can still decrypt and verify it.
+func otlpLogRecord(message outboundMessage, now time.Time) *logspb.LogRecord {
+	record := &logspb.LogRecord{
+		ObservedTimeUnixNano: uint64(now.UnixNano()),
+	}
+	if eventTime, err := time.Parse(time.RFC3339Nano, message.Attributes["event_time"]); err == nil {
+		record.TimeUnixNano = uint64(eventTime.UnixNano())
+	}
+
+	body := parseLogBody(message.Body)
+	switch {
+	case options.EncryptionMode != encryptionModeNone:
+		record.Body = &commonpb.AnyValue{Value: &commonpb.AnyValue_BytesValue{BytesValue: message.Data}}
+	case options.SigningSecretARN != "":
+		record.Body = &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: string(message.Data)}}
+	default:
+		record.Body = &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: message.Body}}
+	}
+	record.SeverityNumber, record.SeverityText = parseSeverity(message.Body, body)
+
+	keys := make([]string, 0, len(message.Attributes))
+	for key := range message.Attributes {
+		switch key {
+		case "owner", "log_group", "log_stream":
+			// Carried as resource attributes.
+		default:
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		record.Attributes = append(record.Attributes, otlpString(key, message.Attributes[key]))
+	}
+	if message.EventID != "" {
+		record.Attributes = append(record.Attributes, otlpString("log.record.uid", message.EventID))
+	}
+	return record
+}
+
+var (
+	severityFields = []string{"level", "severity", "severity_text", "lvl", "log_level"}
+
+	textSeverity = regexp.MustCompile(`(?i)^\W*(trace|debug|info|notice|warn|warning|error|fatal|critical|panic)\b|\blevel=["']?(\w+)`)
+)
+
+// parseSeverity reads the severity of a log line from the first of the
+// common level fields of a JSON body, or from a leading level word or a
+// logfmt level= pair. osquery's numeric glog severities (0 to 3) are
+// understood too.
+func parseSeverity(line string, body map[string]interface{}) (logspb.SeverityNumber, string) {
+	for _, field := range severityFields {
+		switch value := body[field].(type) {
+		case string:
+			if number := severityNumber(value); number != logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED {
+				return number, value
+			}
+		case float64:
+			switch value {
+			case 0:
+				return logspb.SeverityNumber_SEVERITY_NUMBER_INFO, "INFO"
+			case 1:
+				return logspb.SeverityNumber_SEVERITY_NUMBER_WARN, "WARNING"
+			case 2:
+				return logspb.SeverityNumber_SEVERITY_NUMBER_ERROR, "ERROR"
+			case 3:
+				return logspb.SeverityNumber_SEVERITY_NUMBER_FATAL, "FATAL"
+			}
+		}
+	}
+
+	if body == nil {
+		if match := textSeverity.FindStringSubmatch(line); match != nil {
+			text := match[1] + match[2]
+			if number := severityNumber(text); number != logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED {
+				return number, text
+			}
+		}
+	}
+	return logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED, ""
+}
+
+func severityNumber(text string) logspb.SeverityNumber {
+	switch strings.ToLower(strings.TrimSpace(text)) {
+	case "trace":
+		return logspb.SeverityNumber_SEVERITY_NUMBER_TRACE
+	case "debug":
+		return logspb.SeverityNumber_SEVERITY_NUMBER_DEBUG
+	case "info", "information":
+		return logspb.SeverityNumber_SEVERITY_NUMBER_INFO
+	case "notice":
+		return logspb.SeverityNumber_SEVERITY_NUMBER_INFO2
+	case "warn", "warning":
+		return logspb.SeverityNumber_SEVERITY_NUMBER_WARN
+	case "error", "err":
+		return logspb.SeverityNumber_SEVERITY_NUMBER_ERROR
+	case "fatal", "critical", "crit", "panic", "emerg", "alert":
+		return logspb.SeverityNumber_SEVERITY_NUMBER_FATAL
+	}
+	return logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED
+}
+
+func otlpString(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func otlpStringArray(key string, values ...string) *commonpb.KeyValue {
+	array := &commonpb.ArrayValue{}
+	for _, value := range values {
+		array.Values = append(array.Values, &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}})
+	}
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: array}}}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func otlpTestOptions(endpoint string) OptionsStruct {
+	opts := testOptions()
+	opts.Sink = sinkOTLP
+	opts.OTLPEndpoint = endpoint
+	opts.OTLPProtocol = otlpProtocolHTTP
+	opts.OTLPInsecure = true
+	opts.OTLPCompression = "gzip"
+	opts.OTLPServiceName = "fleet"
+	opts.OTLPTimeout = 5 * time.Second
+	opts.OTLPMaxRetries = 2
+	opts.OTLPRetryBackoff = time.Millisecond
+	return opts
+}
+
+func otlpTestMessages() []outboundMessage {
+	return []outboundMessage{
+		{
+			Data:       []byte(`{"message":"a"}`),
+			Attributes: map[string]string{"owner": "111", "log_group": "/fleet/server", "log_stream": "s1", "event_time": "2024-05-01T10:00:00Z"},
+			EventID:    "e1",
+			Body:       `{"level":"error","msg":"boom"}`,
+		},
+		{
+			Data:       []byte(`{"message":"b"}`),
+			Attributes: map[string]string{"owner": "111", "log_group": "/fleet/server", "log_stream": "s2"},
+			EventID:    "e2",
+			Body:       "plain line",
+		},
+		{
+			Data:       []byte(`{"message":"c"}`),
+			Attributes: map[string]string{"owner": "111", "log_group": "/fleet/server", "log_stream": "s1"},
+			EventID:    "e3",
+			Body:       "level=warn msg=slow",
+		},
+	}
+}
+
+func TestParseSeverity(t *testing.T) {
+	cases := []struct {
+		line string
+		want logspb.SeverityNumber
+		text string
+	}{
+		{`{"level":"info","msg":"x"}`, logspb.SeverityNumber_SEVERITY_NUMBER_INFO, "info"},
+		{`{"severity":2,"message":"osquery"}`, logspb.SeverityNumber_SEVERITY_NUMBER_ERROR, "ERROR"},
+		{`{"severity":"bogus","level":"WARN"}`, logspb.SeverityNumber_SEVERITY_NUMBER_WARN, "WARN"},
+		{`ts=1 level=debug msg=x`, logspb.SeverityNumber_SEVERITY_NUMBER_DEBUG, "debug"},
+		{`[ERROR] failed to connect`, logspb.SeverityNumber_SEVERITY_NUMBER_ERROR, "ERROR"},
+		{`information about the host`, logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED, ""},
+		{`{"msg":"level=error is not read from JSON strings"}`, logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED, ""},
+	}
+	for _, c := range cases {
+		number, text := parseSeverity(c.line, parseLogBody(c.line))
+		assert.Equal(t, c.want, number, c.line)
+		assert.Equal(t, c.text, text, c.line)
+	}
+}
+
+func TestOTLPExportRequest(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+	options = otlpTestOptions("http://127.0.0.1:4318")
+	options.AWSRegion = "us-east-2"
+	options.FleetEnvironment = "production"
+
+	now := time.Unix(1714557700, 0)
+	request := otlpExportRequest(otlpTestMessages(), now)
+	require.Len(t, request.ResourceLogs, 2, "one resource per log stream")
+
+	resource := map[string]string{}
+	for _, kv := range request.ResourceLogs[0].Resource.Attributes {
+		if array := kv.Value.GetArrayValue(); array != nil {
+			resource[kv.Key] = array.Values[0].GetStringValue()
+			continue
+		}
+		resource[kv.Key] = kv.Value.GetStringValue()
+	}
+	assert.Equal(t, map[string]string{
+		"cloud.provider":              "aws",
+		"cloud.account.id":            "111",
+		"cloud.region":                "us-east-2",
+		"aws.log.group.names":         "/fleet/server",
+		"aws.log.stream.names":        "s1",
+		"service.name":                "fleet",
+		"deployment.environment.name": "production",
+	}, resource)
+
+	records := request.ResourceLogs[0].ScopeLogs[0].LogRecords
+	require.Len(t, records, 2)
+	assert.Equal(t, otlpScopeName, request.ResourceLogs[0].ScopeLogs[0].Scope.Name)
+	assert.Equal(t, uint64(1714557600*time.Second), records[0].TimeUnixNano)
+	assert.Equal(t, uint64(now.UnixNano()), records[0].ObservedTimeUnixNano)
+	assert.Equal(t, logspb.SeverityNumber_SEVERITY_NUMBER_ERROR, records[0].SeverityNumber)
+	assert.Equal(t, `{"level":"error","msg":"boom"}`, records[0].Body.GetStringValue())
+	assert.Equal(t, logspb.SeverityNumber_SEVERITY_NUMBER_WARN, records[1].SeverityNumber)
+
+	var keys []string
+	for _, kv := range records[0].Attributes {
+		keys = append(keys, kv.Key)
+	}
+	assert.Equal(t, []string{"event_time", "log.record.uid"}, keys)
+
+	options.SigningSecretARN = "arn:aws:secretsmanager:us-east-2:111111111111:secret:signing"
+	record := otlpLogRecord(otlpTestMessages()[0], now)
+	assert.Equal(t, `{"message":"a"}`, record.Body.GetStringValue(), "signed envelopes are sent as published")
+
+	options.EncryptionMode = encryptionModeKMS
+	record = otlpLogRecord(otlpTestMessages()[0], now)
+	assert.Equal(t, []byte(`{"message":"a"}`), record.Body.GetBytesValue())
+}
+
+// fakeOTLPReceiver is an OTLP/HTTP logs receiver.
+type fakeOTLPReceiver struct {
+	mu       sync.Mutex
+	requests []*collogspb.ExportLogsServiceRequest
+	headers  http.Header
+	statuses []int
+	rejected int64
+}
+
+func (f *fakeOTLPReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path != "/v1/logs" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f.headers = r.Header.Clone()
+	if len(f.statuses) > 0 {
+		status := f.statuses[0]
+		f.statuses = f.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body = gz
+	}
+	raw, _ := io.ReadAll(body)
+	request := &collogspb.ExportLogsServiceRequest{}
+	if err := proto.Unmarshal(raw, request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.requests = append(f.requests, request)
+
+	resp, _ := proto.Marshal(&collogspb.ExportLogsServiceResponse{
+		PartialSuccess: &collogspb.ExportLogsPartialSuccess{RejectedLogRecords: f.rejected},
+	})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(resp)
+}
+
+func TestHandlerOTLPHTTPSink(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	receiver := &fakeOTLPReceiver{statuses: []int{http.StatusServiceUnavailable}, rejected: 1}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+
+	options = otlpTestOptions(server.URL)
+	options.OTLPHeadersSecretARN = "arn:aws:secretsmanager:us-east-2:111111111111:secret:otlp"
+	getSecretStringFunc = func(ctx context.Context, secretARN string) (string, error) {
+		return `{"Authorization":"Api-Token abc"}`, nil
+	}
+
+	ev := makeCloudWatchEvent(t, map[string]interface{}{
+		"owner":       "111",
+		"logGroup":    "/fleet/server",
+		"logStream":   "s1",
+		"messageType": "DATA_MESSAGE",
+		"logEvents": []map[string]interface{}{
+			{"id": "1", "timestamp": 10, "message": `{"level":"info"}`},
+			{"id": "2", "timestamp": 11, "message": "m2"},
+		},
+	})
+	resp, err := handler(context.Background(), ev)
+	require.NoError(t, err, "partial success is not an error")
+	assert.Equal(t, 2, resp["published_message_count"])
+
+	require.Len(t, receiver.requests, 1)
+	assert.Equal(t, "Api-Token abc", receiver.headers.Get("Authorization"))
+	assert.Equal(t, "application/x-protobuf", receiver.headers.Get("Content-Type"))
+	assert.Len(t, receiver.requests[0].ResourceLogs[0].ScopeLogs[0].LogRecords, 2)
+
+	receiver.statuses = []int{http.StatusBadRequest}
+	_, err = handler(context.Background(), ev)
+	var httpErr *otlpHTTPError
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusBadRequest, httpErr.StatusCode)
+	assert.Len(t, receiver.requests, 1, "client errors are not retried")
+}
+
+// fakeOTLPGRPCReceiver is an OTLP/gRPC logs receiver.
+type fakeOTLPGRPCReceiver struct {
+	collogspb.UnimplementedLogsServiceServer
+
+	mu       sync.Mutex
+	requests []*collogspb.ExportLogsServiceRequest
+	tokens   []string
+	failures int
+}
+
+func (f *fakeOTLPGRPCReceiver) Export(ctx context.Context, request *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	f.tokens = append(f.tokens, md.Get("x-api-key")...)
+	if f.failures > 0 {
+		f.failures--
+		return nil, status.Error(codes.Unavailable, "try again")
+	}
+	f.requests = append(f.requests, request)
+	return &collogspb.ExportLogsServiceResponse{}, nil
+}
+
+func TestOTLPGRPCSink(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	receiver := &fakeOTLPGRPCReceiver{failures: 1}
+	collogspb.RegisterLogsServiceServer(server, receiver)
+	go func() { _ = server.Serve(ln) }()
+	t.Cleanup(server.Stop)
+
+	options = otlpTestOptions(ln.Addr().String())
+	options.OTLPProtocol = otlpProtocolGRPC
+	options.OTLPHeadersSecretARN = "arn:aws:secretsmanager:us-east-2:111111111111:secret:otlp"
+	getSecretStringFunc = func(ctx context.Context, secretARN string) (string, error) {
+		return `{"x-api-key":"abc"}`, nil
+	}
+	t.Cleanup(func() {
+		if otlpGRPCConn != nil {
+			_ = otlpGRPCConn.Close()
+		}
+	})
+
+	s, err := getOTLPSink(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, s.Publish(context.Background(), otlpTestMessages()))
+
+	require.Len(t, receiver.requests, 1)
+	assert.Len(t, receiver.requests[0].ResourceLogs, 2)
+	assert.Equal(t, []string{"abc", "abc"}, receiver.tokens)
+
+	receiver.failures = 10
+	err = s.Publish(context.Background(), otlpTestMessages())
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+// TestOTLPLocalCollector exports to a real receiver, for example
+//
+//	docker run -p 4317:4317 -p 4318:4318 otel/opentelemetry-collector:latest
+//
+// with OTLP_TEST_ENDPOINT=http://localhost:4318, or localhost:4317 and
+// OTLP_TEST_PROTOCOL=grpc.
+func TestOTLPLocalCollector(t *testing.T) {
+	endpoint := os.Getenv("OTLP_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("OTLP_TEST_ENDPOINT not set")
+	}
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	options = otlpTestOptions(endpoint)
+	if protocol := os.Getenv("OTLP_TEST_PROTOCOL"); protocol != "" {
+		options.OTLPProtocol = protocol
+	}
+
+	s, err := getOTLPSink(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, s.Publish(context.Background(), otlpTestMessages()))
+}
@@ -0,0 +1,189 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/fleetdm/fleet/terraform/addons/byo-cloudwatch-log-sharing/pubsub-bridge/lambda/awslogs"
+)
+
+// archiveConfig configures the archival of stale events. A zero MaxEventAge
+// replays events however old they are.
+type archiveConfig struct {
+	MaxEventAge time.Duration
+	Bucket      string
+	Prefix      string
+}
+
+type s3Putter interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+var (
+	s3ClientOnce sync.Once
+	s3Client     s3Putter
+	s3ClientErr  error
+
+	getS3ClientFunc = getS3Client
+)
+
+func loadArchiveConfig() (archiveConfig, error) {
+	value := strings.TrimSpace(os.Getenv("REPLAY_MAX_EVENT_AGE_SECONDS"))
+	if value == "" {
+		return archiveConfig{}, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return archiveConfig{}, fmt.Errorf("REPLAY_MAX_EVENT_AGE_SECONDS must be a non-negative integer, got %q", value)
+	}
+	cfg := archiveConfig{
+		MaxEventAge: time.Duration(seconds) * time.Second,
+		Bucket:      strings.TrimSpace(os.Getenv("ARCHIVE_BUCKET")),
+		Prefix:      strings.TrimSpace(os.Getenv("ARCHIVE_PREFIX")),
+	}
+	if cfg.MaxEventAge > 0 && cfg.Bucket == "" {
+		return archiveConfig{}, errors.New("ARCHIVE_BUCKET is required when REPLAY_MAX_EVENT_AGE_SECONDS is set")
+	}
+	return cfg, nil
+}
+
+func getS3Client(ctx context.Context) (s3Putter, error) {
+	s3ClientOnce.Do(func() {
+		cfg, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			s3ClientErr = fmt.Errorf("load aws sdk config: %w", err)
+			return
+		}
+		s3Client = s3.NewFromConfig(cfg)
+	})
+
+	if s3ClientErr != nil {
+		return nil, s3ClientErr
+	}
+	return s3Client, nil
+}
+
+// archivedEvent is the index entry for one archived DLQ record. Backfill
+// tooling reads the index to find the objects for a log group and time range
+// without listing the archive.
+type archivedEvent struct {
+	Key          string    `json:"key"`
+	MessageID    string    `json:"message_id"`
+	RequestID    string    `json:"request_id,omitempty"`
+	LogGroup     string    `json:"log_group"`
+	LogStream    string    `json:"log_stream"`
+	EventCount   int       `json:"event_count"`
+	FirstEventAt time.Time `json:"first_event_at"`
+	LastEventAt  time.Time `json:"last_event_at"`
+	ArchivedAt   time.Time `json:"archived_at"`
+}
+
+// staleEvent returns the index entry for message, whose original event
+// decodes to payload, when every log event in it is older than
+// cfg.MaxEventAge, and nil when the event should be replayed. Events that are
+// not CloudWatch Logs subscription events, with a nil payload, are never
+// stale; replaying them reports why they cannot be published.
+func staleEvent(cfg archiveConfig, message asyncDestinationMessage, payload *awslogs.Payload, messageID string, now time.Time) *archivedEvent {
+	if cfg.MaxEventAge <= 0 || payload == nil || len(payload.LogEvents) == 0 {
+		return nil
+	}
+
+	first, last := payload.LogEvents[0].Timestamp, payload.LogEvents[0].Timestamp
+	for _, event := range payload.LogEvents[1:] {
+		first = min(first, event.Timestamp)
+		last = max(last, event.Timestamp)
+	}
+	if now.Sub(time.UnixMilli(last)) <= cfg.MaxEventAge {
+		return nil
+	}
+
+	entry := &archivedEvent{
+		MessageID:    messageID,
+		RequestID:    message.RequestContext.RequestID,
+		LogGroup:     payload.LogGroup,
+		LogStream:    payload.LogStream,
+		EventCount:   len(payload.LogEvents),
+		FirstEventAt: time.UnixMilli(first).UTC(),
+		LastEventAt:  time.UnixMilli(last).UTC(),
+		ArchivedAt:   now.UTC(),
+	}
+	entry.Key = archiveKey(cfg, entry)
+	return entry
+}
+
+// archiveKey partitions archived records by the day of their newest log event
+// and by log group, escaped so that its slashes do not nest prefixes.
+func archiveKey(cfg archiveConfig, entry *archivedEvent) string {
+	return fmt.Sprintf("%sdt=%s/log_group=%s/%s.json",
+		cfg.Prefix, entry.LastEventAt.Format("2006-01-02"), url.PathEscape(entry.LogGroup), entry.MessageID)
+}
+
+// archiveOne stores record's body unchanged at entry.Key, so it can be sent
+// back to the DLQ as is to be replayed.
+func archiveOne(ctx context.Context, client s3Putter, cfg archiveConfig, record events.SQSMessage, entry *archivedEvent) error {
+	if _, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(cfg.Bucket),
+		Key:         aws.String(entry.Key),
+		Body:        strings.NewReader(record.Body),
+		ContentType: aws.String("application/json"),
+	}); err != nil {
+		return fmt.Errorf("archive to s3://%s/%s: %w", cfg.Bucket, entry.Key, err)
+	}
+	return nil
+}
+
+// archiveIndex collects the records of a batch archived by concurrent
+// replays.
+type archiveIndex struct {
+	mu      sync.Mutex
+	entries []*archivedEvent
+	// decisions are the records' decisions, with their reasons. They are
+	// logged once the index is written, since only then are they final.
+	decisions []replayDecision
+}
+
+func (x *archiveIndex) add(entry *archivedEvent, decision replayDecision) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.entries = append(x.entries, entry)
+	x.decisions = append(x.decisions, decision)
+}
+
+// writeArchiveIndex writes one JSON Lines index object listing the records a
+// batch archived. Each batch writes its own object, named after the time and
+// its first record, so concurrent replayers never overwrite each other's.
+func writeArchiveIndex(ctx context.Context, client s3Putter, cfg archiveConfig, entries []*archivedEvent, now time.Time) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return fmt.Errorf("marshal archive index: %w", err)
+		}
+	}
+
+	key := fmt.Sprintf("%sindex/dt=%s/%s-%s.jsonl",
+		cfg.Prefix, now.UTC().Format("2006-01-02"), now.UTC().Format("150405.000Z"), entries[0].MessageID)
+	if _, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(cfg.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body.Bytes()),
+		ContentType: aws.String("application/x-ndjson"),
+	}); err != nil {
+		return fmt.Errorf("write archive index s3://%s/%s: %w", cfg.Bucket, key, err)
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package replay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	awslambda "github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fleetdm/fleet/terraform/addons/byo-cloudwatch-log-sharing/pubsub-bridge/lambda/awslogs"
+)
+
+type fakeS3Client struct {
+	mu      sync.Mutex
+	objects map[string]string
+	putFn   func(key string) error
+}
+
+func (f *fakeS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if f.putFn != nil {
+		if err := f.putFn(*params.Key); err != nil {
+			return nil, err
+		}
+	}
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.objects == nil {
+		f.objects = map[string]string{}
+	}
+	f.objects[*params.Key] = string(body)
+	return &s3.PutObjectOutput{}, nil
+}
+
+// subscriptionEvent returns a subscription filter event for logGroup with one
+// log event at each of timestamps.
+func subscriptionEvent(t *testing.T, logGroup string, timestamps ...time.Time) string {
+	t.Helper()
+	logEvents := make([]map[string]any, 0, len(timestamps))
+	for i, timestamp := range timestamps {
+		logEvents = append(logEvents, map[string]any{"id": fmt.Sprint(i), "timestamp": timestamp.UnixMilli(), "message": "line"})
+	}
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, err := writer.Write([]byte(mustJSON(t, map[string]any{
+		"messageType": "DATA_MESSAGE",
+		"logGroup":    logGroup,
+		"logStream":   "stream",
+		"logEvents":   logEvents,
+	})))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return mustJSON(t, map[string]any{"awslogs": map[string]string{"data": base64.StdEncoding.EncodeToString(compressed.Bytes())}})
+}
+
+func TestLoadArchiveConfig(t *testing.T) {
+	t.Setenv("REPLAY_MAX_EVENT_AGE_SECONDS", "")
+	cfg, err := loadArchiveConfig()
+	require.NoError(t, err)
+	assert.Zero(t, cfg.MaxEventAge)
+
+	t.Setenv("REPLAY_MAX_EVENT_AGE_SECONDS", "3600")
+	_, err = loadArchiveConfig()
+	assert.ErrorContains(t, err, "ARCHIVE_BUCKET is required")
+
+	t.Setenv("ARCHIVE_BUCKET", "archive")
+	t.Setenv("ARCHIVE_PREFIX", "dlq-archive/")
+	cfg, err = loadArchiveConfig()
+	require.NoError(t, err)
+	assert.Equal(t, archiveConfig{MaxEventAge: time.Hour, Bucket: "archive", Prefix: "dlq-archive/"}, cfg)
+
+	for _, value := range []string{"-1", "1h"} {
+		t.Setenv("REPLAY_MAX_EVENT_AGE_SECONDS", value)
+		_, err = loadArchiveConfig()
+		assert.ErrorContains(t, err, "REPLAY_MAX_EVENT_AGE_SECONDS must be a non-negative integer")
+	}
+}
+
+func TestStaleEvent(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	cfg := archiveConfig{MaxEventAge: 24 * time.Hour, Bucket: "archive", Prefix: "dlq-archive/"}
+	message, err := parseDestinationMessage(`{"requestPayload":{},"requestContext":{"requestId":"r1"}}`)
+	require.NoError(t, err)
+	payload := func(event string) *awslogs.Payload {
+		p, err := awslogs.DecodeJSON([]byte(event))
+		require.NoError(t, err)
+		return p
+	}
+
+	stale := payload(subscriptionEvent(t, "/fleet/server", now.Add(-50*time.Hour), now.Add(-30*time.Hour)))
+	entry := staleEvent(cfg, message, stale, "m1", now)
+	require.NotNil(t, entry)
+	assert.Equal(t, &archivedEvent{
+		Key:          "dlq-archive/dt=2026-03-09/log_group=%2Ffleet%2Fserver/m1.json",
+		MessageID:    "m1",
+		RequestID:    "r1",
+		LogGroup:     "/fleet/server",
+		LogStream:    "stream",
+		EventCount:   2,
+		FirstEventAt: now.Add(-50 * time.Hour),
+		LastEventAt:  now.Add(-30 * time.Hour),
+		ArchivedAt:   now,
+	}, entry)
+
+	// One recent log event keeps the whole event replayable.
+	assert.Nil(t, staleEvent(cfg, message, payload(subscriptionEvent(t, "/fleet/server", now.Add(-50*time.Hour), now.Add(-time.Hour))), "m2", now))
+	// Events that do not decode are left for the replay to report.
+	assert.Nil(t, staleEvent(cfg, message, nil, "m3", now))
+	// Without a max age nothing is stale.
+	assert.Nil(t, staleEvent(archiveConfig{}, message, stale, "m1", now))
+}
+
+func TestHandlerArchivesStaleEvents(t *testing.T) {
+	resetReplayerTestState()
+	t.Cleanup(resetReplayerTestState)
+
+	t.Setenv("TARGET_BRIDGE_FUNCTION_NAME", "bridge")
+	t.Setenv("REPLAY_MAX_EVENT_AGE_SECONDS", "86400")
+	t.Setenv("ARCHIVE_BUCKET", "archive")
+	t.Setenv("ARCHIVE_PREFIX", "dlq-archive/")
+	t.Setenv("METRICS_NAMESPACE", "Fleet")
+
+	var invoked []string
+	getLambdaClientFunc = func(ctx context.Context) (lambdaInvoker, error) {
+		return &fakeLambdaInvoker{invokeFn: func(ctx context.Context, params *awslambda.InvokeInput, optFns ...func(*awslambda.Options)) (*awslambda.InvokeOutput, error) {
+			invoked = append(invoked, string(params.Payload))
+			return &awslambda.InvokeOutput{StatusCode: 200, Payload: []byte(`{"published_message_count":1}`)}, nil
+		}}, nil
+	}
+	client := &fakeS3Client{putFn: func(key string) error {
+		if strings.Contains(key, "unavailable") {
+			return errors.New("service unavailable")
+		}
+		return nil
+	}}
+	getS3ClientFunc = func(ctx context.Context) (s3Putter, error) {
+		return client, nil
+	}
+	var decisions, metrics bytes.Buffer
+	decisionWriter = &decisions
+	metricsWriter = &metrics
+
+	old := time.Now().Add(-72 * time.Hour)
+	stale := subscriptionEvent(t, "/fleet/server", old)
+	fresh := subscriptionEvent(t, "/fleet/server", time.Now().Add(-time.Minute))
+	record := func(id, payload string) events.SQSMessage {
+		return events.SQSMessage{MessageId: id, Body: `{"requestPayload":` + payload + `}`}
+	}
+	resp, err := Handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		record("stale", stale),
+		record("fresh", fresh),
+		record("unavailable", stale),
+	}})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{fresh}, invoked, "only fresh events are replayed")
+	assert.Equal(t, []events.SQSBatchItemFailure{{ItemIdentifier: "unavailable"}}, resp.BatchItemFailures)
+
+	key := "dlq-archive/dt=" + old.UTC().Format("2006-01-02") + "/log_group=%2Ffleet%2Fserver/stale.json"
+	assert.Equal(t, `{"requestPayload":`+stale+`}`, client.objects[key], "the DLQ record is archived unchanged")
+
+	var indexKey string
+	for k := range client.objects {
+		if strings.HasPrefix(k, "dlq-archive/index/dt=") {
+			indexKey = k
+		}
+	}
+	require.NotEmpty(t, indexKey)
+	assert.True(t, strings.HasSuffix(indexKey, "-stale.jsonl"), indexKey)
+	assert.Contains(t, client.objects[indexKey], `"key":"`+key+`"`)
+	assert.Equal(t, 1, strings.Count(client.objects[indexKey], "\n"))
+
+	assert.Contains(t, decisions.String(), `"decision":"archived"`)
+	assert.Contains(t, metrics.String(), `"ArchivedEvents":1`)
+}
+
+func TestHandlerRetriesArchivedEventsWithoutIndex(t *testing.T) {
+	resetReplayerTestState()
+	t.Cleanup(resetReplayerTestState)
+
+	t.Setenv("TARGET_BRIDGE_FUNCTION_NAME", "bridge")
+	t.Setenv("REPLAY_MAX_EVENT_AGE_SECONDS", "86400")
+	t.Setenv("ARCHIVE_BUCKET", "archive")
+
+	getLambdaClientFunc = func(ctx context.Context) (lambdaInvoker, error) {
+		return &fakeLambdaInvoker{}, nil
+	}
+	getS3ClientFunc = func(ctx context.Context) (s3Putter, error) {
+		return &fakeS3Client{putFn: func(key string) error {
+			if strings.HasPrefix(key, "index/") {
+				return errors.New("access denied")
+			}
+			return nil
+		}}, nil
+	}
+	var decisions bytes.Buffer
+	decisionWriter = &decisions
+
+	resp, err := Handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "stale", Body: `{"requestPayload":` + subscriptionEvent(t, "/fleet/server", time.Now().Add(-72*time.Hour)) + `}`},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, []events.SQSBatchItemFailure{{ItemIdentifier: "stale"}}, resp.BatchItemFailures)
+
+	assert.Equal(t, 1, strings.Count(decisions.String(), "\n"), "the record is logged once, after the index write")
+	logged := readDecisions(t, &decisions)
+	assert.Equal(t, decisionRetry, logged["stale"].Decision)
+	assert.Contains(t, logged["stale"].Reason, "; archive index not written")
+	assert.Contains(t, logged["stale"].ErrorMessage, "access denied")
+}
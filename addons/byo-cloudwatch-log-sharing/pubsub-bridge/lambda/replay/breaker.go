@@ -0,0 +1,253 @@
+package replay
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+
+	// maxVisibilityTimeout is the longest SQS lets a message stay hidden.
+	maxVisibilityTimeout = 12 * time.Hour
+)
+
+// breakerConfig configures the replay circuit breaker. A zero
+// FailureThreshold disables it.
+type breakerConfig struct {
+	FailureThreshold float64
+	MinimumReplays   int
+	Window           int
+	Cooldown         time.Duration
+	MaxCooldown      time.Duration
+	ProbeSize        int
+}
+
+// breakerOutcome is what a replay says about the bridge's health.
+type breakerOutcome int
+
+const (
+	// outcomeIgnored is a replay that says nothing about the bridge, such as
+	// one cut short by the deadline or one that failed because of the event.
+	outcomeIgnored breakerOutcome = iota
+	outcomeSuccess
+	outcomeFailure
+)
+
+// circuitBreaker stops replays while most of them fail, so an outage behind
+// the bridge does not turn every DLQ message into a wasted bridge invocation
+// and another trip through the DLQ. It opens when the failure rate of the last
+// Window replays reaches FailureThreshold, stays open for a cooldown that
+// doubles each time it opens again without recovering, then lets ProbeSize
+// replays through and closes once they all succeed.
+//
+// State is kept per execution environment, so each concurrent replayer
+// instance trips on its own.
+type circuitBreaker struct {
+	cfg breakerConfig
+
+	mu        sync.Mutex
+	state     string
+	outcomes  []bool
+	openUntil time.Time
+	trips     int
+	probes    int
+	successes int
+}
+
+var (
+	breakerMu     sync.Mutex
+	replayBreaker *circuitBreaker
+
+	deferRecordFunc = deferRecord
+)
+
+func newCircuitBreaker(cfg breakerConfig) *circuitBreaker {
+	return &circuitBreaker{cfg: cfg, state: breakerClosed}
+}
+
+// getBreaker returns the execution environment's circuit breaker, or nil when
+// it is disabled. The breaker is replaced if its configuration changed.
+func getBreaker(cfg breakerConfig) *circuitBreaker {
+	if cfg.FailureThreshold == 0 {
+		return nil
+	}
+
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+
+	if replayBreaker == nil || replayBreaker.cfg != cfg {
+		replayBreaker = newCircuitBreaker(cfg)
+	}
+	return replayBreaker
+}
+
+// allow reports whether a replay may be attempted now. When it may not,
+// retryAfter is how long to hold the record back.
+func (b *circuitBreaker) allow(now time.Time) (allowed bool, retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen {
+		if now.Before(b.openUntil) {
+			return false, b.openUntil.Sub(now)
+		}
+		b.state = breakerHalfOpen
+		b.probes = 0
+		b.successes = 0
+	}
+	if b.state == breakerHalfOpen {
+		if b.probes+b.successes >= b.cfg.ProbeSize {
+			return false, b.cfg.Cooldown
+		}
+		b.probes++
+	}
+	return true, 0
+}
+
+// done records the outcome of a replay that allow let through.
+func (b *circuitBreaker) done(now time.Time, outcome breakerOutcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerHalfOpen:
+		b.probes--
+		switch outcome {
+		case outcomeSuccess:
+			b.successes++
+			if b.successes >= b.cfg.ProbeSize {
+				b.state = breakerClosed
+				b.trips = 0
+				b.outcomes = nil
+			}
+		case outcomeFailure:
+			b.trip(now)
+		}
+	case breakerClosed:
+		if outcome == outcomeIgnored {
+			return
+		}
+		b.outcomes = append(b.outcomes, outcome == outcomeFailure)
+		if len(b.outcomes) > b.cfg.Window {
+			b.outcomes = b.outcomes[len(b.outcomes)-b.cfg.Window:]
+		}
+		if len(b.outcomes) >= b.cfg.MinimumReplays && b.failureRate() >= b.cfg.FailureThreshold {
+			b.trip(now)
+		}
+	}
+}
+
+// tripped reports whether the breaker is not closed, meaning replay failures
+// are currently blamed on the bridge rather than on the events.
+func (b *circuitBreaker) tripped() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != breakerClosed
+}
+
+func (b *circuitBreaker) failureRate() float64 {
+	failures := 0
+	for _, failed := range b.outcomes {
+		if failed {
+			failures++
+		}
+	}
+	return float64(failures) / float64(len(b.outcomes))
+}
+
+func (b *circuitBreaker) trip(now time.Time) {
+	cooldown := b.cfg.Cooldown
+	for i := 0; i < b.trips && cooldown < b.cfg.MaxCooldown; i++ {
+		cooldown *= 2
+	}
+	if cooldown > b.cfg.MaxCooldown {
+		cooldown = b.cfg.MaxCooldown
+	}
+
+	b.state = breakerOpen
+	b.openUntil = now.Add(cooldown)
+	b.trips++
+	b.outcomes = nil
+}
+
+// deferRecord hides record on the DLQ for retryAfter, so it is not received
+// again, and replayed, until the breaker lets replays through.
+func deferRecord(ctx context.Context, client sqsClientAPI, cfg replayerConfig, record events.SQSMessage, retryAfter time.Duration) error {
+	seconds := int32(math.Ceil(retryAfter.Seconds()))
+	seconds = max(seconds, 1)
+	seconds = min(seconds, int32(maxVisibilityTimeout/time.Second))
+
+	if _, err := client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(cfg.DLQQueueURL),
+		ReceiptHandle:     aws.String(record.ReceiptHandle),
+		VisibilityTimeout: seconds,
+	}); err != nil {
+		return fmt.Errorf("change dlq message visibility: %w", err)
+	}
+	return nil
+}
+
+func loadBreakerConfig() (breakerConfig, error) {
+	value := strings.TrimSpace(os.Getenv("REPLAY_BREAKER_FAILURE_THRESHOLD"))
+	if value == "" {
+		return breakerConfig{}, nil
+	}
+	threshold, err := strconv.ParseFloat(value, 64)
+	if err != nil || threshold < 0 || threshold > 1 {
+		return breakerConfig{}, fmt.Errorf("REPLAY_BREAKER_FAILURE_THRESHOLD must be between 0 and 1, got %q", value)
+	}
+
+	cfg := breakerConfig{FailureThreshold: threshold}
+	if cfg.MinimumReplays, err = getPositiveInt("REPLAY_BREAKER_MINIMUM_REPLAYS", 10); err != nil {
+		return breakerConfig{}, err
+	}
+	if cfg.Window, err = getPositiveInt("REPLAY_BREAKER_WINDOW", 20); err != nil {
+		return breakerConfig{}, err
+	}
+	if cfg.ProbeSize, err = getPositiveInt("REPLAY_BREAKER_PROBE_SIZE", 1); err != nil {
+		return breakerConfig{}, err
+	}
+	cooldownSeconds, err := getPositiveInt("REPLAY_BREAKER_COOLDOWN_SECONDS", 60)
+	if err != nil {
+		return breakerConfig{}, err
+	}
+	maxCooldownSeconds, err := getPositiveInt("REPLAY_BREAKER_MAX_COOLDOWN_SECONDS", 900)
+	if err != nil {
+		return breakerConfig{}, err
+	}
+	cfg.Cooldown = time.Duration(cooldownSeconds) * time.Second
+	cfg.MaxCooldown = time.Duration(maxCooldownSeconds) * time.Second
+
+	if cfg.MinimumReplays > cfg.Window {
+		return breakerConfig{}, fmt.Errorf("REPLAY_BREAKER_MINIMUM_REPLAYS (%d) must not exceed REPLAY_BREAKER_WINDOW (%d)", cfg.MinimumReplays, cfg.Window)
+	}
+	if cfg.MaxCooldown < cfg.Cooldown || cfg.MaxCooldown > maxVisibilityTimeout {
+		return breakerConfig{}, fmt.Errorf("REPLAY_BREAKER_MAX_COOLDOWN_SECONDS must be between REPLAY_BREAKER_COOLDOWN_SECONDS and %d", int(maxVisibilityTimeout/time.Second))
+	}
+	return cfg, nil
+}
+
+func getPositiveInt(name string, defaultValue int) (int, error) {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s must be a positive integer, got %q", name, value)
+	}
+	return n, nil
+}
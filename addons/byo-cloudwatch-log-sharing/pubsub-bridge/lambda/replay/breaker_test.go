@@ -0,0 +1,257 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testBreakerConfig() breakerConfig {
+	return breakerConfig{
+		FailureThreshold: 0.5,
+		MinimumReplays:   4,
+		Window:           10,
+		Cooldown:         time.Minute,
+		MaxCooldown:      5 * time.Minute,
+		ProbeSize:        2,
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(testBreakerConfig())
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	replay := func(outcome breakerOutcome) {
+		t.Helper()
+		allowed, _ := b.allow(now)
+		require.True(t, allowed)
+		b.done(now, outcome)
+	}
+
+	// Below MinimumReplays the failure rate is not judged.
+	replay(outcomeFailure)
+	replay(outcomeFailure)
+	replay(outcomeFailure)
+	assert.False(t, b.tripped())
+
+	// Ignored outcomes do not count.
+	replay(outcomeIgnored)
+	assert.False(t, b.tripped())
+
+	replay(outcomeSuccess)
+	assert.True(t, b.tripped(), "3 of 4 replays failed")
+
+	allowed, retryAfter := b.allow(now.Add(20 * time.Second))
+	assert.False(t, allowed)
+	assert.Equal(t, 40*time.Second, retryAfter)
+
+	// After the cooldown ProbeSize replays are let through at a time.
+	now = now.Add(time.Minute)
+	allowed, _ = b.allow(now)
+	assert.True(t, allowed)
+	allowed, _ = b.allow(now)
+	assert.True(t, allowed)
+	allowed, retryAfter = b.allow(now)
+	assert.False(t, allowed)
+	assert.Equal(t, time.Minute, retryAfter)
+
+	// A failed probe reopens the breaker with a doubled cooldown.
+	b.done(now, outcomeSuccess)
+	b.done(now, outcomeFailure)
+	_, retryAfter = b.allow(now)
+	assert.Equal(t, 2*time.Minute, retryAfter)
+
+	now = now.Add(2 * time.Minute)
+	replay(outcomeFailure)
+	_, retryAfter = b.allow(now)
+	assert.Equal(t, 4*time.Minute, retryAfter)
+
+	now = now.Add(4 * time.Minute)
+	replay(outcomeFailure)
+	_, retryAfter = b.allow(now)
+	assert.Equal(t, 5*time.Minute, retryAfter, "the cooldown is capped at MaxCooldown")
+
+	// Successful probes close it and reset the cooldown.
+	now = now.Add(5 * time.Minute)
+	replay(outcomeSuccess)
+	assert.True(t, b.tripped())
+	replay(outcomeSuccess)
+	assert.False(t, b.tripped())
+
+	for i := 0; i < 4; i++ {
+		replay(outcomeFailure)
+	}
+	_, retryAfter = b.allow(now)
+	assert.Equal(t, time.Minute, retryAfter)
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	cfg := testBreakerConfig()
+	cfg.Window = 4
+	b := newCircuitBreaker(cfg)
+	now := time.Now()
+
+	for _, outcome := range []breakerOutcome{outcomeSuccess, outcomeSuccess, outcomeSuccess, outcomeSuccess, outcomeSuccess, outcomeSuccess, outcomeFailure} {
+		b.done(now, outcome)
+	}
+	assert.False(t, b.tripped())
+	b.done(now, outcomeFailure)
+	assert.True(t, b.tripped(), "2 of the last 4 replays failed, though only 2 of 8 in all")
+}
+
+func TestLoadBreakerConfig(t *testing.T) {
+	t.Setenv("REPLAY_BREAKER_FAILURE_THRESHOLD", "")
+	cfg, err := loadBreakerConfig()
+	require.NoError(t, err)
+	assert.Equal(t, breakerConfig{}, cfg)
+
+	t.Setenv("REPLAY_BREAKER_FAILURE_THRESHOLD", "0.8")
+	cfg, err = loadBreakerConfig()
+	require.NoError(t, err)
+	assert.Equal(t, breakerConfig{
+		FailureThreshold: 0.8,
+		MinimumReplays:   10,
+		Window:           20,
+		Cooldown:         time.Minute,
+		MaxCooldown:      15 * time.Minute,
+		ProbeSize:        1,
+	}, cfg)
+
+	tests := []struct {
+		name, value, want string
+	}{
+		{"REPLAY_BREAKER_FAILURE_THRESHOLD", "1.5", "REPLAY_BREAKER_FAILURE_THRESHOLD must be between 0 and 1"},
+		{"REPLAY_BREAKER_WINDOW", "0", "REPLAY_BREAKER_WINDOW must be a positive integer"},
+		{"REPLAY_BREAKER_WINDOW", "5", "REPLAY_BREAKER_MINIMUM_REPLAYS (10) must not exceed REPLAY_BREAKER_WINDOW (5)"},
+		{"REPLAY_BREAKER_MAX_COOLDOWN_SECONDS", "30", "REPLAY_BREAKER_MAX_COOLDOWN_SECONDS must be between"},
+		{"REPLAY_BREAKER_MAX_COOLDOWN_SECONDS", "50000", "REPLAY_BREAKER_MAX_COOLDOWN_SECONDS must be between"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"="+tt.value, func(t *testing.T) {
+			t.Setenv(tt.name, tt.value)
+			_, err := loadBreakerConfig()
+			require.ErrorContains(t, err, tt.want)
+		})
+	}
+}
+
+func TestDeferRecord(t *testing.T) {
+	var input *sqs.ChangeMessageVisibilityInput
+	client := &fakeSQSClient{changeVisibilityFn: func(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error) {
+		input = params
+		return &sqs.ChangeMessageVisibilityOutput{}, nil
+	}}
+	cfg := replayerConfig{DLQQueueURL: "https://sqs/dlq"}
+	record := events.SQSMessage{ReceiptHandle: "rh"}
+
+	require.NoError(t, deferRecord(context.Background(), client, cfg, record, 1500*time.Millisecond))
+	assert.Equal(t, "https://sqs/dlq", aws.ToString(input.QueueUrl))
+	assert.Equal(t, "rh", aws.ToString(input.ReceiptHandle))
+	assert.Equal(t, int32(2), input.VisibilityTimeout)
+
+	require.NoError(t, deferRecord(context.Background(), client, cfg, record, 24*time.Hour))
+	assert.Equal(t, int32(43200), input.VisibilityTimeout)
+
+	client.changeVisibilityFn = func(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error) {
+		return nil, errors.New("receipt handle expired")
+	}
+	require.ErrorContains(t, deferRecord(context.Background(), client, cfg, record, time.Second), "change dlq message visibility: receipt handle expired")
+}
+
+func TestHandlerCircuitBreaker(t *testing.T) {
+	resetReplayerTestState()
+	t.Cleanup(resetReplayerTestState)
+
+	t.Setenv("TARGET_BRIDGE_FUNCTION_NAME", "bridge")
+	t.Setenv("REPLAY_MAX_ATTEMPTS", "2")
+	t.Setenv("PARKING_LOT_QUEUE_URL", "https://sqs/parking")
+	t.Setenv("DLQ_QUEUE_URL", "https://sqs/dlq")
+	t.Setenv("METRICS_NAMESPACE", "Fleet")
+	t.Setenv("REPLAY_BREAKER_FAILURE_THRESHOLD", "0.5")
+	t.Setenv("REPLAY_BREAKER_MINIMUM_REPLAYS", "2")
+	t.Setenv("REPLAY_BREAKER_WINDOW", "2")
+
+	var metrics bytes.Buffer
+	metricsWriter = &metrics
+	decisionWriter = io.Discard
+	getLambdaClientFunc = func(ctx context.Context) (lambdaInvoker, error) {
+		return &fakeLambdaInvoker{}, nil
+	}
+	getSQSClientFunc = func(ctx context.Context) (sqsClientAPI, error) {
+		return &fakeSQSClient{}, nil
+	}
+	replays := 0
+	replayOneFunc = func(ctx context.Context, client lambdaInvoker, cfg replayerConfig, record events.SQSMessage) error {
+		replays++
+		return &functionError{FunctionError: "Unhandled", ErrorType: "wrapError", ErrorMessage: "publish to pubsub: unavailable"}
+	}
+	parkOneFunc = func(ctx context.Context, client sqsClientAPI, cfg replayerConfig, record events.SQSMessage, attempts int, errorType, errorMessage, reason string) error {
+		t.Errorf("record %s parked during an outage", record.MessageId)
+		return nil
+	}
+	deferred := map[string]time.Duration{}
+	deferRecordFunc = func(ctx context.Context, client sqsClientAPI, cfg replayerConfig, record events.SQSMessage, retryAfter time.Duration) error {
+		deferred[record.MessageId] = retryAfter
+		return nil
+	}
+
+	var requeued []string
+	requeueRecordFunc = func(ctx context.Context, client sqsClientAPI, cfg replayerConfig, record events.SQSMessage, attempts int) error {
+		requeued = append(requeued, record.MessageId)
+		return nil
+	}
+
+	// Every record but the first has used up its attempts, yet none is
+	// parked: the failure that opens the breaker is blamed on the bridge.
+	var records []events.SQSMessage
+	for _, id := range []string{"a", "b", "c", "d"} {
+		record := events.SQSMessage{
+			MessageId: id,
+			Body:      `{"requestPayload":{"awslogs":{"data":"abc"}}}`,
+		}
+		if id != "a" {
+			record.MessageAttributes = map[string]events.SQSMessageAttribute{
+				"replay_attempts": {DataType: "Number", StringValue: aws.String("5")},
+			}
+		}
+		records = append(records, record)
+	}
+	resp, err := Handler(context.Background(), events.SQSEvent{Records: records})
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, replays, "replays stop once the breaker opens")
+	assert.Equal(t, []string{"a"}, requeued, "the failure before the breaker opened counts as an attempt")
+	assert.Equal(t, []events.SQSBatchItemFailure{{ItemIdentifier: "b"}, {ItemIdentifier: "c"}, {ItemIdentifier: "d"}}, resp.BatchItemFailures)
+	assert.Len(t, deferred, 2)
+	assert.Contains(t, deferred, "c")
+	assert.InDelta(t, time.Minute, deferred["d"], float64(time.Second))
+
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal(metrics.Bytes(), &record))
+	assert.Equal(t, float64(0), record["ParkedEvents"])
+	assert.Equal(t, float64(2), record["DeferredEvents"])
+	assert.Equal(t, float64(1), record["CircuitBreakerOpen"])
+
+	// The breaker is kept across invocations of the execution environment.
+	_, err = Handler(context.Background(), events.SQSEvent{Records: records[:1]})
+	require.NoError(t, err)
+	assert.Equal(t, 2, replays)
+}
+
+func TestLoadConfigRequiresDLQURLForBreaker(t *testing.T) {
+	t.Setenv("TARGET_BRIDGE_FUNCTION_NAME", "bridge")
+	t.Setenv("REPLAY_BREAKER_FAILURE_THRESHOLD", "0.5")
+	t.Setenv("DLQ_QUEUE_URL", "")
+	_, err := loadConfig()
+	require.ErrorContains(t, err, "DLQ_QUEUE_URL is required")
+}
@@ -0,0 +1,153 @@
+package replay
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/fleetdm/fleet/terraform/addons/byo-cloudwatch-log-sharing/pubsub-bridge/lambda/awslogs"
+)
+
+const (
+	decisionReplayed = "replayed"
+	decisionRetry    = "retry"
+	decisionParked   = "parked"
+	decisionDeferred = "deferred"
+	decisionArchived = "archived"
+	decisionSkipped  = "skipped"
+	decisionRequeued = "requeued"
+)
+
+// nonRetryableMessagePrefixes are the errors the bridge returns when it cannot
+// decode an event (decodeCloudWatchPayload in the bridge). Replaying the same
+// payload fails the same way.
+var nonRetryableMessagePrefixes = []string{
+	"event missing awslogs.data",
+	"decode awslogs.data:",
+	"open gzip payload:",
+	"read gzip payload:",
+	"parse cloudwatch payload:",
+}
+
+// nonRetryableErrorTypes are the error types the Lambda Go runtime reports
+// when the event cannot be unmarshalled into the handler's argument.
+var nonRetryableErrorTypes = map[string]bool{
+	"SyntaxError":        true,
+	"UnmarshalTypeError": true,
+}
+
+var (
+	decisionWriter io.Writer = os.Stdout
+
+	// decisionMu keeps lines from records replayed concurrently whole.
+	decisionMu sync.Mutex
+)
+
+// errorClassification says whether an error is worth replaying, and why.
+type errorClassification struct {
+	Retryable bool
+	Reason    string
+}
+
+// classifyFunctionError classifies an error reported by the function a record
+// is replayed to, either in the DLQ record's responsePayload or by a
+// synchronous replay. Only the bridge's errors are known: anything else, such
+// as a Pub/Sub outage, a timeout or any error from another function, is
+// retryable.
+func classifyFunctionError(errorType, errorMessage string, bridge bool) errorClassification {
+	if !bridge {
+		return errorClassification{Retryable: true, Reason: "function error may be transient"}
+	}
+	if nonRetryableErrorTypes[errorType] {
+		return errorClassification{Reason: "event is not a CloudWatch Logs subscription event"}
+	}
+	for _, prefix := range nonRetryableMessagePrefixes {
+		if strings.HasPrefix(errorMessage, prefix) {
+			return errorClassification{Reason: "event payload cannot be decoded"}
+		}
+	}
+	return errorClassification{Retryable: true, Reason: "bridge error may be transient"}
+}
+
+// classifyRecord classifies a DLQ record before it is replayed, from the error
+// Lambda recorded when the original async invocation failed. bridge is set
+// when the record is replayed to the bridge.
+func classifyRecord(message asyncDestinationMessage, parseErr error, bridge bool) errorClassification {
+	if parseErr != nil {
+		return errorClassification{Reason: "DLQ record is not an async destination record"}
+	}
+	if message.ResponsePayload.ErrorType == "" && message.ResponsePayload.ErrorMessage == "" {
+		// EventAgeExceeded records have no response: the event expired
+		// before it could be processed, often because of throttling.
+		return errorClassification{Retryable: true, Reason: "no bridge error recorded"}
+	}
+	return classifyFunctionError(message.ResponsePayload.ErrorType, message.ResponsePayload.ErrorMessage, bridge)
+}
+
+// replayDecision is a structured log line recording what the replayer did with
+// one DLQ record and why.
+type replayDecision struct {
+	MessageID              string `json:"message_id"`
+	RequestID              string `json:"request_id,omitempty"`
+	Condition              string `json:"condition,omitempty"`
+	ApproximateInvokeCount int    `json:"approximate_invoke_count,omitempty"`
+	ReceiveCount           int    `json:"receive_count"`
+	ReplayAttempts         int    `json:"replay_attempts"`
+	LogGroup               string `json:"log_group,omitempty"`
+	TargetFunction         string `json:"target_function,omitempty"`
+	ErrorType              string `json:"error_type,omitempty"`
+	ErrorMessage           string `json:"error_message,omitempty"`
+	ReplayLagMillis        int64  `json:"replay_lag_ms,omitempty"`
+	Decision               string `json:"decision"`
+	Reason                 string `json:"reason"`
+}
+
+func newReplayDecision(message asyncDestinationMessage, payload *awslogs.Payload, messageID string, receiveCount int) replayDecision {
+	d := replayDecision{
+		MessageID:              messageID,
+		RequestID:              message.RequestContext.RequestID,
+		Condition:              message.RequestContext.Condition,
+		ApproximateInvokeCount: message.RequestContext.ApproximateInvokeCount,
+		ReceiveCount:           receiveCount,
+		ErrorType:              message.ResponsePayload.ErrorType,
+		ErrorMessage:           message.ResponsePayload.ErrorMessage,
+	}
+	if payload != nil {
+		d.LogGroup = payload.LogGroup
+	}
+	return d
+}
+
+// withError records err as the decision's error, taking the error type from a
+// bridge function error.
+func (d replayDecision) withError(err error) replayDecision {
+	var functionErr *functionError
+	if errors.As(err, &functionErr) {
+		d.ErrorType = functionErr.ErrorType
+		d.ErrorMessage = functionErr.ErrorMessage
+		return d
+	}
+	d.ErrorType = ""
+	d.ErrorMessage = err.Error()
+	return d
+}
+
+func (d replayDecision) log(decision, reason string) {
+	d.Decision = decision
+	d.Reason = reason
+
+	line, err := json.Marshal(d)
+	if err != nil {
+		log.Printf("marshal replay decision: %v", err)
+		return
+	}
+	decisionMu.Lock()
+	defer decisionMu.Unlock()
+	if _, err := decisionWriter.Write(append(line, '\n')); err != nil {
+		log.Printf("write replay decision: %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDestinationMessage(t *testing.T) {
+	message, err := parseDestinationMessage(`{
+		"version": "1.0",
+		"requestContext": {
+			"requestId": "r1",
+			"functionArn": "arn:aws:lambda:us-east-1:111111111111:function:bridge:$LATEST",
+			"condition": "RetriesExhausted",
+			"approximateInvokeCount": 3
+		},
+		"requestPayload": {"awslogs": {"data": "abc"}},
+		"responseContext": {"statusCode": 200, "executedVersion": "$LATEST", "functionError": "Unhandled"},
+		"responsePayload": {"errorMessage": "open gzip payload: gzip: invalid header", "errorType": "wrapError"}
+	}`)
+	require.NoError(t, err)
+	assert.Equal(t, "r1", message.RequestContext.RequestID)
+	assert.Equal(t, "arn:aws:lambda:us-east-1:111111111111:function:bridge:$LATEST", message.RequestContext.FunctionArn)
+	assert.Equal(t, "RetriesExhausted", message.RequestContext.Condition)
+	assert.Equal(t, 3, message.RequestContext.ApproximateInvokeCount)
+	assert.Equal(t, "Unhandled", message.ResponseContext.FunctionError)
+	assert.Equal(t, "wrapError", message.ResponsePayload.ErrorType)
+	assert.Equal(t, "open gzip payload: gzip: invalid header", message.ResponsePayload.ErrorMessage)
+
+	// Response payloads that are not error objects are ignored.
+	message, err = parseDestinationMessage(`{"requestPayload":{"k":"v"},"responsePayload":"timed out"}`)
+	require.NoError(t, err)
+	assert.Empty(t, message.ResponsePayload)
+}
+
+func TestClassifyFunctionError(t *testing.T) {
+	tests := []struct {
+		errorType    string
+		errorMessage string
+		retryable    bool
+	}{
+		{"errorString", "event missing awslogs.data", false},
+		{"wrapError", "decode awslogs.data: illegal base64 data at input byte 4", false},
+		{"wrapError", "open gzip payload: gzip: invalid header", false},
+		{"wrapError", "read gzip payload: unexpected EOF", false},
+		{"wrapError", "parse cloudwatch payload: unexpected end of JSON input", false},
+		{"UnmarshalTypeError", "json: cannot unmarshal string into Go value of type main.cloudWatchLogsEvent", false},
+		{"wrapError", "publish to pubsub: rpc error: code = Unavailable", true},
+		{"Sandbox.Timedout", "Task timed out after 60.00 seconds", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.errorMessage, func(t *testing.T) {
+			classification := classifyFunctionError(tt.errorType, tt.errorMessage, true)
+			assert.Equal(t, tt.retryable, classification.Retryable)
+			assert.NotEmpty(t, classification.Reason)
+
+			assert.Equal(t, errorClassification{Retryable: true, Reason: "function error may be transient"},
+				classifyFunctionError(tt.errorType, tt.errorMessage, false), "other functions' errors are not the bridge's")
+		})
+	}
+}
+
+func TestClassifyRecord(t *testing.T) {
+	assert.False(t, classifyRecord(asyncDestinationMessage{}, errors.New("bad json"), true).Retryable)
+
+	var expired asyncDestinationMessage
+	expired.RequestContext.Condition = "EventAgeExceeded"
+	assert.Equal(t, errorClassification{Retryable: true, Reason: "no bridge error recorded"}, classifyRecord(expired, nil, true))
+
+	var undecodable asyncDestinationMessage
+	undecodable.ResponsePayload.ErrorMessage = "decode awslogs.data: illegal base64 data at input byte 0"
+	assert.False(t, classifyRecord(undecodable, nil, true).Retryable)
+	assert.True(t, classifyRecord(undecodable, nil, false).Retryable)
+}
+
+func readDecisions(t *testing.T, buf *bytes.Buffer) map[string]replayDecision {
+	t.Helper()
+	decisions := map[string]replayDecision{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var decision replayDecision
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &decision))
+		decisions[decision.MessageID] = decision
+	}
+	return decisions
+}
+
+func TestHandlerClassifiesRecords(t *testing.T) {
+	resetReplayerTestState()
+	t.Cleanup(resetReplayerTestState)
+
+	t.Setenv("TARGET_BRIDGE_FUNCTION_NAME", "bridge")
+	t.Setenv("REPLAY_MAX_ATTEMPTS", "5")
+	t.Setenv("DLQ_QUEUE_URL", "https://sqs/dlq")
+	t.Setenv("PARKING_LOT_QUEUE_URL", "https://sqs/parking")
+	t.Setenv("METRICS_NAMESPACE", "")
+
+	var decisions bytes.Buffer
+	decisionWriter = &decisions
+	getLambdaClientFunc = func(ctx context.Context) (lambdaInvoker, error) {
+		return &fakeLambdaInvoker{}, nil
+	}
+	getSQSClientFunc = func(ctx context.Context) (sqsClientAPI, error) {
+		return &fakeSQSClient{}, nil
+	}
+	var replayed []string
+	replayOneFunc = func(ctx context.Context, client lambdaInvoker, cfg replayerConfig, record events.SQSMessage) error {
+		replayed = append(replayed, record.MessageId)
+		switch record.MessageId {
+		case "replay-decode-error":
+			return &functionError{FunctionError: "Unhandled", ErrorType: "wrapError", ErrorMessage: "parse cloudwatch payload: invalid character"}
+		case "transient":
+			return &functionError{FunctionError: "Unhandled", ErrorType: "wrapError", ErrorMessage: "publish to pubsub: unavailable"}
+		}
+		return nil
+	}
+	parked := map[string]string{}
+	parkOneFunc = func(ctx context.Context, client sqsClientAPI, cfg replayerConfig, record events.SQSMessage, attempts int, errorType, errorMessage, reason string) error {
+		parked[record.MessageId] = reason
+		return nil
+	}
+
+	destinationRecord := func(id, errorMessage string) events.SQSMessage {
+		return events.SQSMessage{
+			MessageId: id,
+			Body: mustJSON(t, map[string]interface{}{
+				"requestContext":  map[string]interface{}{"requestId": "req-" + id, "condition": "RetriesExhausted", "approximateInvokeCount": 3},
+				"requestPayload":  map[string]interface{}{"awslogs": map[string]string{"data": "abc"}},
+				"responsePayload": map[string]string{"errorType": "wrapError", "errorMessage": errorMessage},
+			}),
+			Attributes: map[string]string{"ApproximateReceiveCount": "1"},
+		}
+	}
+	resp, err := Handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		destinationRecord("ok", "publish to pubsub: deadline exceeded"),
+		destinationRecord("recorded-decode-error", "open gzip payload: gzip: invalid header"),
+		destinationRecord("replay-decode-error", "publish to pubsub: deadline exceeded"),
+		destinationRecord("transient", "publish to pubsub: unavailable"),
+		{MessageId: "malformed", Body: "not json"},
+	}})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"ok", "replay-decode-error", "transient"}, replayed, "non-retryable records are not replayed")
+	assert.Equal(t, map[string]string{
+		"recorded-decode-error": "event payload cannot be decoded",
+		"replay-decode-error":   "event payload cannot be decoded",
+		"malformed":             "DLQ record is not an async destination record",
+	}, parked)
+	assert.Empty(t, resp.BatchItemFailures, "the transient failure is requeued with its attempt counted")
+
+	logged := readDecisions(t, &decisions)
+	require.Len(t, logged, 5)
+	assert.Equal(t, replayDecision{
+		MessageID:              "ok",
+		RequestID:              "req-ok",
+		Condition:              "RetriesExhausted",
+		ApproximateInvokeCount: 3,
+		ReceiveCount:           1,
+		ReplayAttempts:         1,
+		ErrorType:              "wrapError",
+		ErrorMessage:           "publish to pubsub: deadline exceeded",
+		Decision:               decisionReplayed,
+		Reason:                 "replay succeeded",
+	}, logged["ok"])
+	assert.Equal(t, decisionParked, logged["recorded-decode-error"].Decision)
+	assert.Equal(t, decisionParked, logged["replay-decode-error"].Decision)
+	assert.Equal(t, "parse cloudwatch payload: invalid character", logged["replay-decode-error"].ErrorMessage, "the replay error replaces the recorded one")
+	assert.Equal(t, decisionRequeued, logged["transient"].Decision)
+	assert.Equal(t, "replay failed on attempt 1 of 5; sent back to the DLQ", logged["transient"].Reason)
+	assert.Equal(t, decisionParked, logged["malformed"].Decision)
+	assert.Contains(t, logged["malformed"].ErrorMessage, "parse async destination message")
+}
+
+func TestHandlerKeepsNonRetryableRecordsWithoutParkingLot(t *testing.T) {
+	resetReplayerTestState()
+	t.Cleanup(resetReplayerTestState)
+
+	t.Setenv("TARGET_BRIDGE_FUNCTION_NAME", "bridge")
+	t.Setenv("REPLAY_MAX_ATTEMPTS", "0")
+
+	var decisions bytes.Buffer
+	decisionWriter = &decisions
+	getLambdaClientFunc = func(ctx context.Context) (lambdaInvoker, error) {
+		return &fakeLambdaInvoker{}, nil
+	}
+
+	resp, err := Handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{MessageId: "malformed", Body: "{}"}}})
+	require.NoError(t, err)
+	assert.Equal(t, []events.SQSBatchItemFailure{{ItemIdentifier: "malformed"}}, resp.BatchItemFailures)
+
+	logged := readDecisions(t, &decisions)
+	assert.Equal(t, decisionRetry, logged["malformed"].Decision)
+	assert.Equal(t, "DLQ record is not an async destination record; parking is disabled", logged["malformed"].Reason)
+}
@@ -0,0 +1,39 @@
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Publisher publishes a CloudWatch Logs subscription event the way the bridge
+// does when it is invoked with it. It returns the bridge handler's error
+// unchanged, so the error classifies like one reported by an invoked bridge.
+type Publisher func(ctx context.Context, payload json.RawMessage) error
+
+var publishOneFunc = publishOne
+
+func publishOne(ctx context.Context, publish Publisher, record events.SQSMessage) error {
+	message, err := parseDestinationMessage(record.Body)
+	if err != nil {
+		return err
+	}
+	return publish(ctx, message.RequestPayload)
+}
+
+// classifyPublishError classifies an error from direct publishing. An event
+// that does not unmarshal fails like an invoked bridge fails with a
+// SyntaxError or UnmarshalTypeError.
+func classifyPublishError(err error) errorClassification {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return classifyFunctionError("SyntaxError", err.Error(), true)
+	case errors.As(err, &typeErr):
+		return classifyFunctionError("UnmarshalTypeError", err.Error(), true)
+	}
+	return classifyFunctionError("", err.Error(), true)
+}
@@ -0,0 +1,89 @@
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectHandler(t *testing.T) {
+	resetReplayerTestState()
+	t.Cleanup(resetReplayerTestState)
+
+	t.Setenv("TARGET_BRIDGE_FUNCTION_NAME", "bridge")
+	t.Setenv("REPLAY_MAX_ATTEMPTS", "5")
+	t.Setenv("DLQ_QUEUE_URL", "https://sqs/dlq")
+	t.Setenv("PARKING_LOT_QUEUE_URL", "https://sqs/parking")
+	t.Setenv("REPLAY_CONCURRENCY", "4")
+
+	getLambdaClientFunc = func(ctx context.Context) (lambdaInvoker, error) {
+		return nil, errors.New("direct replay must not invoke the bridge")
+	}
+	getSQSClientFunc = func(ctx context.Context) (sqsClientAPI, error) {
+		return &fakeSQSClient{}, nil
+	}
+	parked := map[string]string{}
+	parkOneFunc = func(ctx context.Context, client sqsClientAPI, cfg replayerConfig, record events.SQSMessage, attempts int, errorType, errorMessage, reason string) error {
+		parked[record.MessageId] = reason
+		return nil
+	}
+
+	var published []string
+	publish := func(ctx context.Context, payload json.RawMessage) error {
+		var event struct {
+			AWSLogs struct {
+				Data string `json:"data"`
+			} `json:"awslogs"`
+		}
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return err
+		}
+		published = append(published, event.AWSLogs.Data)
+		switch event.AWSLogs.Data {
+		case "undecodable":
+			return errors.New("decode awslogs.data: illegal base64 data at input byte 4")
+		case "unavailable":
+			return errors.New("publish to pubsub: unavailable")
+		}
+		return nil
+	}
+
+	record := func(id, payload string) events.SQSMessage {
+		return events.SQSMessage{
+			MessageId:  id,
+			Body:       `{"requestPayload":` + payload + `}`,
+			Attributes: map[string]string{"ApproximateReceiveCount": "1"},
+		}
+	}
+	resp, err := DirectHandler(publish)(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		record("ok", `{"awslogs":{"data":"ok"}}`),
+		record("undecodable", `{"awslogs":{"data":"undecodable"}}`),
+		record("unavailable", `{"awslogs":{"data":"unavailable"}}`),
+		record("not-an-event", `{"awslogs":[]}`),
+	}})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"ok", "undecodable", "unavailable"}, published, "records are published one at a time, in order")
+	assert.Equal(t, map[string]string{
+		"undecodable":  "event payload cannot be decoded",
+		"not-an-event": "event is not a CloudWatch Logs subscription event",
+	}, parked)
+	assert.Empty(t, resp.BatchItemFailures, "the failed publish is requeued with its attempt counted")
+}
+
+func TestDirectHandlerRejectsRouting(t *testing.T) {
+	resetReplayerTestState()
+	t.Cleanup(resetReplayerTestState)
+
+	t.Setenv("TARGET_BRIDGE_FUNCTION_NAME", "bridge")
+	t.Setenv("REPLAY_ROUTE_TO_ORIGIN", "true")
+	t.Setenv("REPLAY_ALLOWED_FUNCTION_ARNS", bridgeARN)
+
+	_, err := DirectHandler(func(context.Context, json.RawMessage) error { return nil })(context.Background(), events.SQSEvent{})
+	require.ErrorContains(t, err, "REPLAY_ROUTE_TO_ORIGIN cannot be used with direct replay")
+}
@@ -0,0 +1,67 @@
+package replay
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/fleetdm/fleet/terraform/addons/byo-cloudwatch-log-sharing/pubsub-bridge/lambda/emf"
+)
+
+type metricValue = emf.Value
+
+var metricsWriter io.Writer = os.Stdout
+
+// emitMetrics writes a CloudWatch embedded metric format record to stdout.
+func emitMetrics(namespace string, dimensions map[string]string, metrics map[string]metricValue) {
+	emf.Write(metricsWriter, namespace, dimensions, metrics)
+}
+
+// emitReplayMetrics emits a batch's metrics along with the replay lag of each
+// record it replayed. Lags beyond the first emf.MaxValues go in records of
+// their own.
+func emitReplayMetrics(namespace string, dimensions map[string]string, metrics map[string]metricValue, lags []float64) {
+	first := min(len(lags), emf.MaxValues)
+	if first > 0 {
+		metrics["ReplayLag"] = metricValue{Values: lags[:first], Unit: "Seconds"}
+	}
+	emitMetrics(namespace, dimensions, metrics)
+	for start := first; start < len(lags); start += emf.MaxValues {
+		end := min(start+emf.MaxValues, len(lags))
+		emitMetrics(namespace, dimensions, map[string]metricValue{"ReplayLag": {Values: lags[start:end], Unit: "Seconds"}})
+	}
+}
+
+// failedAt returns when the invocation that record records failed: the time
+// Lambda put in the destination record or, for records without one, when the
+// record was sent to the DLQ.
+func failedAt(message asyncDestinationMessage, record events.SQSMessage) (time.Time, bool) {
+	if !message.Timestamp.IsZero() {
+		return message.Timestamp, true
+	}
+	sentMillis, err := strconv.ParseInt(record.Attributes["SentTimestamp"], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(sentMillis), true
+}
+
+// replayLags collects the replay lags of a batch replayed concurrently, by
+// metric function.
+type replayLags struct {
+	mu      sync.Mutex
+	seconds map[string][]float64
+}
+
+func (l *replayLags) add(function string, lag time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.seconds == nil {
+		l.seconds = map[string][]float64{}
+	}
+	l.seconds[function] = append(l.seconds[function], lag.Seconds())
+}
@@ -0,0 +1,73 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readMetrics(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var record map[string]any
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestEmitReplayMetrics(t *testing.T) {
+	t.Cleanup(resetReplayerTestState)
+	var buf bytes.Buffer
+	metricsWriter = &buf
+
+	lags := make([]float64, 150)
+	for i := range lags {
+		lags[i] = float64(i)
+	}
+	emitReplayMetrics("Fleet", map[string]string{"FunctionName": "bridge"}, map[string]metricValue{
+		"ReplayedEvents": {Value: 150, Unit: "Count"},
+	}, lags)
+
+	records := readMetrics(t, &buf)
+	require.Len(t, records, 2, "lags beyond the first 100 go in a record of their own")
+	assert.Equal(t, float64(150), records[0]["ReplayedEvents"])
+	assert.Len(t, records[0]["ReplayLag"], 100)
+	assert.NotContains(t, records[1], "ReplayedEvents")
+	assert.Len(t, records[1]["ReplayLag"], 50)
+	assert.Equal(t, "bridge", records[1]["FunctionName"])
+
+	// Without lags only the counts are emitted.
+	emitReplayMetrics("Fleet", nil, map[string]metricValue{"ReplayedEvents": {Value: 0, Unit: "Count"}}, nil)
+	records = readMetrics(t, &buf)
+	require.Len(t, records, 1)
+	assert.NotContains(t, records[0], "ReplayLag")
+}
+
+func TestFailedAt(t *testing.T) {
+	failed := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	sent := events.SQSMessage{Attributes: map[string]string{"SentTimestamp": "1773144060000"}}
+
+	message, err := parseDestinationMessage(`{"timestamp":"2026-03-10T12:00:00.000Z","requestPayload":{}}`)
+	require.NoError(t, err)
+	at, ok := failedAt(message, sent)
+	require.True(t, ok)
+	assert.True(t, failed.Equal(at), "the destination record's timestamp is preferred")
+
+	message, err = parseDestinationMessage(`{"requestPayload":{}}`)
+	require.NoError(t, err)
+	at, ok = failedAt(message, sent)
+	require.True(t, ok)
+	assert.True(t, failed.Add(time.Minute).Equal(at))
+
+	_, ok = failedAt(message, events.SQSMessage{})
+	assert.False(t, ok)
+}
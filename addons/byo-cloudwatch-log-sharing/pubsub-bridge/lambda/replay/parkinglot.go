@@ -0,0 +1,208 @@
+package replay
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// replayAttemptsAttribute counts the replays of a DLQ message. SQS cannot
+// change the attributes of a message, so a record whose replay failed is sent
+// back to the DLQ with the count raised.
+const replayAttemptsAttribute = "replay_attempts"
+
+// maxDelay is the longest SQS lets a message be delayed.
+const maxDelay = 15 * time.Minute
+
+// maxParkedErrorBytes bounds the last error kept on a parked message, so the
+// attribute cannot push a large DLQ message over the SQS size limit.
+const maxParkedErrorBytes = 1024
+
+type sqsClientAPI interface {
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+	ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error)
+}
+
+var (
+	sqsClientOnce sync.Once
+	sqsClient     sqsClientAPI
+	sqsClientErr  error
+
+	getSQSClientFunc  = getSQSClient
+	parkOneFunc       = parkOne
+	requeueRecordFunc = requeueRecord
+)
+
+// getMaxAttempts returns how many times a DLQ message is replayed before it is
+// parked. Zero replays it until the DLQ's retention expires.
+func getMaxAttempts() (int, error) {
+	value := strings.TrimSpace(os.Getenv("REPLAY_MAX_ATTEMPTS"))
+	if value == "" {
+		return 0, nil
+	}
+	attempts, err := strconv.Atoi(value)
+	if err != nil || attempts < 0 {
+		return 0, fmt.Errorf("REPLAY_MAX_ATTEMPTS must be a non-negative integer, got %q", value)
+	}
+	return attempts, nil
+}
+
+func getSQSClient(ctx context.Context) (sqsClientAPI, error) {
+	sqsClientOnce.Do(func() {
+		cfg, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			sqsClientErr = fmt.Errorf("load aws sdk config: %w", err)
+			return
+		}
+		sqsClient = sqs.NewFromConfig(cfg)
+	})
+
+	if sqsClientErr != nil {
+		return nil, sqsClientErr
+	}
+	return sqsClient, nil
+}
+
+// getRetryDelay returns how long a record whose replay failed waits on the
+// DLQ before it is replayed again.
+func getRetryDelay() (time.Duration, error) {
+	value := strings.TrimSpace(os.Getenv("REPLAY_RETRY_DELAY_SECONDS"))
+	if value == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 || seconds > int(maxDelay/time.Second) {
+		return 0, fmt.Errorf("REPLAY_RETRY_DELAY_SECONDS must be between 0 and %d, got %q", int(maxDelay/time.Second), value)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// receiveCount is the number of times SQS has delivered record, including
+// this delivery. Deliveries deferred by the circuit breaker count too, so it
+// is logged but not used to park records.
+func receiveCount(record events.SQSMessage) int {
+	count, err := strconv.Atoi(record.Attributes["ApproximateReceiveCount"])
+	if err != nil || count < 1 {
+		return 1
+	}
+	return count
+}
+
+// replayAttempts returns how many times record was replayed before this
+// delivery. Deliveries deferred by the circuit breaker, or left for a later
+// attempt without a replay, are not counted. Records moved back from the
+// parking lot still carry its attributes, and start counting again.
+func replayAttempts(record events.SQSMessage) int {
+	if _, parked := record.MessageAttributes["replay_parked_at"]; parked {
+		return 0
+	}
+	attribute, ok := record.MessageAttributes[replayAttemptsAttribute]
+	if !ok || attribute.StringValue == nil {
+		return 0
+	}
+	attempts, err := strconv.Atoi(*attribute.StringValue)
+	if err != nil || attempts < 0 {
+		return 0
+	}
+	return attempts
+}
+
+// shouldPark reports whether a record whose replay just failed, for the
+// attempts-th time, has used up its attempts.
+func shouldPark(cfg replayerConfig, attempts int) bool {
+	return cfg.MaxAttempts > 0 && attempts >= cfg.MaxAttempts
+}
+
+// originAttributes returns the ID and, when known, the time the record's
+// first DLQ message was sent, which a requeued record carries as attributes.
+func originAttributes(record events.SQSMessage) map[string]sqstypes.MessageAttributeValue {
+	attributes := map[string]sqstypes.MessageAttributeValue{
+		"dlq_message_id": stringAttribute(record.MessageId),
+	}
+	if sentMillis, err := strconv.ParseInt(record.Attributes["SentTimestamp"], 10, 64); err == nil {
+		attributes["dlq_sent_at"] = stringAttribute(time.UnixMilli(sentMillis).UTC().Format(time.RFC3339))
+	}
+	for _, name := range []string{"dlq_message_id", "dlq_sent_at"} {
+		if value := record.MessageAttributes[name]; value.StringValue != nil {
+			attributes[name] = stringAttribute(*value.StringValue)
+		}
+	}
+	return attributes
+}
+
+// requeueRecord sends record back to the DLQ with its body unchanged and
+// attempts as its replay count, to be replayed again after cfg.RetryDelay.
+// The record it was received as is then deleted.
+func requeueRecord(ctx context.Context, client sqsClientAPI, cfg replayerConfig, record events.SQSMessage, attempts int) error {
+	attributes := originAttributes(record)
+	attributes[replayAttemptsAttribute] = numberAttribute(attempts)
+
+	if _, err := client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(cfg.DLQQueueURL),
+		MessageBody:       aws.String(record.Body),
+		MessageAttributes: attributes,
+		DelaySeconds:      int32(cfg.RetryDelay / time.Second),
+	}); err != nil {
+		return fmt.Errorf("send back to dlq: %w", err)
+	}
+	return nil
+}
+
+// parkOne sends record to the parking-lot queue with its body unchanged, so it
+// can be moved back to the DLQ as is, and the last error and the reason it was
+// parked as message attributes.
+func parkOne(ctx context.Context, client sqsClientAPI, cfg replayerConfig, record events.SQSMessage, attempts int, errorType, errorMessage, reason string) error {
+	attributes := originAttributes(record)
+	attributes[replayAttemptsAttribute] = numberAttribute(attempts)
+	attributes["replay_last_error"] = stringAttribute(truncateError(errorMessage))
+	attributes["replay_park_reason"] = stringAttribute(reason)
+	attributes["replay_parked_at"] = stringAttribute(time.Now().UTC().Format(time.RFC3339))
+	if errorType != "" {
+		attributes["replay_last_error_type"] = stringAttribute(errorType)
+	}
+
+	if _, err := client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(cfg.ParkingLotQueueURL),
+		MessageBody:       aws.String(record.Body),
+		MessageAttributes: attributes,
+	}); err != nil {
+		return fmt.Errorf("send to parking-lot queue: %w", err)
+	}
+	return nil
+}
+
+func stringAttribute(value string) sqstypes.MessageAttributeValue {
+	return sqstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+}
+
+func numberAttribute(value int) sqstypes.MessageAttributeValue {
+	return sqstypes.MessageAttributeValue{DataType: aws.String("Number"), StringValue: aws.String(strconv.Itoa(value))}
+}
+
+// truncateError shortens message to maxParkedErrorBytes without splitting a
+// character. SQS rejects empty string attributes, so an empty message is
+// replaced too.
+func truncateError(message string) string {
+	if message == "" {
+		return "unknown error"
+	}
+	if len(message) <= maxParkedErrorBytes {
+		return message
+	}
+	n := maxParkedErrorBytes
+	for n > 0 && !utf8.RuneStart(message[n]) {
+		n--
+	}
+	return message[:n]
+}
@@ -0,0 +1,257 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSQSClient struct {
+	sendFn             func(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+	changeVisibilityFn func(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error)
+}
+
+func (f *fakeSQSClient) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	if f.sendFn != nil {
+		return f.sendFn(ctx, params, optFns...)
+	}
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func (f *fakeSQSClient) ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error) {
+	if f.changeVisibilityFn != nil {
+		return f.changeVisibilityFn(ctx, params, optFns...)
+	}
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func TestGetMaxAttempts(t *testing.T) {
+	t.Setenv("REPLAY_MAX_ATTEMPTS", "")
+	attempts, err := getMaxAttempts()
+	require.NoError(t, err)
+	assert.Equal(t, 0, attempts)
+
+	t.Setenv("REPLAY_MAX_ATTEMPTS", "5")
+	attempts, err = getMaxAttempts()
+	require.NoError(t, err)
+	assert.Equal(t, 5, attempts)
+
+	for _, value := range []string{"-1", "five"} {
+		t.Setenv("REPLAY_MAX_ATTEMPTS", value)
+		_, err = getMaxAttempts()
+		require.ErrorContains(t, err, "REPLAY_MAX_ATTEMPTS must be a non-negative integer")
+	}
+}
+
+func TestLoadConfigRequiresParkingLot(t *testing.T) {
+	t.Setenv("TARGET_BRIDGE_FUNCTION_NAME", "bridge")
+	t.Setenv("REPLAY_MAX_ATTEMPTS", "3")
+	t.Setenv("PARKING_LOT_QUEUE_URL", "")
+	_, err := loadConfig()
+	require.ErrorContains(t, err, "PARKING_LOT_QUEUE_URL is required")
+
+	t.Setenv("PARKING_LOT_QUEUE_URL", "https://sqs/parking")
+	t.Setenv("DLQ_QUEUE_URL", "")
+	_, err = loadConfig()
+	require.ErrorContains(t, err, "DLQ_QUEUE_URL is required", "failed replays are requeued on the DLQ")
+
+	t.Setenv("DLQ_QUEUE_URL", "https://sqs/dlq")
+	t.Setenv("REPLAY_RETRY_DELAY_SECONDS", "901")
+	_, err = loadConfig()
+	require.ErrorContains(t, err, "REPLAY_RETRY_DELAY_SECONDS must be between 0 and 900")
+
+	t.Setenv("REPLAY_RETRY_DELAY_SECONDS", "300")
+	cfg, err := loadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, 3, cfg.MaxAttempts)
+	assert.Equal(t, 5*time.Minute, cfg.RetryDelay)
+	assert.Equal(t, "https://sqs/parking", cfg.ParkingLotQueueURL)
+}
+
+func TestReceiveCount(t *testing.T) {
+	assert.Equal(t, 1, receiveCount(events.SQSMessage{}))
+	assert.Equal(t, 1, receiveCount(events.SQSMessage{Attributes: map[string]string{"ApproximateReceiveCount": "x"}}))
+	assert.Equal(t, 4, receiveCount(events.SQSMessage{Attributes: map[string]string{"ApproximateReceiveCount": "4"}}))
+}
+
+func TestReplayAttempts(t *testing.T) {
+	attempts := func(value string) events.SQSMessage {
+		return events.SQSMessage{MessageAttributes: map[string]events.SQSMessageAttribute{
+			"replay_attempts": {DataType: "Number", StringValue: aws.String(value)},
+		}}
+	}
+	assert.Equal(t, 0, replayAttempts(events.SQSMessage{Attributes: map[string]string{"ApproximateReceiveCount": "7"}}),
+		"deliveries are not replays")
+	assert.Equal(t, 0, replayAttempts(attempts("x")))
+	assert.Equal(t, 2, replayAttempts(attempts("2")))
+
+	unparked := attempts("5")
+	unparked.MessageAttributes["replay_parked_at"] = events.SQSMessageAttribute{DataType: "String", StringValue: aws.String("2024-05-01T10:00:00Z")}
+	assert.Equal(t, 0, replayAttempts(unparked), "events moved back from the parking lot get another max_attempts tries")
+}
+
+func TestRequeueRecord(t *testing.T) {
+	cfg := replayerConfig{DLQQueueURL: "https://sqs/dlq", MaxAttempts: 3, RetryDelay: 5 * time.Minute}
+	record := events.SQSMessage{
+		MessageId:  "m2",
+		Body:       `{"requestPayload":{"awslogs":{"data":"abc"}}}`,
+		Attributes: map[string]string{"SentTimestamp": "1714557660000"},
+		MessageAttributes: map[string]events.SQSMessageAttribute{
+			"replay_attempts": {DataType: "Number", StringValue: aws.String("1")},
+			"dlq_message_id":  {DataType: "String", StringValue: aws.String("m1")},
+			"dlq_sent_at":     {DataType: "String", StringValue: aws.String("2024-05-01T10:00:00Z")},
+		},
+	}
+
+	var input *sqs.SendMessageInput
+	client := &fakeSQSClient{sendFn: func(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+		input = params
+		return &sqs.SendMessageOutput{}, nil
+	}}
+	require.NoError(t, requeueRecord(context.Background(), client, cfg, record, 2))
+
+	require.NotNil(t, input)
+	assert.Equal(t, "https://sqs/dlq", aws.ToString(input.QueueUrl))
+	assert.Equal(t, record.Body, aws.ToString(input.MessageBody))
+	assert.Equal(t, int32(300), input.DelaySeconds)
+	assert.Equal(t, "2", aws.ToString(input.MessageAttributes["replay_attempts"].StringValue))
+	assert.Equal(t, "m1", aws.ToString(input.MessageAttributes["dlq_message_id"].StringValue), "the first DLQ message is kept")
+	assert.Equal(t, "2024-05-01T10:00:00Z", aws.ToString(input.MessageAttributes["dlq_sent_at"].StringValue))
+
+	client.sendFn = func(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+		return nil, errors.New("access denied")
+	}
+	require.ErrorContains(t, requeueRecord(context.Background(), client, cfg, record, 2), "send back to dlq: access denied")
+}
+
+func TestParkOne(t *testing.T) {
+	cfg := replayerConfig{ParkingLotQueueURL: "https://sqs/parking", MaxAttempts: 3}
+	record := events.SQSMessage{
+		MessageId: "m1",
+		Body:      `{"requestPayload":{"awslogs":{"data":"abc"}}}`,
+		Attributes: map[string]string{
+			"ApproximateReceiveCount": "5",
+			"SentTimestamp":           "1714557600000",
+		},
+	}
+
+	var input *sqs.SendMessageInput
+	client := &fakeSQSClient{sendFn: func(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+		input = params
+		return &sqs.SendMessageOutput{}, nil
+	}}
+	require.NoError(t, parkOne(context.Background(), client, cfg, record, 3, "wrapError", "publish to pubsub: unavailable", "replay failed on all 3 attempts"))
+
+	require.NotNil(t, input)
+	assert.Equal(t, "https://sqs/parking", aws.ToString(input.QueueUrl))
+	assert.Equal(t, record.Body, aws.ToString(input.MessageBody), "the body is parked unchanged so it can be moved back to the DLQ")
+	assert.Equal(t, "3", aws.ToString(input.MessageAttributes["replay_attempts"].StringValue))
+	assert.Equal(t, "Number", aws.ToString(input.MessageAttributes["replay_attempts"].DataType))
+	assert.Equal(t, "publish to pubsub: unavailable", aws.ToString(input.MessageAttributes["replay_last_error"].StringValue))
+	assert.Equal(t, "wrapError", aws.ToString(input.MessageAttributes["replay_last_error_type"].StringValue))
+	assert.Equal(t, "replay failed on all 3 attempts", aws.ToString(input.MessageAttributes["replay_park_reason"].StringValue))
+	assert.Equal(t, "m1", aws.ToString(input.MessageAttributes["dlq_message_id"].StringValue))
+	assert.Equal(t, "2024-05-01T10:00:00Z", aws.ToString(input.MessageAttributes["dlq_sent_at"].StringValue))
+	assert.NotEmpty(t, aws.ToString(input.MessageAttributes["replay_parked_at"].StringValue))
+
+	client.sendFn = func(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+		return nil, errors.New("access denied")
+	}
+	require.ErrorContains(t, parkOne(context.Background(), client, cfg, record, 3, "", "x", "y"), "send to parking-lot queue: access denied")
+}
+
+func TestTruncateError(t *testing.T) {
+	assert.Equal(t, "unknown error", truncateError(""))
+	assert.Equal(t, "boom", truncateError("boom"))
+
+	got := truncateError(strings.Repeat("é", maxParkedErrorBytes))
+	assert.LessOrEqual(t, len(got), maxParkedErrorBytes)
+	assert.True(t, strings.HasSuffix(got, "é"), "truncation keeps whole characters")
+}
+
+func TestHandlerParksExhaustedRecords(t *testing.T) {
+	resetReplayerTestState()
+	t.Cleanup(resetReplayerTestState)
+
+	t.Setenv("TARGET_BRIDGE_FUNCTION_NAME", "bridge")
+	t.Setenv("REPLAY_MAX_ATTEMPTS", "3")
+	t.Setenv("PARKING_LOT_QUEUE_URL", "https://sqs/parking")
+	t.Setenv("DLQ_QUEUE_URL", "https://sqs/dlq")
+	t.Setenv("METRICS_NAMESPACE", "Fleet")
+
+	var metrics bytes.Buffer
+	metricsWriter = &metrics
+	decisionWriter = io.Discard
+	getLambdaClientFunc = func(ctx context.Context) (lambdaInvoker, error) {
+		return &fakeLambdaInvoker{}, nil
+	}
+	getSQSClientFunc = func(ctx context.Context) (sqsClientAPI, error) {
+		return &fakeSQSClient{}, nil
+	}
+	replayOneFunc = func(ctx context.Context, client lambdaInvoker, cfg replayerConfig, record events.SQSMessage) error {
+		return errors.New("replay failed")
+	}
+	var parked []string
+	parkOneFunc = func(ctx context.Context, client sqsClientAPI, cfg replayerConfig, record events.SQSMessage, attempts int, errorType, errorMessage, reason string) error {
+		if record.MessageId == "unparkable" {
+			return errors.New("message too large")
+		}
+		assert.Equal(t, "replay failed", errorMessage)
+		assert.Equal(t, "replay failed on all 3 attempts", reason)
+		parked = append(parked, record.MessageId)
+		return nil
+	}
+	requeued := map[string]int{}
+	requeueRecordFunc = func(ctx context.Context, client sqsClientAPI, cfg replayerConfig, record events.SQSMessage, attempts int) error {
+		if record.MessageId == "unrequeueable" {
+			return errors.New("throttled")
+		}
+		requeued[record.MessageId] = attempts
+		return nil
+	}
+
+	attempt := func(id, receives, replays string) events.SQSMessage {
+		record := events.SQSMessage{
+			MessageId:  id,
+			Body:       `{"requestPayload":{"awslogs":{"data":"abc"}}}`,
+			Attributes: map[string]string{"ApproximateReceiveCount": receives},
+		}
+		if replays != "" {
+			record.MessageAttributes = map[string]events.SQSMessageAttribute{
+				"replay_attempts": {DataType: "Number", StringValue: aws.String(replays)},
+			}
+		}
+		return record
+	}
+	resp, err := Handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		attempt("second", "1", "1"),
+		attempt("third", "1", "2"),
+		attempt("tenth", "1", "9"),
+		attempt("unparkable", "1", "2"),
+		attempt("deferred", "10", ""),
+		attempt("unrequeueable", "1", ""),
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"third", "tenth"}, parked)
+	assert.Equal(t, map[string]int{"second": 2, "deferred": 1}, requeued,
+		"failed replays go back to the DLQ with their attempt counted; receives without a replay are not counted")
+	assert.Equal(t, []events.SQSBatchItemFailure{{ItemIdentifier: "unparkable"}, {ItemIdentifier: "unrequeueable"}}, resp.BatchItemFailures,
+		"records neither parked nor requeued stay on the DLQ")
+
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal(metrics.Bytes(), &record))
+	assert.Equal(t, float64(2), record["ParkedEvents"])
+	assert.Equal(t, float64(4), record["FailedEvents"])
+	assert.Equal(t, "bridge", record["FunctionName"])
+}
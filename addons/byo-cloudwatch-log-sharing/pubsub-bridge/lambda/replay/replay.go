@@ -0,0 +1,560 @@
+// Package replay replays the async destination records on the bridge's
+// dead-letter queue. The replayer Lambda invokes the bridge, or another
+// failed function, with each record's original event; in direct mode the
+// bridge binary publishes the events itself. Either way records are
+// classified, archived to S3 when their log events are too old, parked after
+// too many failed replays, and held back while the circuit breaker is open.
+package replay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	awslambda "github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/lambda/types"
+
+	"github.com/fleetdm/fleet/terraform/addons/byo-cloudwatch-log-sharing/pubsub-bridge/lambda/awslogs"
+	"github.com/fleetdm/fleet/terraform/addons/byo-cloudwatch-log-sharing/pubsub-bridge/lambda/dlq"
+)
+
+type asyncDestinationMessage = dlq.Record
+
+type functionError = dlq.FunctionError
+
+type replayerConfig struct {
+	TargetFunctionName  string
+	RouteToOrigin       bool
+	AllowedFunctionARNs map[string]bool
+	InvocationType      types.InvocationType
+	MaxAttempts         int
+	RetryDelay          time.Duration
+	ParkingLotQueueURL  string
+	DLQQueueURL         string
+	MetricsNamespace    string
+	Concurrency         int
+	Breaker             breakerConfig
+	Archive             archiveConfig
+}
+
+type lambdaInvoker interface {
+	Invoke(ctx context.Context, params *awslambda.InvokeInput, optFns ...func(*awslambda.Options)) (*awslambda.InvokeOutput, error)
+}
+
+var (
+	lambdaClientOnce sync.Once
+	lambdaClient     lambdaInvoker
+	lambdaClientErr  error
+
+	getLambdaClientFunc = getLambdaClient
+	replayOneFunc       = replayOne
+)
+
+// replayDeadlineMargin is kept free before the replayer's own deadline so that
+// records not yet replayed can be reported as batch item failures.
+const replayDeadlineMargin = 2 * time.Second
+
+func getTargetFunctionName() (string, error) {
+	name := strings.TrimSpace(os.Getenv("TARGET_BRIDGE_FUNCTION_NAME"))
+	if name == "" {
+		return "", errors.New("missing required environment variable: TARGET_BRIDGE_FUNCTION_NAME")
+	}
+	return name, nil
+}
+
+// getInvocationType returns how the bridge is invoked. RequestResponse waits
+// for the bridge to publish; Event only waits for Lambda to queue the event.
+func getInvocationType() (types.InvocationType, error) {
+	value := strings.TrimSpace(os.Getenv("REPLAY_INVOCATION_TYPE"))
+	switch types.InvocationType(value) {
+	case "":
+		return types.InvocationTypeRequestResponse, nil
+	case types.InvocationTypeRequestResponse, types.InvocationTypeEvent:
+		return types.InvocationType(value), nil
+	}
+	return "", fmt.Errorf("REPLAY_INVOCATION_TYPE must be RequestResponse or Event, got %q", value)
+}
+
+func loadConfig() (replayerConfig, error) {
+	targetFunctionName, err := getTargetFunctionName()
+	if err != nil {
+		return replayerConfig{}, err
+	}
+	invocationType, err := getInvocationType()
+	if err != nil {
+		return replayerConfig{}, err
+	}
+	routeToOrigin, allowedFunctionARNs, err := getRouting()
+	if err != nil {
+		return replayerConfig{}, err
+	}
+	maxAttempts, err := getMaxAttempts()
+	if err != nil {
+		return replayerConfig{}, err
+	}
+	parkingLotQueueURL := strings.TrimSpace(os.Getenv("PARKING_LOT_QUEUE_URL"))
+	if maxAttempts > 0 && parkingLotQueueURL == "" {
+		return replayerConfig{}, errors.New("PARKING_LOT_QUEUE_URL is required when REPLAY_MAX_ATTEMPTS is set")
+	}
+	retryDelay, err := getRetryDelay()
+	if err != nil {
+		return replayerConfig{}, err
+	}
+	concurrency, err := getPositiveInt("REPLAY_CONCURRENCY", 1)
+	if err != nil {
+		return replayerConfig{}, err
+	}
+	breaker, err := loadBreakerConfig()
+	if err != nil {
+		return replayerConfig{}, err
+	}
+	archive, err := loadArchiveConfig()
+	if err != nil {
+		return replayerConfig{}, err
+	}
+	dlqQueueURL := strings.TrimSpace(os.Getenv("DLQ_QUEUE_URL"))
+	if breaker.FailureThreshold > 0 && dlqQueueURL == "" {
+		return replayerConfig{}, errors.New("DLQ_QUEUE_URL is required when REPLAY_BREAKER_FAILURE_THRESHOLD is set")
+	}
+	if maxAttempts > 0 && dlqQueueURL == "" {
+		return replayerConfig{}, errors.New("DLQ_QUEUE_URL is required when REPLAY_MAX_ATTEMPTS is set")
+	}
+	return replayerConfig{
+		TargetFunctionName:  targetFunctionName,
+		RouteToOrigin:       routeToOrigin,
+		AllowedFunctionARNs: allowedFunctionARNs,
+		InvocationType:      invocationType,
+		MaxAttempts:         maxAttempts,
+		RetryDelay:          retryDelay,
+		ParkingLotQueueURL:  parkingLotQueueURL,
+		DLQQueueURL:         dlqQueueURL,
+		MetricsNamespace:    strings.TrimSpace(os.Getenv("METRICS_NAMESPACE")),
+		Concurrency:         concurrency,
+		Breaker:             breaker,
+		Archive:             archive,
+	}, nil
+}
+
+func getLambdaClient(ctx context.Context) (lambdaInvoker, error) {
+	lambdaClientOnce.Do(func() {
+		cfg, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			lambdaClientErr = fmt.Errorf("load aws sdk config: %w", err)
+			return
+		}
+		lambdaClient = awslambda.NewFromConfig(cfg)
+	})
+
+	if lambdaClientErr != nil {
+		return nil, lambdaClientErr
+	}
+	return lambdaClient, nil
+}
+
+func parseDestinationMessage(body string) (asyncDestinationMessage, error) {
+	return dlq.ParseRecord(body)
+}
+
+func replayOne(ctx context.Context, client lambdaInvoker, cfg replayerConfig, record events.SQSMessage) error {
+	message, err := parseDestinationMessage(record.Body)
+	if err != nil {
+		return err
+	}
+	target, err := cfg.targetFor(message)
+	if err != nil {
+		return err
+	}
+
+	description := "bridge lambda"
+	if !target.Bridge {
+		description = "lambda " + target.FunctionName
+	}
+
+	resp, err := client.Invoke(ctx, &awslambda.InvokeInput{
+		FunctionName:   aws.String(target.FunctionName),
+		InvocationType: cfg.InvocationType,
+		Payload:        message.RequestPayload,
+	})
+	if err != nil {
+		return fmt.Errorf("invoke %s: %w", description, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("invoke %s unexpected status code: %d", description, resp.StatusCode)
+	}
+
+	if cfg.InvocationType != types.InvocationTypeRequestResponse {
+		return nil
+	}
+	if target.Bridge {
+		return dlq.CheckBridgeResponse(resp)
+	}
+	return dlq.CheckFunctionResponse(target.FunctionName, resp)
+}
+
+// Handler replays a batch of DLQ records by invoking their target function.
+func Handler(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return events.SQSEventResponse{}, err
+	}
+
+	client, err := getLambdaClientFunc(ctx)
+	if err != nil {
+		return events.SQSEventResponse{}, err
+	}
+
+	return handle(ctx, event, recordProcessor{client: client, cfg: cfg})
+}
+
+// DirectHandler returns a handler that replays a batch of DLQ records by
+// passing their original events to publish instead of invoking the bridge.
+func DirectHandler(publish Publisher) func(context.Context, events.SQSEvent) (events.SQSEventResponse, error) {
+	return func(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+		cfg, err := loadConfig()
+		if err != nil {
+			return events.SQSEventResponse{}, err
+		}
+		if cfg.RouteToOrigin {
+			return events.SQSEventResponse{}, errors.New("REPLAY_ROUTE_TO_ORIGIN cannot be used with direct replay")
+		}
+		// The bridge handles one event at a time, as Lambda invokes it.
+		cfg.Concurrency = 1
+
+		return handle(ctx, event, recordProcessor{publish: publish, cfg: cfg})
+	}
+}
+
+// handle processes a batch with r and reports the records to keep on the DLQ.
+func handle(ctx context.Context, event events.SQSEvent, r recordProcessor) (events.SQSEventResponse, error) {
+	cfg := r.cfg
+	breaker := getBreaker(cfg.Breaker)
+
+	var queues sqsClientAPI
+	if cfg.MaxAttempts > 0 || breaker != nil {
+		var err error
+		if queues, err = getSQSClientFunc(ctx); err != nil {
+			return events.SQSEventResponse{}, err
+		}
+	}
+
+	if cfg.Archive.MaxEventAge > 0 {
+		archiver, err := getS3ClientFunc(ctx)
+		if err != nil {
+			return events.SQSEventResponse{}, err
+		}
+		r.archiver = archiver
+		r.archived = &archiveIndex{}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline.Add(-replayDeadlineMargin))
+		defer cancel()
+	}
+
+	r.queues = queues
+	r.breaker = breaker
+	r.lags = &replayLags{}
+	decisions, functions := r.processAll(ctx, event.Records)
+	r.indexArchived(ctx, decisions)
+
+	failures := make([]events.SQSBatchItemFailure, 0)
+	// Counts are kept per function, so a routed function's failures are not
+	// put down to the bridge. The bridge always gets a record.
+	counts := map[string]map[string]int{cfg.TargetFunctionName: {}}
+	for i, record := range event.Records {
+		if counts[functions[i]] == nil {
+			counts[functions[i]] = map[string]int{}
+		}
+		counts[functions[i]][decisions[i]]++
+		if decisions[i] == decisionRetry || decisions[i] == decisionSkipped || decisions[i] == decisionDeferred {
+			failures = append(failures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+		}
+	}
+
+	names := make([]string, 0, len(counts))
+	for function := range counts {
+		names = append(names, function)
+	}
+	sort.Strings(names)
+	for _, function := range names {
+		metrics := replayMetrics(cfg, counts[function], breaker)
+		if breaker != nil && function == cfg.TargetFunctionName {
+			// The breaker is shared by every function, and reported with
+			// the bridge.
+			open := 0.0
+			if breaker.tripped() {
+				open = 1
+			}
+			metrics["CircuitBreakerOpen"] = metricValue{Value: open, Unit: "None"}
+		}
+		emitReplayMetrics(cfg.MetricsNamespace, map[string]string{"FunctionName": function}, metrics, r.lags.seconds[function])
+	}
+
+	return events.SQSEventResponse{BatchItemFailures: failures}, nil
+}
+
+// replayMetrics returns the metrics for one function's records of a batch,
+// from how many got each decision.
+func replayMetrics(cfg replayerConfig, counts map[string]int, breaker *circuitBreaker) map[string]metricValue {
+	// Records deferred by the breaker are skipped too: none of them got a
+	// replay.
+	metrics := map[string]metricValue{
+		"ReplayedEvents": {Value: float64(counts[decisionReplayed]), Unit: "Count"},
+		"FailedEvents":   {Value: float64(counts[decisionRetry] + counts[decisionRequeued]), Unit: "Count"},
+		"ParkedEvents":   {Value: float64(counts[decisionParked]), Unit: "Count"},
+		"SkippedEvents":  {Value: float64(counts[decisionSkipped] + counts[decisionDeferred]), Unit: "Count"},
+	}
+	if cfg.Archive.MaxEventAge > 0 {
+		metrics["ArchivedEvents"] = metricValue{Value: float64(counts[decisionArchived]), Unit: "Count"}
+	}
+	if breaker != nil {
+		metrics["DeferredEvents"] = metricValue{Value: float64(counts[decisionDeferred]), Unit: "Count"}
+	}
+	return metrics
+}
+
+// recordProcessor decides what happens to each DLQ record of a batch. It
+// replays records with publish when set, and by invoking client otherwise.
+type recordProcessor struct {
+	client   lambdaInvoker
+	publish  Publisher
+	queues   sqsClientAPI
+	archiver s3Putter
+	archived *archiveIndex
+	lags     *replayLags
+	cfg      replayerConfig
+	breaker  *circuitBreaker
+}
+
+// processAll processes records with up to cfg.Concurrency replays in flight,
+// taking them in order, and returns each record's decision and metric
+// function at its index. Records still waiting when ctx expires are left for
+// a later attempt.
+func (r recordProcessor) processAll(ctx context.Context, records []events.SQSMessage) ([]string, []string) {
+	decisions := make([]string, len(records))
+	functions := make([]string, len(records))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(max(r.cfg.Concurrency, 1), len(records)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				message, parseErr := parseDestinationMessage(records[i].Body)
+				functions[i] = r.cfg.metricFunction(message)
+				decisions[i] = r.process(ctx, records[i], message, parseErr)
+			}
+		}()
+	}
+	for i := range records {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return decisions, functions
+}
+
+// process replays, archives, parks, defers, requeues or leaves one DLQ record
+// for a later attempt, logs the decision and returns it.
+func (r recordProcessor) process(ctx context.Context, record events.SQSMessage, message asyncDestinationMessage, parseErr error) string {
+	var payload *awslogs.Payload
+	if parseErr == nil {
+		// Other functions' events do not decode, and are logged without a
+		// log group.
+		payload, _ = awslogs.DecodeJSON(message.RequestPayload)
+	}
+	decision := newReplayDecision(message, payload, record.MessageId, receiveCount(record))
+	decision.ReplayAttempts = replayAttempts(record)
+
+	if ctx.Err() != nil {
+		decision.log(decisionSkipped, "replayer deadline reached before replay")
+		return decisionSkipped
+	}
+
+	// Records that would fail the same way again are parked without a
+	// replay. A record whose function is not replayable is only known to
+	// be parked once it is not archived.
+	target, targetErr := r.cfg.targetFor(message)
+	if classification := classifyRecord(message, parseErr, target.Bridge); !classification.Retryable {
+		if parseErr != nil {
+			decision = decision.withError(parseErr)
+		}
+		return r.parkNonRetryable(ctx, record, decision, classification.Reason)
+	}
+
+	// Events too old to be useful downstream are archived for a deliberate
+	// backfill instead.
+	if entry := staleEvent(r.cfg.Archive, message, payload, record.MessageId, time.Now()); entry != nil {
+		return r.archive(ctx, record, decision, entry)
+	}
+
+	if targetErr != nil {
+		return r.parkNonRetryable(ctx, record, decision.withError(targetErr), "origin function is not replayable")
+	}
+	if r.cfg.RouteToOrigin {
+		decision.TargetFunction = target.FunctionName
+	}
+
+	if r.breaker != nil {
+		if allowed, retryAfter := r.breaker.allow(time.Now()); !allowed {
+			return r.deferRecord(ctx, record, decision, retryAfter)
+		}
+	}
+
+	err := r.replay(ctx, record)
+	decision.ReplayAttempts++
+	if err == nil {
+		r.breakerDone(outcomeSuccess)
+		if failed, ok := failedAt(message, record); ok {
+			lag := time.Since(failed)
+			r.lags.add(r.cfg.metricFunction(message), lag)
+			decision.ReplayLagMillis = lag.Milliseconds()
+		}
+		decision.log(decisionReplayed, "replay succeeded")
+		return decisionReplayed
+	}
+	decision = decision.withError(err)
+
+	if classification := r.classifyReplayError(err, target.Bridge); !classification.Retryable {
+		r.breakerDone(outcomeIgnored)
+		return r.parkNonRetryable(ctx, record, decision, classification.Reason)
+	}
+
+	if ctx.Err() != nil {
+		// A replay cut short by the deadline is not the event's fault, so
+		// it does not get the event parked.
+		r.breakerDone(outcomeIgnored)
+		decision.log(decisionRetry, "replayer deadline reached during replay")
+		return decisionRetry
+	}
+	r.breakerDone(outcomeFailure)
+
+	switch {
+	case r.breaker != nil && r.breaker.tripped():
+		// Failures while the breaker is open are blamed on the bridge, not
+		// the event, so they do not get the event parked.
+		decision.log(decisionRetry, "replay failed and the circuit breaker is open")
+	case shouldPark(r.cfg, decision.ReplayAttempts):
+		return r.park(ctx, record, decision, fmt.Sprintf("replay failed on all %d attempts", r.cfg.MaxAttempts))
+	case r.cfg.MaxAttempts > 0:
+		return r.requeue(ctx, record, decision)
+	default:
+		decision.log(decisionRetry, "replay failed")
+	}
+	return decisionRetry
+}
+
+func (r recordProcessor) replay(ctx context.Context, record events.SQSMessage) error {
+	if r.publish != nil {
+		return publishOneFunc(ctx, r.publish, record)
+	}
+	return replayOneFunc(ctx, r.client, r.cfg, record)
+}
+
+// classifyReplayError classifies the error of a failed replay. Errors from
+// an invoked function are known by their error payload when bridge is set;
+// errors from direct publishing are the bridge's own.
+func (r recordProcessor) classifyReplayError(err error, bridge bool) errorClassification {
+	var functionErr *functionError
+	if errors.As(err, &functionErr) {
+		return classifyFunctionError(functionErr.ErrorType, functionErr.ErrorMessage, bridge)
+	}
+	if r.publish != nil {
+		return classifyPublishError(err)
+	}
+	return errorClassification{Retryable: true, Reason: "replay error may be transient"}
+}
+
+func (r recordProcessor) breakerDone(outcome breakerOutcome) {
+	if r.breaker != nil {
+		r.breaker.done(time.Now(), outcome)
+	}
+}
+
+func (r recordProcessor) deferRecord(ctx context.Context, record events.SQSMessage, decision replayDecision, retryAfter time.Duration) string {
+	reason := fmt.Sprintf("circuit breaker open; retry in %s", retryAfter.Round(time.Second))
+	if err := deferRecordFunc(ctx, r.queues, r.cfg, record, retryAfter); err != nil {
+		// The record still comes back, after the DLQ's visibility timeout.
+		reason = fmt.Sprintf("%s; %v", reason, err)
+	}
+	decision.log(decisionDeferred, reason)
+	return decisionDeferred
+}
+
+// requeue sends a record whose replay failed back to the DLQ with its attempt
+// counted. When that fails the record is left on the DLQ as is, and this
+// attempt is not counted.
+func (r recordProcessor) requeue(ctx context.Context, record events.SQSMessage, decision replayDecision) string {
+	reason := fmt.Sprintf("replay failed on attempt %d of %d", decision.ReplayAttempts, r.cfg.MaxAttempts)
+	if err := requeueRecordFunc(ctx, r.queues, r.cfg, record, decision.ReplayAttempts); err != nil {
+		decision.log(decisionRetry, fmt.Sprintf("%s; %v", reason, err))
+		return decisionRetry
+	}
+	decision.log(decisionRequeued, reason+"; sent back to the DLQ")
+	return decisionRequeued
+}
+
+func (r recordProcessor) archive(ctx context.Context, record events.SQSMessage, decision replayDecision, entry *archivedEvent) string {
+	reason := fmt.Sprintf("newest log event is older than %s", r.cfg.Archive.MaxEventAge)
+	if err := archiveOne(ctx, r.archiver, r.cfg.Archive, record, entry); err != nil {
+		decision.withError(err).log(decisionRetry, reason+"; archive failed")
+		return decisionRetry
+	}
+	decision.Reason = reason + "; archived to " + entry.Key
+	r.archived.add(entry, decision)
+	return decisionArchived
+}
+
+// indexArchived writes the index of the records the batch archived, then logs
+// their decisions. Without an index entry archived records would be hard to
+// find, so when the index cannot be written they are left on the DLQ to be
+// archived again.
+func (r recordProcessor) indexArchived(ctx context.Context, decisions []string) {
+	if r.archived == nil || len(r.archived.entries) == 0 {
+		return
+	}
+	err := writeArchiveIndex(ctx, r.archiver, r.cfg.Archive, r.archived.entries, time.Now())
+	if err != nil {
+		log.Printf("%v; leaving %d archived records on the DLQ", err, len(r.archived.entries))
+		for i, decision := range decisions {
+			if decision == decisionArchived {
+				decisions[i] = decisionRetry
+			}
+		}
+	}
+	for _, decision := range r.archived.decisions {
+		if err != nil {
+			decision.withError(err).log(decisionRetry, decision.Reason+"; archive index not written")
+			continue
+		}
+		decision.log(decisionArchived, decision.Reason)
+	}
+}
+
+func (r recordProcessor) parkNonRetryable(ctx context.Context, record events.SQSMessage, decision replayDecision, reason string) string {
+	if r.cfg.MaxAttempts == 0 {
+		decision.log(decisionRetry, reason+"; parking is disabled")
+		return decisionRetry
+	}
+	return r.park(ctx, record, decision, reason)
+}
+
+func (r recordProcessor) park(ctx context.Context, record events.SQSMessage, decision replayDecision, reason string) string {
+	if err := parkOneFunc(ctx, r.queues, r.cfg, record, decision.ReplayAttempts, decision.ErrorType, decision.ErrorMessage, reason); err != nil {
+		decision.log(decisionRetry, fmt.Sprintf("%s; %v", reason, err))
+		return decisionRetry
+	}
+	decision.log(decisionParked, reason)
+	return decisionParked
+}
@@ -0,0 +1,337 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awslambda "github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeLambdaInvoker struct {
+	invokeFn func(ctx context.Context, params *awslambda.InvokeInput, optFns ...func(*awslambda.Options)) (*awslambda.InvokeOutput, error)
+}
+
+func (f *fakeLambdaInvoker) Invoke(ctx context.Context, params *awslambda.InvokeInput, optFns ...func(*awslambda.Options)) (*awslambda.InvokeOutput, error) {
+	if f.invokeFn != nil {
+		return f.invokeFn(ctx, params, optFns...)
+	}
+	return &awslambda.InvokeOutput{StatusCode: 202}, nil
+}
+
+func resetReplayerTestState() {
+	lambdaClientOnce = sync.Once{}
+	lambdaClient = nil
+	lambdaClientErr = nil
+	getLambdaClientFunc = getLambdaClient
+	replayOneFunc = replayOne
+	sqsClientOnce = sync.Once{}
+	sqsClient = nil
+	sqsClientErr = nil
+	getSQSClientFunc = getSQSClient
+	parkOneFunc = parkOne
+	requeueRecordFunc = requeueRecord
+	metricsWriter = os.Stdout
+	decisionWriter = os.Stdout
+	replayBreaker = nil
+	deferRecordFunc = deferRecord
+	publishOneFunc = publishOne
+	s3ClientOnce = sync.Once{}
+	s3Client = nil
+	s3ClientErr = nil
+	getS3ClientFunc = getS3Client
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestGetInvocationType(t *testing.T) {
+	t.Setenv("REPLAY_INVOCATION_TYPE", "")
+	invocationType, err := getInvocationType()
+	require.NoError(t, err)
+	assert.Equal(t, types.InvocationTypeRequestResponse, invocationType)
+
+	t.Setenv("REPLAY_INVOCATION_TYPE", "Event")
+	invocationType, err = getInvocationType()
+	require.NoError(t, err)
+	assert.Equal(t, types.InvocationTypeEvent, invocationType)
+
+	t.Setenv("REPLAY_INVOCATION_TYPE", "DryRun")
+	_, err = getInvocationType()
+	require.ErrorContains(t, err, `REPLAY_INVOCATION_TYPE must be RequestResponse or Event, got "DryRun"`)
+}
+
+func TestReplayOne(t *testing.T) {
+	record := events.SQSMessage{Body: `{"requestPayload":{"awslogs":{"data":"abc"}}}`}
+	eventConfig := replayerConfig{TargetFunctionName: "bridge", InvocationType: types.InvocationTypeEvent}
+	syncConfig := replayerConfig{TargetFunctionName: "bridge", InvocationType: types.InvocationTypeRequestResponse}
+
+	t.Run("success", func(t *testing.T) {
+		invoker := &fakeLambdaInvoker{invokeFn: func(ctx context.Context, params *awslambda.InvokeInput, optFns ...func(*awslambda.Options)) (*awslambda.InvokeOutput, error) {
+			require.NotNil(t, params.FunctionName)
+			assert.Equal(t, "bridge", *params.FunctionName)
+			assert.Equal(t, types.InvocationTypeEvent, params.InvocationType)
+			assert.Equal(t, `{"awslogs":{"data":"abc"}}`, string(params.Payload))
+			return &awslambda.InvokeOutput{StatusCode: 202}, nil
+		}}
+
+		require.NoError(t, replayOne(context.Background(), invoker, eventConfig, record))
+	})
+
+	t.Run("invoke error", func(t *testing.T) {
+		invoker := &fakeLambdaInvoker{invokeFn: func(ctx context.Context, params *awslambda.InvokeInput, optFns ...func(*awslambda.Options)) (*awslambda.InvokeOutput, error) {
+			return nil, errors.New("boom")
+		}}
+
+		require.Error(t, replayOne(context.Background(), invoker, eventConfig, record))
+	})
+
+	t.Run("non 2xx status", func(t *testing.T) {
+		invoker := &fakeLambdaInvoker{invokeFn: func(ctx context.Context, params *awslambda.InvokeInput, optFns ...func(*awslambda.Options)) (*awslambda.InvokeOutput, error) {
+			return &awslambda.InvokeOutput{StatusCode: 500}, nil
+		}}
+
+		require.Error(t, replayOne(context.Background(), invoker, eventConfig, record))
+	})
+
+	t.Run("synchronous success", func(t *testing.T) {
+		invoker := &fakeLambdaInvoker{invokeFn: func(ctx context.Context, params *awslambda.InvokeInput, optFns ...func(*awslambda.Options)) (*awslambda.InvokeOutput, error) {
+			assert.Equal(t, types.InvocationTypeRequestResponse, params.InvocationType)
+			return &awslambda.InvokeOutput{StatusCode: 200, Payload: []byte(`{"message_type":"DATA_MESSAGE","published_message_count":3}`)}, nil
+		}}
+
+		require.NoError(t, replayOne(context.Background(), invoker, syncConfig, record))
+	})
+
+	t.Run("synchronous function error", func(t *testing.T) {
+		invoker := &fakeLambdaInvoker{invokeFn: func(ctx context.Context, params *awslambda.InvokeInput, optFns ...func(*awslambda.Options)) (*awslambda.InvokeOutput, error) {
+			return &awslambda.InvokeOutput{
+				StatusCode:    200,
+				FunctionError: aws.String("Unhandled"),
+				Payload:       []byte(`{"errorMessage":"publish to pubsub: unavailable","errorType":"wrapError"}`),
+			}, nil
+		}}
+
+		err := replayOne(context.Background(), invoker, syncConfig, record)
+		var functionErr *functionError
+		require.ErrorAs(t, err, &functionErr)
+		assert.Equal(t, "Unhandled", functionErr.FunctionError)
+		assert.Equal(t, "wrapError", functionErr.ErrorType)
+		assert.Equal(t, "publish to pubsub: unavailable", functionErr.ErrorMessage)
+	})
+
+	t.Run("synchronous unexpected payload", func(t *testing.T) {
+		invoker := &fakeLambdaInvoker{invokeFn: func(ctx context.Context, params *awslambda.InvokeInput, optFns ...func(*awslambda.Options)) (*awslambda.InvokeOutput, error) {
+			return &awslambda.InvokeOutput{StatusCode: 200, Payload: []byte(`null`)}, nil
+		}}
+
+		require.ErrorContains(t, replayOne(context.Background(), invoker, syncConfig, record), "bridge lambda returned an unexpected response: null")
+	})
+}
+
+func TestHandler(t *testing.T) {
+	resetReplayerTestState()
+	t.Cleanup(resetReplayerTestState)
+
+	t.Setenv("TARGET_BRIDGE_FUNCTION_NAME", "bridge")
+	getLambdaClientFunc = func(ctx context.Context) (lambdaInvoker, error) {
+		return &fakeLambdaInvoker{}, nil
+	}
+
+	replayOneFunc = func(ctx context.Context, client lambdaInvoker, cfg replayerConfig, record events.SQSMessage) error {
+		if record.MessageId == "bad" {
+			return errors.New("replay failed")
+		}
+		return nil
+	}
+
+	event := events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "ok", Body: mustJSON(t, map[string]interface{}{"requestPayload": map[string]interface{}{"k": "v"}})},
+		{MessageId: "bad", Body: mustJSON(t, map[string]interface{}{"requestPayload": map[string]interface{}{"k": "v2"}})},
+	}}
+
+	resp, err := Handler(context.Background(), event)
+	require.NoError(t, err)
+	require.Len(t, resp.BatchItemFailures, 1)
+	assert.Equal(t, "bad", resp.BatchItemFailures[0].ItemIdentifier)
+}
+
+func TestHandlerDeadline(t *testing.T) {
+	resetReplayerTestState()
+	t.Cleanup(resetReplayerTestState)
+
+	t.Setenv("TARGET_BRIDGE_FUNCTION_NAME", "bridge")
+	getLambdaClientFunc = func(ctx context.Context) (lambdaInvoker, error) {
+		return &fakeLambdaInvoker{}, nil
+	}
+
+	var replayed []string
+	replayOneFunc = func(ctx context.Context, client lambdaInvoker, cfg replayerConfig, record events.SQSMessage) error {
+		replayed = append(replayed, record.MessageId)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	var decisions bytes.Buffer
+	decisionWriter = &decisions
+
+	ctx, cancel := context.WithTimeout(context.Background(), replayDeadlineMargin+50*time.Millisecond)
+	defer cancel()
+	body := `{"requestPayload":{"awslogs":{"data":"abc"}}}`
+	resp, err := Handler(ctx, events.SQSEvent{Records: []events.SQSMessage{{MessageId: "a", Body: body}, {MessageId: "b", Body: body}}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, replayed, "records are not replayed after the deadline")
+	assert.Equal(t, []events.SQSBatchItemFailure{{ItemIdentifier: "a"}, {ItemIdentifier: "b"}}, resp.BatchItemFailures)
+	logged := readDecisions(t, &decisions)
+	assert.Equal(t, decisionRetry, logged["a"].Decision)
+	assert.Equal(t, decisionSkipped, logged["b"].Decision)
+}
+
+func TestHandlerConcurrency(t *testing.T) {
+	resetReplayerTestState()
+	t.Cleanup(resetReplayerTestState)
+
+	t.Setenv("TARGET_BRIDGE_FUNCTION_NAME", "bridge")
+	t.Setenv("REPLAY_CONCURRENCY", "3")
+
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	full := make(chan struct{})
+	var fullOnce sync.Once
+	invoker := &fakeLambdaInvoker{invokeFn: func(ctx context.Context, params *awslambda.InvokeInput, optFns ...func(*awslambda.Options)) (*awslambda.InvokeOutput, error) {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		if inFlight == 3 {
+			fullOnce.Do(func() { close(full) })
+		}
+		mu.Unlock()
+
+		// Hold the first replays until three are in flight at once.
+		select {
+		case <-full:
+		case <-time.After(time.Second):
+		}
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		if string(params.Payload) == `{"awslogs":{"data":"bad"}}` {
+			return &awslambda.InvokeOutput{StatusCode: 200, FunctionError: aws.String("Unhandled"), Payload: []byte(`{"errorType":"wrapError","errorMessage":"publish failed"}`)}, nil
+		}
+		return &awslambda.InvokeOutput{StatusCode: 200, Payload: []byte(`{"published_message_count":1}`)}, nil
+	}}
+	getLambdaClientFunc = func(ctx context.Context) (lambdaInvoker, error) {
+		return invoker, nil
+	}
+
+	var records []events.SQSMessage
+	for _, id := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		data := "ok"
+		if id == "b" || id == "f" {
+			data = "bad"
+		}
+		records = append(records, events.SQSMessage{MessageId: id, Body: `{"requestPayload":{"awslogs":{"data":"` + data + `"}}}`})
+	}
+
+	resp, err := Handler(context.Background(), events.SQSEvent{Records: records})
+	require.NoError(t, err)
+	assert.Equal(t, 3, maxInFlight)
+	assert.Equal(t, []events.SQSBatchItemFailure{{ItemIdentifier: "b"}, {ItemIdentifier: "f"}}, resp.BatchItemFailures)
+}
+
+func TestLoadConfigConcurrency(t *testing.T) {
+	t.Setenv("TARGET_BRIDGE_FUNCTION_NAME", "bridge")
+
+	cfg, err := loadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, 1, cfg.Concurrency)
+
+	t.Setenv("REPLAY_CONCURRENCY", "0")
+	_, err = loadConfig()
+	require.ErrorContains(t, err, `REPLAY_CONCURRENCY must be a positive integer, got "0"`)
+}
+
+func TestHandlerErrors(t *testing.T) {
+	resetReplayerTestState()
+	t.Cleanup(resetReplayerTestState)
+
+	t.Run("missing target env", func(t *testing.T) {
+		t.Setenv("TARGET_BRIDGE_FUNCTION_NAME", "")
+		_, err := Handler(context.Background(), events.SQSEvent{})
+		require.Error(t, err)
+	})
+
+	t.Run("client creation error", func(t *testing.T) {
+		t.Setenv("TARGET_BRIDGE_FUNCTION_NAME", "bridge")
+		getLambdaClientFunc = func(ctx context.Context) (lambdaInvoker, error) {
+			return nil, errors.New("no client")
+		}
+		_, err := Handler(context.Background(), events.SQSEvent{})
+		require.Error(t, err)
+	})
+}
+
+func TestHandlerOutcomes(t *testing.T) {
+	resetReplayerTestState()
+	t.Cleanup(resetReplayerTestState)
+
+	t.Setenv("TARGET_BRIDGE_FUNCTION_NAME", "bridge")
+	t.Setenv("METRICS_NAMESPACE", "Fleet")
+	getLambdaClientFunc = func(ctx context.Context) (lambdaInvoker, error) {
+		return &fakeLambdaInvoker{}, nil
+	}
+	replayOneFunc = func(ctx context.Context, client lambdaInvoker, cfg replayerConfig, record events.SQSMessage) error {
+		if record.MessageId == "bad" {
+			return errors.New("publish to pubsub: unavailable")
+		}
+		return nil
+	}
+	var decisions, metrics bytes.Buffer
+	decisionWriter = &decisions
+	metricsWriter = &metrics
+
+	failed := time.Now().Add(-10 * time.Minute).UTC().Format(time.RFC3339Nano)
+	event := subscriptionEvent(t, "/fleet/server", time.Now())
+	body := `{"timestamp":"` + failed + `","requestPayload":` + event + `,"requestContext":{"requestId":"req-1"}}`
+	resp, err := Handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "ok", Body: body},
+		{MessageId: "bad", Body: body},
+		{MessageId: "other", Body: `{"requestPayload":{"k":"v"}}`},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, []events.SQSBatchItemFailure{{ItemIdentifier: "bad"}}, resp.BatchItemFailures)
+
+	logged := readDecisions(t, &decisions)
+	assert.Equal(t, "req-1", logged["ok"].RequestID)
+	assert.Equal(t, "/fleet/server", logged["ok"].LogGroup)
+	assert.Equal(t, decisionReplayed, logged["ok"].Decision)
+	assert.InDelta(t, (10 * time.Minute).Milliseconds(), logged["ok"].ReplayLagMillis, float64(time.Minute.Milliseconds()))
+	assert.Equal(t, "/fleet/server", logged["bad"].LogGroup)
+	assert.Zero(t, logged["bad"].ReplayLagMillis)
+	assert.Empty(t, logged["other"].LogGroup, "events that are not subscription events have no log group")
+	assert.Zero(t, logged["other"].ReplayLagMillis, "records without a failure time have no lag")
+
+	records := readMetrics(t, &metrics)
+	require.Len(t, records, 1)
+	assert.Equal(t, float64(2), records[0]["ReplayedEvents"])
+	assert.Equal(t, float64(1), records[0]["FailedEvents"])
+	assert.Equal(t, float64(0), records[0]["ParkedEvents"])
+	assert.Equal(t, float64(0), records[0]["SkippedEvents"])
+	require.Len(t, records[0]["ReplayLag"], 1)
+	assert.InDelta(t, 600, records[0]["ReplayLag"].([]any)[0], 60)
+}
@@ -0,0 +1,114 @@
+package replay
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// functionARNParts is the number of colon-separated parts of an unqualified
+// Lambda function ARN: arn:partition:lambda:region:account:function:name.
+const functionARNParts = 7
+
+// errFunctionNotAllowed marks a record whose origin function may not be
+// replayed to. Replaying it again would be refused the same way.
+var errFunctionNotAllowed = errors.New("origin function is not in REPLAY_ALLOWED_FUNCTION_ARNS")
+
+// replayTarget is the function a DLQ record is replayed to.
+type replayTarget struct {
+	// FunctionName is what Invoke is called with: a function name, or an
+	// ARN that may carry a version or alias qualifier.
+	FunctionName string
+	// Bridge is set when the target is the bridge, whose responses say
+	// whether the replay published.
+	Bridge bool
+}
+
+// getRouting returns whether records are replayed to the function that
+// originally failed, and the unqualified function ARNs they may be replayed to.
+func getRouting() (bool, map[string]bool, error) {
+	value := strings.TrimSpace(os.Getenv("REPLAY_ROUTE_TO_ORIGIN"))
+	if value == "" {
+		return false, nil, nil
+	}
+	routeToOrigin, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, nil, fmt.Errorf("REPLAY_ROUTE_TO_ORIGIN must be true or false, got %q", value)
+	}
+	if !routeToOrigin {
+		return false, nil, nil
+	}
+
+	allowed := map[string]bool{}
+	for _, arn := range strings.Split(os.Getenv("REPLAY_ALLOWED_FUNCTION_ARNS"), ",") {
+		arn = strings.TrimSpace(arn)
+		if arn == "" {
+			continue
+		}
+		unqualified, qualifier, ok := splitFunctionARN(arn)
+		if !ok || qualifier != "" {
+			return false, nil, fmt.Errorf("REPLAY_ALLOWED_FUNCTION_ARNS must list unqualified Lambda function ARNs, got %q", arn)
+		}
+		allowed[unqualified] = true
+	}
+	if len(allowed) == 0 {
+		return false, nil, errors.New("REPLAY_ALLOWED_FUNCTION_ARNS is required when REPLAY_ROUTE_TO_ORIGIN is set")
+	}
+	return true, allowed, nil
+}
+
+// splitFunctionARN splits a Lambda function ARN into the unqualified ARN and
+// its version or alias qualifier, if any.
+func splitFunctionARN(arn string) (unqualified, qualifier string, ok bool) {
+	parts := strings.Split(arn, ":")
+	if len(parts) < functionARNParts || len(parts) > functionARNParts+1 ||
+		parts[0] != "arn" || parts[2] != "lambda" || parts[5] != "function" || parts[6] == "" {
+		return "", "", false
+	}
+	if len(parts) > functionARNParts {
+		qualifier = parts[functionARNParts]
+	}
+	return strings.Join(parts[:functionARNParts], ":"), qualifier, true
+}
+
+// metricFunction names the function a record's metrics are reported for:
+// the function it is replayed to or, when that function may not be replayed,
+// the function that failed it. Records without a function ARN are the
+// bridge's.
+func (cfg replayerConfig) metricFunction(message asyncDestinationMessage) string {
+	if !cfg.RouteToOrigin {
+		return cfg.TargetFunctionName
+	}
+	unqualified, _, ok := splitFunctionARN(message.RequestContext.FunctionArn)
+	if !ok {
+		return cfg.TargetFunctionName
+	}
+	return strings.Split(unqualified, ":")[functionARNParts-1]
+}
+
+// targetFor returns the function to replay message to. Without routing, or
+// when the record does not name its function, that is the bridge.
+func (cfg replayerConfig) targetFor(message asyncDestinationMessage) (replayTarget, error) {
+	arn := message.RequestContext.FunctionArn
+	if !cfg.RouteToOrigin || arn == "" {
+		return replayTarget{FunctionName: cfg.TargetFunctionName, Bridge: true}, nil
+	}
+
+	unqualified, qualifier, ok := splitFunctionARN(arn)
+	if !ok || !cfg.AllowedFunctionARNs[unqualified] {
+		return replayTarget{}, fmt.Errorf("%w: %s", errFunctionNotAllowed, arn)
+	}
+
+	target := replayTarget{
+		FunctionName: unqualified,
+		Bridge:       strings.Split(unqualified, ":")[functionARNParts-1] == cfg.TargetFunctionName,
+	}
+	// $LATEST is what an unqualified invoke runs, and IAM grants on the
+	// unqualified ARN cover it.
+	if qualifier != "" && qualifier != "$LATEST" {
+		target.FunctionName += ":" + qualifier
+	}
+	return target, nil
+}
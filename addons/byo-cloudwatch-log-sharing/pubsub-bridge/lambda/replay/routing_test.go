@@ -0,0 +1,270 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awslambda "github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	bridgeARN    = "arn:aws:lambda:us-east-2:111111111111:function:bridge"
+	reencryptARN = "arn:aws:lambda:us-east-2:111111111111:function:alb-reencrypt"
+)
+
+func TestGetRouting(t *testing.T) {
+	t.Setenv("REPLAY_ROUTE_TO_ORIGIN", "")
+	routeToOrigin, _, err := getRouting()
+	require.NoError(t, err)
+	assert.False(t, routeToOrigin)
+
+	t.Setenv("REPLAY_ROUTE_TO_ORIGIN", "true")
+	t.Setenv("REPLAY_ALLOWED_FUNCTION_ARNS", bridgeARN+", "+reencryptARN+",")
+	routeToOrigin, allowed, err := getRouting()
+	require.NoError(t, err)
+	assert.True(t, routeToOrigin)
+	assert.Equal(t, map[string]bool{bridgeARN: true, reencryptARN: true}, allowed)
+
+	t.Setenv("REPLAY_ALLOWED_FUNCTION_ARNS", "")
+	_, _, err = getRouting()
+	require.ErrorContains(t, err, "REPLAY_ALLOWED_FUNCTION_ARNS is required")
+
+	t.Setenv("REPLAY_ALLOWED_FUNCTION_ARNS", bridgeARN+":live")
+	_, _, err = getRouting()
+	require.ErrorContains(t, err, "must list unqualified Lambda function ARNs")
+
+	t.Setenv("REPLAY_ROUTE_TO_ORIGIN", "yes please")
+	_, _, err = getRouting()
+	require.ErrorContains(t, err, "REPLAY_ROUTE_TO_ORIGIN must be true or false")
+}
+
+func TestTargetFor(t *testing.T) {
+	routed := replayerConfig{
+		TargetFunctionName:  "bridge",
+		RouteToOrigin:       true,
+		AllowedFunctionARNs: map[string]bool{bridgeARN: true, reencryptARN: true},
+	}
+	message := func(arn string) asyncDestinationMessage {
+		var m asyncDestinationMessage
+		m.RequestContext.FunctionArn = arn
+		return m
+	}
+
+	tests := []struct {
+		name    string
+		cfg     replayerConfig
+		arn     string
+		want    replayTarget
+		wantErr bool
+	}{
+		{"not routed", replayerConfig{TargetFunctionName: "bridge"}, reencryptARN, replayTarget{FunctionName: "bridge", Bridge: true}, false},
+		{"no function arn", routed, "", replayTarget{FunctionName: "bridge", Bridge: true}, false},
+		{"bridge latest", routed, bridgeARN + ":$LATEST", replayTarget{FunctionName: bridgeARN, Bridge: true}, false},
+		{"alias", routed, reencryptARN + ":live", replayTarget{FunctionName: reencryptARN + ":live"}, false},
+		{"not allowed", routed, "arn:aws:lambda:us-east-2:111111111111:function:other:$LATEST", replayTarget{}, true},
+		{"not an arn", routed, "bridge", replayTarget{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.cfg.targetFor(message(tt.arn))
+			if tt.wantErr {
+				require.ErrorIs(t, err, errFunctionNotAllowed)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestReplayOneToOrigin(t *testing.T) {
+	cfg := replayerConfig{
+		TargetFunctionName:  "bridge",
+		InvocationType:      types.InvocationTypeRequestResponse,
+		RouteToOrigin:       true,
+		AllowedFunctionARNs: map[string]bool{bridgeARN: true, reencryptARN: true},
+	}
+	record := events.SQSMessage{Body: `{"requestPayload":{"k":"v"},"requestContext":{"functionArn":"` + reencryptARN + `:$LATEST"}}`}
+
+	var functionName string
+	invoker := &fakeLambdaInvoker{invokeFn: func(ctx context.Context, params *awslambda.InvokeInput, optFns ...func(*awslambda.Options)) (*awslambda.InvokeOutput, error) {
+		functionName = aws.ToString(params.FunctionName)
+		return &awslambda.InvokeOutput{StatusCode: 200, Payload: []byte(`null`)}, nil
+	}}
+	require.NoError(t, replayOne(context.Background(), invoker, cfg, record), "responses of other functions are not checked for a publish count")
+	assert.Equal(t, reencryptARN, functionName)
+
+	invoker.invokeFn = func(ctx context.Context, params *awslambda.InvokeInput, optFns ...func(*awslambda.Options)) (*awslambda.InvokeOutput, error) {
+		return &awslambda.InvokeOutput{StatusCode: 200, FunctionError: aws.String("Unhandled"), Payload: []byte(`{"errorType":"errorString","errorMessage":"kms unavailable"}`)}, nil
+	}
+	err := replayOne(context.Background(), invoker, cfg, record)
+	require.EqualError(t, err, "lambda "+reencryptARN+" Unhandled error: errorString: kms unavailable")
+}
+
+func TestHandlerParksRecordsFromUnlistedFunctions(t *testing.T) {
+	resetReplayerTestState()
+	t.Cleanup(resetReplayerTestState)
+
+	t.Setenv("TARGET_BRIDGE_FUNCTION_NAME", "bridge")
+	t.Setenv("REPLAY_ROUTE_TO_ORIGIN", "true")
+	t.Setenv("REPLAY_ALLOWED_FUNCTION_ARNS", bridgeARN)
+	t.Setenv("REPLAY_MAX_ATTEMPTS", "5")
+	t.Setenv("DLQ_QUEUE_URL", "https://sqs/dlq")
+	t.Setenv("PARKING_LOT_QUEUE_URL", "https://sqs/parking")
+
+	var decisions bytes.Buffer
+	decisionWriter = &decisions
+	getLambdaClientFunc = func(ctx context.Context) (lambdaInvoker, error) {
+		return &fakeLambdaInvoker{}, nil
+	}
+	getSQSClientFunc = func(ctx context.Context) (sqsClientAPI, error) {
+		return &fakeSQSClient{}, nil
+	}
+	var replayed []string
+	replayOneFunc = func(ctx context.Context, client lambdaInvoker, cfg replayerConfig, record events.SQSMessage) error {
+		replayed = append(replayed, record.MessageId)
+		return nil
+	}
+	parked := map[string]string{}
+	parkOneFunc = func(ctx context.Context, client sqsClientAPI, cfg replayerConfig, record events.SQSMessage, attempts int, errorType, errorMessage, reason string) error {
+		parked[record.MessageId] = reason
+		return nil
+	}
+
+	record := func(id, arn string) events.SQSMessage {
+		return events.SQSMessage{
+			MessageId: id,
+			Body:      `{"requestPayload":{"k":"v"},"requestContext":{"requestId":"r","functionArn":"` + arn + `"}}`,
+		}
+	}
+	resp, err := Handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		record("bridge", bridgeARN+":$LATEST"),
+		record("reencrypt", reencryptARN+":$LATEST"),
+	}})
+	require.NoError(t, err)
+	assert.Empty(t, resp.BatchItemFailures)
+	assert.Equal(t, []string{"bridge"}, replayed)
+	assert.Equal(t, map[string]string{"reencrypt": "origin function is not replayable"}, parked)
+
+	logged := readDecisions(t, &decisions)
+	assert.Equal(t, bridgeARN, logged["bridge"].TargetFunction)
+	assert.Contains(t, logged["reencrypt"].ErrorMessage, "origin function is not in REPLAY_ALLOWED_FUNCTION_ARNS")
+}
+
+func TestHandlerClassifiesOnlyBridgeErrors(t *testing.T) {
+	resetReplayerTestState()
+	t.Cleanup(resetReplayerTestState)
+
+	t.Setenv("TARGET_BRIDGE_FUNCTION_NAME", "bridge")
+	t.Setenv("REPLAY_ROUTE_TO_ORIGIN", "true")
+	t.Setenv("REPLAY_ALLOWED_FUNCTION_ARNS", bridgeARN+","+reencryptARN)
+	t.Setenv("REPLAY_MAX_ATTEMPTS", "5")
+	t.Setenv("DLQ_QUEUE_URL", "https://sqs/dlq")
+	t.Setenv("PARKING_LOT_QUEUE_URL", "https://sqs/parking")
+
+	var decisions bytes.Buffer
+	decisionWriter = &decisions
+	getLambdaClientFunc = func(ctx context.Context) (lambdaInvoker, error) {
+		return &fakeLambdaInvoker{}, nil
+	}
+	getSQSClientFunc = func(ctx context.Context) (sqsClientAPI, error) {
+		return &fakeSQSClient{}, nil
+	}
+	var replayed []string
+	replayOneFunc = func(ctx context.Context, client lambdaInvoker, cfg replayerConfig, record events.SQSMessage) error {
+		replayed = append(replayed, record.MessageId)
+		return &functionError{Function: reencryptARN, FunctionError: "Unhandled", ErrorType: "wrapError", ErrorMessage: "parse cloudwatch payload: invalid character"}
+	}
+	parked := map[string]string{}
+	parkOneFunc = func(ctx context.Context, client sqsClientAPI, cfg replayerConfig, record events.SQSMessage, attempts int, errorType, errorMessage, reason string) error {
+		parked[record.MessageId] = reason
+		return nil
+	}
+
+	// Both functions recorded an error the bridge returns for an event it
+	// cannot decode.
+	record := func(id, arn string) events.SQSMessage {
+		return events.SQSMessage{
+			MessageId: id,
+			Body: `{"requestPayload":{"k":"v"},"requestContext":{"requestId":"r","functionArn":"` + arn + `"}` +
+				`,"responsePayload":{"errorType":"wrapError","errorMessage":"parse cloudwatch payload: invalid character"}}`,
+		}
+	}
+	resp, err := Handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		record("bridge", bridgeARN+":$LATEST"),
+		record("reencrypt", reencryptARN+":$LATEST"),
+	}})
+	require.NoError(t, err)
+	assert.Empty(t, resp.BatchItemFailures)
+	assert.Equal(t, []string{"reencrypt"}, replayed)
+	assert.Equal(t, map[string]string{"bridge": "event payload cannot be decoded"}, parked)
+
+	logged := readDecisions(t, &decisions)
+	assert.Equal(t, decisionRequeued, logged["reencrypt"].Decision, "another function's error is not the bridge's decode error")
+}
+
+func TestHandlerReportsMetricsPerFunction(t *testing.T) {
+	resetReplayerTestState()
+	t.Cleanup(resetReplayerTestState)
+
+	t.Setenv("TARGET_BRIDGE_FUNCTION_NAME", "bridge")
+	t.Setenv("REPLAY_ROUTE_TO_ORIGIN", "true")
+	t.Setenv("REPLAY_ALLOWED_FUNCTION_ARNS", bridgeARN+","+reencryptARN)
+	t.Setenv("REPLAY_MAX_ATTEMPTS", "5")
+	t.Setenv("DLQ_QUEUE_URL", "https://sqs/dlq")
+	t.Setenv("PARKING_LOT_QUEUE_URL", "https://sqs/parking")
+	t.Setenv("METRICS_NAMESPACE", "Fleet")
+
+	decisionWriter = io.Discard
+	var metrics bytes.Buffer
+	metricsWriter = &metrics
+	getLambdaClientFunc = func(ctx context.Context) (lambdaInvoker, error) {
+		return &fakeLambdaInvoker{}, nil
+	}
+	getSQSClientFunc = func(ctx context.Context) (sqsClientAPI, error) {
+		return &fakeSQSClient{}, nil
+	}
+	replayOneFunc = func(ctx context.Context, client lambdaInvoker, cfg replayerConfig, record events.SQSMessage) error {
+		if record.MessageId == "reencrypt" {
+			return errors.New("invoke lambda: throttled")
+		}
+		return nil
+	}
+	parkOneFunc = func(ctx context.Context, client sqsClientAPI, cfg replayerConfig, record events.SQSMessage, attempts int, errorType, errorMessage, reason string) error {
+		return nil
+	}
+
+	record := func(id, arn string) events.SQSMessage {
+		return events.SQSMessage{
+			MessageId: id,
+			Body:      `{"timestamp":"2026-03-10T12:00:00.000Z","requestPayload":{"k":"v"},"requestContext":{"requestId":"r","functionArn":"` + arn + `"}}`,
+		}
+	}
+	_, err := Handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		record("bridge", bridgeARN+":$LATEST"),
+		record("reencrypt", reencryptARN+":live"),
+		record("unlisted", "arn:aws:lambda:us-east-2:111111111111:function:unlisted"),
+	}})
+	require.NoError(t, err)
+
+	byFunction := map[string]map[string]any{}
+	for _, record := range readMetrics(t, &metrics) {
+		byFunction[record["FunctionName"].(string)] = record
+	}
+	require.Len(t, byFunction, 3, "each function gets its own record")
+	assert.Equal(t, float64(1), byFunction["bridge"]["ReplayedEvents"])
+	assert.Equal(t, float64(0), byFunction["bridge"]["FailedEvents"])
+	assert.Len(t, byFunction["bridge"]["ReplayLag"], 1)
+	assert.Equal(t, float64(0), byFunction["alb-reencrypt"]["ReplayedEvents"])
+	assert.Equal(t, float64(1), byFunction["alb-reencrypt"]["FailedEvents"])
+	assert.NotContains(t, byFunction["alb-reencrypt"], "ReplayLag")
+	assert.Equal(t, float64(1), byFunction["unlisted"]["ParkedEvents"], "a function that may not be replayed is reported under its own name")
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const bridgeModeReplay = "replay"
+
+// publishReplayedEvent publishes an event from the bridge's DLQ. It backs the
+// replayer's direct mode, which replays without invoking the bridge again.
+// The event's log events were sampled and rate limited when the bridge first
+// handled it, so every one of them is published now; a payload the tenancy
+// allow-lists no longer accept is a failed replay rather than a silent drop.
+// Errors are returned unwrapped so the replayer classifies them like the
+// errors the bridge reports when invoked.
+func publishReplayedEvent(ctx context.Context, payload json.RawMessage) error {
+	var event cloudWatchLogsEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return err
+	}
+	decoded, err := decodeCloudWatchPayload(event)
+	if err != nil {
+		return err
+	}
+
+	if len(decoded.LogEvents) > 0 {
+		if allowed, reason := checkPayloadSource(tenancy, options.AWSRegion, decoded); !allowed {
+			return fmt.Errorf("replayed event from %s is not allowed: %s", decoded.LogGroup, reason)
+		}
+	}
+
+	messages, err := buildOutboundMessages(decoded)
+	if err != nil || len(messages) == 0 {
+		return err
+	}
+	if _, err := publishMessages(ctx, decoded, messages); err != nil {
+		return err
+	}
+
+	mark, hasMark := newestEvent(decoded, time.Now())
+	recordHandled(ctx, mark, hasMark)
+	return nil
+}
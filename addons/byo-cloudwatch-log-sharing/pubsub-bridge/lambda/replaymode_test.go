@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	pubsub "cloud.google.com/go/pubsub/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishReplayedEvent(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	options = testOptions()
+
+	ev := makeCloudWatchEvent(t, map[string]interface{}{
+		"owner":       "123",
+		"logGroup":    "group",
+		"messageType": "DATA_MESSAGE",
+		"logEvents": []map[string]interface{}{
+			{"id": "1", "timestamp": 10, "message": "m1"},
+			{"id": "2", "timestamp": 11, "message": "m2"},
+		},
+	})
+	payload, err := json.Marshal(ev)
+	require.NoError(t, err)
+
+	var published []string
+	getPublisherFunc = func(ctx context.Context, projectID, topicID, secretARN string) (*pubsub.Publisher, error) {
+		return nil, nil
+	}
+	publishBatchFunc = func(ctx context.Context, publisher *pubsub.Publisher, messages []outboundMessage) error {
+		for _, m := range messages {
+			published = append(published, string(m.Data))
+		}
+		return nil
+	}
+
+	require.NoError(t, publishReplayedEvent(context.Background(), payload))
+	require.Len(t, published, 2)
+	assert.Contains(t, published[0], `"message":"m1"`)
+
+	publishBatchFunc = func(ctx context.Context, publisher *pubsub.Publisher, messages []outboundMessage) error {
+		return errors.New("pubsub unavailable")
+	}
+	require.ErrorContains(t, publishReplayedEvent(context.Background(), payload), "pubsub unavailable")
+
+	err = publishReplayedEvent(context.Background(), json.RawMessage(`{"awslogs":{}}`))
+	require.EqualError(t, err, "event missing awslogs.data", "decode errors stay recognizable to the replayer")
+
+	var typeErr *json.UnmarshalTypeError
+	require.ErrorAs(t, publishReplayedEvent(context.Background(), json.RawMessage(`[]`)), &typeErr)
+
+	t.Run("sampling", func(t *testing.T) {
+		published = nil
+		publishBatchFunc = func(ctx context.Context, publisher *pubsub.Publisher, messages []outboundMessage) error {
+			for _, m := range messages {
+				published = append(published, string(m.Data))
+			}
+			return nil
+		}
+		samplingRules, err = parseSamplingRules(`[{"log_group":"group","sample_rate":0}]`)
+		require.NoError(t, err)
+		t.Cleanup(func() { samplingRules = nil })
+
+		resp, err := handler(context.Background(), ev)
+		require.NoError(t, err)
+		require.Equal(t, 2, resp["sampled_out_count"], "the bridge samples the event out when CloudWatch Logs delivers it")
+
+		require.NoError(t, publishReplayedEvent(context.Background(), payload))
+		assert.Len(t, published, 2, "a replayed event was already sampled, so it is published whole")
+	})
+
+	t.Run("tenancy", func(t *testing.T) {
+		published = nil
+		tenancy = tenancyConfig{allowedOwners: map[string]bool{"111111111111": true}}
+		t.Cleanup(func() { tenancy = tenancyConfig{} })
+
+		err := publishReplayedEvent(context.Background(), payload)
+		require.ErrorContains(t, err, `replayed event from group is not allowed: owner account "123" is not in the allow-list`)
+		assert.Empty(t, published, "a rejected event fails the replay instead of being dropped")
+	})
+}
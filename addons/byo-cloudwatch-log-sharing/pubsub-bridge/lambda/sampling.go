@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// samplingRule applies to log events whose log group matches LogGroup (a
+// path.Match pattern) and, when set, whose message contains Contains. The
+// first matching rule wins; events that match no rule are always kept.
+type samplingRule struct {
+	LogGroup           string   `json:"log_group"`
+	Contains           string   `json:"contains"`
+	SampleRate         *float64 `json:"sample_rate"`
+	RateLimitPerSecond float64  `json:"rate_limit_per_second"`
+	Burst              int      `json:"burst"`
+
+	bucket *tokenBucket
+}
+
+type samplingStats struct {
+	SampledOut  int
+	RateLimited int
+}
+
+// tokenBucket is a per-container rate limiter. Limits therefore apply to each
+// concurrent execution environment rather than to the function as a whole.
+type tokenBucket struct {
+	mu       sync.Mutex
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+var samplingRules []*samplingRule
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	capacity := float64(burst)
+	if capacity <= 0 {
+		capacity = math.Max(1, math.Ceil(rate))
+	}
+	return &tokenBucket{rate: rate, capacity: capacity, tokens: capacity}
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func parseSamplingRules(raw string) ([]*samplingRule, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	var rules []*samplingRule
+	if err := json.Unmarshal([]byte(raw), &rules); err != nil {
+		return nil, fmt.Errorf("parse SAMPLING_RULES: %w", err)
+	}
+
+	var errs []error
+	for i, rule := range rules {
+		if rule == nil {
+			errs = append(errs, fmt.Errorf("SAMPLING_RULES[%d] must be an object", i))
+			continue
+		}
+		if _, err := path.Match(rule.LogGroup, ""); err != nil || rule.LogGroup == "" {
+			errs = append(errs, fmt.Errorf("SAMPLING_RULES[%d].log_group must be a non-empty glob pattern", i))
+		}
+		if rule.SampleRate != nil && (*rule.SampleRate < 0 || *rule.SampleRate > 1) {
+			errs = append(errs, fmt.Errorf("SAMPLING_RULES[%d].sample_rate must be between 0 and 1", i))
+		}
+		if rule.RateLimitPerSecond < 0 || rule.Burst < 0 {
+			errs = append(errs, fmt.Errorf("SAMPLING_RULES[%d].rate_limit_per_second and burst must not be negative", i))
+		}
+		if rule.RateLimitPerSecond > 0 {
+			rule.bucket = newTokenBucket(rule.RateLimitPerSecond, rule.Burst)
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return rules, nil
+}
+
+func matchSamplingRule(rules []*samplingRule, logGroup, message string) *samplingRule {
+	for _, rule := range rules {
+		if ok, _ := path.Match(rule.LogGroup, logGroup); !ok {
+			continue
+		}
+		if rule.Contains != "" && !strings.Contains(message, rule.Contains) {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+// sampleFraction maps an event ID to [0, 1). Sampling on the ID rather than a
+// random number keeps the decision stable when a payload is replayed.
+func sampleFraction(eventID string) float64 {
+	sum := sha256.Sum256([]byte(eventID))
+	return float64(binary.BigEndian.Uint64(sum[:8])>>11) / float64(1<<53)
+}
+
+// sampleLogEvents drops events from payload according to the sampling rules
+// and returns, for each kept event, the rate at which its rule kept events
+// (zero when no rule matched). Events a rule's rate limit drops are folded
+// into its rate over this payload, so that rescaling by it estimates the
+// original volume whichever way events were dropped.
+func sampleLogEvents(rules []*samplingRule, payload *cloudWatchPayload, now time.Time) ([]float64, samplingStats) {
+	var stats samplingStats
+	if len(rules) == 0 {
+		return make([]float64, len(payload.LogEvents)), stats
+	}
+
+	// limited counts, per rule, the events that passed sampling and those
+	// the rate limit then kept.
+	type limitedCounts struct{ sampled, kept int }
+	limited := map[*samplingRule]*limitedCounts{}
+
+	kept := payload.LogEvents[:0]
+	rates := make([]float64, 0, len(payload.LogEvents))
+	keptRules := make([]*samplingRule, 0, len(payload.LogEvents))
+	for _, event := range payload.LogEvents {
+		rule := matchSamplingRule(rules, payload.LogGroup, event.Message)
+		if rule == nil {
+			kept = append(kept, event)
+			rates = append(rates, 0)
+			keptRules = append(keptRules, nil)
+			continue
+		}
+
+		rate := 1.0
+		if rule.SampleRate != nil {
+			rate = *rule.SampleRate
+		}
+		if sampleFraction(event.ID) >= rate {
+			stats.SampledOut++
+			continue
+		}
+
+		counts := limited[rule]
+		if counts == nil {
+			counts = &limitedCounts{}
+			limited[rule] = counts
+		}
+		counts.sampled++
+		if rule.bucket != nil && !rule.bucket.allow(now) {
+			stats.RateLimited++
+			continue
+		}
+		counts.kept++
+
+		kept = append(kept, event)
+		rates = append(rates, rate)
+		keptRules = append(keptRules, rule)
+	}
+	payload.LogEvents = kept
+
+	for i, rule := range keptRules {
+		if rule == nil {
+			continue
+		}
+		if counts := limited[rule]; counts.kept < counts.sampled {
+			rates[i] *= float64(counts.kept) / float64(counts.sampled)
+		}
+	}
+
+	return rates, stats
+}
+
+// stampSampleRates adds a sample_rate attribute to messages built from
+// sampled events so that consumers can rescale counts.
+func stampSampleRates(messages []outboundMessage, rates []float64) {
+	for i := range messages {
+		if i < len(rates) && rates[i] > 0 {
+			messages[i].Attributes["sample_rate"] = strconv.FormatFloat(rates[i], 'f', -1, 64)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	pubsub "cloud.google.com/go/pubsub/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeSamplingPayload(logGroup string, n int, message string) *cloudWatchPayload {
+	payload := &cloudWatchPayload{LogGroup: logGroup, MessageType: "DATA_MESSAGE"}
+	for i := 0; i < n; i++ {
+		payload.LogEvents = append(payload.LogEvents, struct {
+			ID        string `json:"id"`
+			Timestamp int64  `json:"timestamp"`
+			Message   string `json:"message"`
+		}{ID: fmt.Sprintf("event-%d", i), Timestamp: int64(i), Message: message})
+	}
+	return payload
+}
+
+func TestParseSamplingRules(t *testing.T) {
+	rules, err := parseSamplingRules("")
+	require.NoError(t, err)
+	assert.Nil(t, rules)
+
+	rules, err = parseSamplingRules(`[{"log_group":"/fleet/*","sample_rate":0.5,"rate_limit_per_second":10}]`)
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	assert.NotNil(t, rules[0].bucket)
+
+	for name, raw := range map[string]string{
+		"invalid json":   `{`,
+		"empty pattern":  `[{"sample_rate":0.5}]`,
+		"bad pattern":    `[{"log_group":"[","sample_rate":0.5}]`,
+		"rate above one": `[{"log_group":"*","sample_rate":1.5}]`,
+		"negative limit": `[{"log_group":"*","rate_limit_per_second":-1}]`,
+		"null rule":      `[null]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseSamplingRules(raw)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestSampleLogEvents(t *testing.T) {
+	t.Run("no rules keeps everything", func(t *testing.T) {
+		payload := makeSamplingPayload("/fleet/debug", 5, "m")
+		rates, stats := sampleLogEvents(nil, payload, time.Now())
+		assert.Len(t, payload.LogEvents, 5)
+		assert.Equal(t, []float64{0, 0, 0, 0, 0}, rates)
+		assert.Zero(t, stats.SampledOut)
+	})
+
+	t.Run("sample rate is stable and roughly proportional", func(t *testing.T) {
+		rules, err := parseSamplingRules(`[{"log_group":"/fleet/*","contains":"level=debug","sample_rate":0.25}]`)
+		require.NoError(t, err)
+
+		payload := makeSamplingPayload("/fleet/server", 1000, "level=debug msg=x")
+		rates, stats := sampleLogEvents(rules, payload, time.Now())
+		assert.InDelta(t, 250, len(payload.LogEvents), 60)
+		assert.Equal(t, 1000, len(payload.LogEvents)+stats.SampledOut)
+		assert.Len(t, rates, len(payload.LogEvents))
+		assert.Equal(t, 0.25, rates[0])
+
+		again := makeSamplingPayload("/fleet/server", 1000, "level=debug msg=x")
+		sampleLogEvents(rules, again, time.Now())
+		assert.Equal(t, payload.LogEvents, again.LogEvents)
+	})
+
+	t.Run("non matching message is kept", func(t *testing.T) {
+		rules, err := parseSamplingRules(`[{"log_group":"/fleet/*","contains":"level=debug","sample_rate":0}]`)
+		require.NoError(t, err)
+
+		payload := makeSamplingPayload("/fleet/server", 3, "level=info")
+		_, stats := sampleLogEvents(rules, payload, time.Now())
+		assert.Len(t, payload.LogEvents, 3)
+		assert.Zero(t, stats.SampledOut)
+	})
+
+	t.Run("rate limit", func(t *testing.T) {
+		rules, err := parseSamplingRules(`[{"log_group":"/fleet/*","rate_limit_per_second":2,"burst":3}]`)
+		require.NoError(t, err)
+
+		now := time.Unix(1700000000, 0)
+		payload := makeSamplingPayload("/fleet/server", 5, "m")
+		rates, stats := sampleLogEvents(rules, payload, now)
+		assert.Len(t, payload.LogEvents, 3)
+		assert.Equal(t, 2, stats.RateLimited)
+		assert.Equal(t, []float64{0.6, 0.6, 0.6}, rates, "rate-limited events are folded into the sample rate")
+
+		payload = makeSamplingPayload("/fleet/server", 5, "m")
+		_, stats = sampleLogEvents(rules, payload, now.Add(time.Second))
+		assert.Len(t, payload.LogEvents, 2)
+		assert.Equal(t, 3, stats.RateLimited)
+
+		// Without drops a rate-limit-only rule keeps every event.
+		payload = makeSamplingPayload("/fleet/server", 2, "m")
+		rates, _ = sampleLogEvents(rules, payload, now.Add(time.Hour))
+		assert.Equal(t, []float64{1, 1}, rates)
+	})
+}
+
+func TestHandlerSampling(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	options = testOptions()
+	options.MetricsNamespace = "Test"
+	var metrics bytes.Buffer
+	metricsWriter = &metrics
+
+	var err error
+	samplingRules, err = parseSamplingRules(`[{"log_group":"group","sample_rate":0}]`)
+	require.NoError(t, err)
+
+	ev := makeCloudWatchEvent(t, map[string]interface{}{
+		"owner":       "123",
+		"logGroup":    "group",
+		"messageType": "DATA_MESSAGE",
+		"logEvents": []map[string]interface{}{
+			{"id": "1", "timestamp": 10, "message": "m1"},
+			{"id": "2", "timestamp": 11, "message": "m2"},
+		},
+	})
+
+	getPublisherFunc = func(ctx context.Context, projectID, topicID, secretARN string) (*pubsub.Publisher, error) {
+		t.Fatal("publisher should not be created when every event is sampled out")
+		return nil, nil
+	}
+
+	resp, err := handler(context.Background(), ev)
+	require.NoError(t, err)
+	assert.Equal(t, 0, resp["published_message_count"])
+	assert.Equal(t, 2, resp["sampled_out_count"])
+	assert.Contains(t, metrics.String(), `"LogGroup":"group"`)
+	assert.Contains(t, metrics.String(), `"SampledOutEvents":2`)
+	assert.Contains(t, metrics.String(), `"RateLimitedEvents":0`)
+
+	samplingRules, err = parseSamplingRules(`[{"log_group":"group","sample_rate":1}]`)
+	require.NoError(t, err)
+
+	var published []outboundMessage
+	getPublisherFunc = func(ctx context.Context, projectID, topicID, secretARN string) (*pubsub.Publisher, error) {
+		return nil, nil
+	}
+	publishBatchFunc = func(ctx context.Context, publisher *pubsub.Publisher, messages []outboundMessage) error {
+		published = append(published, messages...)
+		return nil
+	}
+
+	_, err = handler(context.Background(), ev)
+	require.NoError(t, err)
+	require.Len(t, published, 2)
+	assert.Equal(t, "1", published[0].Attributes["sample_rate"])
+}
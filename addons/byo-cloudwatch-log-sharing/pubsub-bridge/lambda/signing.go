@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/fleetdm/fleet/terraform/addons/byo-cloudwatch-log-sharing/pubsub-bridge/lambda/signing"
+)
+
+// getSigningKeyset returns the HMAC keyset from Secrets Manager. It is cached
+// for the same TTL as the GCP credentials so that a rotated active key is
+// picked up by warm containers.
+func getSigningKeyset(ctx context.Context, secretARN string) (signing.Keyset, error) {
+	cacheMu.Lock()
+	if cache.signingSecretARN == secretARN && len(cache.signingKeyset.Keys) > 0 && time.Since(cache.signingFetched) < credentialsCacheTTL {
+		keyset := cache.signingKeyset
+		cacheMu.Unlock()
+		return keyset, nil
+	}
+	cacheMu.Unlock()
+
+	secretText, err := getSecretStringFunc(ctx, secretARN)
+	if err != nil {
+		return signing.Keyset{}, err
+	}
+
+	keyset, err := signing.ParseKeyset([]byte(secretText))
+	if err != nil {
+		return signing.Keyset{}, err
+	}
+
+	cacheMu.Lock()
+	cache.signingSecretARN = secretARN
+	cache.signingKeyset = keyset
+	cache.signingFetched = time.Now()
+	cacheMu.Unlock()
+
+	return keyset, nil
+}
+
+// signMessages attaches signature and key_id attributes to each message. It
+// must run after every other step that changes Data or Attributes.
+func signMessages(ctx context.Context, messages []outboundMessage) error {
+	if options.SigningSecretARN == "" {
+		return nil
+	}
+
+	keyset, err := getSigningKeyset(ctx, options.SigningSecretARN)
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		messages[i].Attributes = keyset.Sign(messages[i].Data, messages[i].Attributes)
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+// Package signing implements the HMAC-SHA256 message signatures attached by
+// the Pub/Sub bridge. It is shared by the bridge Lambda and by consumers that
+// need to verify that a message was published by the bridge.
+//
+// The signature covers the message data and every attribute except the
+// signature itself, in a canonical length-prefixed encoding, so that neither
+// the payload nor its routing attributes can be altered without detection.
+//
+// Keys are distributed as a keyset with one active key used for signing and
+// any number of additional keys accepted for verification, which allows keys
+// to be rotated without dropping in-flight messages.
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+const (
+	AttributeSignature = "signature"
+	AttributeKeyID     = "key_id"
+
+	canonicalVersion = "fleet-pubsub-bridge-v1"
+)
+
+// Keyset holds the HMAC keys by key ID and the ID of the key used to sign.
+type Keyset struct {
+	ActiveKeyID string
+	Keys        map[string][]byte
+}
+
+type keysetJSON struct {
+	ActiveKeyID string            `json:"active_key_id"`
+	Keys        map[string]string `json:"keys"`
+}
+
+// ParseKeyset parses a keyset secret of the form
+//
+//	{"active_key_id": "2026-01", "keys": {"2025-07": "<base64>", "2026-01": "<base64>"}}
+//
+// Every key must decode to at least 32 bytes.
+func ParseKeyset(secret []byte) (Keyset, error) {
+	var raw keysetJSON
+	if err := json.Unmarshal(secret, &raw); err != nil {
+		return Keyset{}, fmt.Errorf("parse signing keyset: %w", err)
+	}
+
+	if len(raw.Keys) == 0 {
+		return Keyset{}, errors.New("signing keyset must include at least one key")
+	}
+
+	keyset := Keyset{ActiveKeyID: raw.ActiveKeyID, Keys: make(map[string][]byte, len(raw.Keys))}
+	for id, encoded := range raw.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return Keyset{}, fmt.Errorf("decode signing key %s: %w", id, err)
+		}
+		if len(key) < sha256.Size {
+			return Keyset{}, fmt.Errorf("signing key %s must be at least %d bytes", id, sha256.Size)
+		}
+		keyset.Keys[id] = key
+	}
+
+	if _, ok := keyset.Keys[keyset.ActiveKeyID]; !ok {
+		return Keyset{}, fmt.Errorf("signing keyset active_key_id %q does not match any key", keyset.ActiveKeyID)
+	}
+
+	return keyset, nil
+}
+
+// Sign returns a copy of attributes with the signature and key_id attributes
+// set, computed with the keyset's active key.
+func (k Keyset) Sign(data []byte, attributes map[string]string) map[string]string {
+	signed := make(map[string]string, len(attributes)+2)
+	for name, value := range attributes {
+		signed[name] = value
+	}
+	signed[AttributeKeyID] = k.ActiveKeyID
+	delete(signed, AttributeSignature)
+
+	signed[AttributeSignature] = base64.StdEncoding.EncodeToString(computeMAC(k.Keys[k.ActiveKeyID], data, signed))
+	return signed
+}
+
+// Verify checks the message signature against the key named by its key_id
+// attribute.
+func (k Keyset) Verify(data []byte, attributes map[string]string) error {
+	keyID, ok := attributes[AttributeKeyID]
+	if !ok {
+		return errors.New("message has no key_id attribute")
+	}
+
+	key, ok := k.Keys[keyID]
+	if !ok {
+		return fmt.Errorf("unknown signing key id %q", keyID)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(attributes[AttributeSignature])
+	if err != nil || len(signature) == 0 {
+		return errors.New("message has no valid signature attribute")
+	}
+
+	if !hmac.Equal(signature, computeMAC(key, data, attributes)) {
+		return errors.New("message signature does not match")
+	}
+
+	return nil
+}
+
+// Canonical returns the byte string covered by the signature: a version tag,
+// then each attribute other than signature sorted by name, then the data,
+// each element prefixed with its decimal length.
+func Canonical(data []byte, attributes map[string]string) []byte {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		if name != AttributeSignature {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	buf := appendField(nil, []byte(canonicalVersion))
+	buf = strconv.AppendInt(buf, int64(len(names)), 10)
+	buf = append(buf, '\n')
+	for _, name := range names {
+		buf = appendField(buf, []byte(name))
+		buf = appendField(buf, []byte(attributes[name]))
+	}
+	return appendField(buf, data)
+}
+
+func appendField(buf, field []byte) []byte {
+	buf = strconv.AppendInt(buf, int64(len(field)), 10)
+	buf = append(buf, ':')
+	buf = append(buf, field...)
+	return append(buf, '\n')
+}
+
+func computeMAC(key, data []byte, attributes map[string]string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(Canonical(data, attributes))
+	return mac.Sum(nil)
+}
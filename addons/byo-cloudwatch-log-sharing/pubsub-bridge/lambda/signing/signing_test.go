@@ -0,0 +1,87 @@
+package signing
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func TestParseKeyset(t *testing.T) {
+	keyset, err := ParseKeyset([]byte(`{"active_key_id":"k2","keys":{"k1":"` + testKey(1) + `","k2":"` + testKey(2) + `"}}`))
+	require.NoError(t, err)
+	assert.Equal(t, "k2", keyset.ActiveKeyID)
+	assert.Len(t, keyset.Keys, 2)
+
+	for name, secret := range map[string]string{
+		"invalid json":         `{`,
+		"no keys":              `{"active_key_id":"k1","keys":{}}`,
+		"unknown active key":   `{"active_key_id":"k9","keys":{"k1":"` + testKey(1) + `"}}`,
+		"short key":            `{"active_key_id":"k1","keys":{"k1":"c2hvcnQ="}}`,
+		"non base64 key value": `{"active_key_id":"k1","keys":{"k1":"%%%"}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseKeyset([]byte(secret))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	oldKeyset, err := ParseKeyset([]byte(`{"active_key_id":"k1","keys":{"k1":"` + testKey(1) + `"}}`))
+	require.NoError(t, err)
+	rotated, err := ParseKeyset([]byte(`{"active_key_id":"k2","keys":{"k1":"` + testKey(1) + `","k2":"` + testKey(2) + `"}}`))
+	require.NoError(t, err)
+
+	data := []byte(`{"message":"hello"}`)
+	attributes := map[string]string{"log_group": "group", "owner": "123"}
+
+	signed := oldKeyset.Sign(data, attributes)
+	assert.Equal(t, "k1", signed[AttributeKeyID])
+	assert.NotEmpty(t, signed[AttributeSignature])
+	assert.NotContains(t, attributes, AttributeSignature, "input attributes must not be modified")
+
+	require.NoError(t, oldKeyset.Verify(data, signed))
+	require.NoError(t, rotated.Verify(data, signed), "messages signed with a retired active key still verify")
+
+	signedByNew := rotated.Sign(data, attributes)
+	assert.Equal(t, "k2", signedByNew[AttributeKeyID])
+	require.Error(t, oldKeyset.Verify(data, signedByNew))
+
+	t.Run("tampered data", func(t *testing.T) {
+		require.Error(t, oldKeyset.Verify([]byte(`{"message":"bye"}`), signed))
+	})
+
+	t.Run("tampered attribute", func(t *testing.T) {
+		tampered := map[string]string{}
+		for k, v := range signed {
+			tampered[k] = v
+		}
+		tampered["log_group"] = "other"
+		require.Error(t, oldKeyset.Verify(data, tampered))
+	})
+
+	t.Run("added attribute", func(t *testing.T) {
+		tampered := map[string]string{"extra": "x"}
+		for k, v := range signed {
+			tampered[k] = v
+		}
+		require.Error(t, oldKeyset.Verify(data, tampered))
+	})
+
+	t.Run("missing signature", func(t *testing.T) {
+		require.Error(t, oldKeyset.Verify(data, attributes))
+	})
+}
+
+func TestCanonicalIsUnambiguous(t *testing.T) {
+	a := Canonical([]byte("x"), map[string]string{"a": "b\n1:c"})
+	b := Canonical([]byte("x"), map[string]string{"a": "b", "c": ""})
+	assert.NotEqual(t, a, b)
+}
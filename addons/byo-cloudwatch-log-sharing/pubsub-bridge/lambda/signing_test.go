@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fleetdm/fleet/terraform/addons/byo-cloudwatch-log-sharing/pubsub-bridge/lambda/signing"
+)
+
+func TestSignMessages(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	options = testOptions()
+	options.SigningSecretARN = "arn:aws:secretsmanager:us-east-2:111111111111:secret:signing"
+
+	secret := `{"active_key_id":"k1","keys":{"k1":"` + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{9}, 32)) + `"}}`
+	var fetches int
+	getSecretStringFunc = func(ctx context.Context, secretARN string) (string, error) {
+		fetches++
+		assert.Equal(t, options.SigningSecretARN, secretARN)
+		return secret, nil
+	}
+
+	messages := []outboundMessage{{Data: []byte("one"), Attributes: map[string]string{"log_group": "g"}}}
+	require.NoError(t, signMessages(context.Background(), messages))
+	require.NoError(t, signMessages(context.Background(), []outboundMessage{{Data: []byte("two"), Attributes: map[string]string{}}}))
+	assert.Equal(t, 1, fetches, "keyset should be cached")
+
+	keyset, err := signing.ParseKeyset([]byte(secret))
+	require.NoError(t, err)
+	assert.Equal(t, "k1", messages[0].Attributes[signing.AttributeKeyID])
+	require.NoError(t, keyset.Verify(messages[0].Data, messages[0].Attributes))
+
+	t.Run("disabled", func(t *testing.T) {
+		options.SigningSecretARN = ""
+		unsigned := []outboundMessage{{Data: []byte("x"), Attributes: map[string]string{}}}
+		require.NoError(t, signMessages(context.Background(), unsigned))
+		assert.NotContains(t, unsigned[0].Attributes, signing.AttributeSignature)
+	})
+
+	t.Run("secret error", func(t *testing.T) {
+		cacheMu.Lock()
+		cache = cacheState{}
+		cacheMu.Unlock()
+
+		options.SigningSecretARN = "arn:aws:secretsmanager:us-east-2:111111111111:secret:signing"
+		getSecretStringFunc = func(ctx context.Context, secretARN string) (string, error) {
+			return "", errors.New("access denied")
+		}
+		require.Error(t, signMessages(context.Background(), []outboundMessage{{Attributes: map[string]string{}}}))
+	})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	pubsub "cloud.google.com/go/pubsub/v2"
+)
+
+const (
+	sinkPubSub        = "pubsub"
+	sinkKafka         = "kafka"
+	sinkSplunk        = "splunk"
+	sinkOTLP          = "otlp"
+	sinkLoki          = "loki"
+	sinkElasticsearch = "elasticsearch"
+	sinkSyslog        = "syslog"
+)
+
+// sink delivers batches of outbound messages to one destination. The handler
+// builds, encrypts and signs messages the same way for every sink.
+type sink interface {
+	Publish(ctx context.Context, messages []outboundMessage) error
+}
+
+type cachedSecret struct {
+	value   string
+	fetched time.Time
+}
+
+var getSinkFunc = getSink
+
+func getSink(ctx context.Context, dest pubsubDestination) (sink, error) {
+	switch options.Sink {
+	case sinkKafka:
+		return getKafkaSink(ctx, dest)
+	case sinkSplunk:
+		return getSplunkSink(ctx)
+	case sinkOTLP:
+		return getOTLPSink(ctx)
+	case sinkLoki:
+		return getLokiSink(ctx)
+	case sinkElasticsearch:
+		return getESSink(ctx)
+	case sinkSyslog:
+		return getSyslogSink(ctx)
+	}
+
+	publisher, err := getPublisherFunc(ctx, dest.ProjectID, dest.TopicID, dest.CredentialsSecretARN)
+	if err != nil {
+		return nil, err
+	}
+	return pubsubSink{publisher: publisher}, nil
+}
+
+type pubsubSink struct {
+	publisher *pubsub.Publisher
+}
+
+func (s pubsubSink) Publish(ctx context.Context, messages []outboundMessage) error {
+	return publishBatchFunc(ctx, s.publisher, messages)
+}
+
+// getCachedSecretString returns a Secrets Manager secret, reusing the value
+// for credentialsCacheTTL like the GCP service-account key.
+func getCachedSecretString(ctx context.Context, secretARN string) (string, error) {
+	cacheMu.Lock()
+	if entry, ok := cache.secrets[secretARN]; ok && time.Since(entry.fetched) < credentialsCacheTTL {
+		cacheMu.Unlock()
+		return entry.value, nil
+	}
+	cacheMu.Unlock()
+
+	value, err := getSecretStringFunc(ctx, secretARN)
+	if err != nil {
+		return "", err
+	}
+
+	cacheMu.Lock()
+	if cache.secrets == nil {
+		cache.secrets = make(map[string]cachedSecret)
+	}
+	cache.secrets[secretARN] = cachedSecret{value: value, fetched: time.Now()}
+	cacheMu.Unlock()
+
+	return value, nil
+}
+
+// newTLSConfig returns a client TLS configuration that trusts caPEM in place
+// of the system roots when it is set. setting names the option in errors.
+func newTLSConfig(setting, caPEM string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if strings.TrimSpace(caPEM) == "" {
+		return cfg, nil
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(caPEM)) {
+		return nil, fmt.Errorf("%s contains no PEM encoded certificates", setting)
+	}
+	cfg.RootCAs = pool
+	return cfg, nil
+}
+
+var fieldTemplatePlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// fieldTemplate derives a value such as a Splunk sourcetype from a message.
+// Placeholders are {owner}, {log_group}, {log_stream} and {field.<path>},
+// where path is a dot-separated path into the log body when it is a JSON
+// object. Placeholders that resolve to nothing expand to an empty string.
+type fieldTemplate string
+
+func parseFieldTemplate(setting, raw string) (fieldTemplate, error) {
+	for _, match := range fieldTemplatePlaceholder.FindAllStringSubmatch(raw, -1) {
+		switch name := match[1]; {
+		case name == "owner", name == "log_group", name == "log_stream":
+		case strings.HasPrefix(name, "field.") && len(name) > len("field."):
+		default:
+			return "", fmt.Errorf("%s has unknown placeholder {%s}", setting, name)
+		}
+	}
+	return fieldTemplate(raw), nil
+}
+
+func (t fieldTemplate) expand(message outboundMessage, body map[string]interface{}) string {
+	if !strings.Contains(string(t), "{") {
+		return string(t)
+	}
+	return fieldTemplatePlaceholder.ReplaceAllStringFunc(string(t), func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		if path, ok := strings.CutPrefix(name, "field."); ok {
+			return lookupBodyField(body, path)
+		}
+		return message.Attributes[name]
+	})
+}
+
+// parseLogBody returns the log body as a JSON object, or nil when it is not
+// one.
+func parseLogBody(body string) map[string]interface{} {
+	trimmed := strings.TrimSpace(body)
+	if !strings.HasPrefix(trimmed, "{") {
+		return nil
+	}
+	var parsed map[string]interface{}
+	if err := json.Unmarshal([]byte(trimmed), &parsed); err != nil {
+		return nil
+	}
+	return parsed
+}
+
+func lookupBodyField(body map[string]interface{}, path string) string {
+	var value interface{} = body
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = object[key]
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case map[string]interface{}, []interface{}:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	default:
+		return fmt.Sprint(v)
+	}
+}
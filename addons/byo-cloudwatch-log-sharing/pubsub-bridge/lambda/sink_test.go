@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFieldTemplate(t *testing.T) {
+	tmpl, err := parseFieldTemplate("SETTING", "fleet:{log_group}:{field.name}:{field.decorations.hostname}:{field.missing}")
+	require.NoError(t, err)
+
+	message := outboundMessage{Attributes: map[string]string{"log_group": "/fleet/osquery"}}
+	body := parseLogBody(`{"name":"pack/usb","decorations":{"hostname":"mac-1"},"counter":1700000000000}`)
+	assert.Equal(t, "fleet:/fleet/osquery:pack/usb:mac-1:", tmpl.expand(message, body))
+	assert.Equal(t, "fleet:/fleet/osquery:::", tmpl.expand(message, parseLogBody("plain text")))
+
+	assert.Equal(t, "1700000000000", lookupBodyField(body, "counter"))
+
+	_, err = parseFieldTemplate("SETTING", "{log_type}")
+	require.ErrorContains(t, err, "SETTING has unknown placeholder {log_type}")
+	_, err = parseFieldTemplate("SETTING", "{field.}")
+	require.Error(t, err)
+}
+
+func TestGetCachedSecretString(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	calls := 0
+	getSecretStringFunc = func(ctx context.Context, secretARN string) (string, error) {
+		calls++
+		return "value-" + secretARN, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		value, err := getCachedSecretString(context.Background(), "arn:a")
+		require.NoError(t, err)
+		assert.Equal(t, "value-arn:a", value)
+	}
+	assert.Equal(t, 1, calls)
+
+	credentialsCacheTTL = 0
+	_, err := getCachedSecretString(context.Background(), "arn:a")
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	cfg, err := newTLSConfig("KAFKA_TLS_CA_PEM", "")
+	require.NoError(t, err)
+	assert.Nil(t, cfg.RootCAs)
+
+	_, err = newTLSConfig("KAFKA_TLS_CA_PEM", "not a certificate")
+	require.ErrorContains(t, err, "KAFKA_TLS_CA_PEM")
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	splunkEventPath = "/services/collector/event"
+	splunkAckPath   = "/services/collector/ack"
+)
+
+// splunkRoute overrides the event metadata for log groups matching LogGroup,
+// a path.Match glob. Unset fields fall back to the SPLUNK_* defaults.
+type splunkRoute struct {
+	LogGroup   string `json:"log_group"`
+	Sourcetype string `json:"sourcetype"`
+	Index      string `json:"index"`
+	Host       string `json:"host"`
+	Source     string `json:"source"`
+}
+
+type splunkFields struct {
+	sourcetype fieldTemplate
+	index      fieldTemplate
+	host       fieldTemplate
+	source     fieldTemplate
+}
+
+type splunkConfig struct {
+	defaults splunkFields
+	routes   []splunkRoute
+	fields   []splunkFields
+}
+
+type splunkEvent struct {
+	Time       float64           `json:"time,omitempty"`
+	Host       string            `json:"host,omitempty"`
+	Source     string            `json:"source,omitempty"`
+	Sourcetype string            `json:"sourcetype,omitempty"`
+	Index      string            `json:"index,omitempty"`
+	Event      interface{}       `json:"event"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+// splunkHECError is a non-2xx HEC response.
+type splunkHECError struct {
+	StatusCode int
+	Code       int    `json:"code"`
+	Text       string `json:"text"`
+}
+
+func (e *splunkHECError) Error() string {
+	return fmt.Sprintf("splunk HEC returned HTTP %d (code %d): %s", e.StatusCode, e.Code, e.Text)
+}
+
+var errSplunkAckTimeout = errors.New("timed out waiting for splunk indexer acknowledgement")
+
+var (
+	splunk splunkConfig
+
+	splunkMu     sync.Mutex
+	splunkClient *http.Client
+	// splunkChannel identifies this execution environment to HEC, which
+	// tracks acknowledgements per channel.
+	splunkChannel = uuid.NewString()
+
+	splunkAckPollInterval = time.Second
+)
+
+func parseSplunkConfig(o OptionsStruct) (splunkConfig, error) {
+	var errs []error
+	template := func(setting, raw string) fieldTemplate {
+		t, err := parseFieldTemplate(setting, raw)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return t
+	}
+
+	cfg := splunkConfig{defaults: splunkFields{
+		sourcetype: template("SPLUNK_SOURCETYPE", o.SplunkSourcetype),
+		index:      template("SPLUNK_INDEX", o.SplunkIndex),
+		host:       template("SPLUNK_HOST", o.SplunkHost),
+		source:     template("SPLUNK_SOURCE", o.SplunkSource),
+	}}
+
+	if strings.TrimSpace(o.SplunkRoutes) != "" {
+		if err := json.Unmarshal([]byte(o.SplunkRoutes), &cfg.routes); err != nil {
+			errs = append(errs, fmt.Errorf("parse SPLUNK_ROUTES: %w", err))
+		}
+	}
+	for i, route := range cfg.routes {
+		if _, err := path.Match(route.LogGroup, ""); err != nil || route.LogGroup == "" {
+			errs = append(errs, fmt.Errorf("SPLUNK_ROUTES[%d].log_group must be a log group name or glob", i))
+		}
+		fields := cfg.defaults
+		setting := fmt.Sprintf("SPLUNK_ROUTES[%d]", i)
+		if route.Sourcetype != "" {
+			fields.sourcetype = template(setting+".sourcetype", route.Sourcetype)
+		}
+		if route.Index != "" {
+			fields.index = template(setting+".index", route.Index)
+		}
+		if route.Host != "" {
+			fields.host = template(setting+".host", route.Host)
+		}
+		if route.Source != "" {
+			fields.source = template(setting+".source", route.Source)
+		}
+		cfg.fields = append(cfg.fields, fields)
+	}
+
+	if len(errs) > 0 {
+		return splunkConfig{}, errors.Join(errs...)
+	}
+	return cfg, nil
+}
+
+// usesBodyFields reports whether any template reads the log body.
+func (c splunkConfig) usesBodyFields() bool {
+	for _, fields := range append([]splunkFields{c.defaults}, c.fields...) {
+		for _, t := range []fieldTemplate{fields.sourcetype, fields.index, fields.host, fields.source} {
+			if strings.Contains(string(t), "{field.") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c splunkConfig) fieldsFor(logGroup string) splunkFields {
+	for i, route := range c.routes {
+		if matched, _ := path.Match(route.LogGroup, logGroup); matched {
+			return c.fields[i]
+		}
+	}
+	return c.defaults
+}
+
+func splunkEventFor(cfg splunkConfig, message outboundMessage) splunkEvent {
+	fields := cfg.fieldsFor(message.Attributes["log_group"])
+	body := parseLogBody(message.Body)
+
+	event := splunkEvent{
+		Host:       fields.host.expand(message, body),
+		Source:     fields.source.expand(message, body),
+		Sourcetype: fields.sourcetype.expand(message, body),
+		Index:      fields.index.expand(message, body),
+		Fields:     message.Attributes,
+	}
+	if eventTime, err := time.Parse(time.RFC3339Nano, message.Attributes["event_time"]); err == nil {
+		event.Time = float64(eventTime.UnixMilli()) / 1000
+	}
+
+	switch {
+	case json.Valid(message.Data):
+		event.Event = json.RawMessage(message.Data)
+	case utf8.Valid(message.Data):
+		event.Event = string(message.Data)
+	default:
+		event.Event = base64.StdEncoding.EncodeToString(message.Data)
+	}
+	return event
+}
+
+type splunkSink struct {
+	client *http.Client
+	url    string
+	token  string
+}
+
+func getSplunkSink(ctx context.Context) (sink, error) {
+	secretText, err := getCachedSecretString(ctx, options.SplunkTokenSecretARN)
+	if err != nil {
+		return nil, fmt.Errorf("get splunk HEC token: %w", err)
+	}
+	token, err := parseSplunkToken(secretText)
+	if err != nil {
+		return nil, err
+	}
+
+	splunkMu.Lock()
+	defer splunkMu.Unlock()
+	if splunkClient == nil {
+		// Already validated by loadOptions.
+		tlsConfig, _ := newTLSConfig("SPLUNK_TLS_CA_PEM", options.SplunkTLSCAPEM)
+		splunkClient = &http.Client{
+			Timeout: options.SplunkRequestTimeout,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		}
+	}
+
+	return splunkSink{
+		client: splunkClient,
+		url:    strings.TrimRight(options.SplunkHECURL, "/"),
+		token:  token,
+	}, nil
+}
+
+// parseSplunkToken accepts the token itself or a JSON object with a token
+// field.
+func parseSplunkToken(secretText string) (string, error) {
+	secretText = strings.TrimSpace(secretText)
+	if strings.HasPrefix(secretText, "{") {
+		var parsed struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal([]byte(secretText), &parsed); err != nil {
+			return "", fmt.Errorf("parse splunk HEC token secret: %w", err)
+		}
+		secretText = parsed.Token
+	}
+	if secretText == "" {
+		return "", errors.New("splunk HEC token secret is empty")
+	}
+	return secretText, nil
+}
+
+func (s splunkSink) Publish(ctx context.Context, messages []outboundMessage) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, message := range messages {
+		if err := encoder.Encode(splunkEventFor(splunk, message)); err != nil {
+			return fmt.Errorf("marshal splunk event: %w", err)
+		}
+	}
+
+	backoff := options.SplunkRetryBackoff
+	var err error
+	for attempt := 0; attempt <= options.SplunkMaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("send to splunk HEC: %w", errors.Join(err, ctx.Err()))
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		var ackID int64
+		ackID, err = s.send(ctx, body.Bytes())
+		if err == nil && options.SplunkAck {
+			err = s.waitForAck(ctx, ackID)
+		}
+		if err == nil || !splunkRetriable(err) {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("send to splunk HEC: %w", err)
+	}
+	return nil
+}
+
+func splunkRetriable(err error) bool {
+	var hecErr *splunkHECError
+	if errors.As(err, &hecErr) {
+		return hecErr.StatusCode == http.StatusTooManyRequests || hecErr.StatusCode >= 500
+	}
+	return true
+}
+
+func (s splunkSink) post(ctx context.Context, endpoint string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Splunk "+s.token)
+	req.Header.Set("Content-Type", "application/json")
+	if options.SplunkAck {
+		req.Header.Set("X-Splunk-Request-Channel", splunkChannel)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		hecErr := &splunkHECError{StatusCode: resp.StatusCode}
+		if json.Unmarshal(respBody, hecErr) != nil {
+			hecErr.Text = strings.TrimSpace(string(respBody))
+		}
+		return hecErr
+	}
+	if out != nil {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("decode splunk HEC response: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s splunkSink) send(ctx context.Context, body []byte) (int64, error) {
+	var resp struct {
+		AckID int64 `json:"ackId"`
+	}
+	if err := s.post(ctx, splunkEventPath, body, &resp); err != nil {
+		return 0, err
+	}
+	return resp.AckID, nil
+}
+
+// waitForAck polls until the indexers have committed ackID. An unacknowledged
+// batch is resent by the caller, so consumers may see duplicates.
+func (s splunkSink) waitForAck(ctx context.Context, ackID int64) error {
+	request, _ := json.Marshal(map[string][]int64{"acks": {ackID}})
+	deadline := time.Now().Add(options.SplunkAckTimeout)
+
+	for {
+		var resp struct {
+			Acks map[string]bool `json:"acks"`
+		}
+		if err := s.post(ctx, splunkAckPath, request, &resp); err != nil {
+			return fmt.Errorf("query splunk indexer acknowledgement: %w", err)
+		}
+		if resp.Acks[strconv.FormatInt(ackID, 10)] {
+			return nil
+		}
+		if time.Now().Add(splunkAckPollInterval).After(deadline) {
+			return errSplunkAckTimeout
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(splunkAckPollInterval):
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHEC records event batches and answers like a Splunk HTTP Event
+// Collector.
+type fakeHEC struct {
+	mu         sync.Mutex
+	batches    [][]map[string]interface{}
+	statuses   []int
+	ackPending int
+	headers    http.Header
+}
+
+func (f *fakeHEC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.URL.Path {
+	case splunkEventPath:
+		f.headers = r.Header.Clone()
+		if len(f.statuses) > 0 {
+			status := f.statuses[0]
+			f.statuses = f.statuses[1:]
+			w.WriteHeader(status)
+			_, _ = io.WriteString(w, `{"text":"Server is busy","code":9}`)
+			return
+		}
+
+		var batch []map[string]interface{}
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var event map[string]interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = io.WriteString(w, `{"text":"Invalid data format","code":6}`)
+				return
+			}
+			batch = append(batch, event)
+		}
+		f.batches = append(f.batches, batch)
+		_, _ = io.WriteString(w, `{"text":"Success","code":0,"ackId":7}`)
+	case splunkAckPath:
+		acked := f.ackPending == 0
+		if f.ackPending > 0 {
+			f.ackPending--
+		}
+		_ = json.NewEncoder(w).Encode(map[string]map[string]bool{"acks": {"7": acked}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func splunkTestOptions(url string) OptionsStruct {
+	opts := testOptions()
+	opts.Sink = sinkSplunk
+	opts.SplunkHECURL = url
+	opts.SplunkTokenSecretARN = "arn:aws:secretsmanager:us-east-2:111111111111:secret:hec"
+	opts.SplunkSourcetype = "fleet:cloudwatch"
+	opts.SplunkSource = "{log_group}"
+	opts.SplunkAckTimeout = time.Second
+	opts.SplunkMaxRetries = 2
+	opts.SplunkRetryBackoff = time.Millisecond
+	opts.SplunkRequestTimeout = 5 * time.Second
+	return opts
+}
+
+func setupSplunkTest(t *testing.T) *fakeHEC {
+	t.Helper()
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	hec := &fakeHEC{}
+	server := httptest.NewServer(hec)
+	t.Cleanup(server.Close)
+
+	options = splunkTestOptions(server.URL + "/")
+	var err error
+	splunk, err = parseSplunkConfig(options)
+	require.NoError(t, err)
+	getSecretStringFunc = func(ctx context.Context, secretARN string) (string, error) {
+		return `{"token":"hec-token"}`, nil
+	}
+	splunkAckPollInterval = time.Millisecond
+	return hec
+}
+
+func TestSplunkEventFor(t *testing.T) {
+	options = splunkTestOptions("https://splunk.example.com:8088")
+	options.SplunkRoutes = `[{"log_group":"/fleet/osquery/*","sourcetype":"osquery:{field.name}","index":"osquery","host":"{field.hostIdentifier}"}]`
+	cfg, err := parseSplunkConfig(options)
+	require.NoError(t, err)
+
+	event := splunkEventFor(cfg, outboundMessage{
+		Data: []byte(`{"message":"x"}`),
+		Attributes: map[string]string{
+			"log_group":  "/fleet/osquery/results",
+			"event_time": "2024-05-01T10:00:00.25Z",
+		},
+		Body: `{"name":"usb_devices","hostIdentifier":"mac-1"}`,
+	})
+	assert.Equal(t, "osquery:usb_devices", event.Sourcetype)
+	assert.Equal(t, "osquery", event.Index)
+	assert.Equal(t, "mac-1", event.Host)
+	assert.Equal(t, "/fleet/osquery/results", event.Source)
+	assert.Equal(t, 1714557600.25, event.Time)
+	assert.Equal(t, json.RawMessage(`{"message":"x"}`), event.Event)
+
+	event = splunkEventFor(cfg, outboundMessage{
+		Data:       []byte{0xff, 0x00},
+		Attributes: map[string]string{"log_group": "/fleet/server"},
+	})
+	assert.Equal(t, "fleet:cloudwatch", event.Sourcetype)
+	assert.Empty(t, event.Index)
+	assert.Equal(t, "/wA=", event.Event)
+}
+
+func TestHandlerSplunkSink(t *testing.T) {
+	hec := setupSplunkTest(t)
+	options.PubSubBatchSize = 2
+
+	ev := makeCloudWatchEvent(t, map[string]interface{}{
+		"owner":       "123",
+		"logGroup":    "group",
+		"logStream":   "stream",
+		"messageType": "DATA_MESSAGE",
+		"logEvents": []map[string]interface{}{
+			{"id": "1", "timestamp": 10, "message": "m1"},
+			{"id": "2", "timestamp": 11, "message": "m2"},
+			{"id": "3", "timestamp": 12, "message": "m3"},
+		},
+	})
+
+	resp, err := handler(context.Background(), ev)
+	require.NoError(t, err)
+	assert.Equal(t, 3, resp["published_message_count"])
+
+	require.Len(t, hec.batches, 2)
+	assert.Len(t, hec.batches[0], 2)
+	assert.Equal(t, "Splunk hec-token", hec.headers.Get("Authorization"))
+	assert.Empty(t, hec.headers.Get("X-Splunk-Request-Channel"))
+
+	first := hec.batches[0][0]
+	assert.Equal(t, "group", first["source"])
+	assert.Equal(t, "fleet:cloudwatch", first["sourcetype"])
+	assert.Equal(t, "m1", first["event"].(map[string]interface{})["message"])
+	assert.Equal(t, "stream", first["fields"].(map[string]interface{})["log_stream"])
+}
+
+func TestSplunkSinkAck(t *testing.T) {
+	hec := setupSplunkTest(t)
+	options.SplunkAck = true
+	hec.ackPending = 2
+
+	s, err := getSplunkSink(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, s.Publish(context.Background(), []outboundMessage{{Data: []byte(`{}`), Attributes: map[string]string{}}}))
+	assert.Equal(t, splunkChannel, hec.headers.Get("X-Splunk-Request-Channel"))
+	assert.Len(t, hec.batches, 1)
+
+	hec.ackPending = 1000
+	options.SplunkMaxRetries = 0
+	options.SplunkAckTimeout = 20 * time.Millisecond
+	err = s.Publish(context.Background(), []outboundMessage{{Data: []byte(`{}`), Attributes: map[string]string{}}})
+	require.ErrorIs(t, err, errSplunkAckTimeout)
+}
+
+func TestSplunkSinkRetries(t *testing.T) {
+	hec := setupSplunkTest(t)
+	hec.statuses = []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}
+
+	s, err := getSplunkSink(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, s.Publish(context.Background(), []outboundMessage{{Data: []byte(`{}`), Attributes: map[string]string{}}}))
+	assert.Len(t, hec.batches, 1)
+
+	hec.statuses = []int{http.StatusForbidden, http.StatusServiceUnavailable}
+	err = s.Publish(context.Background(), []outboundMessage{{Data: []byte(`{}`), Attributes: map[string]string{}}})
+	var hecErr *splunkHECError
+	require.ErrorAs(t, err, &hecErr)
+	assert.Equal(t, http.StatusForbidden, hecErr.StatusCode)
+	assert.Len(t, hec.statuses, 1, "client errors are not retried")
+}
+
+func TestParseSplunkToken(t *testing.T) {
+	token, err := parseSplunkToken(" 11111111-2222-3333-4444-555555555555\n")
+	require.NoError(t, err)
+	assert.Equal(t, "11111111-2222-3333-4444-555555555555", token)
+
+	_, err = parseSplunkToken(`{"token":""}`)
+	require.Error(t, err)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+)
+
+const (
+	// syslogDefaultSeverity is informational, used when a line has no
+	// recognizable level.
+	syslogDefaultSeverity = 6
+
+	syslogMaxAppName  = 48
+	syslogMaxHostname = 255
+	syslogNilValue    = "-"
+)
+
+var (
+	// syslogSDID is an SD-ID of the form name@<private enterprise number>.
+	syslogSDID = regexp.MustCompile(`^[!#-<>-\\^-~]{1,32}$`)
+
+	// syslogBOM marks a MSG as UTF-8, as RFC 5424 section 6.4 recommends.
+	syslogBOM = []byte{0xEF, 0xBB, 0xBF}
+
+	syslogAppName  fieldTemplate
+	syslogHostname fieldTemplate
+
+	syslogMu   sync.Mutex
+	syslogConn net.Conn
+
+	dialSyslogFunc = dialSyslog
+)
+
+// syslogSink writes RFC 5424 messages with octet-counting framing (RFC 6587
+// section 3.4.1) over TLS (RFC 5425). The connection is kept open across warm
+// invocations.
+type syslogSink struct{}
+
+func parseSyslogTemplates(o OptionsStruct) (appName, hostname fieldTemplate, err error) {
+	appName, appErr := parseFieldTemplate("SYSLOG_APP_NAME", o.SyslogAppName)
+	hostname, hostErr := parseFieldTemplate("SYSLOG_HOSTNAME", o.SyslogHostname)
+	return appName, hostname, errors.Join(appErr, hostErr)
+}
+
+func getSyslogSink(ctx context.Context) (sink, error) {
+	return syslogSink{}, nil
+}
+
+func dialSyslog(ctx context.Context) (net.Conn, error) {
+	// Already validated by loadOptions.
+	tlsConfig, _ := newTLSConfig("SYSLOG_TLS_CA_PEM", options.SyslogTLSCAPEM)
+	if options.SyslogTLSServerName != "" {
+		tlsConfig.ServerName = options.SyslogTLSServerName
+	}
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: options.SyslogDialTimeout, KeepAlive: 30 * time.Second},
+		Config:    tlsConfig,
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", options.SyslogAddress)
+	if err != nil {
+		return nil, fmt.Errorf("dial syslog %s: %w", options.SyslogAddress, err)
+	}
+	return conn, nil
+}
+
+func (s syslogSink) Publish(ctx context.Context, messages []outboundMessage) error {
+	now := time.Now()
+
+	var frames bytes.Buffer
+	for _, message := range messages {
+		record := formatSyslogMessage(message, now)
+		frames.WriteString(strconv.Itoa(len(record)))
+		frames.WriteByte(' ')
+		frames.Write(record)
+	}
+
+	syslogMu.Lock()
+	defer syslogMu.Unlock()
+
+	backoff := options.SyslogRetryBackoff
+	var err error
+	for attempt := 0; attempt <= options.SyslogMaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("write to syslog: %w", errors.Join(err, ctx.Err()))
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		if syslogConn != nil && !syslogConnAlive(syslogConn) {
+			syslogConn.Close()
+			syslogConn = nil
+		}
+		if syslogConn == nil {
+			syslogConn, err = dialSyslogFunc(ctx)
+			if err != nil {
+				continue
+			}
+		}
+
+		_ = syslogConn.SetWriteDeadline(time.Now().Add(options.SyslogWriteTimeout))
+		if _, err = syslogConn.Write(frames.Bytes()); err == nil {
+			return nil
+		}
+		// Part of the batch may have been written, so a retry can repeat
+		// messages; syslog delivery is at least once.
+		syslogConn.Close()
+		syslogConn = nil
+	}
+	return fmt.Errorf("write to syslog: %w", err)
+}
+
+// syslogConnAlive reports whether the receiver still has conn open. A
+// connection kept across invocations may have been closed while the
+// execution environment was frozen, and writes to it would be lost silently.
+// Receivers never send data on a syslog connection, so a read that times out
+// means the connection is open.
+func syslogConnAlive(conn net.Conn) bool {
+	_ = conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// formatSyslogMessage renders message as an RFC 5424 SYSLOG-MSG:
+//
+//	<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD-ID name="value" ...] BOM MSG
+func formatSyslogMessage(message outboundMessage, now time.Time) []byte {
+	timestamp := now.UTC()
+	if eventTime, err := time.Parse(time.RFC3339Nano, message.Attributes["event_time"]); err == nil {
+		timestamp = eventTime.UTC()
+	}
+
+	body := parseLogBody(message.Body)
+	severity := syslogDefaultSeverity
+	// The level is read from the plaintext body, so it is only used when the
+	// body is published in clear text too.
+	if options.EncryptionMode == encryptionModeNone {
+		number, _ := parseSeverity(message.Body, body)
+		severity = syslogSeverity(number)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s - - ",
+		options.SyslogFacility*8+severity,
+		timestamp.Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderField(syslogHostname.expand(message, body), syslogMaxHostname, false),
+		syslogHeaderField(syslogAppName.expand(message, body), syslogMaxAppName, true),
+	)
+
+	b.WriteByte('[')
+	b.WriteString(options.SyslogSDID)
+	params := map[string]string{}
+	for key, value := range message.Attributes {
+		params[key] = value
+	}
+	if message.EventID != "" {
+		params["event_id"] = message.EventID
+	}
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		b.WriteByte(' ')
+		b.WriteString(syslogHeaderField(key, 32, false))
+		b.WriteString(`="`)
+		b.WriteString(syslogParamEscaper.Replace(strings.ToValidUTF8(params[key], "�")))
+		b.WriteByte('"')
+	}
+	b.WriteByte(']')
+
+	if len(message.Data) > 0 {
+		b.WriteByte(' ')
+		msg := message.Data
+		if utf8.Valid(msg) {
+			b.Write(syslogBOM)
+		} else {
+			msg = []byte(base64.StdEncoding.EncodeToString(msg))
+		}
+		if room := options.SyslogMaxMessageBytes - b.Len(); room < len(msg) {
+			msg = truncateUTF8(msg, max(room, 0))
+		}
+		b.Write(msg)
+	}
+	return b.Bytes()
+}
+
+var syslogParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// syslogHeaderField makes value a valid header field or SD-NAME: printable
+// US-ASCII without spaces, at most limit characters, or NILVALUE when empty.
+// App names are derived from log groups such as /fleet/osquery/result, so
+// trimLeadingSlash drops the leading / and truncation keeps the end, which is
+// the most specific part.
+func syslogHeaderField(value string, limit int, trimLeadingSlash bool) string {
+	if trimLeadingSlash {
+		value = strings.TrimLeft(value, "/")
+	}
+	value = strings.Map(func(r rune) rune {
+		if r < '!' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, value)
+	if value == "" {
+		return syslogNilValue
+	}
+	if len(value) > limit {
+		value = value[len(value)-limit:]
+	}
+	return value
+}
+
+// truncateUTF8 returns at most n bytes of b without splitting a character.
+func truncateUTF8(b []byte, n int) []byte {
+	if len(b) <= n {
+		return b
+	}
+	for n > 0 && !utf8.RuneStart(b[n]) {
+		n--
+	}
+	return b[:n]
+}
+
+// syslogSeverity maps an OpenTelemetry severity number to an RFC 5424
+// severity.
+func syslogSeverity(number logspb.SeverityNumber) int {
+	switch {
+	case number == logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED:
+		return syslogDefaultSeverity
+	case number <= logspb.SeverityNumber_SEVERITY_NUMBER_DEBUG4:
+		return 7
+	case number == logspb.SeverityNumber_SEVERITY_NUMBER_INFO2:
+		return 5
+	case number <= logspb.SeverityNumber_SEVERITY_NUMBER_INFO4:
+		return 6
+	case number <= logspb.SeverityNumber_SEVERITY_NUMBER_WARN4:
+		return 4
+	case number <= logspb.SeverityNumber_SEVERITY_NUMBER_ERROR4:
+		return 3
+	default:
+		return 2
+	}
+}
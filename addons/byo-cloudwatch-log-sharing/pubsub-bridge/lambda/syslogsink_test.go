@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func syslogTestOptions(address, caPEM string) OptionsStruct {
+	opts := testOptions()
+	opts.Sink = sinkSyslog
+	opts.SyslogAddress = address
+	opts.SyslogTLSCAPEM = caPEM
+	opts.SyslogAppName = "{log_group}"
+	opts.SyslogFacility = 1
+	opts.SyslogSDID = "fleet@32473"
+	opts.SyslogMaxMessageBytes = 8192
+	opts.SyslogDialTimeout = 5 * time.Second
+	opts.SyslogWriteTimeout = 5 * time.Second
+	opts.SyslogMaxRetries = 2
+	opts.SyslogRetryBackoff = time.Millisecond
+	return opts
+}
+
+// fakeSyslogReceiver is a TLS syslog receiver that reads octet-counted
+// frames.
+type fakeSyslogReceiver struct {
+	listener net.Listener
+	caPEM    string
+
+	mu       sync.Mutex
+	accepted int
+	conns    []net.Conn
+	messages []string
+	received chan struct{}
+}
+
+func newFakeSyslogReceiver(t *testing.T) *fakeSyslogReceiver {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "syslog.test"},
+		DNSNames:     []string{"syslog.test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	r := &fakeSyslogReceiver{
+		listener: listener,
+		caPEM:    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		received: make(chan struct{}, 100),
+	}
+	go r.serve()
+	return r
+}
+
+func (r *fakeSyslogReceiver) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		r.accepted++
+		r.conns = append(r.conns, conn)
+		r.mu.Unlock()
+		go r.read(conn)
+	}
+}
+
+func (r *fakeSyslogReceiver) read(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		length, err := reader.ReadString(' ')
+		if err != nil {
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil {
+			return
+		}
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return
+		}
+		r.mu.Lock()
+		r.messages = append(r.messages, string(frame))
+		r.mu.Unlock()
+		r.received <- struct{}{}
+	}
+}
+
+// closeConnections closes the receiver side of every open connection, as a
+// receiver restart or idle timeout would.
+func (r *fakeSyslogReceiver) closeConnections() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+	r.conns = nil
+}
+
+func (r *fakeSyslogReceiver) wait(t *testing.T, n int) []string {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d syslog messages", i, n)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.messages...)
+}
+
+func TestFormatSyslogMessage(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+	options = syslogTestOptions("syslog:6514", "")
+	options.SyslogHostname = "{owner}"
+	var err error
+	syslogAppName, syslogHostname, err = parseSyslogTemplates(options)
+	require.NoError(t, err)
+
+	message := outboundMessage{
+		Data: []byte(`{"level":"error","msg":"boom"}`),
+		Attributes: map[string]string{
+			"owner":      "111111111111",
+			"log_group":  "/fleet/osquery/result",
+			"log_stream": `i-0abc"]\`,
+			"event_time": "2024-05-01T10:00:00.123+02:00",
+		},
+		EventID: "3782",
+		Body:    `{"level":"error","msg":"boom"}`,
+	}
+	got := string(formatSyslogMessage(message, time.Now()))
+	assert.Equal(t, `<11>1 2024-05-01T08:00:00.123000Z 111111111111 fleet/osquery/result - - `+
+		`[fleet@32473 event_id="3782" event_time="2024-05-01T10:00:00.123+02:00" log_group="/fleet/osquery/result" log_stream="i-0abc\"\]\\" owner="111111111111"] `+
+		"\xEF\xBB\xBF"+`{"level":"error","msg":"boom"}`, got)
+
+	options.EncryptionMode = encryptionModeKMS
+	options.SyslogMaxMessageBytes = 480
+	message.Data = []byte{0xff, 0xfe}
+	message.Attributes = map[string]string{"log_group": strings.Repeat("g", 60)}
+	message.EventID = ""
+	got = string(formatSyslogMessage(message, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)))
+	assert.Equal(t, `<14>1 2024-05-01T00:00:00.000000Z - `+strings.Repeat("g", 48)+` - - [fleet@32473 log_group="`+strings.Repeat("g", 60)+`"] //4=`, got,
+		"encrypted bodies do not set the severity and binary data is base64 encoded")
+
+	message.Data = []byte(strings.Repeat("é", 300))
+	got = string(formatSyslogMessage(message, time.Now()))
+	assert.LessOrEqual(t, len(got), 480)
+	assert.True(t, strings.HasSuffix(got, "é"), "truncation keeps whole characters")
+}
+
+func TestSyslogSeverity(t *testing.T) {
+	assert.Equal(t, 6, syslogSeverity(logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED))
+	assert.Equal(t, 7, syslogSeverity(logspb.SeverityNumber_SEVERITY_NUMBER_TRACE))
+	assert.Equal(t, 7, syslogSeverity(logspb.SeverityNumber_SEVERITY_NUMBER_DEBUG))
+	assert.Equal(t, 6, syslogSeverity(logspb.SeverityNumber_SEVERITY_NUMBER_INFO))
+	assert.Equal(t, 5, syslogSeverity(logspb.SeverityNumber_SEVERITY_NUMBER_INFO2))
+	assert.Equal(t, 4, syslogSeverity(logspb.SeverityNumber_SEVERITY_NUMBER_WARN))
+	assert.Equal(t, 3, syslogSeverity(logspb.SeverityNumber_SEVERITY_NUMBER_ERROR))
+	assert.Equal(t, 2, syslogSeverity(logspb.SeverityNumber_SEVERITY_NUMBER_FATAL))
+}
+
+func TestHandlerSyslogSink(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	receiver := newFakeSyslogReceiver(t)
+	options = syslogTestOptions(receiver.listener.Addr().String(), receiver.caPEM)
+	var err error
+	syslogAppName, syslogHostname, err = parseSyslogTemplates(options)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if syslogConn != nil {
+			syslogConn.Close()
+		}
+	})
+
+	ev := makeCloudWatchEvent(t, map[string]interface{}{
+		"owner":       "111",
+		"logGroup":    "/fleet/server",
+		"logStream":   "s1",
+		"messageType": "DATA_MESSAGE",
+		"logEvents": []map[string]interface{}{
+			{"id": "1", "timestamp": 1714557600000, "message": "level=warn msg=slow"},
+			{"id": "2", "timestamp": 1714557601000, "message": "m2"},
+		},
+	})
+	resp, err := handler(context.Background(), ev)
+	require.NoError(t, err)
+	assert.Equal(t, 2, resp["published_message_count"])
+
+	messages := receiver.wait(t, 2)
+	assert.True(t, strings.HasPrefix(messages[0], "<12>1 2024-05-01T10:00:00.000000Z - fleet/server - - [fleet@32473 event_id=\"1\""), messages[0])
+	assert.Contains(t, messages[0], `"message":"level=warn msg=slow"`)
+	assert.True(t, strings.HasPrefix(messages[1], "<14>1 2024-05-01T10:00:01.000000Z"), messages[1])
+
+	// A warm invocation reuses the connection.
+	_, err = handler(context.Background(), ev)
+	require.NoError(t, err)
+	receiver.wait(t, 2)
+	receiver.mu.Lock()
+	assert.Equal(t, 1, receiver.accepted)
+	receiver.mu.Unlock()
+
+	// A connection the receiver closed while the environment was idle is
+	// replaced before writing, so no messages are lost.
+	receiver.closeConnections()
+	time.Sleep(50 * time.Millisecond)
+	_, err = handler(context.Background(), ev)
+	require.NoError(t, err)
+	messages = receiver.wait(t, 2)
+	assert.Len(t, messages, 6)
+	receiver.mu.Lock()
+	assert.Equal(t, 2, receiver.accepted)
+	receiver.mu.Unlock()
+}
+
+func TestSyslogSinkDialRetries(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+	options = syslogTestOptions("127.0.0.1:1", "")
+
+	dials := 0
+	dialSyslogFunc = func(ctx context.Context) (net.Conn, error) {
+		dials++
+		return nil, errors.New("connection refused")
+	}
+	s, err := getSyslogSink(context.Background())
+	require.NoError(t, err)
+	err = s.Publish(context.Background(), []outboundMessage{{Data: []byte("x"), Attributes: map[string]string{}}})
+	assert.ErrorContains(t, err, "write to syslog: connection refused")
+	assert.Equal(t, 3, dials)
+}
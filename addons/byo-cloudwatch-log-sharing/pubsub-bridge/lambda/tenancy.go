@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+const (
+	unexpectedOwnerReject     = "reject"
+	unexpectedOwnerQuarantine = "quarantine"
+
+	// quarantineMaxMessageBytes is the largest message SendMessage accepts
+	// by default.
+	quarantineMaxMessageBytes = 256 * 1024
+)
+
+// pubsubDestination is the topic a payload is published to. Owner routes map
+// source AWS accounts to tenant-specific destinations; unset fields fall back
+// to the bridge defaults.
+type pubsubDestination struct {
+	ProjectID            string `json:"project_id"`
+	TopicID              string `json:"topic_id"`
+	CredentialsSecretARN string `json:"credentials_secret_arn"`
+}
+
+type tenancyConfig struct {
+	allowedOwners       map[string]bool
+	allowedLogGroupARNs []string
+	routes              map[string]pubsubDestination
+}
+
+type quarantineMessage struct {
+	Reason         string              `json:"reason"`
+	Owner          string              `json:"owner"`
+	LogGroup       string              `json:"log_group"`
+	LogStream      string              `json:"log_stream"`
+	RequestPayload cloudWatchLogsEvent `json:"requestPayload"`
+	// Part and Parts number the messages a payload too large for one
+	// message was split into, each holding some of its log events.
+	Part  int `json:"part,omitempty"`
+	Parts int `json:"parts,omitempty"`
+}
+
+type sqsSender interface {
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+}
+
+var (
+	tenancy tenancyConfig
+
+	sqsClientOnce sync.Once
+	sqsClient     sqsSender
+	sqsClientErr  error
+
+	getSQSClientFunc = getSQSClient
+)
+
+func splitList(raw string) []string {
+	var values []string
+	for _, value := range strings.Split(raw, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func parseTenancy(o OptionsStruct) (tenancyConfig, error) {
+	var errs []error
+	cfg := tenancyConfig{routes: map[string]pubsubDestination{}}
+
+	for _, owner := range splitList(o.AllowedOwnerAccountIDs) {
+		if cfg.allowedOwners == nil {
+			cfg.allowedOwners = map[string]bool{}
+		}
+		cfg.allowedOwners[owner] = true
+	}
+
+	for _, pattern := range splitList(o.AllowedLogGroupARNs) {
+		if _, err := path.Match(pattern, ""); err != nil || !strings.HasPrefix(pattern, "arn:") {
+			errs = append(errs, fmt.Errorf("ALLOWED_LOG_GROUP_ARNS entry %q must be a log group ARN or ARN glob", pattern))
+			continue
+		}
+		cfg.allowedLogGroupARNs = append(cfg.allowedLogGroupARNs, pattern)
+	}
+
+	if strings.TrimSpace(o.OwnerRoutes) != "" {
+		if err := json.Unmarshal([]byte(o.OwnerRoutes), &cfg.routes); err != nil {
+			errs = append(errs, fmt.Errorf("parse OWNER_ROUTES: %w", err))
+		}
+		for owner, route := range cfg.routes {
+			if route.TopicID == "" {
+				errs = append(errs, fmt.Errorf("OWNER_ROUTES[%s].topic_id must not be empty", owner))
+			}
+			if route.CredentialsSecretARN != "" && !strings.HasPrefix(route.CredentialsSecretARN, "arn:") {
+				errs = append(errs, fmt.Errorf("OWNER_ROUTES[%s].credentials_secret_arn must be a Secrets Manager ARN", owner))
+			}
+		}
+	}
+
+	if o.UnexpectedOwnerAction == unexpectedOwnerQuarantine && strings.TrimSpace(o.QuarantineQueueURL) == "" {
+		errs = append(errs, errors.New("QUARANTINE_QUEUE_URL is required when UNEXPECTED_OWNER_ACTION is quarantine"))
+	}
+
+	if len(errs) > 0 {
+		return tenancyConfig{}, errors.Join(errs...)
+	}
+
+	return cfg, nil
+}
+
+func partitionForRegion(region string) string {
+	switch {
+	case strings.HasPrefix(region, "cn-"):
+		return "aws-cn"
+	case strings.HasPrefix(region, "us-gov-"):
+		return "aws-us-gov"
+	default:
+		return "aws"
+	}
+}
+
+func logGroupARN(region, owner, logGroup string) string {
+	return fmt.Sprintf("arn:%s:logs:%s:%s:log-group:%s", partitionForRegion(region), region, owner, logGroup)
+}
+
+// checkPayloadSource reports whether the payload's owner account and log
+// group are allowed, and if not, why.
+func checkPayloadSource(cfg tenancyConfig, region string, payload *cloudWatchPayload) (bool, string) {
+	if cfg.allowedOwners != nil && !cfg.allowedOwners[payload.Owner] {
+		return false, fmt.Sprintf("owner account %q is not in the allow-list", payload.Owner)
+	}
+
+	if len(cfg.allowedLogGroupARNs) > 0 {
+		arn := logGroupARN(region, payload.Owner, payload.LogGroup)
+		for _, pattern := range cfg.allowedLogGroupARNs {
+			if ok, _ := path.Match(pattern, arn); ok {
+				return true, ""
+			}
+		}
+		return false, fmt.Sprintf("log group %q is not in the allow-list", arn)
+	}
+
+	return true, ""
+}
+
+func resolveDestination(cfg tenancyConfig, owner string) pubsubDestination {
+	dest := pubsubDestination{
+		ProjectID:            options.PubSubProjectID,
+		TopicID:              options.PubSubTopicID,
+		CredentialsSecretARN: options.CredentialsSecretARN,
+	}
+	if options.Sink == sinkKafka {
+		dest.TopicID = options.KafkaTopic
+	}
+
+	route, ok := cfg.routes[owner]
+	if !ok {
+		return dest
+	}
+
+	dest.TopicID = route.TopicID
+	if route.ProjectID != "" {
+		dest.ProjectID = route.ProjectID
+	}
+	if route.CredentialsSecretARN != "" {
+		dest.CredentialsSecretARN = route.CredentialsSecretARN
+	}
+	return dest
+}
+
+func getSQSClient(ctx context.Context) (sqsSender, error) {
+	sqsClientOnce.Do(func() {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			sqsClientErr = fmt.Errorf("load aws sdk config: %w", err)
+			return
+		}
+		sqsClient = sqs.NewFromConfig(cfg)
+	})
+
+	if sqsClientErr != nil {
+		return nil, sqsClientErr
+	}
+	return sqsClient, nil
+}
+
+// quarantinePayload stores a rejected payload, in the same requestPayload
+// shape as async failure records, so it can be inspected and deliberately
+// replayed later. A payload too large for one message is split by its log
+// events, each part a subscription event of its own.
+func quarantinePayload(ctx context.Context, event cloudWatchLogsEvent, payload *cloudWatchPayload, reason string) error {
+	client, err := getSQSClientFunc(ctx)
+	if err != nil {
+		return err
+	}
+
+	bodies, err := quarantineBodies(event, payload, reason)
+	if err != nil {
+		return err
+	}
+
+	for _, body := range bodies {
+		if _, err := client.SendMessage(ctx, &sqs.SendMessageInput{
+			QueueUrl:    aws.String(options.QuarantineQueueURL),
+			MessageBody: aws.String(string(body)),
+		}); err != nil {
+			return fmt.Errorf("send to quarantine queue: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// quarantineBodies returns the quarantine messages for a payload. A payload
+// whose message would not fit in quarantineMaxMessageBytes is split into
+// parts that each do.
+func quarantineBodies(event cloudWatchLogsEvent, payload *cloudWatchPayload, reason string) ([][]byte, error) {
+	message := quarantineMessage{
+		Reason:    reason,
+		Owner:     payload.Owner,
+		LogGroup:  payload.LogGroup,
+		LogStream: payload.LogStream,
+	}
+	parts, err := splitQuarantinePayload(message, event, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	bodies := make([][]byte, 0, len(parts))
+	for i, part := range parts {
+		message.RequestPayload = part
+		if len(parts) > 1 {
+			message.Part = i + 1
+			message.Parts = len(parts)
+		}
+		body, err := json.Marshal(message)
+		if err != nil {
+			return nil, fmt.Errorf("marshal quarantine message: %w", err)
+		}
+		bodies = append(bodies, body)
+	}
+	return bodies, nil
+}
+
+// quarantinePartBytes is room kept in each message for the part numbers of a
+// split payload.
+const quarantinePartBytes = 64
+
+// splitQuarantinePayload halves the payload's log events until the message
+// for each part fits, and returns the parts as subscription events.
+func splitQuarantinePayload(message quarantineMessage, event cloudWatchLogsEvent, payload *cloudWatchPayload) ([]cloudWatchLogsEvent, error) {
+	message.RequestPayload = event
+	body, err := json.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("marshal quarantine message: %w", err)
+	}
+	if len(body) <= quarantineMaxMessageBytes-quarantinePartBytes {
+		return []cloudWatchLogsEvent{event}, nil
+	}
+	if len(payload.LogEvents) < 2 {
+		return nil, fmt.Errorf("quarantine message for %s is %d bytes, over the %d byte limit", payload.LogGroup, len(body), quarantineMaxMessageBytes)
+	}
+
+	var parts []cloudWatchLogsEvent
+	half := len(payload.LogEvents) / 2
+	for _, logEvents := range [][]cloudWatchLogEvent{payload.LogEvents[:half], payload.LogEvents[half:]} {
+		part := *payload
+		part.LogEvents = logEvents
+		partEvent, err := encodeCloudWatchPayload(&part)
+		if err != nil {
+			return nil, err
+		}
+		partEvents, err := splitQuarantinePayload(message, partEvent, &part)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, partEvents...)
+	}
+	return parts, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+
+	pubsub "cloud.google.com/go/pubsub/v2"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSQSSender struct {
+	inputs []*sqs.SendMessageInput
+	err    error
+}
+
+func (f *fakeSQSSender) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	f.inputs = append(f.inputs, params)
+	return &sqs.SendMessageOutput{}, f.err
+}
+
+func TestParseTenancy(t *testing.T) {
+	opts := testOptions()
+	opts.AllowedOwnerAccountIDs = "111111111111, 222222222222"
+	opts.AllowedLogGroupARNs = "arn:aws:logs:us-east-2:111111111111:log-group:/fleet/*"
+	opts.OwnerRoutes = `{"222222222222":{"project_id":"tenant-b","topic_id":"fleet-b"}}`
+
+	cfg, err := parseTenancy(opts)
+	require.NoError(t, err)
+	assert.True(t, cfg.allowedOwners["222222222222"])
+	assert.Len(t, cfg.allowedLogGroupARNs, 1)
+	assert.Equal(t, "fleet-b", cfg.routes["222222222222"].TopicID)
+
+	for name, mutate := range map[string]func(o *OptionsStruct){
+		"bad log group arn":   func(o *OptionsStruct) { o.AllowedLogGroupARNs = "/fleet/*" },
+		"bad routes json":     func(o *OptionsStruct) { o.OwnerRoutes = "{" },
+		"route without topic": func(o *OptionsStruct) { o.OwnerRoutes = `{"1":{"project_id":"p"}}` },
+		"route bad secret":    func(o *OptionsStruct) { o.OwnerRoutes = `{"1":{"topic_id":"t","credentials_secret_arn":"x"}}` },
+		"quarantine without queue": func(o *OptionsStruct) {
+			o.UnexpectedOwnerAction = unexpectedOwnerQuarantine
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			o := testOptions()
+			mutate(&o)
+			_, err := parseTenancy(o)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestCheckPayloadSource(t *testing.T) {
+	payload := &cloudWatchPayload{Owner: "111111111111", LogGroup: "/fleet/server"}
+
+	allowed, _ := checkPayloadSource(tenancyConfig{}, "us-east-2", payload)
+	assert.True(t, allowed, "no allow-list allows everything")
+
+	allowed, reason := checkPayloadSource(tenancyConfig{allowedOwners: map[string]bool{"222222222222": true}}, "us-east-2", payload)
+	assert.False(t, allowed)
+	assert.Contains(t, reason, "111111111111")
+
+	cfg := tenancyConfig{allowedLogGroupARNs: []string{"arn:aws:logs:us-east-2:111111111111:log-group:/fleet/*"}}
+	allowed, _ = checkPayloadSource(cfg, "us-east-2", payload)
+	assert.True(t, allowed)
+
+	allowed, _ = checkPayloadSource(cfg, "us-east-2", &cloudWatchPayload{Owner: "111111111111", LogGroup: "/other/server"})
+	assert.False(t, allowed)
+
+	assert.Equal(t, "arn:aws-us-gov:logs:us-gov-west-1:1:log-group:g", logGroupARN("us-gov-west-1", "1", "g"))
+}
+
+func TestResolveDestination(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+	options = testOptions()
+
+	cfg := tenancyConfig{routes: map[string]pubsubDestination{
+		"222222222222": {TopicID: "fleet-b", CredentialsSecretARN: "arn:aws:secretsmanager:us-east-2:1:secret:b"},
+	}}
+
+	assert.Equal(t, pubsubDestination{ProjectID: "proj", TopicID: "topic", CredentialsSecretARN: options.CredentialsSecretARN}, resolveDestination(cfg, "111111111111"))
+	assert.Equal(t, pubsubDestination{ProjectID: "proj", TopicID: "fleet-b", CredentialsSecretARN: "arn:aws:secretsmanager:us-east-2:1:secret:b"}, resolveDestination(cfg, "222222222222"))
+}
+
+func TestHandlerTenancy(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	ev := makeCloudWatchEvent(t, map[string]interface{}{
+		"owner":       "999999999999",
+		"logGroup":    "group",
+		"messageType": "DATA_MESSAGE",
+		"logEvents": []map[string]interface{}{
+			{"id": "1", "timestamp": 10, "message": "m1"},
+		},
+	})
+
+	getPublisherFunc = func(ctx context.Context, projectID, topicID, secretARN string) (*pubsub.Publisher, error) {
+		t.Fatal("rejected payloads must not be published")
+		return nil, nil
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		options = testOptions()
+		tenancy = tenancyConfig{allowedOwners: map[string]bool{"111111111111": true}}
+
+		resp, err := handler(context.Background(), ev)
+		require.NoError(t, err)
+		assert.Equal(t, 1, resp["rejected_message_count"])
+	})
+
+	t.Run("quarantine", func(t *testing.T) {
+		options = testOptions()
+		options.UnexpectedOwnerAction = unexpectedOwnerQuarantine
+		options.QuarantineQueueURL = "https://sqs.us-east-2.amazonaws.com/111111111111/quarantine"
+		tenancy = tenancyConfig{allowedOwners: map[string]bool{"111111111111": true}}
+
+		sender := &fakeSQSSender{}
+		getSQSClientFunc = func(ctx context.Context) (sqsSender, error) { return sender, nil }
+
+		_, err := handler(context.Background(), ev)
+		require.NoError(t, err)
+		require.Len(t, sender.inputs, 1)
+		assert.Equal(t, options.QuarantineQueueURL, *sender.inputs[0].QueueUrl)
+
+		var body quarantineMessage
+		require.NoError(t, json.Unmarshal([]byte(*sender.inputs[0].MessageBody), &body))
+		assert.Equal(t, "999999999999", body.Owner)
+		assert.Equal(t, ev.AWSLogs.Data, body.RequestPayload.AWSLogs.Data)
+
+		sender.err = errors.New("queue unavailable")
+		_, err = handler(context.Background(), ev)
+		require.Error(t, err, "a failed quarantine must surface so the event is retried")
+	})
+
+	t.Run("routed owner", func(t *testing.T) {
+		options = testOptions()
+		tenancy = tenancyConfig{routes: map[string]pubsubDestination{"999999999999": {ProjectID: "tenant", TopicID: "tenant-topic"}}}
+
+		var gotProject, gotTopic string
+		getPublisherFunc = func(ctx context.Context, projectID, topicID, secretARN string) (*pubsub.Publisher, error) {
+			gotProject, gotTopic = projectID, topicID
+			return nil, nil
+		}
+		publishBatchFunc = func(ctx context.Context, publisher *pubsub.Publisher, messages []outboundMessage) error {
+			return nil
+		}
+
+		_, err := handler(context.Background(), ev)
+		require.NoError(t, err)
+		assert.Equal(t, "tenant", gotProject)
+		assert.Equal(t, "tenant-topic", gotTopic)
+	})
+}
+
+func TestQuarantineSplitsLargePayloads(t *testing.T) {
+	resetMainTestState()
+	t.Cleanup(resetMainTestState)
+
+	options = testOptions()
+	options.QuarantineQueueURL = "https://sqs.us-east-2.amazonaws.com/111111111111/quarantine"
+	sender := &fakeSQSSender{}
+	getSQSClientFunc = func(ctx context.Context) (sqsSender, error) { return sender, nil }
+
+	// Random messages barely compress, so the event is well over the limit.
+	payload := &cloudWatchPayload{Owner: "999999999999", LogGroup: "group", LogStream: "stream", MessageType: "DATA_MESSAGE"}
+	for i := range 1000 {
+		random := make([]byte, 300)
+		_, err := rand.Read(random)
+		require.NoError(t, err)
+		payload.LogEvents = append(payload.LogEvents, cloudWatchLogEvent{ID: strconv.Itoa(i), Timestamp: int64(i), Message: base64.StdEncoding.EncodeToString(random)})
+	}
+	event, err := encodeCloudWatchPayload(payload)
+	require.NoError(t, err)
+	require.Greater(t, len(event.AWSLogs.Data), quarantineMaxMessageBytes)
+
+	require.NoError(t, quarantinePayload(context.Background(), event, payload, "owner account is not allowed"))
+	require.Greater(t, len(sender.inputs), 1)
+
+	var ids []string
+	for i, input := range sender.inputs {
+		assert.LessOrEqual(t, len(*input.MessageBody), quarantineMaxMessageBytes)
+
+		var body quarantineMessage
+		require.NoError(t, json.Unmarshal([]byte(*input.MessageBody), &body))
+		assert.Equal(t, i+1, body.Part)
+		assert.Equal(t, len(sender.inputs), body.Parts)
+		assert.Equal(t, "owner account is not allowed", body.Reason)
+
+		part, err := decodeCloudWatchPayload(body.RequestPayload)
+		require.NoError(t, err, "each part is a subscription event of its own")
+		assert.Equal(t, "group", part.LogGroup)
+		for _, logEvent := range part.LogEvents {
+			ids = append(ids, logEvent.ID)
+		}
+	}
+	require.Len(t, ids, 1000, "every log event is quarantined once")
+	for i, id := range ids {
+		assert.Equal(t, strconv.Itoa(i), id)
+	}
+
+	// A single log event too large for a message cannot be split.
+	random := make([]byte, quarantineMaxMessageBytes)
+	_, err = rand.Read(random)
+	require.NoError(t, err)
+	single := &cloudWatchPayload{Owner: "999999999999", LogGroup: "group", LogEvents: []cloudWatchLogEvent{{ID: "big", Message: base64.StdEncoding.EncodeToString(random)}}}
+	event, err = encodeCloudWatchPayload(single)
+	require.NoError(t, err)
+	sender.inputs = nil
+	require.ErrorContains(t, quarantinePayload(context.Background(), event, single, "owner account is not allowed"), "over the 262144 byte limit")
+	assert.Empty(t, sender.inputs)
+}
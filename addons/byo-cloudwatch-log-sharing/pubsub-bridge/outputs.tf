@@ -20,12 +20,70 @@ output "subscription_filter" {
 output "pubsub" {
   description = "Configured GCP Pub/Sub destination details."
   value = {
-    project_id             = var.gcp_pubsub.project_id
-    topic_id               = var.gcp_pubsub.topic_id
-    credentials_secret_arn = var.gcp_pubsub.credentials_secret_arn
+    sink                   = var.sink
+    project_id             = local.gcp_pubsub.project_id
+    topic_id               = local.gcp_pubsub.topic_id
+    credentials_secret_arn = local.gcp_pubsub.credentials_secret_arn
+    encryption_mode        = var.encryption.mode
+    encryption_kms_key_arn = var.encryption.mode == "kms" ? var.encryption.kms_key_arn : null
+    signing_secret_arn     = var.signing.secret_arn != "" ? var.signing.secret_arn : null
   }
 }
 
+output "kafka" {
+  description = "Kafka sink details, or null when sink is not kafka."
+  value = var.sink == "kafka" ? {
+    brokers         = var.kafka.brokers
+    topic           = var.kafka.topic
+    tls_enabled     = var.kafka.tls_enabled
+    sasl_mechanism  = var.kafka.sasl_mechanism
+    sasl_secret_arn = var.kafka.sasl_secret_arn != "" ? var.kafka.sasl_secret_arn : null
+    idempotent      = var.kafka.idempotent
+  } : null
+}
+
+output "splunk" {
+  description = "Splunk HEC sink details, or null when sink is not splunk."
+  value = var.sink == "splunk" ? {
+    hec_url          = var.splunk.hec_url
+    token_secret_arn = var.splunk.token_secret_arn
+    ack_enabled      = var.splunk.ack_enabled
+  } : null
+}
+
+output "otlp" {
+  description = "OTLP sink details, or null when sink is not otlp."
+  value = var.sink == "otlp" ? {
+    endpoint = var.otlp.endpoint
+    protocol = var.otlp.protocol
+  } : null
+}
+
+output "loki" {
+  description = "Loki sink details, or null when sink is not loki."
+  value = var.sink == "loki" ? {
+    url    = var.loki.url
+    format = var.loki.format
+  } : null
+}
+
+output "elasticsearch" {
+  description = "Elasticsearch/OpenSearch sink details, or null when sink is not elasticsearch."
+  value = var.sink == "elasticsearch" ? {
+    url   = var.elasticsearch.url
+    index = var.elasticsearch.index
+    auth  = var.elasticsearch.auth
+  } : null
+}
+
+output "syslog" {
+  description = "Syslog sink details, or null when sink is not syslog."
+  value = var.sink == "syslog" ? {
+    address  = var.syslog.address
+    app_name = var.syslog.app_name
+  } : null
+}
+
 output "dlq" {
   description = "Dead-letter queue configuration and resource details."
   value = {
@@ -38,6 +96,27 @@ output "dlq" {
   }
 }
 
+output "quarantine" {
+  description = "Quarantine queue for payloads from unexpected owner accounts or log groups."
+  value = {
+    enabled    = local.quarantine_enabled
+    queue_name = try(aws_sqs_queue.quarantine[0].name, null)
+    queue_arn  = try(aws_sqs_queue.quarantine[0].arn, null)
+    queue_url  = try(aws_sqs_queue.quarantine[0].url, null)
+  }
+}
+
+output "parking_lot" {
+  description = "Parking-lot queue for events that failed every replay attempt."
+  value = {
+    enabled      = local.parking_lot_enabled
+    max_attempts = var.replayer.max_attempts
+    queue_name   = try(aws_sqs_queue.parking_lot[0].name, null)
+    queue_arn    = try(aws_sqs_queue.parking_lot[0].arn, null)
+    queue_url    = try(aws_sqs_queue.parking_lot[0].url, null)
+  }
+}
+
 output "alerting" {
   description = "CloudWatch alarm and notification resources for bridge health."
   value = {
@@ -49,6 +128,11 @@ output "alerting" {
     replayer_errors_alarm_arn       = try(aws_cloudwatch_metric_alarm.replayer_errors[0].arn, null)
     dlq_visible_messages_alarm_name = try(aws_cloudwatch_metric_alarm.dlq_visible_messages[0].alarm_name, null)
     dlq_visible_messages_alarm_arn  = try(aws_cloudwatch_metric_alarm.dlq_visible_messages[0].arn, null)
+    parking_lot_alarm_name          = try(aws_cloudwatch_metric_alarm.parking_lot_visible_messages[0].alarm_name, null)
+    parking_lot_alarm_arn           = try(aws_cloudwatch_metric_alarm.parking_lot_visible_messages[0].arn, null)
+    canary_failures_alarm_name      = try(aws_cloudwatch_metric_alarm.canary_failures[0].alarm_name, null)
+    canary_failures_alarm_arn       = try(aws_cloudwatch_metric_alarm.canary_failures[0].arn, null)
+    streams_behind_alarm_names      = [for alarm in aws_cloudwatch_metric_alarm.streams_behind : alarm.alarm_name]
   }
 }
 
@@ -56,6 +140,7 @@ output "replayer" {
   description = "DLQ replayer Lambda and event source mapping details."
   value = {
     enabled                         = local.replayer_enabled
+    mode                            = var.replayer.mode
     function_name                   = try(aws_lambda_function.replayer[0].function_name, null)
     function_arn                    = try(aws_lambda_function.replayer[0].arn, null)
     role_arn                        = try(aws_iam_role.replayer[0].arn, null)
@@ -63,5 +148,31 @@ output "replayer" {
     batch_size                      = var.replayer.batch_size
     maximum_batching_window_seconds = var.replayer.maximum_batching_window_in_seconds
     maximum_concurrency             = var.replayer.maximum_concurrency
+    archive_location                = var.replayer.max_event_age_seconds > 0 ? "s3://${var.replayer.archive_bucket_name}/${var.replayer.archive_prefix}" : null
+  }
+}
+
+output "canary" {
+  description = "End-to-end canary Lambda and schedule details."
+  value = {
+    enabled           = local.canary_enabled
+    function_name     = try(aws_lambda_function.canary[0].function_name, null)
+    function_arn      = try(aws_lambda_function.canary[0].arn, null)
+    role_arn          = try(aws_iam_role.canary[0].arn, null)
+    schedule_rule     = try(aws_cloudwatch_event_rule.canary[0].name, null)
+    log_stream_name   = local.canary_enabled ? var.canary.log_stream_name : null
+    metrics_namespace = var.metrics.namespace
+  }
+}
+
+output "gap_detection" {
+  description = "High-water mark table and gap checker details."
+  value = {
+    enabled       = local.gap_detection_enabled
+    table_name    = local.gap_detection_enabled ? local.gap_detection_table_name : null
+    table_arn     = try(aws_dynamodb_table.high_water_marks[0].arn, null)
+    function_name = try(aws_lambda_function.gap_detection[0].function_name, null)
+    function_arn  = try(aws_lambda_function.gap_detection[0].arn, null)
+    report_uri    = local.gap_detection_enabled && var.gap_detection.report_bucket_name != "" ? "s3://${var.gap_detection.report_bucket_name}/${var.gap_detection.report_prefix}latest.json" : null
   }
 }
@@ -1,16 +1,52 @@
 locals {
-  replayer_lambda_binary_path = "${path.module}/lambda/replayer/bootstrap"
+  replayer_lambda_binary_path  = "${path.module}/lambda/replayer/bootstrap"
+  replayer_lambda_source_files = sort(fileset("${path.module}/lambda", "{replayer/*.go,replay/*.go,awslogs/*.go,dlq/*.go,emf/*.go}"))
+
+  # The bridge is always replayable. Other functions only when routing to
+  # origin.
+  replayer_allowed_function_arns = distinct(concat(
+    [aws_lambda_function.bridge.arn],
+    var.replayer.route_to_origin ? var.replayer.allowed_function_arns : [],
+  ))
+
+  # In direct mode the replayer runs the bridge binary in replay mode, with
+  # the bridge's configuration, and publishes replayed events itself.
+  replayer_lambda_environment = merge(
+    local.replayer_direct ? tomap(merge(local.bridge_lambda_environment, { BRIDGE_MODE = "replay" })) : tomap({}),
+    {
+      TARGET_BRIDGE_FUNCTION_NAME  = aws_lambda_function.bridge.function_name
+      REPLAY_INVOCATION_TYPE       = var.replayer.invocation_type
+      REPLAY_CONCURRENCY           = tostring(var.replayer.replay_concurrency)
+      REPLAY_ROUTE_TO_ORIGIN       = tostring(var.replayer.route_to_origin)
+      REPLAY_ALLOWED_FUNCTION_ARNS = join(",", local.replayer_allowed_function_arns)
+      REPLAY_MAX_ATTEMPTS          = tostring(var.replayer.max_attempts)
+      REPLAY_RETRY_DELAY_SECONDS   = tostring(min(var.dlq.visibility_timeout_seconds, 900))
+      PARKING_LOT_QUEUE_URL        = try(aws_sqs_queue.parking_lot[0].url, "")
+      METRICS_NAMESPACE            = var.metrics.namespace
+      DLQ_QUEUE_URL                = aws_sqs_queue.dlq[0].url
+      REPLAY_MAX_EVENT_AGE_SECONDS = tostring(var.replayer.max_event_age_seconds)
+      ARCHIVE_BUCKET               = var.replayer.archive_bucket_name
+      ARCHIVE_PREFIX               = var.replayer.archive_prefix
+
+      REPLAY_BREAKER_FAILURE_THRESHOLD    = tostring(var.replayer.circuit_breaker.failure_threshold)
+      REPLAY_BREAKER_MINIMUM_REPLAYS      = tostring(var.replayer.circuit_breaker.minimum_replays)
+      REPLAY_BREAKER_WINDOW               = tostring(var.replayer.circuit_breaker.window)
+      REPLAY_BREAKER_COOLDOWN_SECONDS     = tostring(var.replayer.circuit_breaker.cooldown_seconds)
+      REPLAY_BREAKER_MAX_COOLDOWN_SECONDS = tostring(var.replayer.circuit_breaker.max_cooldown_seconds)
+      REPLAY_BREAKER_PROBE_SIZE           = tostring(var.replayer.circuit_breaker.probe_size)
+    },
+  )
 }
 
 resource "null_resource" "replayer_build" {
-  count = local.replayer_enabled ? 1 : 0
+  count = local.replayer_invoke ? 1 : 0
 
   triggers = {
-    main_go_changes = filesha256("${path.module}/lambda/replayer/main.go")
-    go_mod_changes  = filesha256("${path.module}/lambda/go.mod")
-    go_sum_changes  = fileexists("${path.module}/lambda/go.sum") ? filesha256("${path.module}/lambda/go.sum") : ""
-    go_arch         = local.replayer_go_arch
-    binary_exists   = fileexists(local.replayer_lambda_binary_path) ? true : timestamp()
+    go_source_changes = sha256(join("", [for f in local.replayer_lambda_source_files : filesha256("${path.module}/lambda/${f}")]))
+    go_mod_changes    = filesha256("${path.module}/lambda/go.mod")
+    go_sum_changes    = fileexists("${path.module}/lambda/go.sum") ? filesha256("${path.module}/lambda/go.sum") : ""
+    go_arch           = local.replayer_go_arch
+    binary_exists     = fileexists(local.replayer_lambda_binary_path) ? true : timestamp()
   }
 
   provisioner "local-exec" {
@@ -23,7 +59,7 @@ resource "null_resource" "replayer_build" {
 }
 
 data "archive_file" "replayer" {
-  count = local.replayer_enabled ? 1 : 0
+  count = local.replayer_invoke ? 1 : 0
 
   depends_on  = [null_resource.replayer_build[0]]
   type        = "zip"
@@ -44,21 +80,19 @@ resource "aws_lambda_function" "replayer" {
 
   function_name = local.replayer_function_name
   role          = aws_iam_role.replayer[0].arn
-  runtime       = local.replayer_runtime
+  runtime       = local.replayer_direct ? var.lambda.runtime : local.replayer_runtime
   handler       = "bootstrap"
-  architectures = [local.replayer_architecture]
+  architectures = [local.replayer_direct ? var.lambda.architecture : local.replayer_architecture]
   timeout       = var.replayer.timeout
   memory_size   = var.replayer.memory_size
 
   reserved_concurrent_executions = var.replayer.reserved_concurrent_executions == -1 ? null : var.replayer.reserved_concurrent_executions
 
-  filename         = data.archive_file.replayer[0].output_path
-  source_code_hash = data.archive_file.replayer[0].output_base64sha256
+  filename         = local.replayer_direct ? data.archive_file.bridge.output_path : one(data.archive_file.replayer[*].output_path)
+  source_code_hash = local.replayer_direct ? data.archive_file.bridge.output_base64sha256 : one(data.archive_file.replayer[*].output_base64sha256)
 
   environment {
-    variables = {
-      TARGET_BRIDGE_FUNCTION_NAME = aws_lambda_function.bridge.function_name
-    }
+    variables = local.replayer_lambda_environment
   }
 
   tags = var.tags
@@ -67,6 +101,7 @@ resource "aws_lambda_function" "replayer" {
     aws_cloudwatch_log_group.replayer,
     aws_iam_role_policy_attachment.replayer_lambda_basic_execution,
     aws_iam_role_policy_attachment.replayer,
+    aws_iam_role_policy_attachment.replayer_bridge,
   ]
 }
 
@@ -72,32 +72,44 @@ variable "lambda" {
   }
 }
 
+variable "sink" {
+  description = "Where the bridge publishes log events: \"pubsub\" (gcp_pubsub), \"kafka\" (kafka), \"splunk\" (splunk), \"otlp\" (otlp), \"loki\" (loki), \"elasticsearch\" (elasticsearch) or \"syslog\" (syslog). Decoding, sampling, tenancy, message format, encryption and signing are the same for every sink."
+  type        = string
+  default     = "pubsub"
+
+  validation {
+    condition     = contains(["pubsub", "kafka", "splunk", "otlp", "loki", "elasticsearch", "syslog"], var.sink)
+    error_message = "sink must be one of: pubsub, kafka, splunk, otlp, loki, elasticsearch, syslog."
+  }
+}
+
 variable "gcp_pubsub" {
-  description = "GCP Pub/Sub settings and credentials secret reference for cloud.google.com/go/pubsub/v2. The secret must contain a Google service-account key JSON, or a JSON object with a service_account_json field containing that key JSON."
+  description = "GCP Pub/Sub settings and credentials secret reference for cloud.google.com/go/pubsub/v2. The secret must contain a Google service-account key JSON, or a JSON object with a service_account_json field containing that key JSON. Required when sink is pubsub."
   type = object({
     project_id             = string
     topic_id               = string
     credentials_secret_arn = string
     secret_kms_key_arn     = optional(string, "")
   })
+  default = null
 
   validation {
-    condition     = length(trimspace(var.gcp_pubsub.project_id)) > 0
+    condition     = var.gcp_pubsub == null ? true : length(trimspace(var.gcp_pubsub.project_id)) > 0
     error_message = "gcp_pubsub.project_id must not be empty."
   }
 
   validation {
-    condition     = length(trimspace(var.gcp_pubsub.topic_id)) > 0
+    condition     = var.gcp_pubsub == null ? true : length(trimspace(var.gcp_pubsub.topic_id)) > 0
     error_message = "gcp_pubsub.topic_id must not be empty."
   }
 
   validation {
-    condition     = startswith(var.gcp_pubsub.credentials_secret_arn, "arn:")
+    condition     = var.gcp_pubsub == null ? true : startswith(var.gcp_pubsub.credentials_secret_arn, "arn:")
     error_message = "gcp_pubsub.credentials_secret_arn must be a Secrets Manager ARN."
   }
 
   validation {
-    condition = (
+    condition = var.gcp_pubsub == null ? true : (
       var.gcp_pubsub.secret_kms_key_arn == "" ||
       startswith(var.gcp_pubsub.secret_kms_key_arn, "arn:")
     )
@@ -105,6 +117,441 @@ variable "gcp_pubsub" {
   }
 }
 
+variable "kafka" {
+  description = "Kafka settings used when sink is kafka. Brokers must be reachable from the bridge Lambda. sasl_secret_arn names a Secrets Manager secret holding a JSON object with username and password. With idempotent enabled the brokers deduplicate batches the bridge retries after a lost response. tenancy.owner_routes topic_id values name Kafka topics; their project_id and credentials_secret_arn do not apply."
+  type = object({
+    brokers                 = optional(list(string), [])
+    topic                   = optional(string, "")
+    client_id               = optional(string, "fleet-pubsub-bridge")
+    tls_enabled             = optional(bool, true)
+    tls_ca_pem              = optional(string, "")
+    sasl_mechanism          = optional(string, "none")
+    sasl_secret_arn         = optional(string, "")
+    sasl_secret_kms_key_arn = optional(string, "")
+    idempotent              = optional(bool, true)
+    max_retries             = optional(number, 3)
+    request_timeout_seconds = optional(number, 30)
+  })
+  default = {}
+
+  validation {
+    condition     = alltrue([for broker in var.kafka.brokers : can(regex("^[^:]+:[0-9]+$", broker))])
+    error_message = "kafka.brokers entries must be host:port."
+  }
+
+  validation {
+    condition     = contains(["none", "plain", "scram-sha-256", "scram-sha-512"], var.kafka.sasl_mechanism)
+    error_message = "kafka.sasl_mechanism must be one of: none, plain, scram-sha-256, scram-sha-512."
+  }
+
+  validation {
+    condition     = var.kafka.sasl_mechanism == "none" || startswith(var.kafka.sasl_secret_arn, "arn:")
+    error_message = "kafka.sasl_secret_arn must be a Secrets Manager ARN when kafka.sasl_mechanism is set."
+  }
+
+  validation {
+    condition     = var.kafka.sasl_mechanism != "plain" || var.kafka.tls_enabled
+    error_message = "kafka.sasl_mechanism plain requires kafka.tls_enabled."
+  }
+
+  validation {
+    condition     = var.kafka.sasl_secret_kms_key_arn == "" || startswith(var.kafka.sasl_secret_kms_key_arn, "arn:")
+    error_message = "kafka.sasl_secret_kms_key_arn must be empty or a valid KMS key ARN."
+  }
+
+  validation {
+    condition     = var.kafka.max_retries >= 0 && var.kafka.request_timeout_seconds > 0
+    error_message = "kafka.max_retries must be >= 0 and kafka.request_timeout_seconds must be positive."
+  }
+}
+
+variable "splunk" {
+  description = "Splunk HTTP Event Collector settings used when sink is splunk. token_secret_arn names a Secrets Manager secret holding the HEC token, either as plain text or as a JSON object with a token field. sourcetype, index, host and source are templates that may use {owner}, {log_group}, {log_stream} and {field.<path>} (a field of a JSON log body); routes override them for log groups matching a glob, first match wins. With ack_enabled each batch waits for indexer acknowledgement and is resent when it is not acknowledged within ack_timeout_seconds."
+  type = object({
+    hec_url                  = optional(string, "")
+    token_secret_arn         = optional(string, "")
+    token_secret_kms_key_arn = optional(string, "")
+    sourcetype               = optional(string, "fleet:cloudwatch")
+    index                    = optional(string, "")
+    host                     = optional(string, "")
+    source                   = optional(string, "{log_group}")
+    routes = optional(list(object({
+      log_group  = string
+      sourcetype = optional(string, "")
+      index      = optional(string, "")
+      host       = optional(string, "")
+      source     = optional(string, "")
+    })), [])
+    ack_enabled             = optional(bool, false)
+    ack_timeout_seconds     = optional(number, 30)
+    tls_ca_pem              = optional(string, "")
+    max_retries             = optional(number, 3)
+    retry_backoff_ms        = optional(number, 500)
+    request_timeout_seconds = optional(number, 30)
+  })
+  default = {}
+
+  validation {
+    condition     = var.splunk.hec_url == "" || can(regex("^https?://", var.splunk.hec_url))
+    error_message = "splunk.hec_url must be an http(s) URL."
+  }
+
+  validation {
+    condition     = var.splunk.token_secret_arn == "" || startswith(var.splunk.token_secret_arn, "arn:")
+    error_message = "splunk.token_secret_arn must be a Secrets Manager ARN."
+  }
+
+  validation {
+    condition     = var.splunk.token_secret_kms_key_arn == "" || startswith(var.splunk.token_secret_kms_key_arn, "arn:")
+    error_message = "splunk.token_secret_kms_key_arn must be empty or a valid KMS key ARN."
+  }
+
+  validation {
+    condition = (
+      var.splunk.ack_timeout_seconds > 0 &&
+      var.splunk.max_retries >= 0 &&
+      var.splunk.retry_backoff_ms > 0 &&
+      var.splunk.request_timeout_seconds > 0
+    )
+    error_message = "splunk.ack_timeout_seconds, splunk.retry_backoff_ms and splunk.request_timeout_seconds must be positive and splunk.max_retries must be >= 0."
+  }
+}
+
+variable "fleet_environment" {
+  description = "Name of the Fleet environment, such as production or staging. Sinks that label or annotate events with an environment use it; empty omits it."
+  type        = string
+  default     = ""
+}
+
+variable "otlp" {
+  description = "OpenTelemetry logs exporter settings used when sink is otlp. endpoint is a base URL such as https://collector:4318 for http/protobuf (/v1/logs is appended) or host:port for grpc. headers_secret_arn optionally names a Secrets Manager secret holding a JSON object of request headers, such as an API key. fleet_environment is reported as the deployment.environment.name resource attribute."
+  type = object({
+    endpoint                   = optional(string, "")
+    protocol                   = optional(string, "http/protobuf")
+    insecure                   = optional(bool, false)
+    tls_ca_pem                 = optional(string, "")
+    headers_secret_arn         = optional(string, "")
+    headers_secret_kms_key_arn = optional(string, "")
+    compression                = optional(string, "gzip")
+    service_name               = optional(string, "fleet")
+    timeout_seconds            = optional(number, 30)
+    max_retries                = optional(number, 3)
+    retry_backoff_ms           = optional(number, 500)
+  })
+  default = {}
+
+  validation {
+    condition     = contains(["http/protobuf", "grpc"], var.otlp.protocol)
+    error_message = "otlp.protocol must be one of: http/protobuf, grpc."
+  }
+
+  validation {
+    condition     = contains(["gzip", "none"], var.otlp.compression)
+    error_message = "otlp.compression must be one of: gzip, none."
+  }
+
+  validation {
+    condition     = var.otlp.headers_secret_arn == "" || startswith(var.otlp.headers_secret_arn, "arn:")
+    error_message = "otlp.headers_secret_arn must be empty or a Secrets Manager ARN."
+  }
+
+  validation {
+    condition     = var.otlp.headers_secret_kms_key_arn == "" || startswith(var.otlp.headers_secret_kms_key_arn, "arn:")
+    error_message = "otlp.headers_secret_kms_key_arn must be empty or a valid KMS key ARN."
+  }
+
+  validation {
+    condition     = var.otlp.timeout_seconds > 0 && var.otlp.max_retries >= 0 && var.otlp.retry_backoff_ms > 0
+    error_message = "otlp.timeout_seconds and otlp.retry_backoff_ms must be positive and otlp.max_retries must be >= 0."
+  }
+}
+
+variable "loki" {
+  description = "Grafana Loki push API settings used when sink is loki. url is the Loki base URL; /loki/api/v1/push is appended unless present. labels maps label names to templates that may use {owner}, {log_group}, {log_stream} and {field.<path>} (a field of a JSON log body); fleet_environment adds an environment label. log_types sets a log_type label for log groups matching a glob, first match wins. Each label keeps at most max_label_values distinct values per Lambda execution environment, and later values become __overflow__. tenant_id is a template sent as X-Scope-OrgID; requests are split per tenant. auth_secret_arn optionally names a Secrets Manager secret holding a JSON object with username and password, or bearer_token. With structured_metadata the message attributes are attached to each entry as structured metadata."
+  type = object({
+    url    = optional(string, "")
+    format = optional(string, "protobuf")
+    labels = optional(map(string), { log_group = "{log_group}" })
+    log_types = optional(list(object({
+      log_group = string
+      log_type  = string
+    })), [])
+    max_label_values        = optional(number, 50)
+    tenant_id               = optional(string, "")
+    auth_secret_arn         = optional(string, "")
+    auth_secret_kms_key_arn = optional(string, "")
+    structured_metadata     = optional(bool, false)
+    tls_ca_pem              = optional(string, "")
+    timeout_seconds         = optional(number, 30)
+    max_retries             = optional(number, 3)
+    retry_backoff_ms        = optional(number, 500)
+  })
+  default = {}
+
+  validation {
+    condition     = contains(["protobuf", "json"], var.loki.format)
+    error_message = "loki.format must be one of: protobuf, json."
+  }
+
+  validation {
+    condition     = alltrue([for name in keys(var.loki.labels) : can(regex("^[a-zA-Z_][a-zA-Z0-9_]*$", name)) && !startswith(name, "__")]) && length(var.loki.labels) <= 15
+    error_message = "loki.labels names must be valid Loki label names that do not start with __, and at most 15 labels may be set."
+  }
+
+  validation {
+    condition     = var.loki.max_label_values >= 1
+    error_message = "loki.max_label_values must be at least 1."
+  }
+
+  validation {
+    condition     = var.loki.auth_secret_arn == "" || startswith(var.loki.auth_secret_arn, "arn:")
+    error_message = "loki.auth_secret_arn must be empty or a Secrets Manager ARN."
+  }
+
+  validation {
+    condition     = var.loki.auth_secret_kms_key_arn == "" || startswith(var.loki.auth_secret_kms_key_arn, "arn:")
+    error_message = "loki.auth_secret_kms_key_arn must be empty or a valid KMS key ARN."
+  }
+
+  validation {
+    condition     = var.loki.timeout_seconds > 0 && var.loki.max_retries >= 0 && var.loki.retry_backoff_ms > 0
+    error_message = "loki.timeout_seconds and loki.retry_backoff_ms must be positive and loki.max_retries must be >= 0."
+  }
+}
+
+variable "elasticsearch" {
+  description = "Elasticsearch or OpenSearch _bulk settings used when sink is elasticsearch. index is a template that may use {date} (the event date in UTC, formatted with the Go layout index_date_format), {owner}, {log_group}, {log_stream} and {field.<path>}; it is lowercased and characters that are invalid in index names become -. Documents are created with the CloudWatch event ID as _id, so redelivered events are not duplicated. auth is none, basic (basic_auth_secret_arn names a Secrets Manager secret holding a JSON object with username and password) or sigv4 for Amazon OpenSearch Service (sigv4_service es) and OpenSearch Serverless (sigv4_service aoss). With sigv4, resource_arn is the domain or collection ARN the bridge is allowed to write to."
+  type = object({
+    url                           = optional(string, "")
+    index                         = optional(string, "fleet-logs-{date}")
+    index_date_format             = optional(string, "2006.01.02")
+    auth                          = optional(string, "none")
+    basic_auth_secret_arn         = optional(string, "")
+    basic_auth_secret_kms_key_arn = optional(string, "")
+    sigv4_service                 = optional(string, "es")
+    sigv4_region                  = optional(string, "")
+    resource_arn                  = optional(string, "")
+    tls_ca_pem                    = optional(string, "")
+    request_timeout_seconds       = optional(number, 30)
+    max_retries                   = optional(number, 3)
+    retry_backoff_ms              = optional(number, 500)
+  })
+  default = {}
+
+  validation {
+    condition     = contains(["none", "basic", "sigv4"], var.elasticsearch.auth)
+    error_message = "elasticsearch.auth must be one of: none, basic, sigv4."
+  }
+
+  validation {
+    condition     = contains(["es", "aoss"], var.elasticsearch.sigv4_service)
+    error_message = "elasticsearch.sigv4_service must be one of: es, aoss."
+  }
+
+  validation {
+    condition     = var.elasticsearch.auth != "basic" || startswith(var.elasticsearch.basic_auth_secret_arn, "arn:")
+    error_message = "elasticsearch.basic_auth_secret_arn must be a Secrets Manager ARN when elasticsearch.auth is basic."
+  }
+
+  validation {
+    condition     = var.elasticsearch.auth != "sigv4" || startswith(var.elasticsearch.resource_arn, "arn:")
+    error_message = "elasticsearch.resource_arn must be an OpenSearch domain or collection ARN when elasticsearch.auth is sigv4."
+  }
+
+  validation {
+    condition     = var.elasticsearch.basic_auth_secret_kms_key_arn == "" || startswith(var.elasticsearch.basic_auth_secret_kms_key_arn, "arn:")
+    error_message = "elasticsearch.basic_auth_secret_kms_key_arn must be empty or a valid KMS key ARN."
+  }
+
+  validation {
+    condition     = var.elasticsearch.request_timeout_seconds > 0 && var.elasticsearch.max_retries >= 0 && var.elasticsearch.retry_backoff_ms > 0
+    error_message = "elasticsearch.request_timeout_seconds and elasticsearch.retry_backoff_ms must be positive and elasticsearch.max_retries must be >= 0."
+  }
+}
+
+variable "syslog" {
+  description = "RFC 5424 syslog over TLS settings used when sink is syslog. address is the receiver's host:port. tls_ca_pem optionally replaces the system roots, and tls_server_name overrides the name verified in the receiver's certificate. app_name and hostname are templates that may use {owner}, {log_group}, {log_stream} and {field.<path>}; an empty hostname is sent as -. Message attributes are sent as parameters of the sd_id structured data element. Messages longer than max_message_bytes are truncated."
+  type = object({
+    address               = optional(string, "")
+    tls_ca_pem            = optional(string, "")
+    tls_server_name       = optional(string, "")
+    app_name              = optional(string, "{log_group}")
+    hostname              = optional(string, "")
+    facility              = optional(number, 1)
+    sd_id                 = optional(string, "fleet@32473")
+    max_message_bytes     = optional(number, 8192)
+    dial_timeout_seconds  = optional(number, 10)
+    write_timeout_seconds = optional(number, 10)
+    max_retries           = optional(number, 3)
+    retry_backoff_ms      = optional(number, 500)
+  })
+  default = {}
+
+  validation {
+    condition     = var.syslog.facility >= 0 && var.syslog.facility <= 23
+    error_message = "syslog.facility must be between 0 and 23."
+  }
+
+  validation {
+    condition     = length(var.syslog.sd_id) <= 32 && can(regex("^[^= \"\\]@]+@[^= \"\\]]+$", var.syslog.sd_id))
+    error_message = "syslog.sd_id must be an SD-ID of the form name@<enterprise number>."
+  }
+
+  validation {
+    condition     = var.syslog.max_message_bytes >= 480
+    error_message = "syslog.max_message_bytes must be at least 480."
+  }
+
+  validation {
+    condition     = var.syslog.dial_timeout_seconds > 0 && var.syslog.write_timeout_seconds > 0 && var.syslog.max_retries >= 0 && var.syslog.retry_backoff_ms > 0
+    error_message = "syslog.dial_timeout_seconds, syslog.write_timeout_seconds and syslog.retry_backoff_ms must be positive and syslog.max_retries must be >= 0."
+  }
+}
+
+variable "encryption" {
+  description = "Optional client-side envelope encryption of each log payload before it is published. Payloads are sealed with AES-256-GCM using a data key wrapped by AWS KMS (mode = \"kms\") or by an RSA public key (mode = \"rsa\"). The wrapped data key, key ID and algorithm are attached as message attributes."
+  type = object({
+    mode                 = optional(string, "none")
+    kms_key_arn          = optional(string, "")
+    public_key_pem       = optional(string, "")
+    data_key_ttl_seconds = optional(number, 300)
+  })
+  default = {}
+
+  validation {
+    condition     = contains(["none", "kms", "rsa"], var.encryption.mode)
+    error_message = "encryption.mode must be one of: none, kms, rsa."
+  }
+
+  validation {
+    condition     = var.encryption.mode != "kms" || startswith(var.encryption.kms_key_arn, "arn:")
+    error_message = "encryption.kms_key_arn must be a KMS key ARN when encryption.mode is kms."
+  }
+
+  validation {
+    condition     = var.encryption.mode != "rsa" || can(regex("-----BEGIN (RSA )?PUBLIC KEY-----", var.encryption.public_key_pem))
+    error_message = "encryption.public_key_pem must be a PEM encoded RSA public key when encryption.mode is rsa."
+  }
+
+  validation {
+    condition     = var.encryption.data_key_ttl_seconds >= 1 && var.encryption.data_key_ttl_seconds <= 86400
+    error_message = "encryption.data_key_ttl_seconds must be between 1 and 86400."
+  }
+}
+
+variable "signing" {
+  description = "Optional HMAC-SHA256 signing of published messages. The secret must contain a JSON keyset of the form {\"active_key_id\": \"...\", \"keys\": {\"<key id>\": \"<base64 key of at least 32 bytes>\"}}. Messages are signed with the active key and carry signature and key_id attributes."
+  type = object({
+    secret_arn         = optional(string, "")
+    secret_kms_key_arn = optional(string, "")
+  })
+  default = {}
+
+  validation {
+    condition     = var.signing.secret_arn == "" || startswith(var.signing.secret_arn, "arn:")
+    error_message = "signing.secret_arn must be empty or a Secrets Manager ARN."
+  }
+
+  validation {
+    condition     = var.signing.secret_kms_key_arn == "" || startswith(var.signing.secret_kms_key_arn, "arn:")
+    error_message = "signing.secret_kms_key_arn must be empty or a valid KMS key ARN."
+  }
+}
+
+variable "sampling" {
+  description = "Optional per-log-group sampling and rate limiting rules evaluated in order; the first rule whose log_group glob (path.Match syntax, where * does not match /) matches, and whose contains substring is found in the message when set, applies. Kept events from a matching rule carry a sample_rate attribute. Rate limits are enforced per Lambda execution environment."
+  type = list(object({
+    log_group             = string
+    contains              = optional(string, "")
+    sample_rate           = optional(number, 1)
+    rate_limit_per_second = optional(number, 0)
+    burst                 = optional(number, 0)
+  }))
+  default = []
+
+  validation {
+    condition     = alltrue([for rule in var.sampling : length(trimspace(rule.log_group)) > 0])
+    error_message = "sampling[*].log_group must not be empty."
+  }
+
+  validation {
+    condition     = alltrue([for rule in var.sampling : rule.sample_rate >= 0 && rule.sample_rate <= 1])
+    error_message = "sampling[*].sample_rate must be between 0 and 1."
+  }
+
+  validation {
+    condition     = alltrue([for rule in var.sampling : rule.rate_limit_per_second >= 0 && rule.burst >= 0])
+    error_message = "sampling[*].rate_limit_per_second and sampling[*].burst must not be negative."
+  }
+}
+
+variable "tenancy" {
+  description = "Source guard and multi-tenant routing. When allowed_owner_account_ids or allowed_log_group_arns (ARN globs) are set, payloads from other sources are rejected (dropped and logged) or quarantined to a module-managed SQS queue. owner_routes maps source AWS account IDs to tenant-specific Pub/Sub destinations, or Kafka topics when sink is kafka; unset route fields fall back to gcp_pubsub."
+  type = object({
+    allowed_owner_account_ids = optional(list(string), [])
+    allowed_log_group_arns    = optional(list(string), [])
+    unexpected_owner_action   = optional(string, "reject")
+    quarantine_queue_name     = optional(string)
+    owner_routes = optional(map(object({
+      project_id             = optional(string, "")
+      topic_id               = string
+      credentials_secret_arn = optional(string, "")
+    })), {})
+  })
+  default = {}
+
+  validation {
+    condition     = contains(["reject", "quarantine"], var.tenancy.unexpected_owner_action)
+    error_message = "tenancy.unexpected_owner_action must be one of: reject, quarantine."
+  }
+
+  validation {
+    condition     = alltrue([for id in var.tenancy.allowed_owner_account_ids : can(regex("^[0-9]{12}$", id))])
+    error_message = "tenancy.allowed_owner_account_ids must contain 12-digit AWS account IDs."
+  }
+
+  validation {
+    condition     = alltrue([for arn in var.tenancy.allowed_log_group_arns : startswith(arn, "arn:")])
+    error_message = "tenancy.allowed_log_group_arns must contain log group ARNs or ARN globs."
+  }
+
+  validation {
+    condition = alltrue([
+      for route in values(var.tenancy.owner_routes) :
+      length(trimspace(route.topic_id)) > 0 && (route.credentials_secret_arn == "" || startswith(route.credentials_secret_arn, "arn:"))
+    ])
+    error_message = "tenancy.owner_routes entries must set topic_id, and credentials_secret_arn must be empty or a Secrets Manager ARN."
+  }
+}
+
+variable "message_format" {
+  description = "How log bodies are placed in the published envelope. \"string\" keeps the body as an escaped string in message. \"json\" embeds bodies that are JSON objects as message and keeps anything else in message_raw; promote_fields are then copied from the body to the top level of the envelope. event_time_fields lists JSON body fields, tried in order, from which the event_time attribute is taken instead of the CloudWatch timestamp."
+  type = object({
+    format            = optional(string, "string")
+    promote_fields    = optional(list(string), [])
+    event_time_fields = optional(list(string), [])
+  })
+  default = {}
+
+  validation {
+    condition     = contains(["string", "json"], var.message_format.format)
+    error_message = "message_format.format must be one of: string, json."
+  }
+
+  validation {
+    condition     = length(var.message_format.promote_fields) == 0 || var.message_format.format == "json"
+    error_message = "message_format.promote_fields requires message_format.format to be json."
+  }
+
+  validation {
+    condition = length(setintersection(
+      var.message_format.promote_fields,
+      ["owner", "logGroup", "logStream", "subscriptionFilters", "id", "timestamp", "message", "message_raw"],
+    )) == 0
+    error_message = "message_format.promote_fields must not include envelope fields."
+  }
+}
+
 variable "dlq" {
   description = "Asynchronous Lambda failure handling via SQS dead-letter queue."
   type = object({
@@ -202,7 +649,7 @@ variable "alerting" {
 }
 
 variable "replayer" {
-  description = "SQS DLQ replayer settings. Replays failed bridge events back to the main bridge Lambda."
+  description = "SQS DLQ replayer settings. Replays failed bridge events back to the main bridge Lambda, or with mode = \"direct\" publishes them from the replayer itself using the bridge's code and configuration, up to replay_concurrency records of a batch at a time. With route_to_origin, each event is replayed to the function that failed it instead, provided that function is the bridge or listed in allowed_function_arns. After max_attempts failed replays an event is moved, with its last error, to a module-managed parking-lot queue; 0 replays it until the DLQ's retention expires. With max_event_age_seconds, events whose newest log event is older than that are archived under archive_prefix in archive_bucket_name instead of being replayed; 0 replays events of any age. circuit_breaker stops replays for a cooldown while at least failure_threshold of the last window replays fail; set failure_threshold to 0 to disable it."
   type = object({
     enabled                            = optional(bool, true)
     function_name                      = optional(string)
@@ -217,6 +664,24 @@ variable "replayer" {
     batch_size                         = optional(number, 10)
     maximum_batching_window_in_seconds = optional(number, 5)
     maximum_concurrency                = optional(number, 2)
+    mode                               = optional(string, "invoke")
+    invocation_type                    = optional(string, "RequestResponse")
+    replay_concurrency                 = optional(number, 4)
+    route_to_origin                    = optional(bool, false)
+    allowed_function_arns              = optional(list(string), [])
+    max_attempts                       = optional(number, 5)
+    parking_lot_queue_name             = optional(string)
+    max_event_age_seconds              = optional(number, 0)
+    archive_bucket_name                = optional(string, "")
+    archive_prefix                     = optional(string, "dlq-archive/")
+    circuit_breaker = optional(object({
+      failure_threshold    = optional(number, 0.5)
+      minimum_replays      = optional(number, 10)
+      window               = optional(number, 20)
+      cooldown_seconds     = optional(number, 60)
+      max_cooldown_seconds = optional(number, 900)
+      probe_size           = optional(number, 1)
+    }), {})
   })
   default = {}
 
@@ -305,6 +770,190 @@ variable "replayer" {
     )
     error_message = "replayer.maximum_concurrency must be 0 (disabled) or between 2 and 1000."
   }
+
+  validation {
+    condition     = contains(["invoke", "direct"], var.replayer.mode)
+    error_message = "replayer.mode must be one of: invoke, direct."
+  }
+
+  validation {
+    condition     = !(var.replayer.mode == "direct" && var.replayer.route_to_origin)
+    error_message = "replayer.route_to_origin cannot be used with replayer.mode = \"direct\"."
+  }
+
+  validation {
+    condition     = contains(["RequestResponse", "Event"], var.replayer.invocation_type)
+    error_message = "replayer.invocation_type must be one of: RequestResponse, Event."
+  }
+
+  validation {
+    condition     = var.replayer.replay_concurrency >= 1 && var.replayer.replay_concurrency <= 100 && floor(var.replayer.replay_concurrency) == var.replayer.replay_concurrency
+    error_message = "replayer.replay_concurrency must be a whole number between 1 and 100."
+  }
+
+  validation {
+    condition = alltrue([
+      for arn in var.replayer.allowed_function_arns :
+      can(regex("^arn:aws[a-z-]*:lambda:[a-z0-9-]+:[0-9]{12}:function:[A-Za-z0-9_-]+$", arn))
+    ])
+    error_message = "replayer.allowed_function_arns must contain unqualified Lambda function ARNs."
+  }
+
+  validation {
+    condition     = var.replayer.max_attempts >= 0 && var.replayer.max_attempts <= 100 && floor(var.replayer.max_attempts) == var.replayer.max_attempts
+    error_message = "replayer.max_attempts must be a whole number between 0 (unbounded) and 100."
+  }
+
+  validation {
+    condition = (
+      !can(var.replayer.parking_lot_queue_name) ||
+      var.replayer.parking_lot_queue_name == null ||
+      length(trimspace(var.replayer.parking_lot_queue_name)) > 0
+    )
+    error_message = "replayer.parking_lot_queue_name must not be empty when provided."
+  }
+
+  validation {
+    condition     = var.replayer.max_event_age_seconds >= 0 && floor(var.replayer.max_event_age_seconds) == var.replayer.max_event_age_seconds
+    error_message = "replayer.max_event_age_seconds must be a whole number of seconds, or 0 (disabled)."
+  }
+
+  validation {
+    condition     = var.replayer.max_event_age_seconds == 0 || length(trimspace(var.replayer.archive_bucket_name)) > 0
+    error_message = "replayer.archive_bucket_name is required when replayer.max_event_age_seconds is set."
+  }
+
+  validation {
+    condition     = var.replayer.circuit_breaker.failure_threshold >= 0 && var.replayer.circuit_breaker.failure_threshold <= 1
+    error_message = "replayer.circuit_breaker.failure_threshold must be between 0 (disabled) and 1."
+  }
+
+  validation {
+    condition = (
+      var.replayer.circuit_breaker.minimum_replays >= 1 &&
+      var.replayer.circuit_breaker.minimum_replays <= var.replayer.circuit_breaker.window
+    )
+    error_message = "replayer.circuit_breaker.minimum_replays must be between 1 and replayer.circuit_breaker.window."
+  }
+
+  validation {
+    condition = (
+      var.replayer.circuit_breaker.cooldown_seconds >= 1 &&
+      var.replayer.circuit_breaker.max_cooldown_seconds >= var.replayer.circuit_breaker.cooldown_seconds &&
+      var.replayer.circuit_breaker.max_cooldown_seconds <= 43200
+    )
+    error_message = "replayer.circuit_breaker.cooldown_seconds must be at least 1, and max_cooldown_seconds between cooldown_seconds and 43200."
+  }
+
+  validation {
+    condition     = var.replayer.circuit_breaker.probe_size >= 1
+    error_message = "replayer.circuit_breaker.probe_size must be at least 1."
+  }
+}
+
+variable "metrics" {
+  description = "CloudWatch embedded metric format settings shared by the bridge and canary Lambdas. Set namespace to an empty string to disable custom metrics."
+  type = object({
+    namespace = optional(string, "FleetPubSubBridge")
+  })
+  default = {}
+}
+
+variable "canary" {
+  description = "End-to-end synthetic canary. On a schedule it writes a uniquely tagged line into the source log group and waits for it to arrive on a dedicated Pub/Sub subscription of the bridge topic, publishing CanarySuccess and CanaryLatency metrics. The source log group must be in this account."
+  type = object({
+    enabled                = optional(bool, false)
+    function_name          = optional(string)
+    role_name              = optional(string)
+    schedule_expression    = optional(string, "rate(5 minutes)")
+    subscription_id        = optional(string, "")
+    credentials_secret_arn = optional(string, "")
+    log_stream_name        = optional(string, "fleet-pubsub-bridge-canary")
+    receive_timeout        = optional(number, 120)
+    timeout                = optional(number, 180)
+    log_retention_in_days  = optional(number, 30)
+  })
+  default = {}
+
+  validation {
+    condition     = !var.canary.enabled || length(trimspace(var.canary.subscription_id)) > 0
+    error_message = "canary.subscription_id is required when canary.enabled is true."
+  }
+
+  validation {
+    condition     = !var.canary.enabled || var.encryption.mode == "none"
+    error_message = "canary.enabled requires encryption.mode to be none."
+  }
+
+  validation {
+    condition     = var.canary.credentials_secret_arn == "" || startswith(var.canary.credentials_secret_arn, "arn:")
+    error_message = "canary.credentials_secret_arn must be empty or a Secrets Manager ARN."
+  }
+
+  validation {
+    condition     = length(trimspace(var.canary.log_stream_name)) > 0
+    error_message = "canary.log_stream_name must not be empty."
+  }
+
+  validation {
+    condition     = var.canary.receive_timeout >= 1 && var.canary.receive_timeout < var.canary.timeout
+    error_message = "canary.receive_timeout must be at least 1 second and less than canary.timeout."
+  }
+
+  validation {
+    condition     = var.canary.timeout >= 1 && var.canary.timeout <= 900
+    error_message = "canary.timeout must be between 1 and 900 seconds."
+  }
+}
+
+variable "gap_detection" {
+  description = "Completeness tracking. The bridge records a per-stream high-water mark (newest forwarded event timestamp and ID) in a DynamoDB-compatible table, and a scheduled checker compares it with CloudWatch's lastIngestionTime to report streams that have fallen behind or never forwarded."
+  type = object({
+    enabled               = optional(bool, false)
+    create_table          = optional(bool, true)
+    table_name            = optional(string)
+    endpoint_url          = optional(string, "")
+    function_name         = optional(string)
+    role_name             = optional(string)
+    schedule_expression   = optional(string, "rate(15 minutes)")
+    log_group_names       = optional(list(string), [])
+    threshold_seconds     = optional(number, 900)
+    lookback_hours        = optional(number, 24)
+    report_bucket_name    = optional(string, "")
+    report_prefix         = optional(string, "gap-reports/")
+    timeout               = optional(number, 300)
+    log_retention_in_days = optional(number, 30)
+  })
+  default = {}
+
+  validation {
+    condition = (
+      !can(var.gap_detection.table_name) ||
+      var.gap_detection.table_name == null ||
+      length(trimspace(var.gap_detection.table_name)) > 0
+    )
+    error_message = "gap_detection.table_name must not be empty when provided."
+  }
+
+  validation {
+    condition     = var.gap_detection.endpoint_url == "" || can(regex("^https?://", var.gap_detection.endpoint_url))
+    error_message = "gap_detection.endpoint_url must be empty or an http(s) URL."
+  }
+
+  validation {
+    condition     = var.gap_detection.threshold_seconds >= 60
+    error_message = "gap_detection.threshold_seconds must be at least 60."
+  }
+
+  validation {
+    condition     = var.gap_detection.lookback_hours * 3600 > var.gap_detection.threshold_seconds
+    error_message = "gap_detection.lookback_hours must cover more than gap_detection.threshold_seconds."
+  }
+
+  validation {
+    condition     = var.gap_detection.timeout >= 1 && var.gap_detection.timeout <= 900
+    error_message = "gap_detection.timeout must be between 1 and 900 seconds."
+  }
 }
 
 variable "tags" {
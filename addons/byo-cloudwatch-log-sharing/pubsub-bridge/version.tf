@@ -7,6 +7,11 @@ terraform {
       version = ">= 2.4.0"
     }
 
+    external = {
+      source  = "hashicorp/external"
+      version = ">= 2.3.0"
+    }
+
     null = {
       source  = "hashicorp/null"
       version = ">= 3.2.1"